@@ -0,0 +1,40 @@
+package main
+
+import (
+	"SB/service/config"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v2"
+)
+
+const configUsage = "usage: config print [--redacted]"
+
+// runConfig executes the config subcommand with its arguments
+func runConfig(cfg *config.Config, args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return errors.New(configUsage)
+	}
+	fs := flag.NewFlagSet("config print", flag.ContinueOnError)
+	redacted := fs.Bool("redacted", false, "hide passwords and secrets")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	out := *cfg
+	if *redacted {
+		out = cfg.Redacted()
+	}
+	content, err := yaml.Marshal(out)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(content))
+
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return nil
+}
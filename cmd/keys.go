@@ -0,0 +1,58 @@
+package main
+
+import (
+	"SB/service/config"
+	"SB/service/repository/keys"
+	"SB/service/repository/persistence"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+const keysUsage = "usage: keys list|rotate"
+
+// runKeys executes the keys subcommand with its arguments, keys are managed
+// only in the postgres store since the memory store lives in the server
+func runKeys(ctx context.Context, persistent persistence.Persistent, cfg config.Token, args []string) error {
+	if len(args) != 1 {
+		return errors.New(keysUsage)
+	}
+	if cfg.KeyStore != "postgres" {
+		return fmt.Errorf("signing keys are kept in the %s store, only the postgres store can be managed", cfg.KeyStore)
+	}
+	store := keys.NewPostgresStore(persistent)
+	switch args[0] {
+	case "list":
+		list, err := store.Load(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "KID\tALGORITHM\tCREATED AT\tEXPIRES AT")
+		for _, key := range list {
+			expiresAt := "signing"
+			if key.ExpiresAt != nil {
+				expiresAt = key.ExpiresAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", key.ID, key.Algorithm, key.CreatedAt.Format(time.RFC3339), expiresAt)
+		}
+		return w.Flush()
+	case "rotate":
+		key, err := keys.Generate(cfg.SigningAlgorithm)
+		if err != nil {
+			return err
+		}
+		retireAt := keys.RetireAt(key, cfg)
+		if err := store.Rotate(ctx, key, retireAt); err != nil {
+			return err
+		}
+		fmt.Printf("new %s key %s signs tokens from %s, previous keys verify tokens until %s\n", key.Algorithm, key.ID,
+			key.CreatedAt.Add(cfg.JWKSMaxAge).Format(time.RFC3339), retireAt.Format(time.RFC3339))
+		return nil
+	default:
+		return errors.New(keysUsage)
+	}
+}
@@ -2,51 +2,267 @@ package main
 
 import (
 	"SB/service/config"
+	"SB/service/repository/account"
+	"SB/service/repository/admin"
+	"SB/service/repository/apikey"
+	"SB/service/repository/audit"
 	"SB/service/repository/db"
+	"SB/service/repository/health"
+	"SB/service/repository/jobs"
+	"SB/service/repository/keys"
+	"SB/service/repository/lockout"
+	"SB/service/repository/logging"
+	"SB/service/repository/mail"
 	"SB/service/repository/messenger"
+	"SB/service/repository/metrics"
+	"SB/service/repository/migration"
+	"SB/service/repository/oidc"
+	"SB/service/repository/password"
 	"SB/service/repository/persistence"
+	"SB/service/repository/pubsub"
+	"SB/service/repository/retry"
 	"SB/service/repository/token"
+	"SB/service/repository/tracing"
 	"SB/service/repository/training"
+	"SB/service/repository/twofactor"
 	"SB/service/service"
+	"context"
+	"errors"
 	"flag"
-	"fmt"
-	"github.com/labstack/gommon/log"
 	_ "github.com/lib/pq"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
-	"time"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	address := flag.String("address", "", "address to listen")
-	port := flag.String("port", "3000", "port to listen")
+	// the configuration selects the level and format of the logger, errors
+	// in it are written with the defaults
+	logger := logging.New(os.Stdout, logging.LevelInfo, logging.FormatText)
+	cfg, args, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		logger.Fatal("failed to load configuration", logging.Err(err))
+	}
 
-	flag.Parse()
+	if len(args) > 0 && args[0] == "config" {
+		if err := runConfig(cfg, args[1:]); err != nil {
+			logger.Fatal("failed to print configuration", logging.Err(err))
+		}
+		return
+	}
 
-	log.Info(fmt.Sprintf(
-		"address: %s, port: %s", *address, *port,
-	))
+	if err := cfg.Validate(); err != nil {
+		logger.Fatal("invalid configuration", logging.Err(err))
+	}
+	level, _ := logging.ParseLevel(cfg.Log.Level)
+	logger = logging.New(os.Stdout, level, cfg.Log.Format)
 
-	dsn := fmt.Sprintf("user=%s password='%s' dbname=%s sslmode=disable", config.PostgresUser, config.PostgresPassword, config.PostgresDbName)
-	database, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
-	if err != nil {
-		for i := 1; i < 10; i++ {
-			if err == nil {
-				break
+	logger.Info("starting", logging.String("address", cfg.Server.Address), logging.String("port", cfg.Server.Port))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	dsn := cfg.Database.DSN()
+	var database *gorm.DB
+	backoff := retry.Backoff{Attempts: cfg.Database.ConnectAttempts, Wait: cfg.Database.ConnectBackoff, Logger: logger}
+	err = backoff.Do(ctx, "connecting to the database", func(ctx context.Context) error {
+		db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logging.DatabaseLogger(logger)})
+		if err != nil {
+			// a failed attempt may have opened the pool already
+			if db != nil {
+				if sqlDB, dbErr := db.DB(); dbErr == nil {
+					sqlDB.Close()
+				}
 			}
-			log.Error(err)
-			time.Sleep(config.DbConnectTimeout)
-			log.Info("Trying to reconnect...")
-			database, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+			return err
+		}
+		database = db
+		return nil
+	})
+	if err != nil {
+		logger.Fatal("failed to connect to the database", logging.Err(err))
+	}
+	if err := configurePool(database, cfg.Database); err != nil {
+		logger.Fatal("failed to configure the connection pool", logging.Err(err))
+	}
+	if err := database.Use(metrics.DatabasePlugin(metrics.Default)); err != nil {
+		logger.Fatal("failed to measure database statements", logging.Err(err))
+	}
+
+	if len(args) > 0 && args[0] == "migrate" {
+		if err := runMigrate(database, logger, args[1:]); err != nil {
+			logger.Fatal("failed to migrate", logging.Err(err))
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "keys" {
+		if err := runKeys(ctx, persistence.NewPersistent(database, logger), cfg.Token, args[1:]); err != nil {
+			logger.Fatal("failed to manage signing keys", logging.Err(err))
+		}
+		return
+	}
+
+	traceProvider := newTraceProvider(cfg.Tracing, logger)
+	if traceProvider != nil {
+		tracing.SetProvider(traceProvider)
+		if err := database.Use(tracing.DatabasePlugin()); err != nil {
+			logger.Fatal("failed to trace database statements", logging.Err(err))
+		}
+	}
+
+	if cfg.Database.AutoMigrate {
+		migrator, err := migration.NewMigrator(database, logger)
+		if err != nil {
+			logger.Fatal("failed to load migrations", logging.Err(err))
+		}
+		if err = migrator.Up(); err != nil {
+			logger.Fatal("failed to migrate", logging.Err(err))
 		}
-		log.Fatal(err)
 	}
 
-	persistent := persistence.NewPersistent(database)
-	usrMgr := db.NewDbManager(persistent)
-	tknMgr := token.NewTokenManager(persistent)
-	trainingMgr := training.NewTrainingManager(persistent)
+	persistent := persistence.NewPersistent(database, logger)
+	hasher, err := password.NewHasher(cfg.Password)
+	if err != nil {
+		logger.Fatal("failed to create password hasher", logging.Err(err))
+	}
+	auditLog := audit.NewLog(persistent, cfg.Audit, logger)
+	policy, err := password.NewPolicy(cfg.Password, logger)
+	if err != nil {
+		logger.Fatal("failed to load password policy", logging.Err(err))
+	}
+	usrMgr, err := db.NewDbManager(persistent, hasher, policy, auditLog, logger)
+	if err != nil {
+		logger.Fatal("failed to create user manager", logging.Err(err))
+	}
+	ring, err := keys.NewRing(ctx, persistent, cfg.Token, logger)
+	if err != nil {
+		logger.Fatal("failed to load signing keys", logging.Err(err))
+	}
+	tknMgr := token.NewTokenManager(persistent, ring, cfg.Token, auditLog, logger)
+	mailer, err := mail.New(cfg.Mail, logger)
+	if err != nil {
+		logger.Fatal("failed to create mailer", logging.Err(err))
+	}
+	accountMgr := account.NewAccountManager(persistent, hasher, policy, mailer, cfg.Token, cfg.Mail, logger)
+	twoFactorMgr, err := twofactor.NewTwoFactorManager(persistent, tknMgr, cfg.TwoFactor, logger)
+	if err != nil {
+		logger.Fatal("failed to create two-factor manager", logging.Err(err))
+	}
+	guard, err := lockout.NewGuard(persistent, cfg.Lockout, logger)
+	if err != nil {
+		logger.Fatal("failed to create lockout guard", logging.Err(err))
+	}
+	oidcMgr := oidc.NewManager(persistent, ring, cfg.OIDC, logger)
+	apiKeyMgr := apikey.NewManager(persistent, cfg.APIKeys, logger)
+	adminMgr := admin.NewAdminManager(persistent, auditLog)
+	trainingMgr := training.NewTrainingManager(persistent, auditLog)
 	messenger := messenger.NewMessenger(persistent)
-	server := service.NewServer(*address, *port, usrMgr, tknMgr, trainingMgr, messenger)
-	server.Start()
+	checker := health.NewChecker(map[string]health.Check{"database": persistent.Ping})
+	pubSub, err := pubsub.New(persistent, dsn, cfg.Messenger, logger)
+	if err != nil {
+		logger.Fatal("failed to create messenger pubsub", logging.Err(err))
+	}
+	server := service.NewServer(cfg, usrMgr, tknMgr, accountMgr, twoFactorMgr, guard, oidcMgr, apiKeyMgr, adminMgr, auditLog, trainingMgr, messenger, checker, pubSub, logger)
+
+	scheduler := jobs.NewScheduler(logger)
+	scheduler.Add(jobs.Job{
+		Name:     "expired_sessions",
+		Interval: cfg.Jobs.SessionSweepInterval,
+		Run: func(ctx context.Context) (int64, error) {
+			return tknMgr.RemoveExpired(ctx)
+		},
+	})
+	scheduler.Add(jobs.Job{
+		Name:     "two_factor_challenges",
+		Interval: cfg.Jobs.SessionSweepInterval,
+		Run: func(ctx context.Context) (int64, error) {
+			return twoFactorMgr.Sweep(ctx)
+		},
+	})
+	scheduler.Add(jobs.Job{
+		Name:     "login_attempts",
+		Interval: cfg.Jobs.LoginAttemptSweepInterval,
+		Run: func(ctx context.Context) (int64, error) {
+			return guard.Sweep(ctx)
+		},
+	})
+	scheduler.Add(jobs.Job{
+		Name:     "signing_keys",
+		Interval: cfg.Jobs.KeyReloadInterval,
+		Run: func(ctx context.Context) (int64, error) {
+			return ring.Reload(ctx)
+		},
+	})
+	scheduler.Add(jobs.Job{
+		Name:     "audit_log",
+		Interval: cfg.Jobs.AuditSweepInterval,
+		Run: func(ctx context.Context) (int64, error) {
+			return auditLog.Sweep(ctx)
+		},
+	})
+	jobs.RegisterMetrics(metrics.Default, scheduler)
+	scheduler.Start()
+
+	started := make(chan error, 1)
+	go func() {
+		started <- server.Start()
+	}()
+	var serverErr error
+	select {
+	case <-ctx.Done():
+		// a second signal kills the process
+		stop()
+	case serverErr = <-started:
+		logger.Error("server failed", logging.Err(serverErr))
+	}
+
+	logger.Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := server.Stop(shutdownCtx); err != nil {
+		logger.Error("failed to finish requests", logging.Err(err))
+	}
+	scheduler.Stop()
+	accountMgr.Wait()
+	if err := pubSub.Close(); err != nil {
+		logger.Error("failed to close messenger pubsub", logging.Err(err))
+	}
+	if traceProvider != nil {
+		if err := traceProvider.Shutdown(shutdownCtx); err != nil {
+			logger.Error("failed to export spans", logging.Err(err))
+		}
+	}
+	if sqlDB, err := database.DB(); err == nil {
+		_ = sqlDB.Close()
+	}
+	if serverErr != nil {
+		os.Exit(1)
+	}
+}
+
+// newTraceProvider returns the provider of the configured exporter or nil if
+// spans are not exported
+func newTraceProvider(cfg config.Tracing, logger *logging.Logger) *tracing.Provider {
+	switch cfg.Exporter {
+	case "stdout":
+		return tracing.NewProvider(tracing.NewStdoutExporter(os.Stdout, cfg.ServiceName), cfg.SampleRatio, logger)
+	case "otlp":
+		return tracing.NewProvider(tracing.NewOTLPExporter(cfg.Endpoint, cfg.ServiceName), cfg.SampleRatio, logger)
+	}
+	return nil
+}
+
+func configurePool(database *gorm.DB, cfg config.Database) error {
+	sqlDB, err := database.DB()
+	if err != nil {
+		return err
+	}
+	sqlDB.SetMaxOpenConns(cfg.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(cfg.MaxIdleConns)
+	sqlDB.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	return nil
 }
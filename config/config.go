@@ -1,17 +1,894 @@
 package config
 
-import "time"
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	netmail "net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
-var RefreshTokenExpiration = 30 * time.Hour * 24
-var AccessTokenExpiration = 60 * time.Minute
-
-var DbConnectTimeout = 5 * time.Second
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
 
 const (
-	PostgresUser     = "postgres"
-	PostgresPassword = "1"
-	PostgresPort     = "5432"
-	PostgresDbName   = "sport_buddy_v0"
+	envPrefix = "SB_"
+	redacted  = "******"
+)
+
+var passwordEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+type (
+	Config struct {
+		Server   Server   `yaml:"server" toml:"server"`
+		Database Database `yaml:"database" toml:"database"`
+		Token    Token    `yaml:"token" toml:"token"`
+		Jobs     Jobs     `yaml:"jobs" toml:"jobs"`
+		Password Password `yaml:"password" toml:"password"`
+		Mail     Mail     `yaml:"mail" toml:"mail"`
+		// TwoFactor configures TOTP two-factor authentication
+		TwoFactor TwoFactor `yaml:"two_factor" toml:"two_factor"`
+		Lockout   Lockout   `yaml:"lockout" toml:"lockout"`
+		// OIDC configures login with external OpenID Connect providers
+		OIDC OIDC `yaml:"oidc" toml:"oidc"`
+		// APIKeys configures personal keys of integrations
+		APIKeys   APIKeys   `yaml:"api_keys" toml:"api_keys"`
+		Audit     Audit     `yaml:"audit" toml:"audit"`
+		Tracing   Tracing   `yaml:"tracing" toml:"tracing"`
+		Log       Log       `yaml:"log" toml:"log"`
+		Messenger Messenger `yaml:"messenger" toml:"messenger"`
+	}
+
+	Server struct {
+		Address     string   `yaml:"address" toml:"address"`
+		Port        string   `yaml:"port" toml:"port"`
+		CorsOrigins []string `yaml:"cors_origins" toml:"cors_origins"`
+		// Time requests being served get to finish on shutdown
+		ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+		// Bearer token scrapers send to /metrics, the metrics are public if
+		// it is not set. It is required when metrics are served beyond
+		// localhost.
+		MetricsToken string `yaml:"metrics_token" toml:"metrics_token"`
+		// MetricsAddress is the host:port of a listener serving only
+		// /metrics, the API serves it when it is empty
+		MetricsAddress string `yaml:"metrics_address" toml:"metrics_address"`
+		// CIDR ranges of the proxies in front of the service. The client IP
+		// address is taken from X-Forwarded-For only when the request came
+		// through them, otherwise it is the address of the connection.
+		TrustedProxies []string `yaml:"trusted_proxies" toml:"trusted_proxies"`
+	}
+
+	Database struct {
+		Host            string        `yaml:"host" toml:"host"`
+		Port            string        `yaml:"port" toml:"port"`
+		User            string        `yaml:"user" toml:"user"`
+		Password        string        `yaml:"password" toml:"password"`
+		Name            string        `yaml:"name" toml:"name"`
+		SSLMode         string        `yaml:"sslmode" toml:"sslmode"`
+		MaxOpenConns    int           `yaml:"max_open_conns" toml:"max_open_conns"`
+		MaxIdleConns    int           `yaml:"max_idle_conns" toml:"max_idle_conns"`
+		ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" toml:"conn_max_lifetime"`
+		// Time to wait for a connection
+		ConnectTimeout time.Duration `yaml:"connect_timeout" toml:"connect_timeout"`
+		// Connection attempts on startup, the wait between them starts at
+		// ConnectBackoff and doubles after every attempt
+		ConnectAttempts int           `yaml:"connect_attempts" toml:"connect_attempts"`
+		ConnectBackoff  time.Duration `yaml:"connect_backoff" toml:"connect_backoff"`
+		// Deadline of the queries of a request, they are also canceled when
+		// the client disconnects
+		RequestTimeout time.Duration `yaml:"request_timeout" toml:"request_timeout"`
+		AutoMigrate    bool          `yaml:"auto_migrate" toml:"auto_migrate"`
+	}
+
+	Token struct {
+		// Secret of HS256 tokens issued before signing keys were introduced,
+		// they are accepted until they expire if it is set
+		Secret string `yaml:"secret" toml:"secret"`
+		// SigningAlgorithm of new signing keys, EdDSA or RS256
+		SigningAlgorithm string `yaml:"signing_algorithm" toml:"signing_algorithm"`
+		// KeyStore keeps signing keys, postgres to share them between nodes
+		// or memory to generate a key on every start
+		KeyStore string `yaml:"key_store" toml:"key_store"`
+		// Time a rotated key still verifies tokens, it must cover the lifetime
+		// of access tokens signed just before the rotation
+		KeyOverlap time.Duration `yaml:"key_overlap" toml:"key_overlap"`
+		// JWKSMaxAge is how long verifiers may cache the JWKS, a new key is
+		// published for this time before it signs tokens
+		JWKSMaxAge             time.Duration `yaml:"jwks_max_age" toml:"jwks_max_age"`
+		AccessTokenExpiration  time.Duration `yaml:"access_token_expiration" toml:"access_token_expiration"`
+		RefreshTokenExpiration time.Duration `yaml:"refresh_token_expiration" toml:"refresh_token_expiration"`
+		// Lifetime of tokens sent by e-mail
+		PasswordResetExpiration     time.Duration `yaml:"password_reset_expiration" toml:"password_reset_expiration"`
+		EmailVerificationExpiration time.Duration `yaml:"email_verification_expiration" toml:"email_verification_expiration"`
+		// Lifetime of access tokens admins get to impersonate users, they
+		// cannot be refreshed
+		ImpersonationExpiration time.Duration `yaml:"impersonation_expiration" toml:"impersonation_expiration"`
+	}
+
+	Mail struct {
+		// Driver is smtp, file (messages are saved to Dir) or log
+		Driver       string `yaml:"driver" toml:"driver"`
+		From         string `yaml:"from" toml:"from"`
+		SMTPHost     string `yaml:"smtp_host" toml:"smtp_host"`
+		SMTPPort     string `yaml:"smtp_port" toml:"smtp_port"`
+		SMTPUser     string `yaml:"smtp_user" toml:"smtp_user"`
+		SMTPPassword string `yaml:"smtp_password" toml:"smtp_password"`
+		Dir          string `yaml:"dir" toml:"dir"`
+		// BaseURL of the web application used in links sent to users
+		BaseURL string `yaml:"base_url" toml:"base_url"`
+	}
+
+	Password struct {
+		// Algorithm for new hashes, argon2id or bcrypt
+		Algorithm string `yaml:"algorithm" toml:"algorithm"`
+		// Argon2 memory in KiB
+		Argon2Memory      uint32 `yaml:"argon2_memory" toml:"argon2_memory"`
+		Argon2Iterations  uint32 `yaml:"argon2_iterations" toml:"argon2_iterations"`
+		Argon2Parallelism uint8  `yaml:"argon2_parallelism" toml:"argon2_parallelism"`
+		BcryptCost        int    `yaml:"bcrypt_cost" toml:"bcrypt_cost"`
+		MinLength         int    `yaml:"min_length" toml:"min_length"`
+		// Characters, at most 72, passwords longer than 72 bytes are
+		// rejected too since bcrypt ignores the rest
+		MaxLength int `yaml:"max_length" toml:"max_length"`
+		// File with breached passwords or their SHA-1 hashes, one per line
+		BreachedList string `yaml:"breached_list" toml:"breached_list"`
+	}
+
+	TwoFactor struct {
+		// Issuer is the account name shown by authenticator apps
+		Issuer string `yaml:"issuer" toml:"issuer"`
+		// RequiredRoles may use routes of their role only in sessions started
+		// with a second factor
+		RequiredRoles []string `yaml:"required_roles" toml:"required_roles"`
+		// Time to enter a code after the password was accepted
+		ChallengeExpiration time.Duration `yaml:"challenge_expiration" toml:"challenge_expiration"`
+		// Codes that may be entered for a challenge, the password has to be
+		// entered again afterwards
+		ChallengeAttempts int `yaml:"challenge_attempts" toml:"challenge_attempts"`
+		// Number of recovery codes issued when two-factor authentication is enabled
+		RecoveryCodes int `yaml:"recovery_codes" toml:"recovery_codes"`
+	}
+
+	// Lockout slows down password guessing. After the free attempts every
+	// failure doubles the delay before the next attempt up to MaxDelay.
+	Lockout struct {
+		// Store keeps failed attempts, memory for a single node or postgres
+		// to share them between nodes
+		Store string `yaml:"store" toml:"store"`
+		// Failed attempts without delay per account and per IP address
+		AccountAttempts int           `yaml:"account_attempts" toml:"account_attempts"`
+		IPAttempts      int           `yaml:"ip_attempts" toml:"ip_attempts"`
+		BaseDelay       time.Duration `yaml:"base_delay" toml:"base_delay"`
+		MaxDelay        time.Duration `yaml:"max_delay" toml:"max_delay"`
+		// Failures are forgotten after this time without new ones
+		ResetAfter time.Duration `yaml:"reset_after" toml:"reset_after"`
+	}
+
+	OIDC struct {
+		Providers []OIDCProvider `yaml:"providers" toml:"providers"`
+		// Time to log in at the provider and return with the code
+		StateExpiration time.Duration `yaml:"state_expiration" toml:"state_expiration"`
+	}
+
+	// OIDCProvider is an OpenID Connect provider using the authorization
+	// code flow with PKCE, it is set only in the configuration file
+	OIDCProvider struct {
+		// Name of the provider in /auth/oidc/{provider} routes
+		Name string `yaml:"name" toml:"name"`
+		// Issuer URL, endpoints are discovered from its
+		// /.well-known/openid-configuration
+		Issuer       string `yaml:"issuer" toml:"issuer"`
+		ClientID     string `yaml:"client_id" toml:"client_id"`
+		ClientSecret string `yaml:"client_secret" toml:"client_secret"`
+		// RedirectURL is the page of the web application receiving the code,
+		// it must be registered at the provider
+		RedirectURL string   `yaml:"redirect_url" toml:"redirect_url"`
+		Scopes      []string `yaml:"scopes" toml:"scopes"`
+	}
+
+	APIKeys struct {
+		// Active keys a user may have at once
+		MaxPerUser int `yaml:"max_per_user" toml:"max_per_user"`
+	}
+
+	Audit struct {
+		// Entries older than this are deleted by the audit sweep, zero keeps
+		// them forever
+		Retention time.Duration `yaml:"retention" toml:"retention"`
+	}
+
+	// Messenger configures the websockets of the messenger. Clients are
+	// pinged every ping interval, connections that do not answer within the
+	// idle timeout are closed.
+	Messenger struct {
+		// PubSub delivers messages to the websockets, memory for a single
+		// node or postgres to deliver to websockets of all nodes with
+		// LISTEN/NOTIFY. NOTIFY carries less than 8000 bytes, devices on
+		// other nodes are told to fetch longer messages with the dialog.
+		PubSub string `yaml:"pubsub" toml:"pubsub"`
+		// Channel of LISTEN/NOTIFY shared by the nodes
+		Channel      string        `yaml:"channel" toml:"channel"`
+		PingInterval time.Duration `yaml:"ping_interval" toml:"ping_interval"`
+		IdleTimeout  time.Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+		WriteTimeout time.Duration `yaml:"write_timeout" toml:"write_timeout"`
+		// Size limit of a message from a client in bytes
+		MaxMessageSize int `yaml:"max_message_size" toml:"max_message_size"`
+	}
 
-	Secret = "s0Wo!GLNLkjwVG4G:Jf18/KvAM"
+	// Jobs configures background maintenance, zero interval disables a job
+	Jobs struct {
+		SessionSweepInterval      time.Duration `yaml:"session_sweep_interval" toml:"session_sweep_interval"`
+		LoginAttemptSweepInterval time.Duration `yaml:"login_attempt_sweep_interval" toml:"login_attempt_sweep_interval"`
+		// Nodes pick up keys rotated by other nodes or the CLI on reload
+		KeyReloadInterval  time.Duration `yaml:"key_reload_interval" toml:"key_reload_interval"`
+		AuditSweepInterval time.Duration `yaml:"audit_sweep_interval" toml:"audit_sweep_interval"`
+	}
+
+	// Tracing configures the export of OpenTelemetry spans
+	Tracing struct {
+		// none, stdout or otlp
+		Exporter string `yaml:"exporter" toml:"exporter"`
+		// OTLP/HTTP traces endpoint of a collector
+		Endpoint    string `yaml:"endpoint" toml:"endpoint"`
+		ServiceName string `yaml:"service_name" toml:"service_name"`
+		// SampleRatio is the share of traces started by the service that
+		// are recorded, traces continued from a caller follow its decision
+		SampleRatio float64 `yaml:"sample_ratio" toml:"sample_ratio"`
+	}
+
+	// Log configures the lines the service writes to stdout
+	Log struct {
+		// debug, info, warn or error
+		Level string `yaml:"level" toml:"level"`
+		// text or json
+		Format string `yaml:"format" toml:"format"`
+	}
+
+	// option binds a configuration field to its flag and environment variable
+	option struct {
+		name  string
+		usage string
+		value flag.Value
+	}
+
+	stringValue   struct{ p *string }
+	intValue      struct{ p *int }
+	uint32Value   struct{ p *uint32 }
+	uint8Value    struct{ p *uint8 }
+	float64Value  struct{ p *float64 }
+	boolValue     struct{ p *bool }
+	durationValue struct{ p *time.Duration }
+	listValue     struct{ p *[]string }
 )
+
+// Default returns configuration used for values not set anywhere else
+func Default() Config {
+	return Config{
+		Server: Server{
+			Port:            "3000",
+			CorsOrigins:     []string{"*"},
+			ShutdownTimeout: 15 * time.Second,
+			MetricsAddress:  "127.0.0.1:9100",
+		},
+		Database: Database{
+			Host:            "localhost",
+			Port:            "5432",
+			User:            "postgres",
+			Name:            "sport_buddy_v0",
+			SSLMode:         "disable",
+			MaxOpenConns:    20,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: 30 * time.Minute,
+			ConnectTimeout:  5 * time.Second,
+			ConnectAttempts: 10,
+			ConnectBackoff:  time.Second,
+			RequestTimeout:  10 * time.Second,
+		},
+		Token: Token{
+			SigningAlgorithm:            "EdDSA",
+			KeyStore:                    "postgres",
+			KeyOverlap:                  2 * time.Hour,
+			JWKSMaxAge:                  5 * time.Minute,
+			AccessTokenExpiration:       60 * time.Minute,
+			RefreshTokenExpiration:      30 * time.Hour * 24,
+			PasswordResetExpiration:     time.Hour,
+			EmailVerificationExpiration: 48 * time.Hour,
+			ImpersonationExpiration:     15 * time.Minute,
+		},
+		Jobs: Jobs{
+			SessionSweepInterval:      time.Hour,
+			LoginAttemptSweepInterval: time.Hour,
+			KeyReloadInterval:         time.Minute,
+			AuditSweepInterval:        24 * time.Hour,
+		},
+		Password: Password{
+			Algorithm:         "argon2id",
+			Argon2Memory:      64 * 1024,
+			Argon2Iterations:  3,
+			Argon2Parallelism: 2,
+			BcryptCost:        12,
+			MinLength:         8,
+			MaxLength:         72,
+		},
+		Mail: Mail{
+			Driver:   "log",
+			From:     "Sport Buddy <no-reply@localhost>",
+			SMTPPort: "587",
+			BaseURL:  "http://localhost:3000",
+		},
+		TwoFactor: TwoFactor{
+			Issuer:              "Sport Buddy",
+			ChallengeExpiration: 5 * time.Minute,
+			ChallengeAttempts:   5,
+			RecoveryCodes:       10,
+		},
+		Lockout: Lockout{
+			Store:           "memory",
+			AccountAttempts: 5,
+			IPAttempts:      20,
+			BaseDelay:       time.Second,
+			MaxDelay:        15 * time.Minute,
+			ResetAfter:      24 * time.Hour,
+		},
+		OIDC: OIDC{
+			StateExpiration: 10 * time.Minute,
+		},
+		APIKeys: APIKeys{
+			MaxPerUser: 10,
+		},
+		Audit: Audit{
+			Retention: 365 * 24 * time.Hour,
+		},
+		Tracing: Tracing{
+			Exporter:    "none",
+			Endpoint:    "http://localhost:4318/v1/traces",
+			ServiceName: "sport-buddy",
+			SampleRatio: 1,
+		},
+		Log: Log{
+			Level:  "info",
+			Format: "text",
+		},
+		Messenger: Messenger{
+			PubSub:         "memory",
+			Channel:        "sb_messenger",
+			PingInterval:   30 * time.Second,
+			IdleTimeout:    75 * time.Second,
+			WriteTimeout:   10 * time.Second,
+			MaxMessageSize: 32 << 10,
+		},
+	}
+}
+
+// Load builds configuration from defaults, a YAML or TOML file, SB_* environment
+// variables and command line flags, each source overriding the previous one.
+// The file is taken from the -config flag or SB_CONFIG variable.
+// Arguments left after flags are returned to be handled as a subcommand.
+// The result is not validated, call Validate before using it.
+func Load(args []string) (*Config, []string, error) {
+	cfg := Default()
+	fs := flag.NewFlagSet("sport_buddy", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv(envPrefix+"CONFIG"), "path to YAML or TOML configuration file")
+	options := cfg.options()
+	for _, o := range options {
+		fs.Var(o.value, o.name, fmt.Sprintf("%s (env %s)", o.usage, envName(o.name)))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	// flags were parsed into cfg only to validate them, they are applied
+	// again once the file and the environment are loaded
+	fromFlags := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		fromFlags[f.Name] = f.Value.String()
+	})
+	cfg = Default()
+
+	if *configPath != "" {
+		if err := loadFile(*configPath, &cfg); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, o := range options {
+		if v, ok := os.LookupEnv(envName(o.name)); ok {
+			if err := o.value.Set(v); err != nil {
+				return nil, nil, fmt.Errorf("invalid value %q for %s: %s", v, envName(o.name), err)
+			}
+		}
+	}
+	for _, o := range options {
+		if v, ok := fromFlags[o.name]; ok {
+			if err := o.value.Set(v); err != nil {
+				return nil, nil, fmt.Errorf("invalid value %q for -%s: %s", v, o.name, err)
+			}
+		}
+	}
+
+	return &cfg, fs.Args(), nil
+}
+
+func loadFile(path string, cfg *Config) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %s", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(content, cfg)
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(content), cfg)
+		if err == nil && len(md.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown keys %v", md.Undecoded())
+		}
+	default:
+		return fmt.Errorf("unsupported config file format %s", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %s", path, err)
+	}
+	return nil
+}
+
+func (cfg *Config) options() []option {
+	return []option{
+		{"address", "address to listen", &stringValue{&cfg.Server.Address}},
+		{"port", "port to listen", &stringValue{&cfg.Server.Port}},
+		{"cors-origins", "comma separated list of allowed CORS origins", &listValue{&cfg.Server.CorsOrigins}},
+		{"trusted-proxies", "comma separated CIDR ranges of proxies whose X-Forwarded-For is trusted", &listValue{&cfg.Server.TrustedProxies}},
+		{"shutdown-timeout", "time requests being served get to finish on shutdown", &durationValue{&cfg.Server.ShutdownTimeout}},
+		{"metrics-token", "bearer token required to scrape /metrics", &stringValue{&cfg.Server.MetricsToken}},
+		{"metrics-address", "host:port of the listener serving /metrics, empty serves it with the API", &stringValue{&cfg.Server.MetricsAddress}},
+		{"db-host", "database host", &stringValue{&cfg.Database.Host}},
+		{"db-port", "database port", &stringValue{&cfg.Database.Port}},
+		{"db-user", "database user", &stringValue{&cfg.Database.User}},
+		{"db-password", "database password", &stringValue{&cfg.Database.Password}},
+		{"db-name", "database name", &stringValue{&cfg.Database.Name}},
+		{"db-sslmode", "database sslmode", &stringValue{&cfg.Database.SSLMode}},
+		{"db-max-open-conns", "maximum number of open database connections", &intValue{&cfg.Database.MaxOpenConns}},
+		{"db-max-idle-conns", "maximum number of idle database connections", &intValue{&cfg.Database.MaxIdleConns}},
+		{"db-conn-max-lifetime", "maximum time a database connection may be reused", &durationValue{&cfg.Database.ConnMaxLifetime}},
+		{"db-connect-timeout", "database connect timeout", &durationValue{&cfg.Database.ConnectTimeout}},
+		{"db-connect-attempts", "database connection attempts on startup", &intValue{&cfg.Database.ConnectAttempts}},
+		{"db-connect-backoff", "wait before the second database connection attempt, doubled after every attempt", &durationValue{&cfg.Database.ConnectBackoff}},
+		{"db-request-timeout", "deadline of the database queries of a request", &durationValue{&cfg.Database.RequestTimeout}},
+		{"auto-migrate", "apply pending schema migrations on startup", &boolValue{&cfg.Database.AutoMigrate}},
+		{"token-secret", "secret of legacy HS256 access tokens still accepted", &stringValue{&cfg.Token.Secret}},
+		{"token-signing-algorithm", "algorithm of new signing keys, EdDSA or RS256", &stringValue{&cfg.Token.SigningAlgorithm}},
+		{"token-key-store", "store of signing keys, postgres or memory", &stringValue{&cfg.Token.KeyStore}},
+		{"token-key-overlap", "time a rotated signing key still verifies tokens", &durationValue{&cfg.Token.KeyOverlap}},
+		{"token-jwks-max-age", "time verifiers may cache the JWKS, new keys are published this long before they sign", &durationValue{&cfg.Token.JWKSMaxAge}},
+		{"access-token-expiration", "access token lifetime", &durationValue{&cfg.Token.AccessTokenExpiration}},
+		{"refresh-token-expiration", "refresh token lifetime", &durationValue{&cfg.Token.RefreshTokenExpiration}},
+		{"password-reset-expiration", "password reset token lifetime", &durationValue{&cfg.Token.PasswordResetExpiration}},
+		{"email-verification-expiration", "e-mail verification token lifetime", &durationValue{&cfg.Token.EmailVerificationExpiration}},
+		{"impersonation-expiration", "lifetime of access tokens of impersonating admins", &durationValue{&cfg.Token.ImpersonationExpiration}},
+		{"password-algorithm", "password hash algorithm, argon2id or bcrypt", &stringValue{&cfg.Password.Algorithm}},
+		{"argon2-memory", "argon2id memory in KiB", &uint32Value{&cfg.Password.Argon2Memory}},
+		{"argon2-iterations", "argon2id number of iterations", &uint32Value{&cfg.Password.Argon2Iterations}},
+		{"argon2-parallelism", "argon2id degree of parallelism", &uint8Value{&cfg.Password.Argon2Parallelism}},
+		{"bcrypt-cost", "bcrypt cost", &intValue{&cfg.Password.BcryptCost}},
+		{"password-min-length", "minimum password length", &intValue{&cfg.Password.MinLength}},
+		{"password-max-length", "maximum password length", &intValue{&cfg.Password.MaxLength}},
+		{"breached-passwords", "file with breached passwords or their SHA-1 hashes", &stringValue{&cfg.Password.BreachedList}},
+		{"mail-driver", "mail driver, smtp, file or log", &stringValue{&cfg.Mail.Driver}},
+		{"mail-from", "sender of e-mails", &stringValue{&cfg.Mail.From}},
+		{"smtp-host", "SMTP server host", &stringValue{&cfg.Mail.SMTPHost}},
+		{"smtp-port", "SMTP server port", &stringValue{&cfg.Mail.SMTPPort}},
+		{"smtp-user", "SMTP user", &stringValue{&cfg.Mail.SMTPUser}},
+		{"smtp-password", "SMTP password", &stringValue{&cfg.Mail.SMTPPassword}},
+		{"mail-dir", "directory to save e-mails to with the file driver", &stringValue{&cfg.Mail.Dir}},
+		{"base-url", "base URL of links sent by e-mail", &stringValue{&cfg.Mail.BaseURL}},
+		{"two-factor-issuer", "issuer name shown by authenticator apps", &stringValue{&cfg.TwoFactor.Issuer}},
+		{"two-factor-required-roles", "comma separated list of roles that must use two-factor authentication", &listValue{&cfg.TwoFactor.RequiredRoles}},
+		{"two-factor-challenge-expiration", "time to enter a two-factor code after the password", &durationValue{&cfg.TwoFactor.ChallengeExpiration}},
+		{"two-factor-challenge-attempts", "two-factor codes that may be entered after the password", &intValue{&cfg.TwoFactor.ChallengeAttempts}},
+		{"two-factor-recovery-codes", "number of two-factor recovery codes", &intValue{&cfg.TwoFactor.RecoveryCodes}},
+		{"lockout-store", "store of failed login attempts, memory or postgres", &stringValue{&cfg.Lockout.Store}},
+		{"lockout-account-attempts", "failed login attempts per account before delays", &intValue{&cfg.Lockout.AccountAttempts}},
+		{"lockout-ip-attempts", "failed login attempts per IP address before delays", &intValue{&cfg.Lockout.IPAttempts}},
+		{"lockout-base-delay", "delay after the first failure over the limit", &durationValue{&cfg.Lockout.BaseDelay}},
+		{"lockout-max-delay", "longest delay, the duration of a lockout", &durationValue{&cfg.Lockout.MaxDelay}},
+		{"lockout-reset-after", "time after which failed login attempts are forgotten", &durationValue{&cfg.Lockout.ResetAfter}},
+		{"oidc-state-expiration", "time to log in at an OpenID Connect provider", &durationValue{&cfg.OIDC.StateExpiration}},
+		{"api-keys-max-per-user", "number of active API keys a user may have", &intValue{&cfg.APIKeys.MaxPerUser}},
+		{"audit-retention", "time audit log entries are kept, 0 keeps them forever", &durationValue{&cfg.Audit.Retention}},
+		{"session-sweep-interval", "interval between deletions of expired sessions, 0 disables them", &durationValue{&cfg.Jobs.SessionSweepInterval}},
+		{"login-attempt-sweep-interval", "interval between deletions of forgotten login attempts, 0 disables them", &durationValue{&cfg.Jobs.LoginAttemptSweepInterval}},
+		{"key-reload-interval", "interval between reloads of signing keys, 0 disables them", &durationValue{&cfg.Jobs.KeyReloadInterval}},
+		{"audit-sweep-interval", "interval between deletions of audit log entries past retention, 0 disables them", &durationValue{&cfg.Jobs.AuditSweepInterval}},
+		{"tracing-exporter", "exporter of trace spans, none, stdout or otlp", &stringValue{&cfg.Tracing.Exporter}},
+		{"tracing-endpoint", "OTLP/HTTP traces endpoint of the collector", &stringValue{&cfg.Tracing.Endpoint}},
+		{"tracing-service-name", "service name of exported spans", &stringValue{&cfg.Tracing.ServiceName}},
+		{"tracing-sample-ratio", "share of traces started by the service that are recorded, from 0 to 1", &float64Value{&cfg.Tracing.SampleRatio}},
+		{"log-level", "lowest level of logged lines, debug, info, warn or error", &stringValue{&cfg.Log.Level}},
+		{"log-format", "format of logged lines, text or json", &stringValue{&cfg.Log.Format}},
+		{"messenger-pubsub", "delivery of messages to websockets, memory or postgres", &stringValue{&cfg.Messenger.PubSub}},
+		{"messenger-channel", "LISTEN/NOTIFY channel of the messenger shared by the nodes", &stringValue{&cfg.Messenger.Channel}},
+		{"messenger-ping-interval", "interval between pings of messenger websockets", &durationValue{&cfg.Messenger.PingInterval}},
+		{"messenger-idle-timeout", "time after which messenger websockets that do not answer pings are closed", &durationValue{&cfg.Messenger.IdleTimeout}},
+		{"messenger-write-timeout", "time to write a message to a messenger websocket", &durationValue{&cfg.Messenger.WriteTimeout}},
+		{"messenger-max-message-size", "size limit of a message from a messenger client in bytes", &intValue{&cfg.Messenger.MaxMessageSize}},
+	}
+}
+
+// Validate checks the whole configuration and reports all problems at once
+func (cfg *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(validPort(cfg.Server.Port), "server.port must be a number between 1 and 65535, got %q", cfg.Server.Port)
+	for _, origin := range cfg.Server.CorsOrigins {
+		u, err := url.Parse(origin)
+		check(origin == "*" || (err == nil && u.Scheme != "" && u.Host != ""), "server.cors_origins contains invalid origin %q", origin)
+	}
+	check(cfg.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+	check(cfg.Server.MetricsToken == "" || len(cfg.Server.MetricsToken) >= 16, "server.metrics_token must be at least 16 characters long")
+	if cfg.Server.MetricsAddress != "" {
+		host, port, err := net.SplitHostPort(cfg.Server.MetricsAddress)
+		check(err == nil && validPort(port), "server.metrics_address must be host:port, got %q", cfg.Server.MetricsAddress)
+		check(err != nil || cfg.Server.MetricsToken != "" || loopback(host), "server.metrics_token must be set when server.metrics_address is not a loopback address")
+	} else {
+		check(cfg.Server.MetricsToken != "" || loopback(cfg.Server.Address), "server.metrics_token must be set when the API serves /metrics on an address that is not a loopback address")
+	}
+	for _, proxy := range cfg.Server.TrustedProxies {
+		_, _, err := net.ParseCIDR(proxy)
+		check(err == nil, "server.trusted_proxies %q must be a CIDR range", proxy)
+	}
+
+	db := cfg.Database
+	check(db.Host != "", "database.host must be set")
+	check(validPort(db.Port), "database.port must be a number between 1 and 65535, got %q", db.Port)
+	check(db.User != "", "database.user must be set")
+	check(db.Name != "", "database.name must be set")
+	switch db.SSLMode {
+	case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		check(false, "database.sslmode %q is not supported", db.SSLMode)
+	}
+	check(db.MaxOpenConns >= 0, "database.max_open_conns must not be negative")
+	check(db.MaxIdleConns >= 0, "database.max_idle_conns must not be negative")
+	check(db.MaxOpenConns == 0 || db.MaxIdleConns <= db.MaxOpenConns, "database.max_idle_conns must not exceed database.max_open_conns")
+	check(db.ConnMaxLifetime >= 0, "database.conn_max_lifetime must not be negative")
+	check(db.ConnectTimeout > 0, "database.connect_timeout must be positive")
+	check(db.ConnectAttempts > 0, "database.connect_attempts must be positive")
+	check(db.ConnectBackoff > 0, "database.connect_backoff must be positive")
+	check(db.RequestTimeout > 0, "database.request_timeout must be positive")
+
+	tkn := cfg.Token
+	check(tkn.Secret == "" || len(tkn.Secret) >= 16, "token.secret must be at least 16 characters long")
+	switch tkn.SigningAlgorithm {
+	case "EdDSA", "RS256":
+	default:
+		check(false, "token.signing_algorithm %q is not supported", tkn.SigningAlgorithm)
+	}
+	switch tkn.KeyStore {
+	case "memory", "postgres":
+	default:
+		check(false, "token.key_store %q is not supported", tkn.KeyStore)
+	}
+	check(tkn.AccessTokenExpiration > 0, "token.access_token_expiration must be positive")
+	check(tkn.KeyOverlap >= tkn.AccessTokenExpiration, "token.key_overlap must not be less than token.access_token_expiration")
+	check(tkn.JWKSMaxAge >= time.Second, "token.jwks_max_age must be at least a second")
+	check(tkn.RefreshTokenExpiration > tkn.AccessTokenExpiration, "token.refresh_token_expiration must be longer than token.access_token_expiration")
+
+	check(tkn.PasswordResetExpiration > 0, "token.password_reset_expiration must be positive")
+	check(tkn.EmailVerificationExpiration > 0, "token.email_verification_expiration must be positive")
+	check(tkn.ImpersonationExpiration > 0 && tkn.ImpersonationExpiration <= tkn.KeyOverlap, "token.impersonation_expiration must be positive and not longer than token.key_overlap")
+
+	pwd := cfg.Password
+	switch pwd.Algorithm {
+	case "argon2id":
+		check(pwd.Argon2Memory >= 8*uint32(pwd.Argon2Parallelism), "password.argon2_memory must be at least 8 KiB per thread")
+		check(pwd.Argon2Iterations > 0, "password.argon2_iterations must be positive")
+		check(pwd.Argon2Parallelism > 0, "password.argon2_parallelism must be positive")
+	case "bcrypt":
+		check(pwd.BcryptCost >= 4 && pwd.BcryptCost <= 31, "password.bcrypt_cost must be between 4 and 31")
+	default:
+		check(false, "password.algorithm %q is not supported", pwd.Algorithm)
+	}
+	check(pwd.MinLength > 0, "password.min_length must be positive")
+	check(pwd.MaxLength == 0 || pwd.MaxLength >= pwd.MinLength, "password.max_length must not be less than password.min_length")
+	check(pwd.MaxLength <= 72, "password.max_length must be at most 72, bcrypt ignores longer passwords")
+
+	mail := cfg.Mail
+	switch mail.Driver {
+	case "smtp":
+		check(mail.SMTPHost != "", "mail.smtp_host must be set for the smtp driver")
+		check(validPort(mail.SMTPPort), "mail.smtp_port must be a number between 1 and 65535, got %q", mail.SMTPPort)
+	case "file":
+		check(mail.Dir != "", "mail.dir must be set for the file driver")
+	case "log":
+	default:
+		check(false, "mail.driver %q is not supported", mail.Driver)
+	}
+	_, err := netmail.ParseAddress(mail.From)
+	check(err == nil, "mail.from %q is not a valid address", mail.From)
+	u, err := url.Parse(mail.BaseURL)
+	check(err == nil && u.Scheme != "" && u.Host != "", "mail.base_url %q must be an absolute URL", mail.BaseURL)
+
+	tfa := cfg.TwoFactor
+	check(tfa.Issuer != "" && !strings.Contains(tfa.Issuer, ":"), "two_factor.issuer must be set and must not contain a colon")
+	for _, role := range tfa.RequiredRoles {
+		check(role != "", "two_factor.required_roles must not contain empty roles")
+	}
+	check(tfa.ChallengeExpiration > 0, "two_factor.challenge_expiration must be positive")
+	check(tfa.ChallengeAttempts > 0, "two_factor.challenge_attempts must be positive")
+	check(tfa.RecoveryCodes > 0 && tfa.RecoveryCodes <= 100, "two_factor.recovery_codes must be between 1 and 100")
+
+	lockout := cfg.Lockout
+	switch lockout.Store {
+	case "memory", "postgres":
+	default:
+		check(false, "lockout.store %q is not supported", lockout.Store)
+	}
+	check(lockout.AccountAttempts > 0, "lockout.account_attempts must be positive")
+	check(lockout.IPAttempts > 0, "lockout.ip_attempts must be positive")
+	check(lockout.BaseDelay > 0, "lockout.base_delay must be positive")
+	check(lockout.MaxDelay >= lockout.BaseDelay, "lockout.max_delay must not be less than lockout.base_delay")
+	check(lockout.ResetAfter >= lockout.MaxDelay, "lockout.reset_after must not be less than lockout.max_delay")
+
+	names := make(map[string]bool)
+	for i, p := range cfg.OIDC.Providers {
+		check(validProviderName(p.Name), "oidc.providers[%d].name %q must consist of lowercase letters, digits, - and _", i, p.Name)
+		check(!names[p.Name], "oidc.providers[%d].name %q is not unique", i, p.Name)
+		names[p.Name] = true
+		u, err := url.Parse(p.Issuer)
+		check(err == nil && u.Scheme != "" && u.Host != "", "oidc.providers[%d].issuer %q must be an absolute URL", i, p.Issuer)
+		check(p.ClientID != "", "oidc.providers[%d].client_id must be set", i)
+		u, err = url.Parse(p.RedirectURL)
+		check(err == nil && u.Scheme != "" && u.Host != "", "oidc.providers[%d].redirect_url %q must be an absolute URL", i, p.RedirectURL)
+	}
+	check(cfg.OIDC.StateExpiration > 0, "oidc.state_expiration must be positive")
+	check(cfg.APIKeys.MaxPerUser > 0, "api_keys.max_per_user must be positive")
+	check(cfg.Audit.Retention >= 0, "audit.retention must not be negative")
+
+	check(cfg.Jobs.SessionSweepInterval >= 0, "jobs.session_sweep_interval must not be negative")
+	check(cfg.Jobs.LoginAttemptSweepInterval >= 0, "jobs.login_attempt_sweep_interval must not be negative")
+	check(cfg.Jobs.KeyReloadInterval >= 0, "jobs.key_reload_interval must not be negative")
+	check(cfg.Jobs.AuditSweepInterval >= 0, "jobs.audit_sweep_interval must not be negative")
+
+	switch cfg.Tracing.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		u, err := url.Parse(cfg.Tracing.Endpoint)
+		check(err == nil && u.Scheme != "" && u.Host != "", "tracing.endpoint %q must be an absolute URL", cfg.Tracing.Endpoint)
+	default:
+		check(false, "tracing.exporter %q is not supported", cfg.Tracing.Exporter)
+	}
+	check(cfg.Tracing.ServiceName != "", "tracing.service_name must be set")
+	check(cfg.Tracing.SampleRatio >= 0 && cfg.Tracing.SampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1")
+
+	switch strings.ToLower(cfg.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		check(false, "log.level %q is not supported", cfg.Log.Level)
+	}
+	check(cfg.Log.Format == "text" || cfg.Log.Format == "json", "log.format %q is not supported", cfg.Log.Format)
+
+	check(cfg.Messenger.PubSub == "memory" || cfg.Messenger.PubSub == "postgres", "messenger.pubsub %q is not supported", cfg.Messenger.PubSub)
+	check(validChannel(cfg.Messenger.Channel), "messenger.channel %q must be at most 63 lowercase letters, digits and _ starting with a letter", cfg.Messenger.Channel)
+	check(cfg.Messenger.PingInterval > 0, "messenger.ping_interval must be positive")
+	check(cfg.Messenger.IdleTimeout > cfg.Messenger.PingInterval, "messenger.idle_timeout must be longer than messenger.ping_interval")
+	check(cfg.Messenger.WriteTimeout > 0, "messenger.write_timeout must be positive")
+	check(cfg.Messenger.MaxMessageSize > 0, "messenger.max_message_size must be positive")
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Redacted returns a copy of the configuration with secrets hidden
+func (cfg Config) Redacted() Config {
+	if cfg.Server.MetricsToken != "" {
+		cfg.Server.MetricsToken = redacted
+	}
+	if cfg.Database.Password != "" {
+		cfg.Database.Password = redacted
+	}
+	if cfg.Token.Secret != "" {
+		cfg.Token.Secret = redacted
+	}
+	if cfg.Mail.SMTPPassword != "" {
+		cfg.Mail.SMTPPassword = redacted
+	}
+	if len(cfg.OIDC.Providers) > 0 {
+		// the slice is shared with the original config
+		providers := make([]OIDCProvider, len(cfg.OIDC.Providers))
+		for i, p := range cfg.OIDC.Providers {
+			if p.ClientSecret != "" {
+				p.ClientSecret = redacted
+			}
+			providers[i] = p
+		}
+		cfg.OIDC.Providers = providers
+	}
+	return cfg
+}
+
+// DSN returns the connection string for the Postgres driver
+func (db *Database) DSN() string {
+	return fmt.Sprintf("host=%s port=%s user=%s password='%s' dbname=%s sslmode=%s connect_timeout=%d",
+		db.Host, db.Port, db.User, passwordEscaper.Replace(db.Password), db.Name, db.SSLMode, int(db.ConnectTimeout.Seconds()))
+}
+
+func validPort(port string) bool {
+	p, err := strconv.Atoi(port)
+	return err == nil && p > 0 && p < 65536
+}
+
+// loopback reports whether a listener on host accepts local connections
+// only, an empty host listens on all addresses
+func loopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// validChannel reports whether name is a postgres identifier that is not
+// changed by quoting or truncation
+func validChannel(name string) bool {
+	for i, r := range name {
+		if !(r >= 'a' && r <= 'z' || r == '_' || i > 0 && r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return name != "" && len(name) <= 63
+}
+
+func validProviderName(name string) bool {
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+func (v *stringValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return *v.p
+}
+
+func (v *stringValue) Set(s string) error {
+	*v.p = s
+	return nil
+}
+
+func (v *intValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return strconv.Itoa(*v.p)
+}
+
+func (v *intValue) Set(s string) error {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*v.p = i
+	return nil
+}
+
+func (v *uint32Value) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return strconv.FormatUint(uint64(*v.p), 10)
+}
+
+func (v *uint32Value) Set(s string) error {
+	i, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return err
+	}
+	*v.p = uint32(i)
+	return nil
+}
+
+func (v *uint8Value) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return strconv.FormatUint(uint64(*v.p), 10)
+}
+
+func (v *uint8Value) Set(s string) error {
+	i, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return err
+	}
+	*v.p = uint8(i)
+	return nil
+}
+
+func (v *float64Value) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*v.p, 'g', -1, 64)
+}
+
+func (v *float64Value) Set(s string) error {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	*v.p = f
+	return nil
+}
+
+func (v *boolValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return strconv.FormatBool(*v.p)
+}
+
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*v.p = b
+	return nil
+}
+
+func (v *boolValue) IsBoolFlag() bool {
+	return true
+}
+
+func (v *durationValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return v.p.String()
+}
+
+func (v *durationValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*v.p = d
+	return nil
+}
+
+func (v *listValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return strings.Join(*v.p, ",")
+}
+
+func (v *listValue) Set(s string) error {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	*v.p = list
+	return nil
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const yamlConfig = `
+server:
+  port: "4000"
+  cors_origins: ["https://sportbuddy.example"]
+database:
+  host: db.internal
+  password: from-file
+  max_open_conns: 50
+token:
+  secret: file-secret-0123456789
+  access_token_expiration: 15m
+`
+
+const tomlConfig = `
+[database]
+host = "db.internal"
+conn_max_lifetime = "1h"
+
+[token]
+secret = "file-secret-0123456789"
+`
+
+func writeConfig(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func setenv(t *testing.T, key, value string) {
+	require.NoError(t, os.Setenv(key, value))
+	t.Cleanup(func() {
+		os.Unsetenv(key)
+	})
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, "config.yaml", yamlConfig)
+	setenv(t, "SB_DB_HOST", "db.env")
+	setenv(t, "SB_PORT", "5000")
+
+	cfg, args, err := Load([]string{"-config", path, "-port", "6000", "migrate", "up"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"migrate", "up"}, args)
+
+	require.Equal(t, "6000", cfg.Server.Port, "flags override environment")
+	require.Equal(t, "db.env", cfg.Database.Host, "environment overrides file")
+	require.Equal(t, "from-file", cfg.Database.Password)
+	require.Equal(t, 50, cfg.Database.MaxOpenConns)
+	require.Equal(t, []string{"https://sportbuddy.example"}, cfg.Server.CorsOrigins)
+	require.Equal(t, 15*time.Minute, cfg.Token.AccessTokenExpiration)
+	require.Equal(t, Default().Token.RefreshTokenExpiration, cfg.Token.RefreshTokenExpiration, "defaults are kept")
+	require.NoError(t, cfg.Validate())
+}
+
+func TestLoadTOML(t *testing.T) {
+	setenv(t, "SB_CONFIG", writeConfig(t, "config.toml", tomlConfig))
+
+	cfg, _, err := Load(nil)
+	require.NoError(t, err)
+	require.Equal(t, "db.internal", cfg.Database.Host)
+	require.Equal(t, time.Hour, cfg.Database.ConnMaxLifetime)
+	require.NoError(t, cfg.Validate())
+}
+
+func TestLoadUnknownKey(t *testing.T) {
+	path := writeConfig(t, "config.yaml", "database:\n  hots: localhost\n")
+	_, _, err := Load([]string{"-config", path})
+	require.Error(t, err)
+}
+
+func TestLoadInvalidEnv(t *testing.T) {
+	setenv(t, "SB_DB_MAX_OPEN_CONNS", "many")
+	_, _, err := Load(nil)
+	require.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	cfg.Server.Port = "port"
+	cfg.Server.ShutdownTimeout = 0
+	cfg.Server.MetricsToken = "short"
+	cfg.Server.MetricsAddress = "9100"
+	cfg.Server.TrustedProxies = []string{"10.0.0.1"}
+	cfg.TwoFactor.ChallengeAttempts = 0
+	cfg.Database.SSLMode = "sometimes"
+	cfg.Database.MaxIdleConns = 100
+	cfg.Database.RequestTimeout = 0
+	cfg.Database.ConnectAttempts = 0
+	cfg.Token.Secret = "short"
+	cfg.Token.KeyOverlap = cfg.Token.AccessTokenExpiration / 2
+	cfg.Token.JWKSMaxAge = 0
+	cfg.OIDC.Providers = []OIDCProvider{{Name: "Google", Issuer: "https://accounts.google.com", RedirectURL: "/login"}}
+	cfg.APIKeys.MaxPerUser = 0
+	cfg.Audit.Retention = -time.Hour
+	cfg.Tracing.Exporter = "jaeger"
+	cfg.Tracing.SampleRatio = 1.5
+	cfg.Log.Level = "verbose"
+	cfg.Log.Format = "logfmt"
+	cfg.Messenger.IdleTimeout = cfg.Messenger.PingInterval
+	cfg.Messenger.Channel = "sb-messenger"
+	cfg.Password.MaxLength = 128
+
+	err := cfg.Validate()
+	require.Error(t, err)
+	for _, problem := range []string{"server.port", "server.shutdown_timeout", "server.metrics_token", "server.metrics_address", "server.trusted_proxies", "database.sslmode", "database.max_idle_conns", "database.request_timeout", "database.connect_attempts", "token.secret", "token.key_overlap", "token.jwks_max_age", "two_factor.challenge_attempts",
+		"oidc.providers[0].name", "oidc.providers[0].client_id", "oidc.providers[0].redirect_url",
+		"api_keys.max_per_user", "audit.retention", "tracing.exporter", "tracing.sample_ratio", "log.level", "log.format", "messenger.idle_timeout", "messenger.channel", "password.max_length"} {
+		require.True(t, strings.Contains(err.Error(), problem), "expected problem with %s in %q", problem, err)
+	}
+}
+
+func TestMetricsExposure(t *testing.T) {
+	cfg := Default()
+	require.NoError(t, cfg.Validate(), "metrics are served on localhost by default")
+
+	cfg.Server.MetricsAddress = ":9100"
+	require.Error(t, cfg.Validate(), "public metrics need a token")
+	cfg.Server.MetricsToken = "ZTFkYjQ5ODYtYzVlMS00"
+	require.NoError(t, cfg.Validate())
+
+	cfg = Default()
+	cfg.Server.MetricsAddress = ""
+	require.Error(t, cfg.Validate(), "the API listens on every address by default")
+	cfg.Server.Address = "127.0.0.1"
+	require.NoError(t, cfg.Validate())
+}
+
+func TestRedacted(t *testing.T) {
+	cfg := Default()
+	cfg.Database.Password = "1"
+	cfg.Server.MetricsToken = "ZTFkYjQ5ODYtYzVlMS00"
+	cfg.Token.Secret = "s0Wo!GLNLkjwVG4G:Jf18/KvAM"
+	cfg.OIDC.Providers = []OIDCProvider{{Name: "google", ClientSecret: "2"}}
+
+	r := cfg.Redacted()
+	require.Equal(t, redacted, r.Database.Password)
+	require.Equal(t, redacted, r.Token.Secret)
+	require.Equal(t, redacted, r.Server.MetricsToken)
+	require.Equal(t, redacted, r.OIDC.Providers[0].ClientSecret)
+	require.Equal(t, "1", cfg.Database.Password, "original config must not change")
+	require.Equal(t, "2", cfg.OIDC.Providers[0].ClientSecret, "original config must not change")
+}
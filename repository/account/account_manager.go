@@ -0,0 +1,199 @@
+package account
+
+import (
+	"SB/service/config"
+	"SB/service/repository/logging"
+	"SB/service/repository/mail"
+	"SB/service/repository/password"
+	"SB/service/repository/persistence"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPendingResets limits the password reset e-mails being sent at once,
+	// further requests are dropped
+	maxPendingResets = 64
+	// resetTimeout bounds a password reset request handled after the
+	// response
+	resetTimeout = time.Minute
+)
+
+type (
+	// AccountManager recovers accounts and verifies e-mails with single-use
+	// tokens sent by e-mail. Tokens are stored hashed, so a leaked database
+	// does not let anybody reset passwords.
+	AccountManager interface {
+		// RequestPasswordReset sends a reset link if the account exists. It
+		// returns before the account is looked up and reports nothing, so
+		// neither the result nor the response time tell whether an account
+		// has the e-mail.
+		RequestPasswordReset(ctx context.Context, email string)
+		// Wait blocks until the password reset requests are handled
+		Wait()
+		ResetPassword(ctx context.Context, token, newPassword string) (int64, error)
+		SendVerificationEmail(ctx context.Context, idUser int64, email string) error
+		VerifyEmail(ctx context.Context, token string) error
+	}
+
+	accountManager struct {
+		persistent persistence.Persistent
+		hasher     password.Hasher
+		policy     password.Policy
+		mailer     mail.Mailer
+		tokens     config.Token
+		baseURL    string
+		pending    sync.WaitGroup
+		slots      chan struct{}
+		logger     *logging.Logger
+	}
+)
+
+func NewAccountManager(persistent persistence.Persistent, hasher password.Hasher, policy password.Policy, mailer mail.Mailer,
+	tokens config.Token, mailCfg config.Mail, logger *logging.Logger) AccountManager {
+	return &accountManager{
+		persistent: persistent,
+		hasher:     hasher,
+		policy:     policy,
+		mailer:     mailer,
+		tokens:     tokens,
+		baseURL:    mailCfg.BaseURL,
+		slots:      make(chan struct{}, maxPendingResets),
+		logger:     logger,
+	}
+}
+
+func (mgr *accountManager) RequestPasswordReset(ctx context.Context, email string) {
+	logger := mgr.logger.For(ctx)
+	select {
+	case mgr.slots <- struct{}{}:
+	default:
+		logger.Warn("too many pending password resets, request dropped")
+		return
+	}
+	mgr.pending.Add(1)
+	go func() {
+		defer func() {
+			<-mgr.slots
+			mgr.pending.Done()
+		}()
+		// the request is answered already, its context ends
+		ctx, cancel := context.WithTimeout(logging.NewContext(context.Background(), logger), resetTimeout)
+		defer cancel()
+		if err := mgr.sendPasswordReset(ctx, email); err != nil {
+			logger.Error("failed to send password reset e-mail", logging.Err(err))
+		}
+	}()
+}
+
+// sendPasswordReset creates the token and the e-mail for unknown e-mails
+// too, only storing and sending them depend on the account
+func (mgr *accountManager) sendPasswordReset(ctx context.Context, email string) error {
+	token, hash, err := newAccountToken()
+	if err != nil {
+		return err
+	}
+	msg := mail.Message{
+		To:      email,
+		Subject: "Password reset",
+		Body: fmt.Sprintf("To set a new password for your Sport Buddy account open the link:\n\n%s\n\n"+
+			"The link is valid for %s. If you did not request a password reset, ignore this e-mail.\n",
+			mgr.link("/reset-password", token), mgr.tokens.PasswordResetExpiration),
+	}
+	user, err := mgr.persistent.GetUserAuthParams(ctx, email)
+	if errors.Is(err, persistence.ErrUserNotFound) {
+		mgr.logger.For(ctx).Info("password reset requested for unknown user")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	expires := time.Now().UTC().Add(mgr.tokens.PasswordResetExpiration)
+	if err := mgr.persistent.AddAccountToken(ctx, user.GetId(), persistence.PurposePasswordReset, hash, expires); err != nil {
+		return err
+	}
+	return mgr.mailer.Send(msg)
+}
+
+func (mgr *accountManager) Wait() {
+	mgr.pending.Wait()
+}
+
+// ResetPassword returns the id of the user of the token, *password.PolicyError
+// if the new password is rejected and persistence.ErrInvalidAccountToken if
+// the token cannot be used
+func (mgr *accountManager) ResetPassword(ctx context.Context, token, newPassword string) (int64, error) {
+	if err := mgr.policy.Check(newPassword); err != nil {
+		return 0, err
+	}
+	hash, err := mgr.hasher.Hash(newPassword)
+	if err != nil {
+		return 0, err
+	}
+	idUser, err := mgr.persistent.ResetPassword(ctx, hashToken(token), hash)
+	if err != nil {
+		return 0, err
+	}
+	mgr.logger.For(ctx).Info("password reset, all sessions ended", logging.Int("id_user", idUser))
+	return idUser, nil
+}
+
+func (mgr *accountManager) SendVerificationEmail(ctx context.Context, idUser int64, email string) error {
+	token, err := mgr.newToken(ctx, idUser, persistence.PurposeEmailVerification, mgr.tokens.EmailVerificationExpiration)
+	if err != nil {
+		return err
+	}
+	return mgr.mailer.Send(mail.Message{
+		To:      email,
+		Subject: "Confirm your e-mail",
+		Body: fmt.Sprintf("Welcome to Sport Buddy! Confirm your e-mail by opening the link:\n\n%s\n\n"+
+			"The link is valid for %s.\n", mgr.link("/verify-email", token), mgr.tokens.EmailVerificationExpiration),
+	})
+}
+
+func (mgr *accountManager) VerifyEmail(ctx context.Context, token string) error {
+	idUser, err := mgr.persistent.VerifyEmail(ctx, hashToken(token))
+	if err != nil {
+		return err
+	}
+	mgr.logger.For(ctx).Info("e-mail verified", logging.Int("id_user", idUser))
+	return nil
+}
+
+func (mgr *accountManager) newToken(ctx context.Context, idUser int64, purpose string, lifetime time.Duration) (string, error) {
+	token, hash, err := newAccountToken()
+	if err != nil {
+		return "", err
+	}
+	err = mgr.persistent.AddAccountToken(ctx, idUser, purpose, hash, time.Now().UTC().Add(lifetime))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// newAccountToken returns 256 random bits and their hash
+func newAccountToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+func (mgr *accountManager) link(path, token string) string {
+	return mgr.baseURL + path + "?token=" + url.QueryEscape(token)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,268 @@
+package admin
+
+import (
+	"SB/service/repository/audit"
+	"SB/service/repository/errs"
+	"SB/service/repository/persistence"
+	"SB/service/repository/token"
+	"context"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrSelf is returned when an admin tries to change their own role or
+	// ban themselves, so the last admin cannot lock everybody out
+	ErrSelf        = errs.New(errs.ErrForbidden, "admins cannot change their own role or ban themselves")
+	ErrUnknownRole = errs.New(errs.ErrValidation, "unknown role")
+	ErrInvalidName = errs.New(errs.ErrValidation, "name must be between 1 and 100 characters long")
+	// ErrInvalidDescription is returned for level descriptions longer than
+	// 100 characters
+	ErrInvalidDescription = errs.New(errs.ErrValidation, "description must be at most 100 characters long")
+	// ErrInvalidBan is returned for reasons longer than 500 characters and
+	// expiration times in the past
+	ErrInvalidBan = errs.New(errs.ErrValidation, "the reason must be at most 500 characters long and the ban must end in the future")
+	// ErrSameSport is returned when a sport is merged into itself
+	ErrSameSport = errs.New(errs.ErrValidation, "sport cannot be merged into itself")
+)
+
+type (
+	// AdminManager administrates users and the sports and levels
+	// dictionaries. Changes are recorded in the audit log with the acting
+	// admin.
+	AdminManager interface {
+		SearchUsers(ctx context.Context, search persistence.UserSearch) ([]persistence.UserSummary, int64, error)
+		SetRole(ctx context.Context, actor audit.Actor, idUser int64, role string) error
+		// Ban revokes all sessions of the user, a ban without Until is
+		// permanent. Access tokens issued before stay valid until they expire.
+		Ban(ctx context.Context, actor audit.Actor, idUser int64, ban persistence.Ban) error
+		Unban(ctx context.Context, actor audit.Actor, idUser int64) error
+		// GetBan returns nil if the user is not banned
+		GetBan(ctx context.Context, idUser int64) (*persistence.Ban, error)
+		GetSports(ctx context.Context) ([]persistence.SportInfo, error)
+		AddSport(ctx context.Context, actor audit.Actor, name string) (persistence.SportInfo, error)
+		RenameSport(ctx context.Context, actor audit.Actor, idSport int64, name string) error
+		// DeleteSport returns persistence.ErrInUse for sports still
+		// referenced, they have to be merged instead
+		DeleteSport(ctx context.Context, actor audit.Actor, idSport int64) error
+		MergeSports(ctx context.Context, actor audit.Actor, from, into int64) error
+		GetLevels(ctx context.Context) ([]persistence.LevelInfo, error)
+		AddLevel(ctx context.Context, actor audit.Actor, level persistence.LevelInfo) (persistence.LevelInfo, error)
+		UpdateLevel(ctx context.Context, actor audit.Actor, level persistence.LevelInfo) error
+		DeleteLevel(ctx context.Context, actor audit.Actor, idLevel int64) error
+		DeleteTraining(ctx context.Context, actor audit.Actor, idTraining int64) error
+		DeleteMessage(ctx context.Context, actor audit.Actor, idMessage int64) error
+	}
+
+	adminManager struct {
+		persistent persistence.Persistent
+		audit      audit.Log
+		now        func() time.Time
+	}
+)
+
+func NewAdminManager(persistent persistence.Persistent, auditLog audit.Log) AdminManager {
+	return &adminManager{
+		persistent: persistent,
+		audit:      auditLog,
+		now:        time.Now,
+	}
+}
+
+func (mgr *adminManager) SearchUsers(ctx context.Context, search persistence.UserSearch) ([]persistence.UserSummary, int64, error) {
+	search.Query = strings.TrimSpace(search.Query)
+	if search.Role != "" && !knownRole(search.Role) {
+		return nil, 0, ErrUnknownRole
+	}
+	return mgr.persistent.SearchUsers(ctx, search)
+}
+
+func (mgr *adminManager) SetRole(ctx context.Context, actor audit.Actor, idUser int64, role string) error {
+	if actor.IdUser == idUser {
+		return ErrSelf
+	}
+	if !knownRole(role) {
+		return ErrUnknownRole
+	}
+	user, err := mgr.persistent.GetUser(ctx, idUser)
+	if err != nil {
+		return err
+	}
+	if err := mgr.persistent.SetRole(ctx, idUser, role); err != nil {
+		return err
+	}
+	mgr.audit.Record(ctx, actor, audit.ActionRoleChanged, audit.TargetUser, idUser,
+		map[string]string{"role": user.GetRole()}, map[string]string{"role": role})
+	return nil
+}
+
+func (mgr *adminManager) Ban(ctx context.Context, actor audit.Actor, idUser int64, ban persistence.Ban) error {
+	if actor.IdUser == idUser {
+		return ErrSelf
+	}
+	ban.Reason = strings.TrimSpace(ban.Reason)
+	if len(ban.Reason) > 500 || ban.Until != nil && !ban.Until.After(mgr.now()) {
+		return ErrInvalidBan
+	}
+	if err := mgr.persistent.BanUser(ctx, idUser, ban); err != nil {
+		return err
+	}
+	mgr.audit.Record(ctx, actor, audit.ActionUserBanned, audit.TargetUser, idUser, nil, map[string]interface{}{
+		"reason": ban.Reason,
+		"until":  ban.Until,
+	})
+	// refresh tokens stop working, access tokens are not checked against
+	// bans and stay valid until they expire, as the ban endpoint documents
+	if _, err := mgr.persistent.RevokeUserSessions(ctx, idUser, "", true); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (mgr *adminManager) Unban(ctx context.Context, actor audit.Actor, idUser int64) error {
+	if err := mgr.persistent.UnbanUser(ctx, idUser); err != nil {
+		return err
+	}
+	mgr.audit.Record(ctx, actor, audit.ActionUserUnbanned, audit.TargetUser, idUser, nil, nil)
+	return nil
+}
+
+func (mgr *adminManager) GetBan(ctx context.Context, idUser int64) (*persistence.Ban, error) {
+	return mgr.persistent.GetBan(ctx, idUser)
+}
+
+func (mgr *adminManager) GetSports(ctx context.Context) ([]persistence.SportInfo, error) {
+	return mgr.persistent.GetSports(ctx)
+}
+
+func (mgr *adminManager) AddSport(ctx context.Context, actor audit.Actor, name string) (persistence.SportInfo, error) {
+	name, err := validName(name)
+	if err != nil {
+		return persistence.SportInfo{}, err
+	}
+	sport, err := mgr.persistent.AddSport(ctx, name)
+	if err != nil {
+		return persistence.SportInfo{}, err
+	}
+	mgr.audit.Record(ctx, actor, audit.ActionSportAdded, audit.TargetSport, sport.IdSport, nil, map[string]string{"sport_type": name})
+	return sport, nil
+}
+
+func (mgr *adminManager) RenameSport(ctx context.Context, actor audit.Actor, idSport int64, name string) error {
+	name, err := validName(name)
+	if err != nil {
+		return err
+	}
+	previous, err := mgr.persistent.RenameSport(ctx, idSport, name)
+	if err != nil {
+		return err
+	}
+	mgr.audit.Record(ctx, actor, audit.ActionSportRenamed, audit.TargetSport, idSport,
+		map[string]string{"sport_type": previous}, map[string]string{"sport_type": name})
+	return nil
+}
+
+func (mgr *adminManager) DeleteSport(ctx context.Context, actor audit.Actor, idSport int64) error {
+	if err := mgr.persistent.DeleteSport(ctx, idSport); err != nil {
+		return err
+	}
+	mgr.audit.Record(ctx, actor, audit.ActionSportDeleted, audit.TargetSport, idSport, nil, nil)
+	return nil
+}
+
+func (mgr *adminManager) MergeSports(ctx context.Context, actor audit.Actor, from, into int64) error {
+	if from == into {
+		return ErrSameSport
+	}
+	if err := mgr.persistent.MergeSports(ctx, from, into); err != nil {
+		return err
+	}
+	mgr.audit.Record(ctx, actor, audit.ActionSportsMerged, audit.TargetSport, from, nil, map[string]int64{"into": into})
+	return nil
+}
+
+func (mgr *adminManager) GetLevels(ctx context.Context) ([]persistence.LevelInfo, error) {
+	return mgr.persistent.GetLevels(ctx)
+}
+
+func (mgr *adminManager) AddLevel(ctx context.Context, actor audit.Actor, level persistence.LevelInfo) (persistence.LevelInfo, error) {
+	description, err := validDescription(level.Description)
+	if err != nil {
+		return persistence.LevelInfo{}, err
+	}
+	level.Description = description
+	added, err := mgr.persistent.AddLevel(ctx, level)
+	if err != nil {
+		return persistence.LevelInfo{}, err
+	}
+	mgr.audit.Record(ctx, actor, audit.ActionLevelAdded, audit.TargetLevel, added.IdLevel, nil, added)
+	return added, nil
+}
+
+func (mgr *adminManager) UpdateLevel(ctx context.Context, actor audit.Actor, level persistence.LevelInfo) error {
+	description, err := validDescription(level.Description)
+	if err != nil {
+		return err
+	}
+	level.Description = description
+	previous, err := mgr.persistent.UpdateLevel(ctx, level)
+	if err != nil {
+		return err
+	}
+	mgr.audit.Record(ctx, actor, audit.ActionLevelUpdated, audit.TargetLevel, level.IdLevel, previous, level)
+	return nil
+}
+
+func (mgr *adminManager) DeleteLevel(ctx context.Context, actor audit.Actor, idLevel int64) error {
+	if err := mgr.persistent.DeleteLevel(ctx, idLevel); err != nil {
+		return err
+	}
+	mgr.audit.Record(ctx, actor, audit.ActionLevelDeleted, audit.TargetLevel, idLevel, nil, nil)
+	return nil
+}
+
+func (mgr *adminManager) DeleteTraining(ctx context.Context, actor audit.Actor, idTraining int64) error {
+	before, err := mgr.persistent.GetGroupTraining(ctx, idTraining)
+	if err != nil {
+		return err
+	}
+	if err := mgr.persistent.DeleteGroupTraining(ctx, idTraining); err != nil {
+		return err
+	}
+	mgr.audit.Record(ctx, actor, audit.ActionTrainingDeleted, audit.TargetTraining, idTraining, before, nil)
+	return nil
+}
+
+func (mgr *adminManager) DeleteMessage(ctx context.Context, actor audit.Actor, idMessage int64) error {
+	if err := mgr.persistent.DeleteMessage(ctx, idMessage); err != nil {
+		return err
+	}
+	mgr.audit.Record(ctx, actor, audit.ActionMessageDeleted, audit.TargetMessage, idMessage, nil, nil)
+	return nil
+}
+
+func validName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 100 {
+		return "", ErrInvalidName
+	}
+	return name, nil
+}
+
+// validDescription allows empty descriptions, levels are identified by number
+func validDescription(description string) (string, error) {
+	description = strings.TrimSpace(description)
+	if len(description) > 100 {
+		return "", ErrInvalidDescription
+	}
+	return description, nil
+}
+
+func knownRole(role string) bool {
+	for _, r := range token.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
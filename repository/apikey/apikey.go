@@ -0,0 +1,182 @@
+package apikey
+
+import (
+	"SB/service/config"
+	"SB/service/repository/errs"
+	"SB/service/repository/logging"
+	"SB/service/repository/persistence"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Prefix starts every key so leaked keys are easy to find in code and logs
+const Prefix = "sbk_"
+
+// touchInterval limits updates of the last use time of a key busy
+// integrations would make on every request
+const touchInterval = time.Minute
+
+// Scopes an API key can be granted, each route accepting keys requires one
+const (
+	ScopeProfileRead    = "profile:read"
+	ScopeProfileWrite   = "profile:write"
+	ScopeTrainingsRead  = "trainings:read"
+	ScopeTrainingsWrite = "trainings:write"
+	ScopeMessagesRead   = "messages:read"
+	ScopeMessagesWrite  = "messages:write"
+)
+
+// Scopes lists every scope a key can be granted
+var Scopes = []string{ScopeProfileRead, ScopeProfileWrite, ScopeTrainingsRead, ScopeTrainingsWrite, ScopeMessagesRead, ScopeMessagesWrite}
+
+var (
+	// ErrInvalidKey is returned for malformed, unknown, revoked and expired keys
+	ErrInvalidKey   = errors.New("invalid API key")
+	ErrUnknownScope = errs.New(errs.ErrValidation, "unknown scope")
+	ErrInvalidName  = errs.New(errs.ErrValidation, "name must be between 1 and 100 characters long")
+	// ErrInvalidExpiration is returned for expiration times in the past
+	ErrInvalidExpiration = errs.New(errs.ErrValidation, "expiration must be in the future")
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type (
+	// Manager issues personal API keys acting as their owner with the
+	// granted scopes only. A key is sbk_<id>_<secret>, the id is stored to
+	// find the key and the whole key is stored only as a hash.
+	Manager interface {
+		// Create returns the key, it cannot be shown again. Keys created in
+		// sessions started with a second factor count as such sessions.
+		Create(ctx context.Context, idUser int64, name string, scopes []string, expiresAt *time.Time, twoFactor bool) (string, persistence.APIKey, error)
+		List(ctx context.Context, idUser int64) ([]persistence.APIKey, error)
+		Revoke(ctx context.Context, idUser int64, idKey int64) error
+		// Authenticate returns the key with the role of its owner or
+		// ErrInvalidKey
+		Authenticate(ctx context.Context, key string) (persistence.APIKey, error)
+	}
+
+	manager struct {
+		persistent persistence.Persistent
+		config     config.APIKeys
+		now        func() time.Time
+		logger     *logging.Logger
+	}
+)
+
+func NewManager(persistent persistence.Persistent, cfg config.APIKeys, logger *logging.Logger) Manager {
+	return &manager{
+		persistent: persistent,
+		config:     cfg,
+		now:        time.Now,
+		logger:     logger,
+	}
+}
+
+func (mgr *manager) Create(ctx context.Context, idUser int64, name string, scopes []string, expiresAt *time.Time, twoFactor bool) (string, persistence.APIKey, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 100 {
+		return "", persistence.APIKey{}, ErrInvalidName
+	}
+	if len(scopes) == 0 {
+		return "", persistence.APIKey{}, fmt.Errorf("%w: at least one scope is required", ErrUnknownScope)
+	}
+	for _, scope := range scopes {
+		if !knownScope(scope) {
+			return "", persistence.APIKey{}, fmt.Errorf("%w %q", ErrUnknownScope, scope)
+		}
+	}
+	if expiresAt != nil && !expiresAt.After(mgr.now()) {
+		return "", persistence.APIKey{}, ErrInvalidExpiration
+	}
+
+	id, err := random(5)
+	if err != nil {
+		return "", persistence.APIKey{}, err
+	}
+	secret, err := random(20)
+	if err != nil {
+		return "", persistence.APIKey{}, err
+	}
+	prefix := Prefix + id
+	key := prefix + "_" + secret
+	stored, err := mgr.persistent.AddAPIKey(ctx, persistence.APIKey{
+		IdUser:    idUser,
+		Name:      name,
+		Prefix:    prefix,
+		Hash:      hashKey(key),
+		Scopes:    strings.Join(scopes, " "),
+		ExpiresAt: expiresAt,
+		TwoFactor: twoFactor,
+	}, mgr.config.MaxPerUser)
+	if err != nil {
+		return "", persistence.APIKey{}, err
+	}
+	mgr.logger.For(ctx).Info("API key created", logging.String("prefix", prefix), logging.Int("id_user", idUser))
+	return key, stored, nil
+}
+
+func (mgr *manager) List(ctx context.Context, idUser int64) ([]persistence.APIKey, error) {
+	return mgr.persistent.GetAPIKeys(ctx, idUser)
+}
+
+func (mgr *manager) Revoke(ctx context.Context, idUser int64, idKey int64) error {
+	return mgr.persistent.RevokeAPIKey(ctx, idUser, idKey)
+}
+
+func (mgr *manager) Authenticate(ctx context.Context, key string) (persistence.APIKey, error) {
+	i := strings.LastIndexByte(key, '_')
+	if !strings.HasPrefix(key, Prefix) || i < len(Prefix) {
+		return persistence.APIKey{}, ErrInvalidKey
+	}
+	stored, err := mgr.persistent.GetAPIKey(ctx, key[:i])
+	if errors.Is(err, persistence.ErrAPIKeyNotFound) {
+		return persistence.APIKey{}, ErrInvalidKey
+	} else if err != nil {
+		return persistence.APIKey{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(stored.Hash), []byte(hashKey(key))) != 1 {
+		return persistence.APIKey{}, ErrInvalidKey
+	}
+	now := mgr.now()
+	if stored.ExpiresAt != nil && !stored.ExpiresAt.After(now) {
+		return persistence.APIKey{}, ErrInvalidKey
+	}
+	if stored.LastUsedAt == nil || stored.LastUsedAt.Before(now.Add(-touchInterval)) {
+		if err := mgr.persistent.TouchAPIKey(ctx, stored.Id); err != nil {
+			mgr.logger.For(ctx).Error("failed to update last use of API key", logging.Int("id_key", stored.Id), logging.Err(err))
+		}
+	}
+	return stored, nil
+}
+
+// random returns n random bytes in lowercase base32
+func random(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return strings.ToLower(encoding.EncodeToString(b)), nil
+}
+
+// hashKey does not need a slow hash, keys have 160 random bits
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func knownScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+package audit
+
+import (
+	"SB/service/config"
+	"SB/service/repository/detach"
+	"SB/service/repository/logging"
+	"SB/service/repository/persistence"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// recordTimeout bounds writing an entry, changes are recorded after they are
+// made even if the request is canceled meanwhile
+const recordTimeout = 10 * time.Second
+
+// Actions recorded in the audit log
+const (
+	ActionUserDeleted     = "user.deleted"
+	ActionRoleChanged     = "user.role_changed"
+	ActionUserBanned      = "user.banned"
+	ActionUserUnbanned    = "user.unbanned"
+	ActionTrainingUpdated = "training.updated"
+	ActionTrainingDeleted = "training.deleted"
+	ActionMessageDeleted  = "message.deleted"
+	ActionSportAdded      = "sport.added"
+	ActionSportRenamed    = "sport.renamed"
+	ActionSportDeleted    = "sport.deleted"
+	ActionSportsMerged    = "sport.merged"
+	ActionLevelAdded      = "level.added"
+	ActionLevelUpdated    = "level.updated"
+	ActionLevelDeleted    = "level.deleted"
+
+	// impersonation entries are made by the user with ImpersonatedBy set
+	ActionImpersonationStarted = "user.impersonation_started"
+	ActionImpersonatedRequest  = "user.impersonated_request"
+)
+
+// Types of targets of audited actions
+const (
+	TargetUser     = "user"
+	TargetTraining = "training"
+	TargetMessage  = "message"
+	TargetSport    = "sport"
+	TargetLevel    = "level"
+)
+
+// ExportLimit is the largest number of entries exported at once
+const ExportLimit = 10000
+
+type (
+	// Actor is the user making a change and the request the change was
+	// made in, the zero Actor is the service itself
+	Actor struct {
+		IdUser int64
+		// ImpersonatedBy is the admin acting as the user
+		ImpersonatedBy int64
+		IP             string
+		RequestId      string
+	}
+
+	// Log records changes in the append-only audit log. Managers record a
+	// change after it is made, a failure to record is logged and does not
+	// undo the change.
+	Log interface {
+		// Record keeps the fields of before and after that differ, either
+		// may be nil for created and deleted targets
+		Record(ctx context.Context, actor Actor, action, targetType string, targetId int64, before, after interface{})
+		Search(ctx context.Context, filter persistence.AuditFilter) ([]persistence.AuditEntry, int64, error)
+		// Export returns up to ExportLimit newest entries
+		Export(ctx context.Context, filter persistence.AuditFilter) ([]persistence.AuditEntry, error)
+		// Sweep deletes entries past the retention period
+		Sweep(ctx context.Context) (int64, error)
+	}
+
+	auditLog struct {
+		persistent persistence.Persistent
+		config     config.Audit
+		logger     *logging.Logger
+	}
+)
+
+func NewLog(persistent persistence.Persistent, cfg config.Audit, logger *logging.Logger) Log {
+	return &auditLog{
+		persistent: persistent,
+		config:     cfg,
+		logger:     logger,
+	}
+}
+
+func (l *auditLog) Record(ctx context.Context, actor Actor, action, targetType string, targetId int64, before, after interface{}) {
+	b, a, err := Diff(before, after)
+	if err != nil {
+		l.logger.For(ctx).Error("failed to record change in audit log", logging.String("action", action),
+			logging.String("target_type", targetType), logging.Int("target_id", targetId), logging.Err(err))
+		return
+	}
+	ctx, cancel := detach.Context(ctx, recordTimeout)
+	defer cancel()
+	err = l.persistent.AddAuditEntry(ctx, persistence.AuditEntry{
+		IdActor:        optional(actor.IdUser),
+		ImpersonatedBy: optional(actor.ImpersonatedBy),
+		Action:         action,
+		TargetType:     targetType,
+		TargetId:       targetId,
+		Before:         persistence.RawJSON(b),
+		After:          persistence.RawJSON(a),
+		IP:             actor.IP,
+		RequestId:      actor.RequestId,
+	})
+	if err != nil {
+		l.logger.For(ctx).Error("failed to record change in audit log", logging.String("action", action),
+			logging.String("target_type", targetType), logging.Int("target_id", targetId), logging.Err(err))
+	}
+}
+
+func (l *auditLog) Search(ctx context.Context, filter persistence.AuditFilter) ([]persistence.AuditEntry, int64, error) {
+	return l.persistent.GetAuditEntries(ctx, filter)
+}
+
+func (l *auditLog) Export(ctx context.Context, filter persistence.AuditFilter) ([]persistence.AuditEntry, error) {
+	filter.Limit = ExportLimit
+	filter.Offset = 0
+	entries, _, err := l.persistent.GetAuditEntries(ctx, filter)
+	return entries, err
+}
+
+func (l *auditLog) Sweep(ctx context.Context) (int64, error) {
+	if l.config.Retention == 0 {
+		return 0, nil
+	}
+	return l.persistent.DeleteAuditEntries(ctx, l.config.Retention)
+}
+
+// Diff converts before and after to JSON objects and drops the fields equal
+// in both, nil stays nil
+func Diff(before, after interface{}) (json.RawMessage, json.RawMessage, error) {
+	b, err := toObject(before)
+	if err != nil {
+		return nil, nil, err
+	}
+	a, err := toObject(after)
+	if err != nil {
+		return nil, nil, err
+	}
+	for key, value := range b {
+		if other, ok := a[key]; ok && reflect.DeepEqual(value, other) {
+			delete(b, key)
+			delete(a, key)
+		}
+	}
+	bj, err := marshal(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	aj, err := marshal(a)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bj, aj, nil
+}
+
+// toObject converts a struct or a map to a JSON object
+func toObject(v interface{}) (map[string]interface{}, error) {
+	if v == nil || reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil() {
+		return nil, nil
+	}
+	content, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(content, &object); err != nil {
+		return nil, fmt.Errorf("%T is not an object: %w", v, err)
+	}
+	return object, nil
+}
+
+func marshal(object map[string]interface{}) (json.RawMessage, error) {
+	if object == nil {
+		return nil, nil
+	}
+	return json.Marshal(object)
+}
+
+func optional(id int64) *int64 {
+	if id == 0 {
+		return nil
+	}
+	return &id
+}
@@ -0,0 +1,31 @@
+package audit
+
+import (
+	"SB/service/repository/persistence"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	before := persistence.LevelInfo{IdLevel: 2, Level: 3, Description: "junior"}
+	after := persistence.LevelInfo{IdLevel: 2, Level: 3, Description: "middle"}
+	b, a, err := Diff(before, after)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"description":"junior"}`, string(b))
+	require.JSONEq(t, `{"description":"middle"}`, string(a))
+
+	b, a, err = Diff(nil, map[string]string{"sport_type": "Padel"})
+	require.NoError(t, err)
+	require.Nil(t, b)
+	require.JSONEq(t, `{"sport_type":"Padel"}`, string(a))
+
+	var deleted *persistence.LevelInfo
+	b, a, err = Diff(before, deleted)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"id_level":2,"level":3,"description":"junior"}`, string(b))
+	require.Nil(t, a)
+
+	_, _, err = Diff("user", nil)
+	require.Error(t, err)
+}
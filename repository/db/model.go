@@ -11,27 +11,27 @@ type (
 		// Id of a user
 		IdUser int64 `json:"id_user" example:"709786"`
 		// First name of a user
-		Name string `json:"name" example:"Андрей"`
+		Name string `json:"name" maxLength:"100" example:"Андрей"`
 		// Second name of a user
-		SecondName string `json:"second_name" example:"Попов"`
+		SecondName string `json:"second_name" maxLength:"100" example:"Попов"`
 		// Sex of a user
-		Sex string `json:"sex" example:"male"`
+		Sex string `json:"sex" enums:"male,female" example:"male"`
 		// Height of a user
-		Height int64 `json:"height" example:"180"`
+		Height int64 `json:"height" minimum:"1" maximum:"300" example:"180"`
 		// Weight of a user
-		Weight int64 `json:"weight" example:"80"`
+		Weight int64 `json:"weight" minimum:"1" maximum:"500" example:"80"`
 		// User's e-mail
-		Email string `json:"email" example:"andrey@gmail.com"`
+		Email string `json:"email" validate:"email" example:"andrey@gmail.com"`
 		// Level id. Can be 1 - junior, 2 - middle, 3 - senior
-		IdLevel int64 `json:"id_level" example:"1"`
+		IdLevel int64 `json:"id_level" minimum:"1" example:"1"`
 		// Preferred location (metro station)
-		Location string `json:"location" example:"Петроградская"`
+		Location string `json:"location" maxLength:"100" example:"Петроградская"`
 		// Date of birth of a user
 		DateOfBirth time.Time `json:"date_of_birth" example:"2000-01-01T00:00:00Z"`
 		// Description of a user
-		About string `json:"about" example:"Я люблю бегать"`
+		About string `json:"about" maxLength:"1000" example:"Я люблю бегать"`
 		// User's kinds of sport
-		Sport []string `json:"sport" example:"волейбол"`
+		Sport []string `json:"sport" maxLength:"100" example:"волейбол"`
 	} // @name UserProfile
 
 	UserProfileFilterParams struct {
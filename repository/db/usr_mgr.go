@@ -1,47 +1,85 @@
 package db
 
 import (
+	"SB/service/repository/audit"
+	"SB/service/repository/logging"
+	"SB/service/repository/password"
 	"SB/service/repository/persistence"
+	"context"
 	"encoding/json"
 	"errors"
-	"github.com/labstack/gommon/log"
 )
 
+// ErrInvalidCredentials is returned for unknown logins and wrong passwords
+// alike, so callers cannot tell which logins exist
+var ErrInvalidCredentials = errors.New("invalid login or password")
+
 type (
 	userManager struct {
 		persistent persistence.Persistent
+		hasher     password.Hasher
+		policy     password.Policy
+		audit      audit.Log
+		// dummyHash is verified for unknown logins, so they take as long to
+		// check as wrong passwords
+		dummyHash string
+		logger    *logging.Logger
 	}
 
 	UserManager interface {
-		Authenticate(login, password string) (persistence.User, error)
-		AddUser(login, password string) (persistence.User, error)
-		DeleteUser(id int64) error
-		GetUserProfile(id int64) (UserProfile, error)
-		UpdateUserProfile(profile persistence.PersistentObject, sports ...string) error
-		GetRole(id int64) string
-		GetProfiles(filter UserProfileFilterParams) []persistence.FilteredUserProfileImpl
-		GetUserTrainings(idUser int64) ([]persistence.PersistentObject, error)
+		Authenticate(ctx context.Context, login, password string) (persistence.User, error)
+		AddUser(ctx context.Context, login, password string) (persistence.User, error)
+		DeleteUser(ctx context.Context, actor audit.Actor, id int64) error
+		GetUserProfile(ctx context.Context, id int64) (UserProfile, error)
+		UpdateUserProfile(ctx context.Context, profile persistence.PersistentObject, sports ...string) error
+		GetRole(ctx context.Context, id int64) string
+		GetUsername(ctx context.Context, id int64) (string, error)
+		GetProfiles(ctx context.Context, filter UserProfileFilterParams) []persistence.FilteredUserProfileImpl
+		GetUserTrainings(ctx context.Context, idUser int64) ([]persistence.PersistentObject, error)
 	}
 )
 
-func NewDbManager(persistent persistence.Persistent) UserManager {
+func NewDbManager(persistent persistence.Persistent, hasher password.Hasher, policy password.Policy, auditLog audit.Log, logger *logging.Logger) (UserManager, error) {
+	dummyHash, err := hasher.Hash("dummy password")
+	if err != nil {
+		return nil, err
+	}
 	return &userManager{
 		persistent: persistent,
-	}
+		hasher:     hasher,
+		policy:     policy,
+		audit:      auditLog,
+		dummyHash:  dummyHash,
+		logger:     logger,
+	}, nil
 }
 
-func (usrMgr *userManager) Authenticate(login, password string) (persistence.User, error) {
-	access, err := usrMgr.persistent.CheckPassword(login, password)
-	user := userImpl{
-		Username: login,
+// Authenticate checks the password and replaces its hash if it was made by
+// an outdated algorithm or with other parameters than configured. It returns
+// ErrInvalidCredentials if the login does not exist or the password is wrong.
+func (usrMgr *userManager) Authenticate(ctx context.Context, login, pwd string) (persistence.User, error) {
+	hash, err := usrMgr.persistent.GetPasswordHash(ctx, login)
+	if err != nil {
+		usrMgr.hasher.Verify(pwd, usrMgr.dummyHash)
+		if errors.Is(err, persistence.ErrUserNotFound) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
 	}
+	match, rehash, err := usrMgr.hasher.Verify(pwd, hash)
 	if err != nil {
 		return nil, err
 	}
-	if !access {
-		return nil, errors.New("invalid password")
+	if !match {
+		return nil, ErrInvalidCredentials
+	}
+	if rehash {
+		usrMgr.rehash(ctx, login, pwd)
 	}
-	authParams, err := usrMgr.persistent.GetUserAuthParams(login)
+	user := userImpl{
+		Username: login,
+	}
+	authParams, err := usrMgr.persistent.GetUserAuthParams(ctx, login)
 	if err != nil {
 		return nil, err
 	}
@@ -51,8 +89,17 @@ func (usrMgr *userManager) Authenticate(login, password string) (persistence.Use
 	return &user, nil
 }
 
-func (usrMgr *userManager) AddUser(login, password string) (persistence.User, error) {
-	authParams, err := usrMgr.persistent.AddUser(login, password)
+// AddUser checks the password against the policy and returns
+// *password.PolicyError if it is rejected
+func (usrMgr *userManager) AddUser(ctx context.Context, login, pwd string) (persistence.User, error) {
+	if err := usrMgr.policy.Check(pwd); err != nil {
+		return nil, err
+	}
+	hash, err := usrMgr.hasher.Hash(pwd)
+	if err != nil {
+		return nil, err
+	}
+	authParams, err := usrMgr.persistent.AddUser(ctx, login, hash)
 	if err != nil {
 		return nil, err
 	}
@@ -64,49 +111,68 @@ func (usrMgr *userManager) AddUser(login, password string) (persistence.User, er
 	return &user, nil
 }
 
-func (usrMgr *userManager) DeleteUser(id int64) error {
-	deleted := usrMgr.persistent.DeleteUser(id)
-	if !deleted {
-		return errors.New("failed to delete user")
+// rehash failures are only logged, the old hash still works
+func (usrMgr *userManager) rehash(ctx context.Context, login, pwd string) {
+	hash, err := usrMgr.hasher.Hash(pwd)
+	if err == nil {
+		err = usrMgr.persistent.UpdatePasswordHash(ctx, login, hash)
+	}
+	if err != nil {
+		usrMgr.logger.For(ctx).Error("failed to rehash password", logging.String("login", login), logging.Err(err))
+		return
+	}
+	usrMgr.logger.For(ctx).Info("password hash upgraded", logging.String("login", login))
+}
+
+func (usrMgr *userManager) DeleteUser(ctx context.Context, actor audit.Actor, id int64) error {
+	user, err := usrMgr.persistent.GetUser(ctx, id)
+	if err != nil {
+		return err
 	}
+	if err := usrMgr.persistent.DeleteUser(ctx, id); err != nil {
+		return err
+	}
+	usrMgr.audit.Record(ctx, actor, audit.ActionUserDeleted, audit.TargetUser, id, map[string]string{
+		"username": user.GetUsername(),
+		"role":     user.GetRole(),
+	}, nil)
 	return nil
 }
 
-func (usrMgr *userManager) GetUserProfile(id int64) (UserProfile, error) {
-	profile, err := usrMgr.persistent.GetUserProfile(id)
+func (usrMgr *userManager) GetUserProfile(ctx context.Context, id int64) (UserProfile, error) {
+	profile, err := usrMgr.persistent.GetUserProfile(ctx, id)
 	if err != nil {
 		return UserProfile{}, err
 	}
 	prof := UserProfile{}
 	err = json.Unmarshal(profile.Serialize(), &prof)
 	if err != nil {
-		log.Error("failed to unmarshal profile: ", err)
+		usrMgr.logger.For(ctx).Error("failed to unmarshal profile", logging.Int("id_user", id), logging.Err(err))
 		return UserProfile{}, err
 	}
-	prof.Sport = usrMgr.persistent.GetUserSport(id)
+	prof.Sport = usrMgr.persistent.GetUserSport(ctx, id)
 	return prof, nil
 }
 
-func (usrMgr *userManager) UpdateUserProfile(profile persistence.PersistentObject, sports ...string) error {
-	log.Info(profile)
-	updated := usrMgr.persistent.UpdateUserProfile(profile, sports...)
-	if !updated {
-		return errors.New("failed to update profile")
-	}
-	return nil
+func (usrMgr *userManager) UpdateUserProfile(ctx context.Context, profile persistence.PersistentObject, sports ...string) error {
+	return usrMgr.persistent.UpdateUserProfile(ctx, profile, sports...)
+}
+
+func (usrMgr *userManager) GetRole(ctx context.Context, id int64) string {
+	return usrMgr.persistent.GetRole(ctx, id)
 }
 
-func (usrMgr *userManager) GetRole(id int64) string {
-	return usrMgr.persistent.GetRole(id)
+func (usrMgr *userManager) GetUsername(ctx context.Context, id int64) (string, error) {
+	return usrMgr.persistent.GetUsername(ctx, id)
 }
 
-func (usrMgr *userManager) GetProfiles(filter UserProfileFilterParams) []persistence.FilteredUserProfileImpl {
-	profiles := usrMgr.persistent.GetFilteredProfiles(&filter)
+func (usrMgr *userManager) GetProfiles(ctx context.Context, filter UserProfileFilterParams) []persistence.FilteredUserProfileImpl {
+	profiles := usrMgr.persistent.GetFilteredProfiles(ctx, &filter)
 	return profiles
 }
 
-func (usrMgr *userManager) GetUserTrainings(idUser int64) ([]persistence.PersistentObject, error) {
-	trainings, err := usrMgr.persistent.GetUserTrainings(idUser)
+func (usrMgr *userManager) GetUserTrainings(ctx context.Context, idUser int64) ([]persistence.PersistentObject, error) {
+	trainings, err := usrMgr.persistent.GetUserTrainings(ctx, idUser)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,32 @@
+// Package detach runs writes that must not be lost when the request that
+// made them is canceled, like the audit log and counted login attempts
+package detach
+
+import (
+	"context"
+	"time"
+)
+
+// values has the values of a context, like its logger and span, but is
+// never canceled
+type values struct {
+	context.Context
+}
+
+// Context returns a context with the values of parent that ends after
+// timeout, whether parent is canceled or past its deadline or not
+func Context(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(values{parent}, timeout)
+}
+
+func (values) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (values) Done() <-chan struct{} {
+	return nil
+}
+
+func (values) Err() error {
+	return nil
+}
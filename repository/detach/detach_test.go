@@ -0,0 +1,27 @@
+package detach
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type key struct{}
+
+func TestContext(t *testing.T) {
+	parent, cancel := context.WithTimeout(context.WithValue(context.Background(), key{}, "value"), time.Hour)
+	cancel()
+
+	ctx, cancelDetached := Context(parent, time.Minute)
+	defer cancelDetached()
+	require.NoError(t, ctx.Err(), "canceling the parent does not end the context")
+	require.Equal(t, "value", ctx.Value(key{}))
+	deadline, ok := ctx.Deadline()
+	require.True(t, ok)
+	require.WithinDuration(t, time.Now().Add(time.Minute), deadline, time.Second)
+
+	cancelDetached()
+	require.ErrorIs(t, ctx.Err(), context.Canceled)
+}
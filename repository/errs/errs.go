@@ -0,0 +1,77 @@
+// Package errs defines the kinds of domain errors. Persistence and managers
+// return errors of these kinds and the API maps every kind to one HTTP
+// status, so a handler does not have to know every error a manager returns.
+package errs
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Kinds of domain errors, match them with errors.Is
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrConflict   = errors.New("conflict")
+	ErrForbidden  = errors.New("forbidden")
+	ErrValidation = errors.New("validation failed")
+)
+
+type (
+	// kindError is an error with its own message of one of the kinds
+	kindError struct {
+		kind    error
+		message string
+	}
+
+	// ValidationError is an ErrValidation with the reasons of invalid fields
+	// keyed by their JSON names
+	ValidationError struct {
+		Fields map[string]string
+	}
+)
+
+// New returns an error with the message which is also the kind
+func New(kind error, message string) error {
+	return &kindError{kind: kind, message: message}
+}
+
+func (e *kindError) Error() string {
+	return e.message
+}
+
+func (e *kindError) Unwrap() error {
+	return e.kind
+}
+
+// Invalid returns a ValidationError of a single field
+func Invalid(field, reason string) *ValidationError {
+	return &ValidationError{Fields: map[string]string{field: reason}}
+}
+
+// Error lists the fields sorted by name, like "name: is required"
+func (e *ValidationError) Error() string {
+	fields := make([]string, 0, len(e.Fields))
+	for field := range e.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for i, field := range fields {
+		fields[i] = field + ": " + e.Fields[field]
+	}
+	return strings.Join(fields, ", ")
+}
+
+// Is makes every ValidationError an ErrValidation
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+// Fields returns the invalid fields of an ErrValidation, nil for other errors
+func Fields(err error) map[string]string {
+	var validation *ValidationError
+	if errors.As(err, &validation) {
+		return validation.Fields
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package errs
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKinds(t *testing.T) {
+	err := New(ErrNotFound, "no such user")
+	require.EqualError(t, err, "no such user")
+	require.True(t, errors.Is(fmt.Errorf("failed to delete user: %w", err), ErrNotFound))
+	require.False(t, errors.Is(err, ErrConflict))
+}
+
+func TestValidation(t *testing.T) {
+	err := &ValidationError{Fields: map[string]string{"sport": "is required", "fee": "must not be negative"}}
+	require.EqualError(t, err, "fee: must not be negative, sport: is required")
+
+	wrapped := fmt.Errorf("failed to add training: %w", err)
+	require.True(t, errors.Is(wrapped, ErrValidation))
+	require.Equal(t, err.Fields, Fields(wrapped))
+	require.Nil(t, Fields(New(ErrNotFound, "no such training")))
+}
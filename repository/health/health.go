@@ -0,0 +1,48 @@
+// Package health reports whether the service can serve requests. A live
+// process that is not ready, e.g. without a database connection, is taken out
+// of rotation by load balancers instead of being restarted.
+package health
+
+import (
+	"context"
+	"sync"
+)
+
+type (
+	// Check returns an error if a dependency cannot be used
+	Check func(ctx context.Context) error
+
+	Checker interface {
+		// Ready runs all checks at once and returns their results keyed by
+		// name, a nil error means the dependency is available
+		Ready(ctx context.Context) map[string]error
+	}
+
+	checker struct {
+		checks map[string]Check
+	}
+)
+
+func NewChecker(checks map[string]Check) Checker {
+	return &checker{checks: checks}
+}
+
+func (c *checker) Ready(ctx context.Context) map[string]error {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]error, len(c.checks))
+	)
+	for name, check := range c.checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			err := check(ctx)
+			mu.Lock()
+			results[name] = err
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,19 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReady(t *testing.T) {
+	down := errors.New("connection refused")
+	checker := NewChecker(map[string]Check{
+		"database": func(ctx context.Context) error { return down },
+		"mail":     func(ctx context.Context) error { return nil },
+	})
+	require.Equal(t, map[string]error{"database": down, "mail": nil}, checker.Ready(context.Background()))
+	require.Empty(t, NewChecker(nil).Ready(context.Background()))
+}
@@ -0,0 +1,143 @@
+package jobs
+
+import (
+	"SB/service/repository/logging"
+	"context"
+	"sync"
+	"time"
+)
+
+type (
+	// Job is a maintenance task run periodically in the background. Run
+	// returns the number of processed items, e.g. deleted rows, for reports.
+	Job struct {
+		Name     string
+		Interval time.Duration
+		Run      func(ctx context.Context) (int64, error)
+	}
+
+	// Stats is a report of job runs since the scheduler started
+	Stats struct {
+		Runs      int64
+		Failures  int64
+		Processed int64
+		LastRun   time.Time
+		LastError string
+	}
+
+	Scheduler interface {
+		// Add registers a job, jobs added after Start are started at once
+		Add(job Job)
+		Start()
+		// Stop cancels running jobs and waits for them to return
+		Stop()
+		Stats() map[string]Stats
+	}
+
+	scheduler struct {
+		mu      sync.Mutex
+		jobs    []Job
+		stats   map[string]Stats
+		ctx     context.Context
+		cancel  context.CancelFunc
+		wg      sync.WaitGroup
+		started bool
+		logger  *logging.Logger
+	}
+)
+
+// NewScheduler creates a scheduler, jobs run with a context carrying logger
+// with the name of the job
+func NewScheduler(logger *logging.Logger) Scheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &scheduler{
+		stats:  make(map[string]Stats),
+		ctx:    ctx,
+		cancel: cancel,
+		logger: logger,
+	}
+}
+
+func (s *scheduler) Add(job Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs = append(s.jobs, job)
+	s.stats[job.Name] = Stats{}
+	if s.started {
+		s.start(job)
+	}
+}
+
+func (s *scheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return
+	}
+	s.started = true
+	for _, job := range s.jobs {
+		s.start(job)
+	}
+}
+
+func (s *scheduler) Stop() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+func (s *scheduler) Stats() map[string]Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make(map[string]Stats, len(s.stats))
+	for name, st := range s.stats {
+		stats[name] = st
+	}
+	return stats
+}
+
+func (s *scheduler) start(job Job) {
+	logger := s.logger.With(logging.String("job", job.Name))
+	if job.Interval <= 0 {
+		logger.Info("job is disabled")
+		return
+	}
+	logger.Info("starting job", logging.Duration("interval", job.Interval))
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(job.Interval)
+		defer ticker.Stop()
+		for {
+			s.run(job, logger)
+			select {
+			case <-s.ctx.Done():
+				logger.Info("job stopped")
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (s *scheduler) run(job Job, logger *logging.Logger) {
+	if s.ctx.Err() != nil {
+		return
+	}
+	processed, err := job.Run(logging.NewContext(s.ctx, logger))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.stats[job.Name]
+	st.Runs++
+	st.Processed += processed
+	st.LastRun = time.Now().UTC()
+	st.LastError = ""
+	if err != nil {
+		st.Failures++
+		st.LastError = err.Error()
+		logger.Error("job failed", logging.Err(err))
+	} else {
+		logger.Info("job done", logging.Int("processed", processed))
+	}
+	s.stats[job.Name] = st
+}
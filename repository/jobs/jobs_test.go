@@ -0,0 +1,129 @@
+package jobs
+
+import (
+	"SB/service/repository/logging"
+	"SB/service/repository/metrics"
+	"bytes"
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduler(t *testing.T) {
+	var runs int64
+	s := NewScheduler(logging.Discard())
+	s.Add(Job{
+		Name:     "count",
+		Interval: 10 * time.Millisecond,
+		Run: func(ctx context.Context) (int64, error) {
+			atomic.AddInt64(&runs, 1)
+			return 2, nil
+		},
+	})
+	s.Add(Job{
+		Name:     "fail",
+		Interval: 10 * time.Millisecond,
+		Run: func(ctx context.Context) (int64, error) {
+			return 0, errors.New("database is down")
+		},
+	})
+	s.Add(Job{
+		Name: "disabled",
+		Run: func(ctx context.Context) (int64, error) {
+			t.Error("disabled job must not run")
+			return 0, nil
+		},
+	})
+	s.Start()
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&runs) >= 3
+	}, time.Second, 5*time.Millisecond)
+	s.Stop()
+
+	stopped := atomic.LoadInt64(&runs)
+	time.Sleep(30 * time.Millisecond)
+	require.Equal(t, stopped, atomic.LoadInt64(&runs), "jobs must not run after Stop")
+
+	stats := s.Stats()
+	require.Equal(t, stopped, stats["count"].Runs)
+	require.Equal(t, 2*stopped, stats["count"].Processed)
+	require.Zero(t, stats["count"].Failures)
+	require.NotZero(t, stats["fail"].Failures)
+	require.Equal(t, "database is down", stats["fail"].LastError)
+	require.Zero(t, stats["disabled"].Runs)
+}
+
+func TestJobLogger(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewScheduler(logging.New(&buf, logging.LevelInfo, logging.FormatText))
+	done := make(chan struct{})
+	s.Add(Job{
+		Name:     "sweep",
+		Interval: time.Hour,
+		Run: func(ctx context.Context) (int64, error) {
+			defer close(done)
+			// managers log with the logger the context carries
+			logging.Discard().For(ctx).Info("rows deleted")
+			return 0, nil
+		},
+	})
+	s.Start()
+	<-done
+	s.Stop()
+	require.Contains(t, buf.String(), "rows deleted job=sweep")
+}
+
+func TestStopCancelsRunningJob(t *testing.T) {
+	started := make(chan struct{})
+	s := NewScheduler(logging.Discard())
+	s.Add(Job{
+		Name:     "long",
+		Interval: time.Hour,
+		Run: func(ctx context.Context) (int64, error) {
+			close(started)
+			<-ctx.Done()
+			return 0, ctx.Err()
+		},
+	})
+	s.Start()
+	<-started
+
+	done := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Stop did not wait for the running job to return")
+	}
+}
+
+func TestRegisterMetrics(t *testing.T) {
+	s := NewScheduler(logging.Discard())
+	s.Add(Job{
+		Name:     "fail",
+		Interval: time.Hour,
+		Run: func(ctx context.Context) (int64, error) {
+			return 0, errors.New("database is down")
+		},
+	})
+	s.Start()
+	defer s.Stop()
+	require.Eventually(t, func() bool {
+		return s.Stats()["fail"].Runs == 1
+	}, time.Second, 5*time.Millisecond)
+
+	r := metrics.NewRegistry()
+	RegisterMetrics(r, s)
+	var buf bytes.Buffer
+	require.NoError(t, r.Write(&buf))
+	require.Contains(t, buf.String(), `sb_job_runs_total{job="fail"} 1`)
+	require.Contains(t, buf.String(), `sb_job_failures_total{job="fail"} 1`)
+	require.Contains(t, buf.String(), `sb_job_processed_total{job="fail"} 0`)
+}
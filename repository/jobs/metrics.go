@@ -0,0 +1,37 @@
+package jobs
+
+import (
+	"SB/service/repository/metrics"
+	"sort"
+)
+
+// RegisterMetrics reports the stats of the jobs of s in r
+func RegisterMetrics(r *metrics.Registry, s Scheduler) {
+	collect := func(value func(st Stats) float64) func(report func(value float64, labels ...string)) {
+		return func(report func(value float64, labels ...string)) {
+			stats := s.Stats()
+			names := make([]string, 0, len(stats))
+			for name := range stats {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				report(value(stats[name]), name)
+			}
+		}
+	}
+	job := []string{"job"}
+	r.NewCollector("sb_job_runs_total", "Runs of background jobs", metrics.TypeCounter, job,
+		collect(func(st Stats) float64 { return float64(st.Runs) }))
+	r.NewCollector("sb_job_failures_total", "Failed runs of background jobs", metrics.TypeCounter, job,
+		collect(func(st Stats) float64 { return float64(st.Failures) }))
+	r.NewCollector("sb_job_processed_total", "Items processed by background jobs, e.g. deleted rows", metrics.TypeCounter, job,
+		collect(func(st Stats) float64 { return float64(st.Processed) }))
+	r.NewCollector("sb_job_last_run_timestamp_seconds", "Time of the last run of background jobs, 0 if they have not run", metrics.TypeGauge, job,
+		collect(func(st Stats) float64 {
+			if st.LastRun.IsZero() {
+				return 0
+			}
+			return float64(st.LastRun.Unix())
+		}))
+}
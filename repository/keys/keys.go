@@ -0,0 +1,262 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	AlgorithmEdDSA = "EdDSA"
+	AlgorithmRS256 = "RS256"
+
+	rsaBits = 2048
+)
+
+type (
+	// Key signs access tokens, its id is sent in the kid header
+	Key struct {
+		ID        string
+		Algorithm string
+		Signer    crypto.Signer
+		CreatedAt time.Time
+		// ExpiresAt is set once the key is rotated, after that it only
+		// verifies tokens until it expires
+		ExpiresAt *time.Time
+	}
+
+	// JWK is the public part of a key as published in the JWKS (RFC 7517)
+	JWK struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		Alg string `json:"alg"`
+		// RSA modulus and exponent
+		N string `json:"n,omitempty"`
+		E string `json:"e,omitempty"`
+		// curve and public key of Ed25519 and EC keys, Y is set only for EC
+		Crv string `json:"crv,omitempty"`
+		X   string `json:"x,omitempty"`
+		Y   string `json:"y,omitempty"`
+	}
+
+	JWKS struct {
+		Keys []JWK `json:"keys"`
+		// MaxAge is how long verifiers may cache the set
+		MaxAge time.Duration `json:"-"`
+	}
+)
+
+// Generate creates a key for the algorithm, its id is the JWK thumbprint
+// (RFC 7638) of the public key
+func Generate(algorithm string) (Key, error) {
+	var signer crypto.Signer
+	var err error
+	switch algorithm {
+	case AlgorithmEdDSA:
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	case AlgorithmRS256:
+		signer, err = rsa.GenerateKey(rand.Reader, rsaBits)
+	default:
+		return Key{}, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+	if err != nil {
+		return Key{}, err
+	}
+	return newKey(algorithm, signer, time.Now().UTC(), nil)
+}
+
+func newKey(algorithm string, signer crypto.Signer, createdAt time.Time, expiresAt *time.Time) (Key, error) {
+	key := Key{
+		Algorithm: algorithm,
+		Signer:    signer,
+		CreatedAt: createdAt,
+		ExpiresAt: expiresAt,
+	}
+	jwk, err := key.publicJWK()
+	if err != nil {
+		return Key{}, err
+	}
+	key.ID, err = thumbprint(jwk)
+	if err != nil {
+		return Key{}, err
+	}
+	return key, nil
+}
+
+// Method returns the jwt signing method of the key
+func (key Key) Method() jwt.SigningMethod {
+	if key.Algorithm == AlgorithmEdDSA {
+		return SigningMethodEdDSA
+	}
+	return jwt.SigningMethodRS256
+}
+
+// Public returns the key verifying signatures in the form jwt-go expects
+func (key Key) Public() crypto.PublicKey {
+	return key.Signer.Public()
+}
+
+func (key Key) Expired(now time.Time) bool {
+	return key.ExpiresAt != nil && !key.ExpiresAt.After(now)
+}
+
+// Published tells whether the key has been in the JWKS for maxAge and has
+// not expired, verifiers that cache the set know it by then
+func (key Key) Published(now time.Time, maxAge time.Duration) bool {
+	return !key.Expired(now) && !key.CreatedAt.Add(maxAge).After(now)
+}
+
+// JWK returns the public key to publish
+func (key Key) JWK() JWK {
+	jwk, _ := key.publicJWK()
+	jwk.Kid = key.ID
+	jwk.Use = "sig"
+	jwk.Alg = key.Algorithm
+	return jwk
+}
+
+// publicJWK returns the required members of the public key, they are used
+// for the thumbprint
+func (key Key) publicJWK() (JWK, error) {
+	switch public := key.Public().(type) {
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Crv: "Ed25519", X: encode(public)}, nil
+	case *rsa.PublicKey:
+		return JWK{Kty: "RSA", N: encode(public.N.Bytes()), E: encode(big.NewInt(int64(public.E)).Bytes())}, nil
+	default:
+		return JWK{}, fmt.Errorf("unsupported public key %T", public)
+	}
+}
+
+// MarshalPEM encodes the private key in PKCS #8
+func (key Key) MarshalPEM() (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key.Signer)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+// ParsePEM reads a key stored by MarshalPEM
+func ParsePEM(algorithm, encoded string, createdAt time.Time, expiresAt *time.Time) (Key, error) {
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil {
+		return Key{}, errors.New("no PEM block in signing key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return Key{}, err
+	}
+	var signer crypto.Signer
+	switch k := parsed.(type) {
+	case ed25519.PrivateKey:
+		if algorithm == AlgorithmEdDSA {
+			signer = k
+		}
+	case *rsa.PrivateKey:
+		if algorithm == AlgorithmRS256 {
+			signer = k
+		}
+	}
+	if signer == nil {
+		return Key{}, fmt.Errorf("%T is not a %s key", parsed, algorithm)
+	}
+	return newKey(algorithm, signer, createdAt, expiresAt)
+}
+
+// PublicKey decodes a published RSA, EC or Ed25519 key in the form jwt-go
+// expects, it is used to verify tokens of other issuers
+func (jwk JWK) PublicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return key, nil
+	case "OKP":
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if jwk.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("unsupported OKP key %q", jwk.Crv)
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+}
+
+func thumbprint(jwk JWK) (string, error) {
+	// members in lexicographic order without whitespace, as json.Marshal
+	// writes map keys
+	members := map[string]string{"kty": jwk.Kty}
+	if jwk.Kty == "RSA" {
+		members["e"], members["n"] = jwk.E, jwk.N
+	} else {
+		members["crv"], members["x"] = jwk.Crv, jwk.X
+	}
+	canonical, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return encode(sum[:]), nil
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
@@ -0,0 +1,126 @@
+package keys
+
+import (
+	"SB/service/config"
+	"SB/service/repository/logging"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+)
+
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func TestGenerate(t *testing.T) {
+	for _, algorithm := range []string{AlgorithmEdDSA, AlgorithmRS256} {
+		key, err := Generate(algorithm)
+		require.NoError(t, err)
+		require.Len(t, key.ID, 43, "base64url SHA-256 thumbprint")
+
+		tkn := jwt.NewWithClaims(key.Method(), jwt.StandardClaims{Subject: "test"})
+		signed, err := tkn.SignedString(key.Signer)
+		require.NoError(t, err)
+		parsed, err := jwt.Parse(signed, func(token *jwt.Token) (interface{}, error) {
+			require.Equal(t, algorithm, token.Method.Alg())
+			return key.Public(), nil
+		})
+		require.NoError(t, err)
+		require.True(t, parsed.Valid)
+
+		encoded, err := key.MarshalPEM()
+		require.NoError(t, err)
+		decoded, err := ParsePEM(algorithm, encoded, key.CreatedAt, nil)
+		require.NoError(t, err)
+		require.Equal(t, key.ID, decoded.ID, "the id does not change when the key is stored")
+		require.Equal(t, key.JWK(), decoded.JWK())
+	}
+
+	key, err := Generate(AlgorithmEdDSA)
+	require.NoError(t, err)
+	encoded, err := key.MarshalPEM()
+	require.NoError(t, err)
+	_, err = ParsePEM(AlgorithmRS256, encoded, key.CreatedAt, nil)
+	require.Error(t, err, "the algorithm must match the key")
+}
+
+// TestThumbprint checks the example of RFC 7638 section 3.1
+func TestThumbprint(t *testing.T) {
+	jwk := JWK{
+		Kty: "RSA",
+		N: "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMs" +
+			"tn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91" +
+			"CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E: "AQAB",
+	}
+	kid, err := thumbprint(jwk)
+	require.NoError(t, err)
+	require.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", kid)
+}
+
+func TestRotate(t *testing.T) {
+	c := &clock{t: time.Unix(1637603397, 0)}
+	cfg := config.Default().Token
+	store := &memoryStore{now: c.now}
+	r, err := newRing(context.Background(), store, cfg, c.now, logging.Discard())
+	require.NoError(t, err)
+	first, err := r.Signing()
+	require.NoError(t, err)
+
+	second, err := r.Rotate(context.Background())
+	require.NoError(t, err)
+	require.Len(t, r.JWKS().Keys, 2)
+	signing, err := r.Signing()
+	require.NoError(t, err)
+	require.Equal(t, first.ID, signing.ID, "the new key is published before it signs tokens")
+
+	c.t = c.t.Add(cfg.JWKSMaxAge)
+	signing, err = r.Signing()
+	require.NoError(t, err)
+	require.Equal(t, second.ID, signing.ID, "the new key signs tokens")
+	_, err = r.Verifier(context.Background(), first.ID)
+	require.NoError(t, err, "the old key verifies tokens during the overlap")
+	require.Len(t, r.JWKS().Keys, 2)
+
+	c.t = c.t.Add(cfg.KeyOverlap)
+	_, err = r.Verifier(context.Background(), first.ID)
+	require.ErrorIs(t, err, ErrKeyExpired)
+	require.Len(t, r.JWKS().Keys, 1)
+	deleted, err := r.Reload(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, int64(1), deleted)
+
+	_, err = r.Verifier(context.Background(), "unknown")
+	require.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestVerifierReloads(t *testing.T) {
+	c := &clock{t: time.Unix(1637603397, 0)}
+	cfg := config.Default().Token
+	store := &memoryStore{now: c.now}
+	r, err := newRing(context.Background(), store, cfg, c.now, logging.Discard())
+	require.NoError(t, err)
+
+	// another node rotates the key
+	key, err := Generate(cfg.SigningAlgorithm)
+	require.NoError(t, err)
+	key.CreatedAt = c.t
+	require.NoError(t, store.Rotate(context.Background(), key, RetireAt(key, cfg)))
+
+	_, err = r.Verifier(context.Background(), key.ID)
+	require.ErrorIs(t, err, ErrUnknownKey, "reloads are limited")
+	c.t = c.t.Add(minReloadInterval)
+	_, err = r.Verifier(context.Background(), key.ID)
+	require.NoError(t, err)
+	c.t = c.t.Add(cfg.JWKSMaxAge)
+	signing, err := r.Signing()
+	require.NoError(t, err)
+	require.Equal(t, key.ID, signing.ID)
+}
@@ -0,0 +1,229 @@
+package keys
+
+import (
+	"SB/service/config"
+	"SB/service/repository/logging"
+	"SB/service/repository/persistence"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// minReloadInterval limits reloads caused by tokens with unknown key ids
+const minReloadInterval = 10 * time.Second
+
+var (
+	// ErrUnknownKey is returned for key ids not in the ring
+	ErrUnknownKey = errors.New("unknown signing key")
+	// ErrKeyExpired is returned for keys rotated longer than the overlap ago
+	ErrKeyExpired = errors.New("signing key expired")
+)
+
+type (
+	// Ring holds the key signing new access tokens and the rotated keys
+	// still verifying tokens signed before the rotation. A new key is
+	// published in the JWKS for the max-age verifiers cache it before it
+	// signs tokens.
+	Ring interface {
+		// Signing returns the newest key published for at least the JWKS
+		// max-age, a ring without one signs with its oldest key
+		Signing() (Key, error)
+		// Verifier returns the key with the id, unknown ids make the ring
+		// reload keys rotated by other nodes
+		Verifier(ctx context.Context, kid string) (Key, error)
+		// JWKS returns public keys of every key that has not expired
+		JWKS() JWKS
+		// Rotate adds a new key that signs tokens once the JWKS max-age has
+		// passed, the previous one verifies tokens for the overlap after that
+		Rotate(ctx context.Context) (Key, error)
+		// Reload deletes expired keys and loads the others from the store
+		Reload(ctx context.Context) (int64, error)
+	}
+
+	ring struct {
+		store  Store
+		config config.Token
+		now    func() time.Time
+		logger *logging.Logger
+
+		mu       sync.RWMutex
+		keys     []Key
+		loadedAt time.Time
+	}
+)
+
+// NewRing loads keys from the store selected in the configuration and
+// creates the first signing key if there is none
+func NewRing(ctx context.Context, persistent persistence.Persistent, cfg config.Token, logger *logging.Logger) (Ring, error) {
+	var store Store
+	switch cfg.KeyStore {
+	case "memory":
+		store = NewMemoryStore()
+	case "postgres":
+		store = NewPostgresStore(persistent)
+	default:
+		return nil, fmt.Errorf("unknown key store %q", cfg.KeyStore)
+	}
+	return newRing(ctx, store, cfg, time.Now, logger)
+}
+
+func newRing(ctx context.Context, store Store, cfg config.Token, now func() time.Time, logger *logging.Logger) (Ring, error) {
+	r := &ring{
+		store:  store,
+		config: cfg,
+		now:    now,
+		logger: logger,
+	}
+	if err := r.load(ctx); err != nil {
+		return nil, err
+	}
+	if _, err := r.Signing(); errors.Is(err, ErrUnknownKey) {
+		if _, err := r.Rotate(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *ring) Signing() (Key, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	now := r.now()
+	for i := len(r.keys) - 1; i >= 0; i-- {
+		if r.keys[i].Published(now, r.config.JWKSMaxAge) {
+			return r.keys[i], nil
+		}
+	}
+	// the first key of a new ring is not cached by any verifier yet
+	for _, key := range r.keys {
+		if !key.Expired(now) {
+			return key, nil
+		}
+	}
+	return Key{}, ErrUnknownKey
+}
+
+func (r *ring) Verifier(ctx context.Context, kid string) (Key, error) {
+	key, ok := r.find(kid)
+	if !ok && r.reloadAllowed() {
+		if err := r.load(ctx); err != nil {
+			return Key{}, err
+		}
+		key, ok = r.find(kid)
+	}
+	if !ok {
+		return Key{}, ErrUnknownKey
+	}
+	if key.Expired(r.now()) {
+		return Key{}, ErrKeyExpired
+	}
+	return key, nil
+}
+
+func (r *ring) JWKS() JWKS {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	jwks := JWKS{Keys: make([]JWK, 0, len(r.keys)), MaxAge: r.config.JWKSMaxAge}
+	for _, key := range r.keys {
+		if !key.Expired(r.now()) {
+			jwks.Keys = append(jwks.Keys, key.JWK())
+		}
+	}
+	return jwks
+}
+
+func (r *ring) Rotate(ctx context.Context) (Key, error) {
+	key, err := Generate(r.config.SigningAlgorithm)
+	if err != nil {
+		return Key{}, err
+	}
+	key.CreatedAt = r.now().UTC()
+	if err := r.store.Rotate(ctx, key, RetireAt(key, r.config)); err != nil {
+		return Key{}, err
+	}
+	r.logger.For(ctx).Info("new signing key", logging.String("algorithm", key.Algorithm), logging.String("kid", key.ID))
+	return key, r.load(ctx)
+}
+
+func (r *ring) Reload(ctx context.Context) (int64, error) {
+	deleted, err := r.store.DeleteExpired(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return deleted, r.load(ctx)
+}
+
+func (r *ring) load(ctx context.Context) error {
+	keys, err := r.store.Load(ctx)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = keys
+	r.loadedAt = r.now()
+	return nil
+}
+
+func (r *ring) find(kid string) (Key, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, key := range r.keys {
+		if key.ID == kid {
+			return key, true
+		}
+	}
+	return Key{}, false
+}
+
+func (r *ring) reloadAllowed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.now().Sub(r.loadedAt) >= minReloadInterval
+}
+
+// RetireAt returns the expiration of the keys replaced by key, they sign
+// tokens until key is published for the JWKS max-age and verify them for
+// the overlap after that
+func RetireAt(key Key, cfg config.Token) time.Time {
+	return key.CreatedAt.Add(cfg.JWKSMaxAge + cfg.KeyOverlap)
+}
+
+// Sign signs the claims with the current key of the ring and names the key
+// in the kid header
+func Sign(r Ring, claims jwt.Claims) (string, error) {
+	return SignType(r, "JWT", claims)
+}
+
+// SignType is Sign with the typ header set to typ, verifiers tell the kinds
+// of tokens signed with the same keys apart by it
+func SignType(r Ring, typ string, claims jwt.Claims) (string, error) {
+	key, err := r.Signing()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(key.Method(), claims)
+	token.Header["kid"] = key.ID
+	token.Header["typ"] = typ
+	return token.SignedString(key.Signer)
+}
+
+// KeyFunc returns the public key named by the kid header of a token, ctx
+// bounds the reload of keys rotated by other nodes
+func KeyFunc(ctx context.Context, r Ring) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := r.Verifier(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		if token.Method.Alg() != key.Algorithm {
+			return nil, fmt.Errorf("unexpected signing method %v for key %s", token.Header["alg"], kid)
+		}
+		return key.Public(), nil
+	}
+}
@@ -0,0 +1,112 @@
+package keys
+
+import (
+	"SB/service/repository/persistence"
+	"context"
+	"sync"
+	"time"
+)
+
+type (
+	// Store keeps signing keys
+	Store interface {
+		// Load returns keys that have not expired, the oldest first
+		Load(ctx context.Context) ([]Key, error)
+		// Rotate adds a key, keys without expiration expire at retireAt
+		Rotate(ctx context.Context, key Key, retireAt time.Time) error
+		DeleteExpired(ctx context.Context) (int64, error)
+	}
+
+	memoryStore struct {
+		mu   sync.Mutex
+		keys []Key
+		now  func() time.Time
+	}
+
+	postgresStore struct {
+		persistent persistence.Persistent
+	}
+)
+
+// NewMemoryStore keeps keys of a single node, tokens signed before a
+// restart can not be verified after it
+func NewMemoryStore() Store {
+	return &memoryStore{now: time.Now}
+}
+
+// NewPostgresStore shares keys between nodes using the same database
+func NewPostgresStore(persistent persistence.Persistent) Store {
+	return &postgresStore{persistent: persistent}
+}
+
+func (s *memoryStore) Load(ctx context.Context) ([]Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []Key
+	for _, key := range s.keys {
+		if !key.Expired(s.now()) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (s *memoryStore) Rotate(ctx context.Context, key Key, retireAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.keys {
+		if s.keys[i].ExpiresAt == nil {
+			expiresAt := retireAt
+			s.keys[i].ExpiresAt = &expiresAt
+		}
+	}
+	s.keys = append(s.keys, key)
+	return nil
+}
+
+func (s *memoryStore) DeleteExpired(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var kept []Key
+	for _, key := range s.keys {
+		if !key.Expired(s.now()) {
+			kept = append(kept, key)
+		}
+	}
+	deleted := int64(len(s.keys) - len(kept))
+	s.keys = kept
+	return deleted, nil
+}
+
+func (s *postgresStore) Load(ctx context.Context) ([]Key, error) {
+	stored, err := s.persistent.GetSigningKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]Key, 0, len(stored))
+	for _, k := range stored {
+		key, err := ParsePEM(k.Algorithm, k.PrivateKey, k.CreatedAt, k.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (s *postgresStore) Rotate(ctx context.Context, key Key, retireAt time.Time) error {
+	encoded, err := key.MarshalPEM()
+	if err != nil {
+		return err
+	}
+	return s.persistent.RotateSigningKey(ctx, persistence.SigningKey{
+		Kid:        key.ID,
+		Algorithm:  key.Algorithm,
+		PrivateKey: encoded,
+		CreatedAt:  key.CreatedAt,
+	}, retireAt)
+}
+
+func (s *postgresStore) DeleteExpired(ctx context.Context) (int64, error) {
+	return s.persistent.DeleteExpiredSigningKeys(ctx)
+}
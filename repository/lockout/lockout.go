@@ -0,0 +1,194 @@
+package lockout
+
+import (
+	"SB/service/config"
+	"SB/service/repository/detach"
+	"SB/service/repository/logging"
+	"SB/service/repository/persistence"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// updateTimeout bounds counting an attempt, a canceled request is counted
+// all the same
+const updateTimeout = 10 * time.Second
+
+type (
+	// LockedError is returned while an account or an IP address has to wait
+	// before the next attempt
+	LockedError struct {
+		RetryAfter time.Duration
+	}
+
+	// Guard tracks failed attempts per account and per IP address. Accounts
+	// are tracked by the login sent by the client whether it exists or not,
+	// so a lockout does not tell which logins are registered.
+	Guard interface {
+		// Attempt counts an attempt of the login from the IP address as
+		// failed before it is made, so parallel attempts cannot all pass
+		// the check. It returns *LockedError without counting the attempt
+		// if the login or the IP address must wait, an empty login counts
+		// only the IP address.
+		Attempt(ctx context.Context, login, ip string) error
+		// Succeed takes a successful attempt back and forgets failures of
+		// the login, failures of the IP address are kept so an attacker
+		// cannot reset them with an own account
+		Succeed(ctx context.Context, login, ip string) error
+		Unlock(ctx context.Context, login string) error
+		// Sweep deletes failures older than the reset period
+		Sweep(ctx context.Context) (int64, error)
+	}
+
+	guard struct {
+		store  Store
+		config config.Lockout
+		now    func() time.Time
+		logger *logging.Logger
+	}
+
+	// key is a key of the store with the attempts allowed without delay
+	key struct {
+		name    string
+		free    int
+		account bool
+	}
+)
+
+// NewGuard creates a guard with the store selected in the configuration
+func NewGuard(persistent persistence.Persistent, cfg config.Lockout, logger *logging.Logger) (Guard, error) {
+	var store Store
+	switch cfg.Store {
+	case "memory":
+		store = NewMemoryStore()
+	case "postgres":
+		store = NewPostgresStore(persistent)
+	default:
+		return nil, fmt.Errorf("unknown lockout store %q", cfg.Store)
+	}
+	return newGuard(store, cfg, time.Now, logger), nil
+}
+
+func newGuard(store Store, cfg config.Lockout, now func() time.Time, logger *logging.Logger) Guard {
+	return &guard{
+		store:  store,
+		config: cfg,
+		now:    now,
+		logger: logger,
+	}
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("too many failed attempts, retry after %s", e.RetryAfter)
+}
+
+func (g *guard) Attempt(ctx context.Context, login, ip string) error {
+	keys := g.keys(login, ip)
+	now := g.now()
+	staleBefore := now.Add(-g.config.ResetAfter)
+	var wait time.Duration
+	var counted []Attempts
+	ctx, cancel := detach.Context(ctx, updateTimeout)
+	defer cancel()
+	err := g.store.Update(ctx, names(keys), func(attempts []Attempts) []Attempts {
+		wait = 0
+		for i, a := range attempts {
+			if d := g.wait(a, keys[i].free); d > wait {
+				wait = d
+			}
+		}
+		if wait > 0 {
+			return attempts
+		}
+		for i := range attempts {
+			if attempts[i].LastFailure.Before(staleBefore) {
+				attempts[i].Failures = 0
+			}
+			attempts[i].Failures++
+			attempts[i].LastFailure = now
+		}
+		counted = attempts
+		return attempts
+	})
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		return &LockedError{RetryAfter: wait}
+	}
+	for i, a := range counted {
+		if a.Failures == keys[i].free {
+			g.logger.For(ctx).Warn("too many failed attempts, delaying next attempts", logging.String("key", keys[i].name))
+		}
+	}
+	return nil
+}
+
+func (g *guard) Succeed(ctx context.Context, login, ip string) error {
+	keys := g.keys(login, ip)
+	ctx, cancel := detach.Context(ctx, updateTimeout)
+	defer cancel()
+	return g.store.Update(ctx, names(keys), func(attempts []Attempts) []Attempts {
+		for i := range attempts {
+			if keys[i].account {
+				attempts[i].Failures = 0
+			} else if attempts[i].Failures > 0 {
+				attempts[i].Failures--
+			}
+		}
+		return attempts
+	})
+}
+
+func (g *guard) Unlock(ctx context.Context, login string) error {
+	g.logger.For(ctx).Info("unlocking account", logging.String("login", login))
+	return g.store.Reset(ctx, accountKey(login))
+}
+
+func (g *guard) Sweep(ctx context.Context) (int64, error) {
+	return g.store.DeleteStale(ctx, g.now().Add(-g.config.ResetAfter))
+}
+
+// keys returns the keys of the login and the IP address that are set
+func (g *guard) keys(login, ip string) []key {
+	keys := make([]key, 0, 2)
+	if login != "" {
+		keys = append(keys, key{name: accountKey(login), free: g.config.AccountAttempts, account: true})
+	}
+	if ip != "" {
+		keys = append(keys, key{name: ipKey(ip), free: g.config.IPAttempts})
+	}
+	return keys
+}
+
+func names(keys []key) []string {
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = k.name
+	}
+	return names
+}
+
+// wait returns how long to wait after the last failure, the delay doubles
+// with every failure over the free attempts
+func (g *guard) wait(attempts Attempts, free int) time.Duration {
+	if attempts.Failures < free {
+		return 0
+	}
+	delay := g.config.MaxDelay
+	if over := attempts.Failures - free; over < 32 {
+		if d := g.config.BaseDelay << uint(over); d > 0 && d < delay {
+			delay = d
+		}
+	}
+	return attempts.LastFailure.Add(delay).Sub(g.now())
+}
+
+func accountKey(login string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(login))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
@@ -0,0 +1,115 @@
+package lockout
+
+import (
+	"SB/service/config"
+	"SB/service/repository/logging"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var ctx = context.Background()
+
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func newTestGuard() (Guard, *clock) {
+	c := &clock{t: time.Unix(1637603397, 0)}
+	cfg := config.Default().Lockout
+	cfg.AccountAttempts = 3
+	cfg.IPAttempts = 5
+	return newGuard(NewMemoryStore(), cfg, c.now, logging.Discard()), c
+}
+
+func retryAfter(t *testing.T, err error) time.Duration {
+	var locked *LockedError
+	require.True(t, errors.As(err, &locked), "expected LockedError, got %v", err)
+	return locked.RetryAfter
+}
+
+func TestBackoff(t *testing.T) {
+	g, c := newTestGuard()
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, g.Attempt(ctx, "Test", "192.0.2.1"), "free attempts do not wait")
+	}
+	require.Equal(t, time.Second, retryAfter(t, g.Attempt(ctx, "test", "192.0.2.2")))
+	require.Equal(t, time.Second, retryAfter(t, g.Attempt(ctx, "test", "192.0.2.2")), "refused attempts are not counted")
+	c.t = c.t.Add(time.Second)
+	require.NoError(t, g.Attempt(ctx, "test", "192.0.2.2"))
+	require.Equal(t, 2*time.Second, retryAfter(t, g.Attempt(ctx, "test", "192.0.2.3")), "delay doubles")
+
+	for i := 0; i < 20; i++ {
+		c.t = c.t.Add(15 * time.Minute)
+		require.NoError(t, g.Attempt(ctx, "test", "192.0.2.3"))
+	}
+	require.Equal(t, 15*time.Minute, retryAfter(t, g.Attempt(ctx, "test", "")), "delay is capped")
+	require.NoError(t, g.Attempt(ctx, "other", "192.0.2.2"), "other accounts and IP addresses are not affected")
+	require.Error(t, g.Attempt(ctx, "other", "192.0.2.3"), "IP address over its limit waits")
+}
+
+func TestParallelAttempts(t *testing.T) {
+	g, _ := newTestGuard()
+	var passed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if g.Attempt(ctx, "test", "") == nil {
+				atomic.AddInt32(&passed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(3), passed, "only the free attempts pass")
+}
+
+func TestSucceedKeepsIPFailures(t *testing.T) {
+	g, _ := newTestGuard()
+	for i := 0; i < 2; i++ {
+		require.NoError(t, g.Attempt(ctx, "test", "192.0.2.1"))
+	}
+	require.NoError(t, g.Attempt(ctx, "test", "192.0.2.1"))
+	require.NoError(t, g.Succeed(ctx, "test", "192.0.2.1"))
+
+	// failures of the account are forgotten, the IP address has two
+	for i := 0; i < 3; i++ {
+		require.NoError(t, g.Attempt(ctx, "", "192.0.2.1"), "the successful attempt is not counted")
+	}
+	require.Error(t, g.Attempt(ctx, "", "192.0.2.1"))
+	for i := 0; i < 3; i++ {
+		require.NoError(t, g.Attempt(ctx, "test", ""))
+	}
+	require.Error(t, g.Attempt(ctx, "test", ""))
+
+	require.NoError(t, g.Unlock(ctx, "test"))
+	require.NoError(t, g.Attempt(ctx, "test", ""))
+	require.Error(t, g.Attempt(ctx, "", "192.0.2.1"))
+}
+
+func TestResetAfter(t *testing.T) {
+	g, c := newTestGuard()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, g.Attempt(ctx, "test", ""))
+	}
+	require.Error(t, g.Attempt(ctx, "test", ""))
+	c.t = c.t.Add(25 * time.Hour)
+	require.NoError(t, g.Attempt(ctx, "test", ""))
+	require.NoError(t, g.Attempt(ctx, "test", ""), "old failures are not counted")
+
+	c.t = c.t.Add(25 * time.Hour)
+	deleted, err := g.Sweep(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), deleted)
+}
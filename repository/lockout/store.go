@@ -0,0 +1,100 @@
+package lockout
+
+import (
+	"SB/service/repository/persistence"
+	"context"
+	"sync"
+	"time"
+)
+
+type (
+	// Attempts counts failures in a row of a key
+	Attempts struct {
+		Failures    int
+		LastFailure time.Time
+	}
+
+	// Store keeps failed attempts
+	Store interface {
+		// Update replaces the attempts of the keys with the ones returned by
+		// update in one atomic step, attempts are in the order of the keys
+		// and unknown keys have zero attempts
+		Update(ctx context.Context, keys []string, update func(attempts []Attempts) []Attempts) error
+		Reset(ctx context.Context, key string) error
+		DeleteStale(ctx context.Context, before time.Time) (int64, error)
+	}
+
+	memoryStore struct {
+		mu       sync.Mutex
+		attempts map[string]Attempts
+	}
+
+	postgresStore struct {
+		persistent persistence.Persistent
+	}
+)
+
+// NewMemoryStore keeps attempts of a single node
+func NewMemoryStore() Store {
+	return &memoryStore{attempts: make(map[string]Attempts)}
+}
+
+// NewPostgresStore shares attempts between nodes using the same database
+func NewPostgresStore(persistent persistence.Persistent) Store {
+	return &postgresStore{persistent: persistent}
+}
+
+func (s *memoryStore) Update(ctx context.Context, keys []string, update func(attempts []Attempts) []Attempts) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attempts := make([]Attempts, len(keys))
+	for i, key := range keys {
+		attempts[i] = s.attempts[key]
+	}
+	for i, a := range update(attempts) {
+		s.attempts[keys[i]] = a
+	}
+	return nil
+}
+
+func (s *memoryStore) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, key)
+	return nil
+}
+
+func (s *memoryStore) DeleteStale(ctx context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deleted int64
+	for key, a := range s.attempts {
+		if a.LastFailure.Before(before) {
+			delete(s.attempts, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *postgresStore) Update(ctx context.Context, keys []string, update func(attempts []Attempts) []Attempts) error {
+	return s.persistent.UpdateLoginAttempts(ctx, keys, func(rows []persistence.LoginAttempts) []persistence.LoginAttempts {
+		attempts := make([]Attempts, len(rows))
+		for i, row := range rows {
+			attempts[i] = Attempts{Failures: row.Failures, LastFailure: row.LastFailure}
+		}
+		for i, a := range update(attempts) {
+			rows[i].Failures = a.Failures
+			rows[i].LastFailure = a.LastFailure
+		}
+		return rows
+	})
+}
+
+func (s *postgresStore) Reset(ctx context.Context, key string) error {
+	return s.persistent.DeleteLoginAttempts(ctx, key)
+}
+
+func (s *postgresStore) DeleteStale(ctx context.Context, before time.Time) (int64, error) {
+	return s.persistent.DeleteStaleLoginAttempts(ctx, before)
+}
@@ -0,0 +1,69 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+	"gorm.io/gorm/utils"
+)
+
+// slowStatement is the duration over which statements are logged as slow
+const slowStatement = 200 * time.Millisecond
+
+// databaseLogger writes the lines of gorm with the logger of the context of
+// statements or base. Statements are never written, their values may be
+// personal data or password hashes, lines have the code that ran them instead.
+type databaseLogger struct {
+	base *Logger
+}
+
+// DatabaseLogger returns the logger of gorm, pass it in gorm.Config
+func DatabaseLogger(base *Logger) gormlogger.Interface {
+	return databaseLogger{base: base}
+}
+
+// LogMode is ignored, levels are set by the logger of the context
+func (d databaseLogger) LogMode(gormlogger.LogLevel) gormlogger.Interface {
+	return d
+}
+
+func (d databaseLogger) Info(ctx context.Context, msg string, args ...interface{}) {
+	d.base.For(ctx).Info(fmt.Sprintf(msg, args...))
+}
+
+func (d databaseLogger) Warn(ctx context.Context, msg string, args ...interface{}) {
+	d.base.For(ctx).Warn(fmt.Sprintf(msg, args...))
+}
+
+func (d databaseLogger) Error(ctx context.Context, msg string, args ...interface{}) {
+	d.base.For(ctx).Error(fmt.Sprintf(msg, args...))
+}
+
+// Trace logs slow statements, failed ones are logged at debug level since
+// persistence logs its failures with the operation
+func (d databaseLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	l := d.base.For(ctx)
+	elapsed := time.Since(begin)
+	failed := err != nil && !errors.Is(err, gorm.ErrRecordNotFound)
+	if elapsed < slowStatement && !(failed && l.Enabled(LevelDebug)) {
+		return
+	}
+	_, rows := fc()
+	source := utils.FileWithLineNum()
+	fields := []Field{
+		String("source", filepath.Base(filepath.Dir(source))+"/"+filepath.Base(source)),
+		Duration("duration", elapsed),
+		Int("rows", rows),
+	}
+	if failed {
+		l.Debug("database statement failed", append(fields, Err(err))...)
+	}
+	if elapsed >= slowStatement {
+		l.Warn("slow database statement", fields...)
+	}
+}
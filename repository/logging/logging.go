@@ -0,0 +1,259 @@
+// Package logging writes leveled, structured log lines as text or JSON.
+// Every line has the time, level, message and caller followed by fields.
+//
+// Loggers are passed to constructors, there is no global logger. The logger
+// of a request is derived from the one of the server and carried by its
+// context: middleware puts a logger with the request id into it and managers
+// and persistence log with For, so every line of a request has its id.
+//
+// Values of fields and messages are redacted before they are written, see
+// Redact.
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int8
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// Formats of lines
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+type (
+	// Field is a key and value describing a log line
+	Field struct {
+		Key   string
+		Value interface{}
+	}
+
+	Logger struct {
+		out    *output
+		level  Level
+		json   bool
+		fields []Field
+	}
+
+	// output is the writer shared by a logger and the loggers derived from it
+	output struct {
+		mu sync.Mutex
+		w  io.Writer
+	}
+
+	contextKey struct{}
+)
+
+// New returns a logger writing lines of the level and above in the format
+func New(w io.Writer, level Level, format string) *Logger {
+	return &Logger{out: &output{w: w}, level: level, json: format == FormatJSON}
+}
+
+// Discard returns a logger writing nothing, for tests
+func Discard() *Logger {
+	return New(io.Discard, LevelError+1, FormatText)
+}
+
+// ParseLevel parses a level name like info
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+func (level Level) String() string {
+	if level < LevelDebug || level > LevelError {
+		return strconv.Itoa(int(level))
+	}
+	return levelNames[level]
+}
+
+// NewContext returns ctx carrying l
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// For returns the logger ctx carries, the one of its request or job, or l
+func (l *Logger) For(ctx context.Context) *Logger {
+	if carried, ok := ctx.Value(contextKey{}).(*Logger); ok {
+		return carried
+	}
+	return l
+}
+
+// String returns a field
+func String(key, value string) Field {
+	return Field{key, value}
+}
+
+// Int returns a field
+func Int(key string, value int64) Field {
+	return Field{key, value}
+}
+
+// Duration returns a field in milliseconds
+func Duration(key string, value time.Duration) Field {
+	return Field{key + "_ms", float64(value) / float64(time.Millisecond)}
+}
+
+// Err returns the error field
+func Err(err error) Field {
+	if err == nil {
+		return Field{"error", nil}
+	}
+	return Field{"error", err.Error()}
+}
+
+// Any returns a field with a value formatted with fmt
+func Any(key string, value interface{}) Field {
+	return Field{key, value}
+}
+
+// With returns a logger adding the fields to every line
+func (l *Logger) With(fields ...Field) *Logger {
+	derived := *l
+	derived.fields = append(append([]Field(nil), l.fields...), fields...)
+	return &derived
+}
+
+// Enabled reports whether lines of the level are written
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+func (l *Logger) Debug(msg string, fields ...Field) {
+	l.log(LevelDebug, msg, fields)
+}
+
+func (l *Logger) Info(msg string, fields ...Field) {
+	l.log(LevelInfo, msg, fields)
+}
+
+func (l *Logger) Warn(msg string, fields ...Field) {
+	l.log(LevelWarn, msg, fields)
+}
+
+func (l *Logger) Error(msg string, fields ...Field) {
+	l.log(LevelError, msg, fields)
+}
+
+// Fatal writes an error line and exits, only main may call it
+func (l *Logger) Fatal(msg string, fields ...Field) {
+	l.log(LevelError, msg, fields)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level Level, msg string, fields []Field) {
+	if !l.Enabled(level) {
+		return
+	}
+	caller := ""
+	// 0 is log, 1 is the method of the level and 2 its caller
+	if _, file, line, ok := runtime.Caller(2); ok {
+		caller = filepath.Base(filepath.Dir(file)) + "/" + filepath.Base(file) + ":" + strconv.Itoa(line)
+	}
+	all := make([]Field, 0, len(l.fields)+len(fields))
+	for _, f := range l.fields {
+		all = append(all, Field{f.Key, Redact(f.Key, f.Value)})
+	}
+	for _, f := range fields {
+		all = append(all, Field{f.Key, Redact(f.Key, f.Value)})
+	}
+	now := time.Now().UTC()
+	msg = redactText(msg)
+
+	var line []byte
+	if l.json {
+		line = jsonLine(now, level, msg, caller, all)
+	} else {
+		line = textLine(now, level, msg, caller, all)
+	}
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	_, _ = l.out.w.Write(line)
+}
+
+func jsonLine(t time.Time, level Level, msg, caller string, fields []Field) []byte {
+	var b strings.Builder
+	b.WriteString(`{"time":"` + t.Format(time.RFC3339Nano) + `","level":"` + level.String() + `","msg":`)
+	writeJSON(&b, msg)
+	b.WriteString(`,"caller":`)
+	writeJSON(&b, caller)
+	for _, f := range fields {
+		b.WriteByte(',')
+		writeJSON(&b, f.Key)
+		b.WriteByte(':')
+		writeJSON(&b, f.Value)
+	}
+	b.WriteString("}\n")
+	return []byte(b.String())
+}
+
+func writeJSON(b *strings.Builder, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(data)
+}
+
+func textLine(t time.Time, level Level, msg, caller string, fields []Field) []byte {
+	var b strings.Builder
+	b.WriteString(t.Format("2006-01-02T15:04:05.000Z07:00"))
+	b.WriteByte(' ')
+	b.WriteString(strings.ToUpper(level.String()))
+	b.WriteByte(' ')
+	b.WriteString(caller)
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for _, f := range fields {
+		b.WriteByte(' ')
+		b.WriteString(f.Key)
+		b.WriteByte('=')
+		b.WriteString(textValue(f.Value))
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+// textValue quotes values with spaces, quotes or equal signs
+func textValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		s = v
+	case fmt.Stringer:
+		s = v.String()
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,133 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestText(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, LevelInfo, FormatText).With(String("request_id", "abc"))
+	l.Info("user updated", Int("id_user", 7), String("note", "two words"))
+
+	line := buf.String()
+	require.True(t, strings.HasSuffix(line, "\n"))
+	require.Contains(t, line, " INFO logging/logging_test.go:")
+	require.Contains(t, line, ` user updated request_id=abc id_user=7 note="two words"`)
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, LevelDebug, FormatJSON).With(String("request_id", "abc"))
+	l.Error("query failed", Err(errors.New("timeout")), Int("id_user", 7))
+
+	var line map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	require.Equal(t, "error", line["level"])
+	require.Equal(t, "query failed", line["msg"])
+	require.Equal(t, "abc", line["request_id"])
+	require.Equal(t, "timeout", line["error"])
+	require.Equal(t, float64(7), line["id_user"])
+	require.Contains(t, line["caller"], "logging/logging_test.go:")
+	require.NotEmpty(t, line["time"])
+}
+
+func TestLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, LevelWarn, FormatText)
+	l.Debug("debug")
+	l.Info("info")
+	require.Empty(t, buf.String())
+	require.False(t, l.Enabled(LevelInfo))
+
+	l.Warn("warn")
+	require.Contains(t, buf.String(), " WARN ")
+
+	level, err := ParseLevel("ERROR")
+	require.NoError(t, err)
+	require.Equal(t, LevelError, level)
+	_, err = ParseLevel("verbose")
+	require.Error(t, err)
+}
+
+func TestContext(t *testing.T) {
+	base := New(&bytes.Buffer{}, LevelInfo, FormatText)
+	require.Same(t, base, base.For(context.Background()))
+
+	l := base.With(String("request_id", "1"))
+	require.Same(t, l, base.For(NewContext(context.Background(), l)))
+}
+
+func TestWithDoesNotShareFields(t *testing.T) {
+	var buf bytes.Buffer
+	base := New(&buf, LevelInfo, FormatText).With(String("a", "1"))
+	first := base.With(String("b", "2"))
+	second := base.With(String("c", "3"))
+	first.Info("first")
+	second.Info("second")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	require.True(t, strings.HasSuffix(lines[0], "first a=1 b=2"))
+	require.True(t, strings.HasSuffix(lines[1], "second a=1 c=3"))
+}
+
+func TestRedact(t *testing.T) {
+	for _, tc := range []struct {
+		key   string
+		value interface{}
+		want  interface{}
+	}{
+		{"password", "hunter2", Redacted},
+		{"NewPassword", "hunter2", Redacted},
+		{"refresh_token", "abc", Redacted},
+		{"Authorization", "Bearer abc", Redacted},
+		{"code", "123456", Redacted},
+		{"email", "ann@example.com", RedactedEmail},
+		{"id_user", int64(7), int64(7)},
+		{"verified", true, true},
+		{"code_length", 6, 6},
+		{"error", "no user ann@example.com", "no user " + RedactedEmail},
+		{"header", "bearer abc.def-ghi", "Bearer " + RedactedToken},
+		{"detail", "got eyJhbGciOi.eyJzdWIiOiI3In0.c2lnbmF0dXJl", "got " + RedactedToken},
+		{"detail", "key sbk_ab12cd_s3cr3tpart used", "key sbk_ab12cd_" + Redacted + " used"},
+		{"profile", struct{ Email string }{"ann@example.com"}, "{Email:" + RedactedEmail + "}"},
+		{"error", nil, nil},
+	} {
+		require.Equal(t, tc.want, Redact(tc.key, tc.value), "%s=%v", tc.key, tc.value)
+	}
+}
+
+func TestDatabaseLogger(t *testing.T) {
+	var buf bytes.Buffer
+	ctx := NewContext(context.Background(), New(&buf, LevelInfo, FormatJSON))
+	statement := func() (string, int64) {
+		return `SELECT * FROM users WHERE login = 'ann@example.com'`, 1
+	}
+
+	DatabaseLogger(Discard()).Trace(ctx, time.Now(), statement, nil)
+	DatabaseLogger(Discard()).Trace(ctx, time.Now(), statement, errors.New("syntax error"))
+	require.Empty(t, buf.String(), "fast statements are not logged, failures only at debug level")
+
+	DatabaseLogger(Discard()).Trace(ctx, time.Now().Add(-time.Second), statement, nil)
+	var line map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	require.Equal(t, "slow database statement", line["msg"])
+	require.Equal(t, float64(1), line["rows"])
+	require.NotContains(t, buf.String(), "users", "statements are never logged")
+}
+
+func TestRedactMessage(t *testing.T) {
+	var buf bytes.Buffer
+	New(&buf, LevelInfo, FormatText).Info("mail sent to ann@example.com", String("password", "hunter2"))
+	require.NotContains(t, buf.String(), "ann@example.com")
+	require.NotContains(t, buf.String(), "hunter2")
+	require.Contains(t, buf.String(), "mail sent to "+RedactedEmail+" password="+Redacted)
+}
@@ -0,0 +1,81 @@
+package logging
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Replacements of redacted values
+const (
+	Redacted      = "[REDACTED]"
+	RedactedEmail = "[EMAIL]"
+	RedactedToken = "[TOKEN]"
+)
+
+// sensitiveKeys are parts of keys whose values are never written
+var sensitiveKeys = []string{
+	"password", "passwd", "secret", "token", "authorization", "cookie", "otp", "recovery", "api_key",
+}
+
+// sensitiveNames are keys whose values are never written, they are too short
+// to match parts of keys
+var sensitiveNames = map[string]bool{
+	"code":      true,
+	"totp_code": true,
+	"session":   true,
+}
+
+var (
+	emailPattern  = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	jwtPattern    = regexp.MustCompile(`eyJ[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]*`)
+	bearerPattern = regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9._~+/\-]+=*`)
+	apiKeyPattern = regexp.MustCompile(`\b(sbk_[a-z0-9]+)_[a-z0-9]+`)
+)
+
+// Redact returns the value of a field as it may be written. Values of keys
+// naming passwords, tokens, secrets, cookies and one-time codes are replaced
+// entirely, values of e-mail keys by [EMAIL]. Other values are written but
+// e-mail addresses, JWTs, bearer tokens and secrets of API keys in them are
+// replaced, values that are not numbers or booleans are formatted first.
+func Redact(key string, value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	lower := strings.ToLower(key)
+	if sensitiveNames[lower] {
+		return Redacted
+	}
+	for _, part := range sensitiveKeys {
+		if strings.Contains(lower, part) {
+			return Redacted
+		}
+	}
+	if strings.Contains(lower, "email") {
+		return RedactedEmail
+	}
+	switch v := value.(type) {
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	case string:
+		return redactText(v)
+	case fmt.Stringer:
+		return redactText(v.String())
+	case error:
+		return redactText(v.Error())
+	default:
+		return redactText(fmt.Sprintf("%+v", v))
+	}
+}
+
+// redactText replaces e-mail addresses, JWTs, bearer tokens and secrets of
+// API keys in s
+func redactText(s string) string {
+	if !strings.ContainsAny(s, "@_.") && !strings.Contains(strings.ToLower(s), "bearer") {
+		return s
+	}
+	s = bearerPattern.ReplaceAllString(s, "Bearer "+RedactedToken)
+	s = jwtPattern.ReplaceAllString(s, RedactedToken)
+	s = apiKeyPattern.ReplaceAllString(s, "${1}_"+Redacted)
+	return emailPattern.ReplaceAllString(s, RedactedEmail)
+}
@@ -0,0 +1,130 @@
+package mail
+
+import (
+	"SB/service/config"
+	"SB/service/repository/logging"
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	Message struct {
+		To      string
+		Subject string
+		Body    string
+	}
+
+	// Mailer delivers plain text e-mails to users
+	Mailer interface {
+		Send(msg Message) error
+	}
+
+	smtpMailer struct {
+		from string
+		addr string
+		auth smtp.Auth
+	}
+
+	fileMailer struct {
+		from string
+		dir  string
+		seq  uint64
+	}
+
+	// logMailer is meant for development, it logs recipients and subjects
+	// only since bodies have tokens, the file driver keeps whole messages
+	logMailer struct {
+		from   string
+		logger *logging.Logger
+	}
+)
+
+// New creates the mailer selected by the driver in configuration, the log
+// driver writes with logger
+func New(cfg config.Mail, logger *logging.Logger) (Mailer, error) {
+	switch cfg.Driver {
+	case "smtp":
+		return NewSMTPMailer(cfg), nil
+	case "file":
+		return NewFileMailer(cfg.From, cfg.Dir)
+	case "log":
+		return &logMailer{from: cfg.From, logger: logger}, nil
+	}
+	return nil, fmt.Errorf("unsupported mail driver %q", cfg.Driver)
+}
+
+func NewSMTPMailer(cfg config.Mail) Mailer {
+	m := &smtpMailer{
+		from: cfg.From,
+		addr: cfg.SMTPHost + ":" + cfg.SMTPPort,
+	}
+	if cfg.SMTPUser != "" {
+		m.auth = smtp.PlainAuth("", cfg.SMTPUser, cfg.SMTPPassword, cfg.SMTPHost)
+	}
+	return m
+}
+
+func (m *smtpMailer) Send(msg Message) error {
+	from, err := mail.ParseAddress(m.from)
+	if err != nil {
+		return err
+	}
+	content, err := format(m.from, msg)
+	if err != nil {
+		return err
+	}
+	if err := smtp.SendMail(m.addr, m.auth, from.Address, []string{msg.To}, content); err != nil {
+		return fmt.Errorf("failed to send e-mail to %s: %s", msg.To, err)
+	}
+	return nil
+}
+
+func NewFileMailer(from, dir string) (Mailer, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileMailer{from: from, dir: dir}, nil
+}
+
+// Send saves the message to a .eml file, the files are sorted by time
+func (m *fileMailer) Send(msg Message) error {
+	content, err := format(m.from, msg)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%04d.eml", time.Now().UTC().Format("20060102T150405.000000"), atomic.AddUint64(&m.seq, 1))
+	return os.WriteFile(filepath.Join(m.dir, name), content, 0600)
+}
+
+func (m *logMailer) Send(msg Message) error {
+	m.logger.Info("e-mail not sent, the log driver is configured", logging.String("to", msg.To), logging.String("subject", msg.Subject))
+	return nil
+}
+
+func format(from string, msg Message) ([]byte, error) {
+	if _, err := mail.ParseAddress(msg.To); err != nil {
+		return nil, fmt.Errorf("invalid recipient %q: %s", msg.To, err)
+	}
+	if strings.ContainsAny(msg.To+msg.Subject, "\r\n") {
+		return nil, fmt.Errorf("invalid e-mail header")
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return b.Bytes(), nil
+}
@@ -0,0 +1,123 @@
+package mail
+
+import (
+	"SB/service/config"
+	"SB/service/repository/logging"
+	"bufio"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// smtpServer is a stand-in SMTP server accepting a single message
+type smtpServer struct {
+	listener net.Listener
+	from     string
+	to       []string
+	data     chan string
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &smtpServer{listener: l, data: make(chan string, 1)}
+	t.Cleanup(func() { l.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *smtpServer) serve() {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250-localhost")
+			tp.PrintfLine("250 8BITMIME")
+		case "MAIL":
+			s.from = line
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			s.to = append(s.to, line)
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.data <- string(data)
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+func TestSMTPMailer(t *testing.T) {
+	server := newSMTPServer(t)
+	host, port, err := net.SplitHostPort(server.listener.Addr().String())
+	require.NoError(t, err)
+
+	cfg := config.Default().Mail
+	cfg.Driver = "smtp"
+	cfg.From = "Sport Buddy <no-reply@sportbuddy.example>"
+	cfg.SMTPHost = host
+	cfg.SMTPPort = port
+	mailer, err := New(cfg, logging.Discard())
+	require.NoError(t, err)
+
+	require.NoError(t, mailer.Send(Message{To: "andrey@gmail.com", Subject: "Сброс пароля", Body: "line 1\nline 2\n"}))
+
+	data := <-server.data
+	require.Equal(t, "MAIL FROM:<no-reply@sportbuddy.example> BODY=8BITMIME", server.from)
+	require.Equal(t, []string{"RCPT TO:<andrey@gmail.com>"}, server.to)
+	require.Contains(t, data, "From: Sport Buddy <no-reply@sportbuddy.example>\n")
+	require.Contains(t, data, "To: andrey@gmail.com\n")
+	require.Contains(t, data, "Subject: =?utf-8?q?")
+	require.True(t, strings.HasSuffix(data, "\nline 1\nline 2\n"), data)
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	mailer, err := NewFileMailer("no-reply@localhost", dir)
+	require.NoError(t, err)
+
+	require.NoError(t, mailer.Send(Message{To: "andrey@gmail.com", Subject: "first", Body: "body"}))
+	require.NoError(t, mailer.Send(Message{To: "andrey@gmail.com", Subject: "second", Body: "body"}))
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	f, err := os.Open(filepath.Join(dir, files[1].Name()))
+	require.NoError(t, err)
+	defer f.Close()
+	header, err := textproto.NewReader(bufio.NewReader(f)).ReadMIMEHeader()
+	require.NoError(t, err)
+	require.Equal(t, "second", header.Get("Subject"))
+}
+
+func TestHeaderInjection(t *testing.T) {
+	mailer, err := NewFileMailer("no-reply@localhost", t.TempDir())
+	require.NoError(t, err)
+	require.Error(t, mailer.Send(Message{To: "andrey@gmail.com", Subject: "hi\r\nBcc: victim@example.com"}))
+	require.Error(t, mailer.Send(Message{To: "not an address"}))
+}
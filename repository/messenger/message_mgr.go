@@ -1,21 +1,25 @@
 package messenger
 
 import (
+	"SB/service/repository/metrics"
 	"SB/service/repository/persistence"
+	"context"
 	"time"
 )
 
+var messagesSent = metrics.NewCounter("sb_messages_sent_total", "Messages sent in the messenger")
+
 type (
 	messenger struct {
 		persistent persistence.Persistent
 	}
 
 	Messenger interface {
-		AddMessage(msg persistence.PersistentObject) error
-		GetDialogs(idUser int64) ([]persistence.PersistentObject, error)
-		AddRequest(req persistence.PersistentObject) error
-		UpdateRequest(req persistence.PersistentObject) (persistence.PersistentObject, error)
-		GetMessages(idUsers []int64, t time.Time) ([]persistence.PersistentObject, error)
+		AddMessage(ctx context.Context, msg persistence.PersistentObject) error
+		GetDialogs(ctx context.Context, idUser int64) ([]persistence.PersistentObject, error)
+		AddRequest(ctx context.Context, req persistence.PersistentObject) error
+		UpdateRequest(ctx context.Context, req persistence.PersistentObject) (persistence.PersistentObject, error)
+		GetMessages(ctx context.Context, idUsers []int64, t time.Time) ([]persistence.PersistentObject, error)
 	}
 )
 
@@ -25,26 +29,30 @@ func NewMessenger(persistent persistence.Persistent) Messenger {
 	}
 }
 
-func (messenger *messenger) AddMessage(msg persistence.PersistentObject) error {
-	return messenger.persistent.AddMessage(msg)
+func (messenger *messenger) AddMessage(ctx context.Context, msg persistence.PersistentObject) error {
+	if err := messenger.persistent.AddMessage(ctx, msg); err != nil {
+		return err
+	}
+	messagesSent.Inc()
+	return nil
 }
 
-func (messenger *messenger) GetDialogs(idUser int64) ([]persistence.PersistentObject, error) {
-	return messenger.persistent.GetDialogs(idUser)
+func (messenger *messenger) GetDialogs(ctx context.Context, idUser int64) ([]persistence.PersistentObject, error) {
+	return messenger.persistent.GetDialogs(ctx, idUser)
 }
 
-func (messenger *messenger) AddRequest(req persistence.PersistentObject) error {
-	return messenger.persistent.AddRequest(req)
+func (messenger *messenger) AddRequest(ctx context.Context, req persistence.PersistentObject) error {
+	return messenger.persistent.AddRequest(ctx, req)
 }
 
-func (messenger *messenger) UpdateRequest(req persistence.PersistentObject) (persistence.PersistentObject, error) {
-	return messenger.persistent.UpdateRequest(req)
+func (messenger *messenger) UpdateRequest(ctx context.Context, req persistence.PersistentObject) (persistence.PersistentObject, error) {
+	return messenger.persistent.UpdateRequest(ctx, req)
 }
 
-func (messenger *messenger) GetMessages(idUsers []int64, t time.Time) ([]persistence.PersistentObject, error) {
+func (messenger *messenger) GetMessages(ctx context.Context, idUsers []int64, t time.Time) ([]persistence.PersistentObject, error) {
 	nullTime := time.Time{}
 	if t == nullTime {
 		t = time.Now()
 	}
-	return messenger.persistent.GetMessages(idUsers, t)
+	return messenger.persistent.GetMessages(ctx, idUsers, t)
 }
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"database/sql"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const startedKey = "metrics:started"
+
+// databasePlugin is a gorm plugin measuring statements and the connection pool
+type databasePlugin struct {
+	registry *Registry
+}
+
+// DatabasePlugin returns a gorm plugin registering the durations of
+// statements and the stats of the connection pool in r
+func DatabasePlugin(r *Registry) gorm.Plugin {
+	return &databasePlugin{registry: r}
+}
+
+func (p *databasePlugin) Name() string {
+	return "metrics"
+}
+
+func (p *databasePlugin) Initialize(db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	duration := p.registry.NewHistogram("sb_db_query_duration_seconds", "Time to run database statements by operation and table",
+		DefaultBuckets, "operation", "table")
+
+	callbacks := db.Callback()
+	start := func(db *gorm.DB) {
+		db.InstanceSet(startedKey, time.Now())
+	}
+	finish := func(operation string) func(*gorm.DB) {
+		return func(db *gorm.DB) {
+			if started, ok := db.InstanceGet(startedKey); ok {
+				duration.Observe(time.Since(started.(time.Time)).Seconds(), operation, db.Statement.Table)
+			}
+		}
+	}
+	for _, err := range []error{
+		callbacks.Create().Before("gorm:create").Register("metrics:before_create", start),
+		callbacks.Create().After("gorm:create").Register("metrics:after_create", finish("create")),
+		callbacks.Query().Before("gorm:query").Register("metrics:before_query", start),
+		callbacks.Query().After("gorm:query").Register("metrics:after_query", finish("query")),
+		callbacks.Update().Before("gorm:update").Register("metrics:before_update", start),
+		callbacks.Update().After("gorm:update").Register("metrics:after_update", finish("update")),
+		callbacks.Delete().Before("gorm:delete").Register("metrics:before_delete", start),
+		callbacks.Delete().After("gorm:delete").Register("metrics:after_delete", finish("delete")),
+		callbacks.Row().Before("gorm:row").Register("metrics:before_row", start),
+		callbacks.Row().After("gorm:row").Register("metrics:after_row", finish("row")),
+		callbacks.Raw().Before("gorm:raw").Register("metrics:before_raw", start),
+		callbacks.Raw().After("gorm:raw").Register("metrics:after_raw", finish("raw")),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+
+	p.registerPool(sqlDB)
+	return nil
+}
+
+func (p *databasePlugin) registerPool(sqlDB *sql.DB) {
+	p.registry.NewCollector("sb_db_connections", "Connections of the pool by state", TypeGauge, []string{"state"},
+		func(report func(value float64, labels ...string)) {
+			stats := sqlDB.Stats()
+			report(float64(stats.InUse), "in_use")
+			report(float64(stats.Idle), "idle")
+		})
+	p.registry.NewCollector("sb_db_max_open_connections", "Limit of open connections of the pool", TypeGauge, nil,
+		func(report func(value float64, labels ...string)) {
+			report(float64(sqlDB.Stats().MaxOpenConnections))
+		})
+	p.registry.NewCollector("sb_db_wait_count_total", "Times a query waited for a free connection", TypeCounter, nil,
+		func(report func(value float64, labels ...string)) {
+			report(float64(sqlDB.Stats().WaitCount))
+		})
+	p.registry.NewCollector("sb_db_wait_duration_seconds_total", "Time queries waited for free connections", TypeCounter, nil,
+		func(report func(value float64, labels ...string)) {
+			report(sqlDB.Stats().WaitDuration.Seconds())
+		})
+}
@@ -0,0 +1,308 @@
+// Package metrics keeps counters, gauges and histograms and writes them in
+// the Prometheus text format. Packages declare their metrics in Default when
+// they are loaded, collectors report values read at scrape time, like the
+// stats of the connection pool.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Types of metrics
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+)
+
+// DefaultBuckets are upper bounds of histogram buckets in seconds fitting the
+// durations of requests and queries
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry served by the API
+var Default = NewRegistry()
+
+type (
+	// Registry is a set of metrics with unique names
+	Registry struct {
+		mu      sync.Mutex
+		metrics map[string]metric
+	}
+
+	metric interface {
+		write(w *bufio.Writer)
+	}
+
+	// desc describes a metric
+	desc struct {
+		name   string
+		help   string
+		kind   string
+		labels []string
+	}
+
+	// series are the values of a metric keyed by label values
+	series struct {
+		desc
+		mu     sync.Mutex
+		values map[string]*value
+	}
+
+	value struct {
+		labels []string
+		value  float64
+		// histograms only
+		buckets []float64
+		counts  []uint64
+		count   uint64
+	}
+
+	// Counter is a value that only goes up, like the number of requests
+	Counter struct{ *series }
+
+	// Gauge is a value that goes up and down, like the number of sessions
+	Gauge struct{ *series }
+
+	// Histogram counts observations like durations in buckets
+	Histogram struct {
+		*series
+		buckets []float64
+	}
+
+	// collector reports values when the registry is written
+	collector struct {
+		desc
+		collect func(report func(value float64, labels ...string))
+	}
+)
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// NewCounter registers a counter in Default
+func NewCounter(name, help string, labels ...string) *Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+// NewGauge registers a gauge in Default
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return Default.NewGauge(name, help, labels...)
+}
+
+// NewHistogram registers a histogram in Default
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+// NewCollector registers a collector in Default
+func NewCollector(name, help, kind string, labels []string, collect func(report func(value float64, labels ...string))) {
+	Default.NewCollector(name, help, kind, labels, collect)
+}
+
+// NewCounter registers a counter with the names of its labels, values of
+// the labels are passed in the same order when it is changed
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newSeries(desc{name, help, TypeCounter, labels})}
+	r.register(name, c)
+	return c
+}
+
+// NewGauge registers a gauge with the names of its labels
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newSeries(desc{name, help, TypeGauge, labels})}
+	r.register(name, g)
+	return g
+}
+
+// NewHistogram registers a histogram with increasing bucket bounds and the
+// names of its labels
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("metrics: buckets of %s are not sorted", name))
+	}
+	h := &Histogram{series: newSeries(desc{name, help, TypeHistogram, labels}), buckets: buckets}
+	r.register(name, h)
+	return h
+}
+
+// NewCollector registers a counter or gauge whose values are reported by
+// collect every time the registry is written
+func (r *Registry) NewCollector(name, help, kind string, labels []string, collect func(report func(value float64, labels ...string))) {
+	r.register(name, &collector{desc{name, help, kind, labels}, collect})
+}
+
+// register panics if the name is taken, metrics are registered on startup
+// so it is a programming error
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.metrics[name]; ok {
+		panic(fmt.Sprintf("metrics: %s is already registered", name))
+	}
+	r.metrics[name] = m
+}
+
+// Write writes all metrics in the Prometheus text format sorted by name
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	metrics := make([]metric, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		metrics[i] = r.metrics[name]
+	}
+	r.mu.Unlock()
+
+	buf := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(buf)
+	}
+	return buf.Flush()
+}
+
+func newSeries(d desc) *series {
+	return &series{desc: d, values: make(map[string]*value)}
+}
+
+// get returns the value with the label values, the caller holds the lock
+func (s *series) get(labels []string) *value {
+	if len(labels) != len(s.labels) {
+		panic(fmt.Sprintf("metrics: %s has labels %v, got %d values", s.name, s.labels, len(labels)))
+	}
+	key := strings.Join(labels, "\xff")
+	v, ok := s.values[key]
+	if !ok {
+		v = &value{labels: append([]string(nil), labels...)}
+		s.values[key] = v
+	}
+	return v
+}
+
+func (s *series) add(delta float64, labels []string) {
+	s.mu.Lock()
+	s.get(labels).value += delta
+	s.mu.Unlock()
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc(labels ...string) {
+	c.add(1, labels)
+}
+
+// Add adds a non-negative delta to the counter
+func (c *Counter) Add(delta float64, labels ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("metrics: counter %s cannot decrease", c.name))
+	}
+	c.add(delta, labels)
+}
+
+// Set sets the gauge
+func (g *Gauge) Set(v float64, labels ...string) {
+	g.mu.Lock()
+	g.get(labels).value = v
+	g.mu.Unlock()
+}
+
+// Add adds a delta, possibly negative, to the gauge
+func (g *Gauge) Add(delta float64, labels ...string) {
+	g.add(delta, labels)
+}
+
+// Observe counts v in the buckets it fits
+func (h *Histogram) Observe(v float64, labels ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	val := h.get(labels)
+	if val.counts == nil {
+		val.buckets = h.buckets
+		val.counts = make([]uint64, len(h.buckets))
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			val.counts[i]++
+		}
+	}
+	val.count++
+	val.value += v
+}
+
+func (s *series) write(w *bufio.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeHeader(w, s.desc)
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := s.values[key]
+		if s.kind != TypeHistogram {
+			writeSample(w, s.name, s.labels, v.labels, v.value)
+			continue
+		}
+		names := append(append([]string(nil), s.labels...), "le")
+		for i, bound := range v.buckets {
+			writeSample(w, s.name+"_bucket", names, append(append([]string(nil), v.labels...), formatFloat(bound)), float64(v.counts[i]))
+		}
+		writeSample(w, s.name+"_bucket", names, append(append([]string(nil), v.labels...), "+Inf"), float64(v.count))
+		writeSample(w, s.name+"_sum", s.labels, v.labels, v.value)
+		writeSample(w, s.name+"_count", s.labels, v.labels, float64(v.count))
+	}
+}
+
+func (c *collector) write(w *bufio.Writer) {
+	writeHeader(w, c.desc)
+	c.collect(func(value float64, labels ...string) {
+		if len(labels) != len(c.labels) {
+			panic(fmt.Sprintf("metrics: %s has labels %v, got %d values", c.name, c.labels, len(labels)))
+		}
+		writeSample(w, c.name, c.labels, labels, value)
+	})
+}
+
+func writeHeader(w *bufio.Writer, d desc) {
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, help, d.name, d.kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func writeSample(w *bufio.Writer, name string, names, values []string, v float64) {
+	w.WriteString(name)
+	if len(names) > 0 {
+		w.WriteByte('{')
+		for i, label := range names {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, label, labelEscaper.Replace(values[i]))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+	logins := r.NewCounter("sb_logins_total", "Login attempts", "method", "result")
+	sessions := r.NewGauge("sb_sessions", "Open sessions")
+	duration := r.NewHistogram("sb_duration_seconds", "Durations\nin seconds", []float64{.1, 1}, "route")
+	r.NewCollector("sb_jobs_total", "Job runs", TypeCounter, []string{"job"}, func(report func(value float64, labels ...string)) {
+		report(3, `audit "log"`)
+	})
+
+	logins.Inc("password", "success")
+	logins.Add(2, "password", "failure")
+	sessions.Set(5)
+	sessions.Add(-1)
+	duration.Observe(.05, "/training")
+	duration.Observe(.5, "/training")
+	duration.Observe(2, "/training")
+
+	var buf bytes.Buffer
+	require.NoError(t, r.Write(&buf))
+	require.Equal(t, `# HELP sb_duration_seconds Durations\nin seconds
+# TYPE sb_duration_seconds histogram
+sb_duration_seconds_bucket{route="/training",le="0.1"} 1
+sb_duration_seconds_bucket{route="/training",le="1"} 2
+sb_duration_seconds_bucket{route="/training",le="+Inf"} 3
+sb_duration_seconds_sum{route="/training"} 2.55
+sb_duration_seconds_count{route="/training"} 3
+# HELP sb_jobs_total Job runs
+# TYPE sb_jobs_total counter
+sb_jobs_total{job="audit \"log\""} 3
+# HELP sb_logins_total Login attempts
+# TYPE sb_logins_total counter
+sb_logins_total{method="password",result="failure"} 2
+sb_logins_total{method="password",result="success"} 1
+# HELP sb_sessions Open sessions
+# TYPE sb_sessions gauge
+sb_sessions 4
+`, buf.String())
+}
+
+func TestMisuse(t *testing.T) {
+	r := NewRegistry()
+	counter := r.NewCounter("sb_total", "Total", "kind")
+	require.Panics(t, func() { r.NewGauge("sb_total", "Total") }, "names are unique")
+	require.Panics(t, func() { counter.Inc() }, "label values are required")
+	require.Panics(t, func() { counter.Add(-1, "a") }, "counters only go up")
+	require.Panics(t, func() { r.NewHistogram("sb_seconds", "Seconds", []float64{1, .1}) })
+}
+
+func TestDatabasePlugin(t *testing.T) {
+	sqlDB, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{})
+	require.NoError(t, err)
+	r := NewRegistry()
+	require.NoError(t, db.Use(DatabasePlugin(r)))
+
+	mock.ExpectQuery(`SELECT "id_user" FROM "users"`).WillReturnRows(sqlmock.NewRows([]string{"id_user"}).AddRow(1))
+	var ids []int64
+	require.NoError(t, db.WithContext(context.Background()).Table("users").Pluck("id_user", &ids).Error)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	var buf bytes.Buffer
+	require.NoError(t, r.Write(&buf))
+	require.Contains(t, buf.String(), `sb_db_query_duration_seconds_count{operation="query",table="users"} 1`)
+	require.Contains(t, buf.String(), `sb_db_connections{state="idle"} 1`)
+	require.Contains(t, buf.String(), "sb_db_wait_count_total 0")
+}
@@ -0,0 +1,289 @@
+package migration
+
+import (
+	"SB/service/repository/logging"
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+//go:embed sql/*.sql
+var sqlFiles embed.FS
+
+// lockKey identifies the advisory lock held while migrations are applied,
+// so that several replicas starting at once do not migrate concurrently
+const lockKey int64 = 7235601
+
+var fileNamePattern = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type (
+	Migration struct {
+		Version int
+		Name    string
+		Up      string
+		Down    string
+	}
+
+	MigrationStatus struct {
+		Version   int
+		Name      string
+		Applied   bool
+		AppliedAt time.Time
+	}
+
+	Migrator interface {
+		// Up applies all pending migrations
+		Up() error
+		// Down reverts the last applied migration
+		Down() error
+		// To migrates the schema up or down to the given version
+		To(version int) error
+		// Status lists the migrations and whether they are applied, it only
+		// reads and neither waits for the lock nor creates the version table
+		Status() ([]MigrationStatus, error)
+		Latest() int
+	}
+
+	migrator struct {
+		db         *gorm.DB
+		migrations []Migration
+		logger     *logging.Logger
+	}
+
+	schemaMigration struct {
+		Version   int
+		Name      string
+		AppliedAt time.Time
+	}
+)
+
+func NewMigrator(db *gorm.DB, logger *logging.Logger) (Migrator, error) {
+	migrations, err := loadMigrations(sqlFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &migrator{
+		db:         db,
+		migrations: migrations,
+		logger:     logger,
+	}, nil
+}
+
+func loadMigrations(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.Glob(fsys, "sql/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, f := range files {
+		parts := fileNamePattern.FindStringSubmatch(f[len("sql/"):])
+		if parts == nil {
+			return nil, fmt.Errorf("invalid migration file name %s", f)
+		}
+		version, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %s: %s", f, err)
+		}
+		content, err := fs.ReadFile(fsys, f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %s", f, err)
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[2]}
+			byVersion[version] = m
+		} else if m.Name != parts[2] {
+			return nil, fmt.Errorf("migration %d has different names: %s and %s", version, m.Name, parts[2])
+		}
+		if parts[3] == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d must have both up and down scripts", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+func (m *migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+func (m *migrator) Up() error {
+	return m.To(m.Latest())
+}
+
+func (m *migrator) Down() error {
+	return m.withLock(func(conn *gorm.DB) error {
+		applied, err := m.applied(conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			if _, ok := applied[m.migrations[i].Version]; ok {
+				return m.revert(conn, m.migrations[i])
+			}
+		}
+		m.logger.Info("no migrations to revert")
+		return nil
+	})
+}
+
+func (m *migrator) To(version int) error {
+	if version < 0 || version > m.Latest() {
+		return fmt.Errorf("unknown schema version %d, latest is %d", version, m.Latest())
+	}
+	return m.withLock(func(conn *gorm.DB) error {
+		applied, err := m.applied(conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			mg := m.migrations[i]
+			if _, ok := applied[mg.Version]; ok && mg.Version > version {
+				if err := m.revert(conn, mg); err != nil {
+					return err
+				}
+			}
+		}
+		for _, mg := range m.migrations {
+			if _, ok := applied[mg.Version]; !ok && mg.Version <= version {
+				if err := m.apply(conn, mg); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (m *migrator) Status() ([]MigrationStatus, error) {
+	conn := m.db.WithContext(context.Background())
+	// a database never migrated has no version table
+	var exists bool
+	if err := conn.Raw(`SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists).Error; err != nil {
+		return nil, fmt.Errorf("failed to find schema_migrations table: %s", err)
+	}
+	applied := map[int]schemaMigration{}
+	if exists {
+		var err error
+		if applied, err = m.applied(conn); err != nil {
+			return nil, err
+		}
+	}
+	result := make([]MigrationStatus, 0, len(m.migrations))
+	for _, mg := range m.migrations {
+		s := MigrationStatus{
+			Version: mg.Version,
+			Name:    mg.Name,
+		}
+		if a, ok := applied[mg.Version]; ok {
+			s.Applied = true
+			s.AppliedAt = a.AppliedAt
+		}
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+// withLock runs fc on a single connection holding the migrations advisory
+// lock, session level locks are bound to the connection they were taken on
+func (m *migrator) withLock(fc func(conn *gorm.DB) error) error {
+	sqlDB, err := m.db.DB()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	c, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get database connection: %s", err)
+	}
+	defer c.Close()
+
+	conn := m.db.WithContext(ctx)
+	conn.Statement.ConnPool = c
+
+	if err := conn.Exec(`SELECT pg_advisory_lock(?)`, lockKey).Error; err != nil {
+		return fmt.Errorf("failed to acquire migrations lock: %s", err)
+	}
+	defer func() {
+		if err := conn.Exec(`SELECT pg_advisory_unlock(?)`, lockKey).Error; err != nil {
+			m.logger.Error("failed to release migrations lock", logging.Err(err))
+		}
+	}()
+
+	err = conn.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+version BIGINT PRIMARY KEY,
+name TEXT NOT NULL,
+applied_at TIMESTAMPTZ NOT NULL DEFAULT now())`).Error
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %s", err)
+	}
+	return fc(conn)
+}
+
+func (m *migrator) applied(conn *gorm.DB) (map[int]schemaMigration, error) {
+	var rows []schemaMigration
+	res := conn.Table(`schema_migrations`).Order(`version`).Find(&rows)
+	if res.Error != nil {
+		return nil, fmt.Errorf("failed to get applied migrations: %s", res.Error)
+	}
+	result := make(map[int]schemaMigration, len(rows))
+	for _, r := range rows {
+		result[r.Version] = r
+	}
+	return result, nil
+}
+
+func (m *migrator) apply(conn *gorm.DB, mg Migration) error {
+	m.logger.Info("applying migration", logging.Int("version", int64(mg.Version)), logging.String("name", mg.Name))
+	err := conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(mg.Up).Error; err != nil {
+			return err
+		}
+		return tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, mg.Version, mg.Name).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to apply migration %d_%s: %s", mg.Version, mg.Name, err)
+	}
+	return nil
+}
+
+func (m *migrator) revert(conn *gorm.DB, mg Migration) error {
+	m.logger.Info("reverting migration", logging.Int("version", int64(mg.Version)), logging.String("name", mg.Name))
+	err := conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(mg.Down).Error; err != nil {
+			return err
+		}
+		res := tx.Exec(`DELETE FROM schema_migrations WHERE version = ?`, mg.Version)
+		if res.Error == nil && res.RowsAffected == 0 {
+			return errors.New("migration is not recorded as applied")
+		}
+		return res.Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to revert migration %d_%s: %s", mg.Version, mg.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package migration
+
+import (
+	"SB/service/repository/logging"
+	"regexp"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+var mockMigrations = []Migration{
+	{Version: 1, Name: "create_foo", Up: `CREATE TABLE foo (id BIGINT)`, Down: `DROP TABLE foo`},
+	{Version: 2, Name: "create_bar", Up: `CREATE TABLE bar (id BIGINT)`, Down: `DROP TABLE bar`},
+}
+
+func newMockMigrator(t *testing.T) (*migrator, sqlmock.Sqlmock) {
+	psqlDb, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	db, err := gorm.Open(postgres.New(postgres.Config{
+		Conn: psqlDb,
+	}), &gorm.Config{})
+	require.NoError(t, err)
+	return &migrator{db: db, migrations: mockMigrations, logger: logging.Discard()}, mock
+}
+
+func expectLock(mock sqlmock.Sqlmock, applied ...int) {
+	mock.ExpectExec(regexp.QuoteMeta(`SELECT pg_advisory_lock($1)`)).WithArgs(lockKey).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE IF NOT EXISTS schema_migrations`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	rows := sqlmock.NewRows([]string{"version", "name", "applied_at"})
+	for _, v := range applied {
+		rows.AddRow(v, mockMigrations[v-1].Name, time.Unix(1637603397, 0))
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "schema_migrations" ORDER BY version`)).WillReturnRows(rows)
+}
+
+func expectUnlock(mock sqlmock.Sqlmock) {
+	mock.ExpectExec(regexp.QuoteMeta(`SELECT pg_advisory_unlock($1)`)).WithArgs(lockKey).WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := loadMigrations(sqlFiles)
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+	for i, m := range migrations {
+		require.Equal(t, i+1, m.Version, "migration versions must be sequential")
+		require.NotEmpty(t, m.Up)
+		require.NotEmpty(t, m.Down)
+	}
+}
+
+func TestLoadMigrationsWithoutDown(t *testing.T) {
+	fsys := fstest.MapFS{
+		"sql/0001_init.up.sql": {Data: []byte(`CREATE TABLE foo (id BIGINT)`)},
+	}
+	_, err := loadMigrations(fsys)
+	require.Error(t, err)
+}
+
+func TestUp(t *testing.T) {
+	m, mock := newMockMigrator(t)
+	expectLock(mock, 1)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(mockMigrations[1].Up)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`)).WithArgs(2, "create_bar").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectUnlock(mock)
+
+	require.NoError(t, m.Up())
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDown(t *testing.T) {
+	m, mock := newMockMigrator(t)
+	expectLock(mock, 1, 2)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(mockMigrations[1].Down)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM schema_migrations WHERE version = $1`)).WithArgs(2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectUnlock(mock)
+
+	require.NoError(t, m.Down())
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestStatus(t *testing.T) {
+	m, mock := newMockMigrator(t)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT to_regclass('schema_migrations') IS NOT NULL`)).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "schema_migrations" ORDER BY version`)).
+		WillReturnRows(sqlmock.NewRows([]string{"version", "name", "applied_at"}).AddRow(1, "create_foo", time.Unix(1637603397, 0)))
+
+	status, err := m.Status()
+	require.NoError(t, err)
+	require.Len(t, status, 2)
+	require.True(t, status[0].Applied)
+	require.Equal(t, time.Unix(1637603397, 0), status[0].AppliedAt)
+	require.False(t, status[1].Applied)
+	require.NoError(t, mock.ExpectationsWereMet(), "status neither takes the lock nor creates the version table")
+}
+
+func TestStatusOfNewDatabase(t *testing.T) {
+	m, mock := newMockMigrator(t)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT to_regclass('schema_migrations') IS NOT NULL`)).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+	status, err := m.Status()
+	require.NoError(t, err)
+	require.Len(t, status, 2)
+	require.False(t, status[0].Applied)
+	require.False(t, status[1].Applied)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestToUnknownVersion(t *testing.T) {
+	m, _ := newMockMigrator(t)
+	require.Error(t, m.To(3))
+}
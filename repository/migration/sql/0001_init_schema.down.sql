@@ -0,0 +1,11 @@
+DROP TABLE IF EXISTS relationships;
+DROP TABLE IF EXISTS messages;
+DROP TABLE IF EXISTS member_training;
+DROP TABLE IF EXISTS group_training;
+DROP TABLE IF EXISTS person_sports;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS user_auth_info;
+DROP TABLE IF EXISTS user_info;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS sports;
+DROP TABLE IF EXISTS levels;
@@ -0,0 +1,115 @@
+CREATE EXTENSION IF NOT EXISTS pgcrypto;
+
+CREATE TABLE levels
+(
+    id_level    BIGSERIAL PRIMARY KEY,
+    level       INTEGER NOT NULL UNIQUE,
+    description TEXT    NOT NULL DEFAULT ''
+);
+
+CREATE TABLE sports
+(
+    id_sport   BIGSERIAL PRIMARY KEY,
+    sport_type TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE users
+(
+    id_user  BIGSERIAL PRIMARY KEY,
+    username TEXT NOT NULL UNIQUE,
+    role     TEXT NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'admin'))
+);
+
+CREATE TABLE user_info
+(
+    id_user       BIGINT PRIMARY KEY REFERENCES users (id_user) ON DELETE CASCADE,
+    name          TEXT,
+    second_name   TEXT,
+    sex           TEXT CHECK (sex IN ('male', 'female')),
+    height        BIGINT CHECK (height > 0),
+    weight        BIGINT CHECK (weight > 0),
+    email         TEXT,
+    id_level      BIGINT REFERENCES levels (id_level) ON DELETE SET NULL,
+    location      TEXT,
+    date_of_birth TIMESTAMPTZ,
+    about         TEXT
+);
+
+CREATE TABLE user_auth_info
+(
+    id_user  BIGINT PRIMARY KEY REFERENCES users (id_user) ON DELETE CASCADE,
+    login    TEXT NOT NULL UNIQUE,
+    password TEXT NOT NULL
+);
+
+CREATE TABLE sessions
+(
+    token      TEXT PRIMARY KEY,
+    id_user    BIGINT      NOT NULL REFERENCES users (id_user) ON DELETE CASCADE,
+    login_time TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires    TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX sessions_id_user_idx ON sessions (id_user);
+CREATE INDEX sessions_expires_idx ON sessions (expires);
+
+CREATE TABLE person_sports
+(
+    id_user  BIGINT NOT NULL REFERENCES users (id_user) ON DELETE CASCADE,
+    id_sport BIGINT NOT NULL REFERENCES sports (id_sport) ON DELETE CASCADE,
+    PRIMARY KEY (id_user, id_sport)
+);
+
+CREATE INDEX person_sports_id_sport_idx ON person_sports (id_sport);
+
+CREATE TABLE group_training
+(
+    id_training BIGSERIAL PRIMARY KEY,
+    meet_date   TIMESTAMPTZ NOT NULL,
+    duration    BIGINT      NOT NULL DEFAULT 0 CHECK (duration >= 0),
+    location    TEXT        NOT NULL DEFAULT '',
+    id_sport    BIGINT      NOT NULL REFERENCES sports (id_sport),
+    id_level    BIGINT REFERENCES levels (id_level) ON DELETE SET NULL,
+    comment     TEXT        NOT NULL DEFAULT '',
+    fee         BIGINT      NOT NULL DEFAULT 0 CHECK (fee >= 0),
+    kind        TEXT        NOT NULL DEFAULT 'group' CHECK (kind IN ('group', 'personal'))
+);
+
+CREATE INDEX group_training_meet_date_idx ON group_training (meet_date);
+CREATE INDEX group_training_id_sport_idx ON group_training (id_sport);
+
+CREATE TABLE member_training
+(
+    id_user        BIGINT  NOT NULL REFERENCES users (id_user) ON DELETE CASCADE,
+    id_training    BIGINT  NOT NULL REFERENCES group_training (id_training) ON DELETE CASCADE,
+    training_owner BOOLEAN NOT NULL DEFAULT false,
+    PRIMARY KEY (id_user, id_training)
+);
+
+CREATE INDEX member_training_id_training_idx ON member_training (id_training);
+CREATE UNIQUE INDEX member_training_owner_idx ON member_training (id_training) WHERE training_owner;
+
+CREATE TABLE messages
+(
+    id_mes     BIGSERIAL PRIMARY KEY,
+    id_to      BIGINT      NOT NULL REFERENCES users (id_user) ON DELETE CASCADE,
+    id_from    BIGINT      NOT NULL REFERENCES users (id_user) ON DELETE CASCADE,
+    content    TEXT        NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX messages_dialog_idx ON messages (id_from, id_to, created_at DESC);
+
+CREATE TABLE relationships
+(
+    id_to      BIGINT      NOT NULL REFERENCES users (id_user) ON DELETE CASCADE,
+    id_from    BIGINT      NOT NULL REFERENCES users (id_user) ON DELETE CASCADE,
+    seen       BOOLEAN     NOT NULL DEFAULT false,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    type       TEXT        NOT NULL DEFAULT 'personal' CHECK (type IN ('personal', 'group')),
+    status     TEXT        NOT NULL DEFAULT 'request' CHECK (status IN ('request', 'accepted', 'declined')),
+    PRIMARY KEY (id_from, id_to),
+    CHECK (id_from <> id_to)
+);
+
+CREATE INDEX relationships_id_to_idx ON relationships (id_to);
@@ -0,0 +1,9 @@
+DELETE FROM sports
+WHERE sport_type IN ('футбол', 'волейбол', 'баскетбол', 'теннис', 'бег', 'плавание')
+  AND id_sport NOT IN (SELECT id_sport FROM person_sports)
+  AND id_sport NOT IN (SELECT id_sport FROM group_training);
+
+DELETE FROM levels
+WHERE id_level IN (1, 2, 3)
+  AND id_level NOT IN (SELECT id_level FROM user_info WHERE id_level IS NOT NULL)
+  AND id_level NOT IN (SELECT id_level FROM group_training WHERE id_level IS NOT NULL);
@@ -0,0 +1,16 @@
+INSERT INTO levels (id_level, level, description)
+VALUES (1, 1, 'junior'),
+       (2, 2, 'middle'),
+       (3, 3, 'senior')
+ON CONFLICT DO NOTHING;
+
+SELECT setval(pg_get_serial_sequence('levels', 'id_level'), (SELECT max(id_level) FROM levels));
+
+INSERT INTO sports (sport_type)
+VALUES ('футбол'),
+       ('волейбол'),
+       ('баскетбол'),
+       ('теннис'),
+       ('бег'),
+       ('плавание')
+ON CONFLICT DO NOTHING;
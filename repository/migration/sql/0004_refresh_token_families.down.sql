@@ -0,0 +1,12 @@
+DROP TABLE IF EXISTS security_events;
+
+-- rotated tokens are useless without families
+DELETE
+FROM sessions
+WHERE rotated_at IS NOT NULL;
+
+DROP INDEX IF EXISTS sessions_family_idx;
+
+ALTER TABLE sessions
+    DROP COLUMN IF EXISTS rotated_at,
+    DROP COLUMN IF EXISTS family;
@@ -0,0 +1,23 @@
+ALTER TABLE sessions
+    ADD COLUMN family     TEXT,
+    ADD COLUMN rotated_at TIMESTAMPTZ;
+
+-- every session issued before families existed starts its own family
+UPDATE sessions
+SET family = token;
+
+ALTER TABLE sessions
+    ALTER COLUMN family SET NOT NULL;
+
+CREATE INDEX sessions_family_idx ON sessions (family);
+
+CREATE TABLE security_events
+(
+    id_event   BIGSERIAL PRIMARY KEY,
+    id_user    BIGINT REFERENCES users (id_user) ON DELETE CASCADE,
+    event      TEXT        NOT NULL,
+    details    JSONB       NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX security_events_id_user_idx ON security_events (id_user, created_at);
@@ -0,0 +1,5 @@
+ALTER TABLE sessions
+    ADD COLUMN device     TEXT        NOT NULL DEFAULT '',
+    ADD COLUMN user_agent TEXT        NOT NULL DEFAULT '',
+    ADD COLUMN ip         TEXT        NOT NULL DEFAULT '',
+    ADD COLUMN last_used  TIMESTAMPTZ NOT NULL DEFAULT now();
@@ -0,0 +1,16 @@
+ALTER TABLE users
+    ADD COLUMN email_verified_at TIMESTAMPTZ;
+
+-- single-use tokens sent by e-mail, only their SHA-256 is stored
+CREATE TABLE account_tokens
+(
+    token_hash TEXT PRIMARY KEY,
+    id_user    BIGINT      NOT NULL REFERENCES users (id_user) ON DELETE CASCADE,
+    purpose    TEXT        NOT NULL CHECK (purpose IN ('password_reset', 'email_verification')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires    TIMESTAMPTZ NOT NULL,
+    used_at    TIMESTAMPTZ
+);
+
+CREATE INDEX account_tokens_id_user_idx ON account_tokens (id_user, purpose);
+CREATE INDEX account_tokens_expires_idx ON account_tokens (expires);
@@ -0,0 +1,24 @@
+-- TOTP secrets, enabled_at is NULL until the user confirms the setup with
+-- a code and last_step keeps a code from being used twice
+CREATE TABLE user_totp
+(
+    id_user    BIGINT PRIMARY KEY REFERENCES users (id_user) ON DELETE CASCADE,
+    secret     TEXT        NOT NULL,
+    last_step  BIGINT      NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    enabled_at TIMESTAMPTZ
+);
+
+-- single-use codes to log in without the authenticator, only their SHA-256
+-- is stored
+CREATE TABLE recovery_codes
+(
+    id_user   BIGINT NOT NULL REFERENCES users (id_user) ON DELETE CASCADE,
+    code_hash TEXT   NOT NULL,
+    used_at   TIMESTAMPTZ,
+    PRIMARY KEY (id_user, code_hash)
+);
+
+-- sessions started with a second factor
+ALTER TABLE sessions
+    ADD COLUMN two_factor BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,10 @@
+-- failed login attempts per account and per IP, used when nodes share the
+-- lockout state through the database
+CREATE TABLE login_attempts
+(
+    key          TEXT PRIMARY KEY,
+    failures     INT         NOT NULL,
+    last_failure TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX login_attempts_last_failure_idx ON login_attempts (last_failure);
@@ -0,0 +1,10 @@
+-- keys signing access tokens, a key with no expiration signs new tokens and
+-- rotated keys only verify tokens until they expire
+CREATE TABLE signing_keys
+(
+    kid         TEXT PRIMARY KEY,
+    algorithm   TEXT        NOT NULL,
+    private_key TEXT        NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at  TIMESTAMPTZ
+);
@@ -0,0 +1,12 @@
+-- accounts of external OpenID Connect providers linked to users
+CREATE TABLE user_identities
+(
+    provider   TEXT        NOT NULL,
+    subject    TEXT        NOT NULL,
+    id_user    BIGINT      NOT NULL REFERENCES users (id_user) ON DELETE CASCADE,
+    email      TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (provider, subject)
+);
+
+CREATE INDEX user_identities_id_user_idx ON user_identities (id_user);
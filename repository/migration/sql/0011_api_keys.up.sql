@@ -0,0 +1,18 @@
+-- personal API keys of integrations, only a hash of the key is stored and
+-- its prefix identifies the key in lists and logs
+CREATE TABLE api_keys
+(
+    id_key       BIGSERIAL PRIMARY KEY,
+    id_user      BIGINT      NOT NULL REFERENCES users (id_user) ON DELETE CASCADE,
+    name         TEXT        NOT NULL,
+    prefix       TEXT        NOT NULL UNIQUE,
+    hash         TEXT        NOT NULL,
+    -- space separated scopes like trainings:read
+    scopes       TEXT        NOT NULL,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_used_at TIMESTAMPTZ,
+    expires_at   TIMESTAMPTZ,
+    revoked_at   TIMESTAMPTZ
+);
+
+CREATE INDEX api_keys_id_user_idx ON api_keys (id_user);
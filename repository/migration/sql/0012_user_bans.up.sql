@@ -0,0 +1,5 @@
+-- banned users cannot log in until banned_until, bans without it are permanent
+ALTER TABLE users
+    ADD COLUMN banned_at    TIMESTAMPTZ,
+    ADD COLUMN banned_until TIMESTAMPTZ,
+    ADD COLUMN ban_reason   TEXT;
@@ -0,0 +1,36 @@
+-- append-only log of security- and data-relevant changes. Entries are never
+-- updated, only the retention sweep deletes them. Users are not referenced by
+-- foreign keys, so entries about deleted users are kept.
+CREATE TABLE audit_log
+(
+    id_entry        BIGSERIAL PRIMARY KEY,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    -- NULL for changes made by the service itself
+    id_actor        BIGINT,
+    impersonated_by BIGINT,
+    action          TEXT        NOT NULL,
+    target_type     TEXT        NOT NULL,
+    target_id       BIGINT      NOT NULL,
+    -- fields of the target that have changed
+    before          JSONB,
+    after           JSONB,
+    ip              TEXT        NOT NULL DEFAULT '',
+    request_id      TEXT        NOT NULL DEFAULT ''
+);
+
+CREATE INDEX audit_log_created_at_idx ON audit_log (created_at);
+CREATE INDEX audit_log_target_idx ON audit_log (target_type, target_id);
+CREATE INDEX audit_log_id_actor_idx ON audit_log (id_actor);
+
+CREATE FUNCTION audit_log_immutable() RETURNS trigger AS
+$$
+BEGIN
+    RAISE EXCEPTION 'audit log entries cannot be changed';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_immutable
+    BEFORE UPDATE
+    ON audit_log
+    FOR EACH ROW
+EXECUTE FUNCTION audit_log_immutable();
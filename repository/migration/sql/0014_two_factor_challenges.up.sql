@@ -0,0 +1,11 @@
+-- challenges issued after the password check, a challenge is deleted when
+-- a code is accepted and refused after too many attempts
+CREATE TABLE two_factor_challenges
+(
+    id       TEXT PRIMARY KEY,
+    id_user  BIGINT      NOT NULL REFERENCES users (id_user) ON DELETE CASCADE,
+    attempts INT         NOT NULL DEFAULT 0,
+    expires  TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX two_factor_challenges_expires_idx ON two_factor_challenges (expires);
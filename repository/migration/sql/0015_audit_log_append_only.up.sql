@@ -0,0 +1,26 @@
+-- audit log entries cannot be deleted but by the retention sweep, it sets the
+-- retention in sb.audit_retention for its transaction and deletes only the
+-- entries older than that
+CREATE FUNCTION audit_log_retention() RETURNS trigger AS
+$$
+DECLARE
+    retention INTERVAL := NULLIF(current_setting('sb.audit_retention', true), '')::INTERVAL;
+BEGIN
+    IF retention IS NULL OR OLD.created_at >= now() - retention THEN
+        RAISE EXCEPTION 'audit log entries are deleted only after the retention period';
+    END IF;
+    RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_retention
+    BEFORE DELETE
+    ON audit_log
+    FOR EACH ROW
+EXECUTE FUNCTION audit_log_retention();
+
+CREATE TRIGGER audit_log_no_truncate
+    BEFORE TRUNCATE
+    ON audit_log
+    FOR EACH STATEMENT
+EXECUTE FUNCTION audit_log_immutable();
@@ -0,0 +1,4 @@
+-- keys act with the second factor of the session they were created in,
+-- keys created before it was recorded need a new key to pass the
+-- two-factor requirement of a role
+ALTER TABLE api_keys ADD COLUMN two_factor BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,258 @@
+package oidc
+
+import (
+	"SB/service/config"
+	"SB/service/repository/keys"
+	"SB/service/repository/logging"
+	"SB/service/repository/persistence"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// stateAudience marks tokens carrying the state of a login at a provider,
+// they are not accepted as access tokens
+const stateAudience = "oidc"
+
+// usernameAttempts is the number of random suffixes tried when the username
+// of a new user is taken
+const usernameAttempts = 5
+
+var (
+	ErrUnknownProvider = errors.New("unknown identity provider")
+	// ErrInvalidState is returned for forged or expired states and for
+	// states of another provider or user
+	ErrInvalidState = errors.New("invalid or expired login state")
+)
+
+type (
+	// Manager logs users in with OpenID Connect providers using the
+	// authorization code flow with PKCE. The state, nonce and code verifier
+	// are kept by the client in a signed token until it returns with the
+	// code, so any node can finish the login.
+	Manager interface {
+		// Providers returns names of the configured providers
+		Providers() []string
+		// Authorize starts a login, or linking of an identity to the user if
+		// idUser is not zero
+		Authorize(ctx context.Context, provider string, idUser int64) (Authorization, error)
+		// Login returns the user of the identity and creates one with
+		// user_info on the first login
+		Login(ctx context.Context, provider string, callback Callback) (persistence.User, error)
+		// Link adds the identity to the user who started the authorization
+		Link(ctx context.Context, provider string, idUser int64, callback Callback) error
+	}
+
+	Authorization struct {
+		// URL of the provider page to send the user to
+		URL string
+		// State is returned by the client with the code
+		State   string
+		Expires time.Time
+	}
+
+	// Callback is what the client sends back after the provider redirected
+	// the user to the application
+	Callback struct {
+		Code string
+		// State is the state parameter returned by the provider
+		State string
+		// StateToken is the state of Authorization kept by the client
+		StateToken string
+	}
+
+	manager struct {
+		persistent persistence.Persistent
+		keys       keys.Ring
+		config     config.OIDC
+		providers  map[string]*provider
+		logger     *logging.Logger
+	}
+
+	stateClaims struct {
+		jwt.StandardClaims
+		State        string `json:"state"`
+		Nonce        string `json:"nonce"`
+		CodeVerifier string `json:"cv"`
+		IdUser       int64  `json:"uid,omitempty"`
+	}
+)
+
+// NewManager creates clients of the configured providers, the state is
+// signed with keys of the ring
+func NewManager(persistent persistence.Persistent, ring keys.Ring, cfg config.OIDC, logger *logging.Logger) Manager {
+	client := &http.Client{Timeout: 10 * time.Second}
+	providers := make(map[string]*provider, len(cfg.Providers))
+	for _, p := range cfg.Providers {
+		providers[p.Name] = newProvider(p, client)
+	}
+	return &manager{
+		persistent: persistent,
+		keys:       ring,
+		config:     cfg,
+		providers:  providers,
+		logger:     logger,
+	}
+}
+
+func (mgr *manager) Providers() []string {
+	names := make([]string, 0, len(mgr.providers))
+	for name := range mgr.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (mgr *manager) Authorize(ctx context.Context, name string, idUser int64) (Authorization, error) {
+	p, ok := mgr.providers[name]
+	if !ok {
+		return Authorization{}, ErrUnknownProvider
+	}
+	var claims stateClaims
+	for _, v := range []*string{&claims.State, &claims.Nonce, &claims.CodeVerifier} {
+		random, err := randomString()
+		if err != nil {
+			return Authorization{}, err
+		}
+		*v = random
+	}
+	authURL, err := p.authCodeURL(ctx, claims.State, claims.Nonce, codeChallenge(claims.CodeVerifier))
+	if err != nil {
+		return Authorization{}, err
+	}
+	expires := time.Now().UTC().Add(mgr.config.StateExpiration)
+	claims.StandardClaims = jwt.StandardClaims{
+		Audience:  stateAudience,
+		Subject:   name,
+		ExpiresAt: expires.Unix(),
+	}
+	claims.IdUser = idUser
+	state, err := keys.Sign(mgr.keys, &claims)
+	if err != nil {
+		return Authorization{}, err
+	}
+	return Authorization{URL: authURL, State: state, Expires: expires}, nil
+}
+
+func (mgr *manager) Login(ctx context.Context, name string, callback Callback) (persistence.User, error) {
+	identity, idUser, err := mgr.identity(ctx, name, callback)
+	if err != nil {
+		return nil, err
+	}
+	if idUser != 0 {
+		return nil, ErrInvalidState
+	}
+	user, err := mgr.persistent.GetIdentityUser(ctx, identity.Provider, identity.Subject)
+	if !errors.Is(err, persistence.ErrUserNotFound) {
+		return user, err
+	}
+
+	username := baseUsername(identity)
+	for i := 0; i < usernameAttempts; i++ {
+		user, err = mgr.persistent.AddExternalUser(ctx, username, identity)
+		if !errors.Is(err, persistence.ErrUsernameTaken) {
+			break
+		}
+		suffix, err := randomString()
+		if err != nil {
+			return nil, err
+		}
+		username = baseUsername(identity) + "-" + strings.ToLower(suffix[:5])
+	}
+	if err != nil {
+		return nil, err
+	}
+	mgr.logger.For(ctx).Info("user signed up with an identity", logging.Int("id_user", user.GetId()), logging.String("provider", name))
+	return user, nil
+}
+
+func (mgr *manager) Link(ctx context.Context, name string, idUser int64, callback Callback) error {
+	identity, stateUser, err := mgr.identity(ctx, name, callback)
+	if err != nil {
+		return err
+	}
+	if stateUser == 0 || stateUser != idUser {
+		return ErrInvalidState
+	}
+	if err := mgr.persistent.LinkIdentity(ctx, idUser, identity); err != nil {
+		return err
+	}
+	mgr.logger.For(ctx).Info("user linked an identity", logging.Int("id_user", idUser), logging.String("provider", name))
+	return nil
+}
+
+// identity checks the state, redeems the code and verifies the ID token, it
+// returns the user who started linking or zero for a login
+func (mgr *manager) identity(ctx context.Context, name string, callback Callback) (persistence.Identity, int64, error) {
+	p, ok := mgr.providers[name]
+	if !ok {
+		return persistence.Identity{}, 0, ErrUnknownProvider
+	}
+	claims := &stateClaims{}
+	_, err := jwt.ParseWithClaims(callback.StateToken, claims, keys.KeyFunc(ctx, mgr.keys))
+	if err != nil || !claims.VerifyAudience(stateAudience, true) || claims.Subject != name || claims.State != callback.State {
+		mgr.logger.For(ctx).Warn("invalid OpenID Connect state", logging.String("provider", name), logging.Err(err))
+		return persistence.Identity{}, 0, ErrInvalidState
+	}
+	idToken, err := p.exchange(ctx, callback.Code, claims.CodeVerifier)
+	if err != nil {
+		return persistence.Identity{}, 0, err
+	}
+	idClaims, err := p.verify(ctx, idToken, claims.Nonce)
+	if err != nil {
+		return persistence.Identity{}, 0, err
+	}
+	return persistence.Identity{
+		Provider:      name,
+		Subject:       idClaims.Subject,
+		Email:         idClaims.Email,
+		EmailVerified: idClaims.EmailVerified && idClaims.Email != "",
+		Username:      idClaims.PreferredUsername,
+	}, claims.IdUser, nil
+}
+
+// baseUsername takes the preferred username or the local part of the e-mail
+// and keeps characters safe in URLs and logs
+func baseUsername(identity persistence.Identity) string {
+	candidate := identity.Username
+	if candidate == "" {
+		candidate = strings.SplitN(identity.Email, "@", 2)[0]
+	}
+	var b strings.Builder
+	for _, r := range strings.ToLower(candidate) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-' {
+			b.WriteRune(r)
+		}
+		if b.Len() == 32 {
+			break
+		}
+	}
+	if b.Len() == 0 {
+		return identity.Provider + "-user"
+	}
+	return b.String()
+}
+
+// codeChallenge is the S256 PKCE challenge of the verifier (RFC 7636)
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// randomString returns 256 random bits, long enough for a PKCE verifier
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,273 @@
+package oidc
+
+import (
+	"SB/service/config"
+	"SB/service/repository/keys"
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// minKeysRefresh limits fetches of provider keys caused by unknown key ids
+const minKeysRefresh = time.Minute
+
+// signingAlgorithms are accepted in ID tokens, symmetric and none are not
+var signingAlgorithms = []string{"RS256", "ES256", keys.AlgorithmEdDSA}
+
+type (
+	// provider talks to one OpenID Connect provider, its endpoints are
+	// discovered on first use so a provider being down does not stop the
+	// service
+	provider struct {
+		config config.OIDCProvider
+		client *http.Client
+
+		mu          sync.Mutex
+		discovery   *discovery
+		keys        map[string]crypto.PublicKey
+		keysFetched time.Time
+	}
+
+	discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+
+	tokenResponse struct {
+		IdToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+
+	idTokenClaims struct {
+		Issuer            string   `json:"iss"`
+		Subject           string   `json:"sub"`
+		Audience          audience `json:"aud"`
+		AuthorizedParty   string   `json:"azp"`
+		ExpiresAt         int64    `json:"exp"`
+		Nonce             string   `json:"nonce"`
+		Email             string   `json:"email"`
+		EmailVerified     bool     `json:"email_verified"`
+		PreferredUsername string   `json:"preferred_username"`
+	}
+
+	// audience is a single string or an array in ID tokens
+	audience []string
+)
+
+func newProvider(cfg config.OIDCProvider, client *http.Client) *provider {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	return &provider{config: cfg, client: client}
+}
+
+// authCodeURL returns the page the user logs in at, the code challenge is
+// the S256 hash of the verifier sent with the code later
+func (p *provider) authCodeURL(ctx context.Context, state, nonce, codeChallenge string) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.config.ClientID)
+	q.Set("redirect_uri", p.config.RedirectURL)
+	q.Set("scope", strings.Join(p.config.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", codeChallenge)
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// exchange redeems the code for an ID token
+func (p *provider) exchange(ctx context.Context, code, codeVerifier string) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"code_verifier": {codeVerifier},
+	}
+	if p.config.ClientSecret != "" {
+		form.Set("client_secret", p.config.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var tokens tokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return "", fmt.Errorf("invalid token response of %s: %s", p.config.Name, err)
+	}
+	if tokens.Error != "" {
+		return "", fmt.Errorf("%s rejected the code: %s %s", p.config.Name, tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.IdToken == "" {
+		return "", fmt.Errorf("%s returned no ID token", p.config.Name)
+	}
+	return tokens.IdToken, nil
+}
+
+// verify checks signature, issuer, audience, expiration and nonce of the ID
+// token (OpenID Connect Core 3.1.3.7)
+func (p *provider) verify(ctx context.Context, idToken, nonce string) (*idTokenClaims, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	claims := &idTokenClaims{}
+	parser := jwt.Parser{ValidMethods: signingAlgorithms}
+	keyFunc := func(token *jwt.Token) (interface{}, error) {
+		return p.key(ctx, token)
+	}
+	if _, err := parser.ParseWithClaims(idToken, claims, keyFunc); err != nil {
+		return nil, err
+	}
+	if claims.Issuer != d.Issuer {
+		return nil, fmt.Errorf("ID token issued by %q", claims.Issuer)
+	}
+	if !claims.Audience.contains(p.config.ClientID) {
+		return nil, errors.New("ID token issued for another client")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.config.ClientID {
+		return nil, errors.New("ID token authorized for another client")
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("ID token nonce does not match")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+	return claims, nil
+}
+
+func (p *provider) discover(ctx context.Context) (discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return *p.discovery, nil
+	}
+	var d discovery
+	if err := p.get(ctx, strings.TrimSuffix(p.config.Issuer, "/")+"/.well-known/openid-configuration", &d); err != nil {
+		return discovery{}, err
+	}
+	if d.Issuer != p.config.Issuer {
+		return discovery{}, fmt.Errorf("%s reports issuer %q instead of %q", p.config.Name, d.Issuer, p.config.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return discovery{}, fmt.Errorf("%s does not support the authorization code flow", p.config.Name)
+	}
+	p.discovery = &d
+	return d, nil
+}
+
+// key returns the provider key named by the kid header, keys are fetched
+// again when the provider rotates them
+func (p *provider) key(ctx context.Context, token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < minKeysRefresh {
+		return nil, fmt.Errorf("unknown key %q of %s", kid, p.config.Name)
+	}
+	var set keys.JWKS
+	if err := p.get(ctx, d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	p.keys = make(map[string]crypto.PublicKey, len(set.Keys))
+	p.keysFetched = time.Now()
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.PublicKey(); err == nil {
+			p.keys[jwk.Kid] = key
+		}
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q of %s", kid, p.config.Name)
+}
+
+func (p *provider) get(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func (c *idTokenClaims) Valid() error {
+	if c.ExpiresAt <= time.Now().Unix() {
+		return errors.New("ID token is expired")
+	}
+	return nil
+}
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package password
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MaxBytes is the longest password bcrypt hashes whole, it ignores the bytes
+// past it, so longer passwords are rejected by the policy
+const MaxBytes = 72
+
+// ErrTooLong is returned for passwords bcrypt would truncate
+var ErrTooLong = errors.New("password is longer than 72 bytes")
+
+func isBcrypt(hash string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func hashBcrypt(password string, cost int) (string, error) {
+	if len(password) > MaxBytes {
+		return "", ErrTooLong
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	return string(hash), err
+}
+
+func verifyBcrypt(password, hash string) (int, bool, error) {
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return 0, false, err
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return cost, false, nil
+	}
+	return cost, err == nil, err
+}
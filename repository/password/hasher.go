@@ -0,0 +1,77 @@
+package password
+
+import (
+	"SB/service/config"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+)
+
+// ErrUnknownFormat is returned for hashes not produced by any supported algorithm
+var ErrUnknownFormat = errors.New("unknown password hash format")
+
+type (
+	// Hasher hashes passwords with the configured algorithm and verifies
+	// hashes of every supported format. The format is recognized by its
+	// prefix: $argon2id$, $2a$ (bcrypt) or $1$ (MD5 crypt from pgcrypto).
+	Hasher interface {
+		Hash(password string) (string, error)
+		// Verify reports whether the password matches the hash and whether the
+		// hash should be replaced because it was made with other parameters
+		Verify(password, hash string) (match bool, rehash bool, err error)
+	}
+
+	hasher struct {
+		config config.Password
+	}
+)
+
+func NewHasher(cfg config.Password) (Hasher, error) {
+	switch cfg.Algorithm {
+	case Argon2id, Bcrypt:
+	default:
+		return nil, fmt.Errorf("unsupported password hash algorithm %q", cfg.Algorithm)
+	}
+	return &hasher{config: cfg}, nil
+}
+
+func (h *hasher) Hash(password string) (string, error) {
+	if h.config.Algorithm == Bcrypt {
+		return hashBcrypt(password, h.config.BcryptCost)
+	}
+	return hashArgon2id(password, h.argon2Params())
+}
+
+func (h *hasher) Verify(password, hash string) (match bool, rehash bool, err error) {
+	switch {
+	case strings.HasPrefix(hash, argon2idPrefix):
+		params, match, err := verifyArgon2id(password, hash)
+		if err != nil || !match {
+			return false, false, err
+		}
+		return true, h.config.Algorithm != Argon2id || params != h.argon2Params(), nil
+	case isBcrypt(hash):
+		cost, match, err := verifyBcrypt(password, hash)
+		if err != nil || !match {
+			return false, false, err
+		}
+		return true, h.config.Algorithm != Bcrypt || cost != h.config.BcryptCost, nil
+	case strings.HasPrefix(hash, md5CryptPrefix):
+		match, err := verifyMD5Crypt(password, hash)
+		return match, match, err
+	}
+	return false, false, ErrUnknownFormat
+}
+
+func (h *hasher) argon2Params() argon2Params {
+	return argon2Params{
+		memory:      h.config.Argon2Memory,
+		iterations:  h.config.Argon2Iterations,
+		parallelism: h.config.Argon2Parallelism,
+	}
+}
@@ -0,0 +1,107 @@
+package password
+
+import (
+	"SB/service/config"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testConfig(algorithm string) config.Password {
+	cfg := config.Default().Password
+	cfg.Algorithm = algorithm
+	cfg.Argon2Memory = 1024
+	cfg.Argon2Iterations = 1
+	cfg.BcryptCost = 4
+	return cfg
+}
+
+func TestHashAndVerify(t *testing.T) {
+	for _, algorithm := range []string{Argon2id, Bcrypt} {
+		t.Run(algorithm, func(t *testing.T) {
+			h, err := NewHasher(testConfig(algorithm))
+			require.NoError(t, err)
+
+			hash, err := h.Hash("correct horse")
+			require.NoError(t, err)
+			require.NotContains(t, hash, "correct horse")
+
+			match, rehash, err := h.Verify("correct horse", hash)
+			require.NoError(t, err)
+			require.True(t, match)
+			require.False(t, rehash)
+
+			match, _, err = h.Verify("battery staple", hash)
+			require.NoError(t, err)
+			require.False(t, match)
+
+			other, err := h.Hash("correct horse")
+			require.NoError(t, err)
+			require.NotEqual(t, hash, other, "hashes must be salted")
+		})
+	}
+}
+
+func TestArgon2idFormat(t *testing.T) {
+	h, err := NewHasher(testConfig(Argon2id))
+	require.NoError(t, err)
+	hash, err := h.Hash("correct horse")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=2$"), hash)
+}
+
+func TestRehash(t *testing.T) {
+	argon, err := NewHasher(testConfig(Argon2id))
+	require.NoError(t, err)
+	argonHash, err := argon.Hash("correct horse")
+	require.NoError(t, err)
+
+	cfg := testConfig(Argon2id)
+	cfg.Argon2Iterations = 2
+	stronger, err := NewHasher(cfg)
+	require.NoError(t, err)
+	match, rehash, err := stronger.Verify("correct horse", argonHash)
+	require.NoError(t, err)
+	require.True(t, match)
+	require.True(t, rehash, "hash with other parameters must be replaced")
+
+	bcrypt, err := NewHasher(testConfig(Bcrypt))
+	require.NoError(t, err)
+	match, rehash, err = bcrypt.Verify("correct horse", argonHash)
+	require.NoError(t, err)
+	require.True(t, match, "hashes of other algorithms must verify")
+	require.True(t, rehash)
+
+	match, rehash, err = argon.Verify("wrong", argonHash)
+	require.NoError(t, err)
+	require.False(t, match)
+	require.False(t, rehash, "hash must not be replaced without a valid password")
+}
+
+func TestVerifyMD5Crypt(t *testing.T) {
+	h, err := NewHasher(testConfig(Argon2id))
+	require.NoError(t, err)
+
+	// produced by pgcrypto crypt(password, gen_salt('md5')) and openssl passwd -1
+	for password, hash := range map[string]string{
+		"password":      "$1$saltsalt$qjXMvbEw8oaL.CzflDtaK/",
+		"correct horse": "$1$ab$.ThsTrbyIbEahEdE8LNwj1",
+	} {
+		match, rehash, err := h.Verify(password, hash)
+		require.NoError(t, err)
+		require.True(t, match, password)
+		require.True(t, rehash, "MD5 crypt hashes must always be replaced")
+
+		match, _, err = h.Verify(password+"1", hash)
+		require.NoError(t, err)
+		require.False(t, match)
+	}
+}
+
+func TestVerifyUnknownFormat(t *testing.T) {
+	h, err := NewHasher(testConfig(Argon2id))
+	require.NoError(t, err)
+	_, _, err = h.Verify("password", "password")
+	require.ErrorIs(t, err, ErrUnknownFormat)
+}
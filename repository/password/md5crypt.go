@@ -0,0 +1,93 @@
+package password
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"strings"
+)
+
+// MD5 crypt is what pgcrypto produced with crypt(password, gen_salt('md5')),
+// it is only verified so that such hashes can be replaced on login
+const md5CryptPrefix = "$1$"
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+func verifyMD5Crypt(password, hash string) (bool, error) {
+	rest := strings.TrimPrefix(hash, md5CryptPrefix)
+	i := strings.IndexByte(rest, '$')
+	if i < 0 {
+		return false, ErrUnknownFormat
+	}
+	other := md5Crypt([]byte(password), []byte(rest[:i]))
+	return subtle.ConstantTimeCompare([]byte(hash), other) == 1, nil
+}
+
+// md5Crypt implements the FreeBSD MD5 based crypt algorithm
+func md5Crypt(password, salt []byte) []byte {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alternate := md5.New()
+	alternate.Write(password)
+	alternate.Write(salt)
+	alternate.Write(password)
+	alt := alternate.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(password)
+	ctx.Write([]byte(md5CryptPrefix))
+	ctx.Write(salt)
+	for n := len(password); n > 0; n -= 16 {
+		if n > 16 {
+			ctx.Write(alt)
+		} else {
+			ctx.Write(alt[:n])
+		}
+	}
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 == 1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(password[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 == 1 {
+			round.Write(password)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write(salt)
+		}
+		if i%7 != 0 {
+			round.Write(password)
+		}
+		if i&1 == 1 {
+			round.Write(final)
+		} else {
+			round.Write(password)
+		}
+		final = round.Sum(nil)
+	}
+
+	out := append([]byte(md5CryptPrefix), salt...)
+	out = append(out, '$')
+	for _, group := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		v := uint(final[group[0]])<<16 | uint(final[group[1]])<<8 | uint(final[group[2]])
+		out = appendCrypt64(out, v, 4)
+	}
+	return appendCrypt64(out, uint(final[11]), 2)
+}
+
+func appendCrypt64(out []byte, v uint, n int) []byte {
+	for ; n > 0; n-- {
+		out = append(out, cryptAlphabet[v&0x3f])
+		v >>= 6
+	}
+	return out
+}
@@ -0,0 +1,93 @@
+package password
+
+import (
+	"SB/service/config"
+	"SB/service/repository/logging"
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+type (
+	// Policy decides whether a new password is good enough
+	Policy interface {
+		Check(password string) error
+	}
+
+	// PolicyError explains to the user why the password is rejected
+	PolicyError struct {
+		Reason string
+	}
+
+	policy struct {
+		minLength int
+		maxLength int
+		breached  map[[sha1.Size]byte]struct{}
+	}
+)
+
+func (e *PolicyError) Error() string {
+	return e.Reason
+}
+
+// NewPolicy creates a policy and loads the list of breached passwords. Each
+// line of the list is either a password or its SHA-1 in hex, as in the Have I
+// Been Pwned dumps, where the ":count" suffix is ignored.
+func NewPolicy(cfg config.Password, logger *logging.Logger) (Policy, error) {
+	p := &policy{
+		minLength: cfg.MinLength,
+		maxLength: cfg.MaxLength,
+		breached:  make(map[[sha1.Size]byte]struct{}),
+	}
+	if cfg.BreachedList == "" {
+		return p, nil
+	}
+	f, err := os.Open(cfg.BreachedList)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open breached passwords list: %s", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var sum [sha1.Size]byte
+		if hash := strings.SplitN(line, ":", 2)[0]; len(hash) == 2*sha1.Size {
+			if _, err := hex.Decode(sum[:], []byte(hash)); err == nil {
+				p.breached[sum] = struct{}{}
+				continue
+			}
+		}
+		p.breached[sha1.Sum([]byte(line))] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read breached passwords list: %s", err)
+	}
+	logger.Info("loaded breached passwords", logging.Int("passwords", int64(len(p.breached))))
+	return p, nil
+}
+
+func (p *policy) Check(password string) error {
+	length := utf8.RuneCountInString(password)
+	if length < p.minLength {
+		return &PolicyError{fmt.Sprintf("Password must be at least %d characters long", p.minLength)}
+	}
+	if p.maxLength > 0 && length > p.maxLength {
+		return &PolicyError{fmt.Sprintf("Password must be at most %d characters long", p.maxLength)}
+	}
+	// hashes may be made with bcrypt after the algorithm is changed
+	if len(password) > MaxBytes {
+		return &PolicyError{fmt.Sprintf("Password must be at most %d bytes long, letters outside the Latin alphabet take 2 or more bytes", MaxBytes)}
+	}
+	if _, ok := p.breached[sha1.Sum([]byte(password))]; ok {
+		return &PolicyError{"Password is known from data breaches, choose another one"}
+	}
+	return nil
+}
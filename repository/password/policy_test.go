@@ -0,0 +1,56 @@
+package password
+
+import (
+	"SB/service/config"
+	"SB/service/repository/logging"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy(t *testing.T) {
+	list := filepath.Join(t.TempDir(), "breached.txt")
+	require.NoError(t, os.WriteFile(list, []byte("qwerty123\n"+
+		// SHA-1 of "password1" as in Have I Been Pwned dumps
+		"E38AD214943DAAD1D64C102FAEC29DE4AFE9DA3D:2413945\n"), 0600))
+
+	cfg := config.Default().Password
+	cfg.MinLength = 8
+	cfg.MaxLength = 16
+	cfg.BreachedList = list
+	p, err := NewPolicy(cfg, logging.Discard())
+	require.NoError(t, err)
+
+	require.NoError(t, p.Check("correct horse"))
+	require.NoError(t, p.Check("пароль-пароль"), "length is counted in characters")
+	for _, password := range []string{"short", "correct horse battery staple", "qwerty123", "password1"} {
+		err := p.Check(password)
+		var policyErr *PolicyError
+		require.ErrorAs(t, err, &policyErr, password)
+	}
+}
+
+func TestPolicyBcryptLimit(t *testing.T) {
+	cfg := config.Default().Password
+	cfg.MaxLength = 0
+	p, err := NewPolicy(cfg, logging.Discard())
+	require.NoError(t, err)
+
+	require.NoError(t, p.Check(strings.Repeat("a", MaxBytes)))
+	var policyErr *PolicyError
+	require.ErrorAs(t, p.Check(strings.Repeat("a", MaxBytes+1)), &policyErr)
+	require.ErrorAs(t, p.Check(strings.Repeat("я", MaxBytes/2+1)), &policyErr, "bcrypt counts bytes, not characters")
+
+	_, err = hashBcrypt(strings.Repeat("a", MaxBytes+1), 4)
+	require.ErrorIs(t, err, ErrTooLong, "bcrypt would ignore the bytes past the limit")
+}
+
+func TestPolicyMissingList(t *testing.T) {
+	cfg := config.Default().Password
+	cfg.BreachedList = filepath.Join(t.TempDir(), "missing.txt")
+	_, err := NewPolicy(cfg, logging.Discard())
+	require.Error(t, err)
+}
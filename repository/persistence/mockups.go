@@ -1,6 +1,7 @@
 package persistence
 
 import (
+	"context"
 	"time"
 )
 
@@ -13,11 +14,11 @@ type (
 //	return &persistentMock{}
 //}
 
-func (persistent *persistentMock) CheckPassword(login, password string) (bool, error) {
-	return true, nil
+func (persistent *persistentMock) GetPasswordHash(ctx context.Context, login string) (string, error) {
+	return "", nil
 }
 
-func (persistent *persistentMock) GetUserAuthParams(login string) (User, error) {
+func (persistent *persistentMock) GetUserAuthParams(ctx context.Context, login string) (User, error) {
 	user := user{
 		IdUser:   1,
 		Username: "1",
@@ -25,7 +26,7 @@ func (persistent *persistentMock) GetUserAuthParams(login string) (User, error)
 	}
 	return &user, nil
 }
-func (persistent *persistentMock) AddUser(login string, password string) (User, error) {
+func (persistent *persistentMock) AddUser(ctx context.Context, login string, password string) (User, error) {
 	user := user{
 		IdUser:   1,
 		Username: "1",
@@ -33,8 +34,8 @@ func (persistent *persistentMock) AddUser(login string, password string) (User,
 	}
 	return &user, nil
 }
-func (persistent *persistentMock) DeleteUser(id int64) bool {
-	return true
+func (persistent *persistentMock) DeleteUser(ctx context.Context, id int64) error {
+	return nil
 }
 
 //func (persistent *persistentMock) GetUserProfile(id int64) (UserProfile, error) {
@@ -56,7 +57,7 @@ func (persistent *persistentMock) DeleteUser(id int64) bool {
 //	return true
 //}
 
-func (persistent *persistentMock) GetLevel(id int64) (Level, error) {
+func (persistent *persistentMock) GetLevel(ctx context.Context, id int64) (Level, error) {
 	lvl := level{
 		id,
 		1,
@@ -65,11 +66,11 @@ func (persistent *persistentMock) GetLevel(id int64) (Level, error) {
 	return &lvl, nil
 }
 
-func (persistent *persistentMock) AddSession(token Token) bool {
-	return true
+func (persistent *persistentMock) AddSession(ctx context.Context, token Token) error {
+	return nil
 }
 
-func (persistent *persistentMock) GetSession(tknId string) (tokenResp Token, err error) {
+func (persistent *persistentMock) GetSession(ctx context.Context, tknId string) (tokenResp Token, err error) {
 	tkn := token{
 		Token:     tknId,
 		IdUser:    1,
@@ -78,13 +79,16 @@ func (persistent *persistentMock) GetSession(tknId string) (tokenResp Token, err
 	return &tkn, err
 }
 
-func (persistent *persistentMock) RemoveSession(tknId string) error {
+func (persistent *persistentMock) RemoveSession(ctx context.Context, tknId string) error {
 	return nil
 }
 
-func (persistent *persistentMock) UpdateSession(tkn Token) error {
+func (persistent *persistentMock) UpdateSession(ctx context.Context, tkn Token) error {
 	return nil
 }
-func (persistent *persistentMock) GetRole(id int64) string {
+func (persistent *persistentMock) GetRole(ctx context.Context, id int64) string {
 	return ""
 }
+func (persistent *persistentMock) Ping(ctx context.Context) error {
+	return nil
+}
@@ -86,10 +86,41 @@ type (
 		IdUser    int64
 		Username  string
 		Role      string
-		LoginDate time.Time
+		LoginDate time.Time `gorm:"column:login_time"`
 		Expires   time.Time
+		// Family is shared by all refresh tokens rotated from the same login
+		Family    string
+		RotatedAt *time.Time
+		Device    string
+		UserAgent string
+		IP        string `gorm:"column:ip"`
+		LastUsed  time.Time
+		// TwoFactor is set when the session was started with a second factor
+		TwoFactor bool
 	}
 
+	// ClientInfo describes the device a session was started or refreshed from
+	ClientInfo struct {
+		Device    string
+		UserAgent string
+		IP        string
+	}
+
+	SessionInfo struct {
+		// Id of a session, it stays the same while the refresh token is rotated
+		Id string `json:"id" gorm:"column:family" example:"Q2V3OPVKXEPU6JH6RBMIAFHSTQZ4ZJ3WQJQNE4LBKL7QWF2N"`
+		// Device name sent by the client on login
+		Device    string `json:"device" example:"Pixel 7"`
+		UserAgent string `json:"user_agent" example:"okhttp/4.9.3"`
+		// IP address the session was last used from
+		IP        string    `json:"ip" gorm:"column:ip" example:"192.0.2.1"`
+		LoginTime time.Time `json:"login_time" example:"2021-11-22T17:49:57Z"`
+		// Time the access token of the session was last refreshed
+		LastUsed time.Time `json:"last_used" example:"2021-11-23T09:12:01Z"`
+		// The session of the access token used for the request
+		Current bool `json:"current" gorm:"-"`
+	} // @name Session
+
 	Token interface {
 		GetUsername() string
 		GetId() string
@@ -97,6 +128,143 @@ type (
 		GetUserId() int64
 		GetLoginDate() time.Time
 		GetExpirationTime() time.Time
+		GetFamily() string
+		IsRotated() bool
+		GetClient() ClientInfo
+		IsTwoFactor() bool
+	}
+
+	// LoginAttempts counts failed attempts in a row of an account or an IP
+	LoginAttempts struct {
+		Key         string
+		Failures    int
+		LastFailure time.Time
+	}
+
+	// Identity is an account of an external OpenID Connect provider
+	Identity struct {
+		Provider      string
+		Subject       string
+		Email         string
+		EmailVerified bool
+		// Username preferred by the user at the provider
+		Username string
+	}
+
+	// UserSearch filters users listed to admins, Query matches username,
+	// e-mail and names
+	UserSearch struct {
+		Query  string
+		Role   string
+		Limit  int
+		Offset int
+	}
+
+	// UserSummary is a user as listed to admins
+	UserSummary struct {
+		IdUser     int64  `json:"id_user" example:"709786"`
+		Username   string `json:"username" example:"andrey"`
+		Role       string `json:"role" example:"user"`
+		Email      string `json:"email,omitempty" example:"andrey@gmail.com"`
+		Name       string `json:"name,omitempty" example:"Андрей"`
+		SecondName string `json:"second_name,omitempty" example:"Попов"`
+		Banned     bool   `json:"banned" example:"true"`
+		// Set while the user is banned, a ban without it is permanent
+		BannedUntil *time.Time `json:"banned_until,omitempty" example:"2021-12-22T00:00:00Z"`
+		BanReason   string     `json:"ban_reason,omitempty" example:"Spam"`
+	} // @name UserSummary
+
+	// Ban keeps a user from logging in
+	Ban struct {
+		Reason string
+		// Until is nil for permanent bans
+		Until *time.Time
+	}
+
+	// SportInfo is an entry of the sports dictionary with the number of
+	// profiles and trainings using it
+	SportInfo struct {
+		IdSport   int64  `json:"id_sport" example:"1"`
+		SportType string `json:"sport_type" example:"футбол"`
+		Users     int64  `json:"users" example:"120"`
+		Trainings int64  `json:"trainings" example:"14"`
+	} // @name Sport
+
+	// LevelInfo is an entry of the levels dictionary
+	LevelInfo struct {
+		IdLevel     int64  `json:"id_level" example:"1"`
+		Level       int    `json:"level" example:"1"`
+		Description string `json:"description" example:"junior"`
+	} // @name Level
+
+	// AuditEntry records a change of a target by an actor, Before and After
+	// hold only the fields that have changed
+	AuditEntry struct {
+		Id        int64     `json:"id" gorm:"column:id_entry" example:"1031"`
+		CreatedAt time.Time `json:"created_at" example:"2021-11-22T17:49:57Z"`
+		// Not set for changes made by the service itself
+		IdActor *int64 `json:"id_actor" example:"3"`
+		// Admin acting as the actor
+		ImpersonatedBy *int64  `json:"impersonated_by,omitempty" example:"1"`
+		Action         string  `json:"action" example:"user.role_changed"`
+		TargetType     string  `json:"target_type" example:"user"`
+		TargetId       int64   `json:"target_id" example:"709786"`
+		Before         RawJSON `json:"before" swaggertype:"object"`
+		After          RawJSON `json:"after" swaggertype:"object"`
+		IP             string  `json:"ip" example:"192.0.2.1"`
+		RequestId      string  `json:"request_id" example:"0ujsswThIGTUYm2K8FjOOfXtY1K"`
+	} // @name AuditEntry
+
+	// AuditFilter selects audit entries, zero fields match all entries
+	AuditFilter struct {
+		IdActor    int64
+		Action     string
+		TargetType string
+		TargetId   int64
+		From       *time.Time
+		To         *time.Time
+		Limit      int
+		Offset     int
+	}
+
+	// APIKey is a personal key of an integration acting as its owner, only
+	// a hash of the key is stored
+	APIKey struct {
+		Id     int64 `gorm:"column:id_key"`
+		IdUser int64
+		Name   string
+		// Prefix is the public part of the key identifying it
+		Prefix string
+		Hash   string
+		// Scopes are space separated
+		Scopes     string
+		CreatedAt  time.Time
+		LastUsedAt *time.Time
+		ExpiresAt  *time.Time
+		// TwoFactor is set when the key was created in a session started
+		// with a second factor
+		TwoFactor bool
+		// Role of the owner, it is set only by GetAPIKey
+		Role string
+	}
+
+	// SigningKey is a PEM encoded private key signing access tokens, keys
+	// without expiration sign new tokens
+	SigningKey struct {
+		Kid        string
+		Algorithm  string
+		PrivateKey string
+		CreatedAt  time.Time
+		ExpiresAt  *time.Time
+	}
+
+	// TOTP is the authenticator secret of a user, it is enabled once the
+	// user confirms it with a code
+	TOTP struct {
+		IdUser    int64
+		Secret    string
+		LastStep  int64
+		EnabledAt *time.Time
 	}
 
 	level struct {
@@ -213,6 +381,26 @@ func (token *token) GetUsername() string {
 	return token.Username
 }
 
+func (token *token) GetFamily() string {
+	return token.Family
+}
+
+func (token *token) IsRotated() bool {
+	return token.RotatedAt != nil
+}
+
+func (token *token) GetClient() ClientInfo {
+	return ClientInfo{Device: token.Device, UserAgent: token.UserAgent, IP: token.IP}
+}
+
+func (token *token) IsTwoFactor() bool {
+	return token.TwoFactor
+}
+
+func (totp *TOTP) IsEnabled() bool {
+	return totp.EnabledAt != nil
+}
+
 func (lvl *level) GetId() int64 {
 	return lvl.IdLevel
 }
@@ -228,6 +416,46 @@ func (prf *UserProfileImpl) Serialize() []byte {
 	return prof
 }
 
+// RawJSON is a JSON column kept encoded, empty RawJSON is NULL
+type RawJSON json.RawMessage
+
+// MarshalJSON returns the encoded JSON or null
+func (j RawJSON) MarshalJSON() ([]byte, error) {
+	if len(j) == 0 {
+		return []byte("null"), nil
+	}
+	return j, nil
+}
+
+// UnmarshalJSON keeps a copy of the encoded JSON
+func (j *RawJSON) UnmarshalJSON(data []byte) error {
+	*j = append((*j)[0:0], data...)
+	return nil
+}
+
+// Value converts RawJSON to a string or NULL
+func (j RawJSON) Value() (driver.Value, error) {
+	if len(j) == 0 {
+		return nil, nil
+	}
+	return string(j), nil
+}
+
+// Scan reads RawJSON from a json or jsonb column
+func (j *RawJSON) Scan(raw interface{}) error {
+	switch v := raw.(type) {
+	case []byte:
+		*j = append(RawJSON(nil), v...)
+	case string:
+		*j = RawJSON(v)
+	case nil:
+		*j = nil
+	default:
+		return fmt.Errorf("cannot sql.Scan() RawJSON from: %#v", v)
+	}
+	return nil
+}
+
 // Value converts Duration to a primitive value ready to written to a database.
 func (d Duration) Value() (driver.Value, error) {
 	return driver.Value(int64(d)), nil
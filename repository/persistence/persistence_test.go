@@ -1,6 +1,9 @@
 package persistence
 
 import (
+	"SB/service/repository/errs"
+	"SB/service/repository/logging"
+	"context"
 	"database/sql"
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/stretchr/testify/require"
@@ -14,17 +17,23 @@ import (
 )
 
 var (
-	username        = "test"
-	password        = "123"
-	idUser    int64 = 11111
-	userRole        = "user"
-	mockToken       = token{
+	ctx                = context.Background()
+	username           = "test"
+	passwordHash       = "$argon2id$v=19$m=65536,t=3,p=2$c29tZXNhbHRzb21lc2FsdA$RdescudvJCsgt3ub+b+dWRWJTmaaJObG"
+	idUser       int64 = 11111
+	userRole           = "user"
+	mockToken          = token{
 		Token:     "YHT2HFCRKALV7ZMQRMBFH6434T6PCZWD7X73AOJVRDCS3ERR",
 		IdUser:    idUser,
 		Username:  username,
 		Role:      userRole,
 		LoginDate: time.Unix(1637603397, 0),
 		Expires:   time.Unix(1640184760, 0),
+		Family:    "Q2V3OPVKXEPU6JH6RBMIAFHSTQZ4ZJ3WQJQNE4LBKL7QWF2N",
+		Device:    "Pixel 7",
+		UserAgent: "okhttp/4.9.3",
+		IP:        "192.0.2.1",
+		LastUsed:  time.Unix(1637603397, 0),
 	}
 	mockFilteredProfile = FilteredUserProfileImpl{
 		IdUser: idUser, Name: "name", SecondName: "secondname", Sex: "male", Height: 150, Weight: 50, IdLevel: 1, Location: "Avtovo", Age: 20, About: "about", Sports: "{football}",
@@ -33,7 +42,7 @@ var (
 	mockGroupTraining = groupTraining{
 		IdTraining:       1,
 		Owner:            idUser,
-		MeetDate:         time.Unix(1640184760, 0),
+		MeetDate:         time.Unix(1640184760, 0).UTC(),
 		Duration:         3600000000000,
 		TrainingDuration: "1h0m0s",
 		Location:         "Avtovo",
@@ -154,32 +163,170 @@ func (s *Suite) SetupSuite() {
 
 	s.DB.Debug()
 
-	s.persistent = NewPersistent(s.DB)
+	s.persistent = NewPersistent(s.DB, logging.Discard())
 }
 
 func (s *Suite) TestGetUserAuthParams() {
 	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT id_user, role FROM "users" WHERE username=$1`)).WithArgs(username).
 		WillReturnRows(sqlmock.NewRows([]string{"id_user", "role"}).AddRow(idUser, userRole))
 
-	u, err := s.persistent.GetUserAuthParams(username)
+	u, err := s.persistent.GetUserAuthParams(ctx, username)
 	require.NoError(s.T(), err)
 	require.Equal(s.T(), mockUser, u)
 }
 
-func (s *Suite) TestCheckPassword() {
-	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT (password = crypt($1, password)) AS pswmatch FROM "user_auth_info" WHERE login=$2`)).WithArgs(password, username).
-		WillReturnRows(sqlmock.NewRows([]string{"pswmatch"}).AddRow(true))
+func (s *Suite) TestGetPasswordHash() {
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT "password" FROM "user_auth_info" WHERE login=$1 LIMIT 1`)).WithArgs(username).
+		WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(passwordHash))
 
-	res, err := s.persistent.CheckPassword(username, password)
+	res, err := s.persistent.GetPasswordHash(ctx, username)
 	require.NoError(s.T(), err)
-	require.Equal(s.T(), true, res)
+	require.Equal(s.T(), passwordHash, res)
+
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT "password" FROM "user_auth_info" WHERE login=$1 LIMIT 1`)).WithArgs("unknown").
+		WillReturnRows(sqlmock.NewRows([]string{"password"}))
+
+	_, err = s.persistent.GetPasswordHash(ctx, "unknown")
+	require.ErrorIs(s.T(), err, ErrUserNotFound)
+}
+
+func (s *Suite) TestUpdatePasswordHash() {
+	s.mock.ExpectExec(regexp.QuoteMeta(`UPDATE user_auth_info SET password = $1 WHERE login = $2;`)).WithArgs(passwordHash, username).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	require.NoError(s.T(), s.persistent.UpdatePasswordHash(ctx, username, passwordHash))
+}
+
+func (s *Suite) TestAddAccountToken() {
+	expires := time.Unix(1640184760, 0)
+	s.mock.ExpectBegin()
+	s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM account_tokens WHERE id_user = $1 AND purpose = $2 AND used_at IS NULL;`)).WithArgs(idUser, PurposePasswordReset).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	s.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO account_tokens (token_hash, id_user, purpose, expires) VALUES ($1, $2, $3, $4);`)).WithArgs("hash", idUser, PurposePasswordReset, expires).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	s.mock.ExpectCommit()
+
+	require.NoError(s.T(), s.persistent.AddAccountToken(ctx, idUser, PurposePasswordReset, "hash", expires))
+}
+
+func (s *Suite) TestResetPassword() {
+	useToken := regexp.QuoteMeta(`UPDATE account_tokens SET used_at = now() WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires > now() RETURNING id_user;`)
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(useToken).WithArgs("hash", PurposePasswordReset).
+		WillReturnRows(sqlmock.NewRows([]string{"id_user"}).AddRow(idUser))
+	s.mock.ExpectExec(regexp.QuoteMeta(`UPDATE user_auth_info SET password = $1 WHERE id_user = $2;`)).WithArgs(passwordHash, idUser).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM sessions WHERE id_user = $1;`)).WithArgs(idUser).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	s.mock.ExpectExec(regexp.QuoteMeta(`UPDATE api_keys SET revoked_at = now() WHERE id_user = $1 AND revoked_at IS NULL;`)).WithArgs(idUser).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	s.mock.ExpectCommit()
+
+	id, err := s.persistent.ResetPassword(ctx, "hash", passwordHash)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), idUser, id)
+
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(useToken).WithArgs("used", PurposePasswordReset).
+		WillReturnRows(sqlmock.NewRows([]string{"id_user"}))
+	s.mock.ExpectRollback()
+
+	_, err = s.persistent.ResetPassword(ctx, "used", passwordHash)
+	require.ErrorIs(s.T(), err, ErrInvalidAccountToken)
+}
+
+func (s *Suite) TestVerifyEmail() {
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta(`UPDATE account_tokens SET used_at = now() WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires > now() RETURNING id_user;`)).WithArgs("hash", PurposeEmailVerification).
+		WillReturnRows(sqlmock.NewRows([]string{"id_user"}).AddRow(idUser))
+	s.mock.ExpectExec(regexp.QuoteMeta(`UPDATE users SET email_verified_at = now() WHERE id_user = $1 AND email_verified_at IS NULL;`)).WithArgs(idUser).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	s.mock.ExpectCommit()
+
+	id, err := s.persistent.VerifyEmail(ctx, "hash")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), idUser, id)
+}
+
+func (s *Suite) TestTOTP() {
+	query := regexp.QuoteMeta(`SELECT id_user, secret, last_step, enabled_at FROM "user_totp" WHERE id_user = $1 LIMIT 1`)
+	columns := []string{"id_user", "secret", "last_step", "enabled_at"}
+	s.mock.ExpectQuery(query).WithArgs(idUser).WillReturnRows(sqlmock.NewRows(columns))
+	totp, err := s.persistent.GetTOTP(ctx, idUser)
+	require.NoError(s.T(), err)
+	require.Nil(s.T(), totp)
+
+	enabledAt := time.Unix(1637603400, 0)
+	s.mock.ExpectQuery(query).WithArgs(idUser).WillReturnRows(sqlmock.NewRows(columns).AddRow(idUser, "JBSWY3DPEHPK3PXP", 54586780, enabledAt))
+	totp, err = s.persistent.GetTOTP(ctx, idUser)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), &TOTP{IdUser: idUser, Secret: "JBSWY3DPEHPK3PXP", LastStep: 54586780, EnabledAt: &enabledAt}, totp)
+	require.True(s.T(), totp.IsEnabled())
+
+	s.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO user_totp (id_user, secret) VALUES ($1, $2)`)).WithArgs(idUser, "JBSWY3DPEHPK3PXP").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	require.ErrorIs(s.T(), s.persistent.SetTOTPSecret(ctx, idUser, "JBSWY3DPEHPK3PXP"), ErrTwoFactorEnabled)
+
+	useStep := regexp.QuoteMeta(`UPDATE user_totp SET last_step = $1 WHERE id_user = $2 AND enabled_at IS NOT NULL AND last_step < $3;`)
+	s.mock.ExpectExec(useStep).WithArgs(54586781, idUser, 54586781).WillReturnResult(sqlmock.NewResult(0, 1))
+	fresh, err := s.persistent.UseTOTPStep(ctx, idUser, 54586781)
+	require.NoError(s.T(), err)
+	require.True(s.T(), fresh)
+
+	s.mock.ExpectExec(useStep).WithArgs(54586781, idUser, 54586781).WillReturnResult(sqlmock.NewResult(0, 0))
+	fresh, err = s.persistent.UseTOTPStep(ctx, idUser, 54586781)
+	require.NoError(s.T(), err)
+	require.False(s.T(), fresh, "a step can be used once")
+}
+
+func (s *Suite) TestEnableTOTP() {
+	s.mock.ExpectBegin()
+	s.mock.ExpectExec(regexp.QuoteMeta(`UPDATE user_totp SET enabled_at = now(), last_step = $1 WHERE id_user = $2 AND enabled_at IS NULL;`)).WithArgs(54586780, idUser).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM recovery_codes WHERE id_user = $1;`)).WithArgs(idUser).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	for _, hash := range []string{"hash1", "hash2"} {
+		s.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO recovery_codes (id_user, code_hash) VALUES ($1, $2);`)).WithArgs(idUser, hash).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	s.mock.ExpectCommit()
+
+	require.NoError(s.T(), s.persistent.EnableTOTP(ctx, idUser, 54586780, []string{"hash1", "hash2"}))
+}
+
+func (s *Suite) TestTwoFactorChallenge() {
+	expires := time.Unix(1637603697, 0)
+	s.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO two_factor_challenges (id, id_user, expires) VALUES ($1, $2, $3);`)).WithArgs("challenge", idUser, expires).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(s.T(), s.persistent.AddTwoFactorChallenge(ctx, "challenge", idUser, expires))
+
+	attempt := regexp.QuoteMeta(`UPDATE two_factor_challenges SET attempts = attempts + 1 WHERE id = $1 AND expires > now() AND attempts < $2;`)
+	s.mock.ExpectExec(attempt).WithArgs("challenge", 5).WillReturnResult(sqlmock.NewResult(0, 1))
+	ok, err := s.persistent.AttemptTwoFactorChallenge(ctx, "challenge", 5)
+	require.NoError(s.T(), err)
+	require.True(s.T(), ok)
+	s.mock.ExpectExec(attempt).WithArgs("challenge", 5).WillReturnResult(sqlmock.NewResult(0, 0))
+	ok, err = s.persistent.AttemptTwoFactorChallenge(ctx, "challenge", 5)
+	require.NoError(s.T(), err)
+	require.False(s.T(), ok, "no attempts are left")
+
+	s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM two_factor_challenges WHERE id = $1 AND expires > now();`)).WithArgs("challenge").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	used, err := s.persistent.UseTwoFactorChallenge(ctx, "challenge")
+	require.NoError(s.T(), err)
+	require.True(s.T(), used)
+
+	s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM two_factor_challenges WHERE expires <= now();`)).WillReturnResult(sqlmock.NewResult(0, 3))
+	deleted, err := s.persistent.DeleteExpiredTwoFactorChallenges(ctx)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), int64(3), deleted)
 }
 
 func (s *Suite) TestGetRole() {
 	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT role FROM "users" WHERE id_user=$1`)).WithArgs(idUser).
 		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(userRole))
 
-	res := s.persistent.GetRole(idUser)
+	res := s.persistent.GetRole(ctx, idUser)
 	require.Equal(s.T(), userRole, res)
 }
 
@@ -189,10 +336,10 @@ func (s *Suite) TestAddUser() {
 		WillReturnRows(sqlmock.NewRows([]string{"id_user"}).AddRow(idUser))
 	s.mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "user_info" ("id_user") VALUES ($1) RETURNING "id_user"`)).WithArgs(idUser).
 		WillReturnRows(sqlmock.NewRows([]string{"id_user"}).AddRow(idUser))
-	s.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO user_auth_info  (id_user, login, password) VALUES ($1, $2,  crypt($3, gen_salt('md5')));`)).WithArgs(idUser, username, password).WillReturnResult(sqlmock.NewResult(idUser, 1))
+	s.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO user_auth_info  (id_user, login, password) VALUES ($1, $2, $3);`)).WithArgs(idUser, username, passwordHash).WillReturnResult(sqlmock.NewResult(idUser, 1))
 	s.mock.ExpectCommit()
 
-	res, err := s.persistent.AddUser(username, password)
+	res, err := s.persistent.AddUser(ctx, username, passwordHash)
 
 	require.NoError(s.T(), err)
 	require.Equal(s.T(), mockUser, res)
@@ -205,17 +352,29 @@ func (s *Suite) TestDeleteUser() {
 	s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM users WHERE id_user = $1;`)).WithArgs(idUser).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 	s.mock.ExpectCommit()
-	res := s.persistent.DeleteUser(idUser)
-	require.Equal(s.T(), true, res)
+	require.NoError(s.T(), s.persistent.DeleteUser(ctx, idUser))
+
+	s.mock.ExpectBegin()
+	s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "group_training"`)).WithArgs(idUser).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM users WHERE id_user = $1;`)).WithArgs(idUser).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	s.mock.ExpectRollback()
+	require.ErrorIs(s.T(), s.persistent.DeleteUser(ctx, idUser), ErrUserNotFound)
 }
 
 func (s *Suite) TestGetUserProfile() {
 	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "user_info" WHERE id_user=$1 ORDER BY "user_info"."id_user" LIMIT 1`)).WithArgs(sqlmock.AnyArg()).
 		WillReturnRows(sqlmock.NewRows([]string{"id_user", "name", "second_name", "sex", "height", "weight", "email", "id_level", "location", "date_of_birth", "about"}).AddRow(mockProfile.IdUser, mockProfile.Name,
 			mockProfile.SecondName, mockProfile.Sex, mockProfile.Height, mockProfile.Weight, mockProfile.Email, mockProfile.IdLevel, mockProfile.Location, mockProfile.DateOfBirth, mockProfile.About))
-	res, err := s.persistent.GetUserProfile(idUser)
+	res, err := s.persistent.GetUserProfile(ctx, idUser)
 	require.NoError(s.T(), err)
 	require.Equal(s.T(), mockProfile, res)
+
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "user_info" WHERE id_user=$1 ORDER BY "user_info"."id_user" LIMIT 1`)).WithArgs(idUser).
+		WillReturnRows(sqlmock.NewRows([]string{"id_user"}))
+	_, err = s.persistent.GetUserProfile(ctx, idUser)
+	require.ErrorIs(s.T(), err, ErrUserNotFound)
 }
 
 func (s *Suite) TestUpdateUserProfile() {
@@ -228,24 +387,438 @@ func (s *Suite) TestUpdateUserProfile() {
 	s.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "person_sports" ("id_user","id_sport") VALUES ($1,$2) ON CONFLICT DO NOTHING`)).WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(mockSportType.IdSport, 1))
 	s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "person_sports" WHERE id_user=$1 AND id_sport NOT IN ($2)`)).WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
 	s.mock.ExpectCommit()
-	res := s.persistent.UpdateUserProfile(mockProfile, mockSports...)
-	require.Equal(s.T(), true, res)
+	require.NoError(s.T(), s.persistent.UpdateUserProfile(ctx, mockProfile, mockSports...))
 }
 
 func (s *Suite) TestAddSession() {
-	s.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO sessions (id_user, login_time, token, expires) VALUES ($1, $2, $3, $4)`)).WithArgs(mockToken.IdUser, mockToken.LoginDate, mockToken.Token, mockToken.Expires).
+	s.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO sessions (id_user, login_time, token, expires, family, device, user_agent, ip, two_factor) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`)).
+		WithArgs(mockToken.IdUser, mockToken.LoginDate, mockToken.Token, mockToken.Expires, mockToken.Family, mockToken.Device, mockToken.UserAgent, mockToken.IP, mockToken.TwoFactor).
 		WillReturnResult(sqlmock.NewResult(1, 1))
-	res := s.persistent.AddSession(&mockToken)
-	require.Equal(s.T(), true, res)
+	require.NoError(s.T(), s.persistent.AddSession(ctx, &mockToken))
 }
 
 func (s *Suite) TestGetSession() {
-	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT login_time, token, expires, sessions.id_user, username, role FROM "sessions" join users u on u.id_user = sessions.id_user WHERE "sessions"."token" = $1 LIMIT 1`)).WithArgs(mockToken.Token).
-		WillReturnRows(sqlmock.NewRows([]string{"id_user", "login_date", "token", "expires", "username", "role"}).AddRow(mockToken.IdUser, mockToken.LoginDate, mockToken.Token, mockToken.Expires, mockToken.Username, mockToken.Role))
+	rotatedAt := time.Unix(1637603400, 0)
+	rotated := mockToken
+	rotated.RotatedAt = &rotatedAt
+	twoFactor := mockToken
+	twoFactor.TwoFactor = true
+	columns := []string{"id_user", "login_time", "token", "expires", "family", "rotated_at", "device", "user_agent", "ip", "last_used", "two_factor", "username", "role"}
+	for _, tkn := range []token{mockToken, rotated, twoFactor} {
+		s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT login_time, token, expires, family, rotated_at, device, user_agent, ip, last_used, two_factor, sessions.id_user, username, role FROM "sessions" join users u on u.id_user = sessions.id_user WHERE "sessions"."token" = $1 LIMIT 1`)).WithArgs(tkn.Token).
+			WillReturnRows(sqlmock.NewRows(columns).AddRow(tkn.IdUser, tkn.LoginDate, tkn.Token, tkn.Expires, tkn.Family, tkn.RotatedAt, tkn.Device, tkn.UserAgent, tkn.IP, tkn.LastUsed, tkn.TwoFactor, tkn.Username, tkn.Role))
+
+		res, err := s.persistent.GetSession(ctx, tkn.Token)
+		require.NoError(s.T(), err)
+		require.Equal(s.T(), &tkn, res)
+		require.Equal(s.T(), tkn.RotatedAt != nil, res.IsRotated())
+		require.Equal(s.T(), tkn.TwoFactor, res.IsTwoFactor())
+	}
+}
+
+func (s *Suite) TestRotateSession() {
+	next := mockToken
+	next.Token = "ZUQ6QIDKB7ZJFDT5CVMOCA3AYBNDQIJXWGQV2XF5YJ4JIFBC"
+
+	s.mock.ExpectBegin()
+	s.mock.ExpectExec(regexp.QuoteMeta(`UPDATE sessions SET rotated_at = now() WHERE token = $1 AND rotated_at IS NULL`)).WithArgs(mockToken.Token).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	s.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO sessions (id_user, login_time, token, expires, family, device, user_agent, ip, two_factor) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`)).
+		WithArgs(next.IdUser, next.LoginDate, next.Token, next.Expires, next.Family, next.Device, next.UserAgent, next.IP, next.TwoFactor).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	s.mock.ExpectCommit()
+	require.NoError(s.T(), s.persistent.RotateSession(ctx, mockToken.Token, &next))
+
+	s.mock.ExpectBegin()
+	s.mock.ExpectExec(regexp.QuoteMeta(`UPDATE sessions SET rotated_at = now() WHERE token = $1 AND rotated_at IS NULL`)).WithArgs(mockToken.Token).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	s.mock.ExpectRollback()
+	require.ErrorIs(s.T(), s.persistent.RotateSession(ctx, mockToken.Token, &next), ErrSessionRotated)
+}
+
+func (s *Suite) TestRevokeSessionFamily() {
+	s.mock.ExpectBegin()
+	s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "sessions" WHERE family=$1`)).WithArgs(mockToken.Family).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	s.mock.ExpectCommit()
+	require.NoError(s.T(), s.persistent.RevokeSessionFamily(ctx, mockToken.Family))
+}
+
+func (s *Suite) TestGetSessions() {
+	expected := []SessionInfo{{
+		Id:        mockToken.Family,
+		Device:    mockToken.Device,
+		UserAgent: mockToken.UserAgent,
+		IP:        mockToken.IP,
+		LoginTime: mockToken.LoginDate,
+		LastUsed:  mockToken.LastUsed,
+	}}
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT family, device, user_agent, ip, login_time, last_used FROM "sessions" WHERE id_user = $1 AND rotated_at IS NULL AND expires > now() ORDER BY last_used DESC`)).WithArgs(idUser).
+		WillReturnRows(sqlmock.NewRows([]string{"family", "device", "user_agent", "ip", "login_time", "last_used"}).
+			AddRow(mockToken.Family, mockToken.Device, mockToken.UserAgent, mockToken.IP, mockToken.LoginDate, mockToken.LastUsed))
+
+	res, err := s.persistent.GetSessions(ctx, idUser)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), expected, res)
+}
+
+func (s *Suite) TestRevokeSession() {
+	s.mock.ExpectBegin()
+	s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "sessions" WHERE id_user=$1 AND family=$2`)).WithArgs(idUser, mockToken.Family).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	s.mock.ExpectCommit()
+	require.NoError(s.T(), s.persistent.RevokeSession(ctx, idUser, mockToken.Family))
+
+	s.mock.ExpectBegin()
+	s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "sessions" WHERE id_user=$1 AND family=$2`)).WithArgs(idUser, "unknown").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	s.mock.ExpectCommit()
+	require.ErrorIs(s.T(), s.persistent.RevokeSession(ctx, idUser, "unknown"), ErrNoSession)
+}
+
+func (s *Suite) TestHasSession() {
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "sessions" WHERE id_user = $1 AND family = $2 AND expires > now()`)).WithArgs(idUser, mockToken.Family).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	active, err := s.persistent.HasSession(ctx, idUser, mockToken.Family)
+	require.NoError(s.T(), err)
+	require.True(s.T(), active)
+
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "sessions" WHERE id_user = $1 AND family = $2 AND expires > now()`)).WithArgs(idUser, "revoked").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	active, err = s.persistent.HasSession(ctx, idUser, "revoked")
+	require.NoError(s.T(), err)
+	require.False(s.T(), active)
+}
+
+func (s *Suite) TestRevokeUserSessions() {
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "sessions" WHERE id_user=$1 AND family<>$2 AND rotated_at IS NULL AND expires > now()`)).WithArgs(idUser, mockToken.Family).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "sessions" WHERE id_user=$1 AND family<>$2`)).WithArgs(idUser, mockToken.Family).
+		WillReturnResult(sqlmock.NewResult(0, 5))
+	s.mock.ExpectCommit()
 
-	res, err := s.persistent.GetSession(mockToken.Token)
+	revoked, err := s.persistent.RevokeUserSessions(ctx, idUser, mockToken.Family, false)
 	require.NoError(s.T(), err)
-	require.Equal(s.T(), &mockToken, res)
+	require.Equal(s.T(), int64(2), revoked)
+}
+
+func (s *Suite) TestRevokeUserSessionsAndKeys() {
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "sessions" WHERE id_user=$1 AND family<>$2 AND rotated_at IS NULL AND expires > now()`)).WithArgs(idUser, "").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "sessions" WHERE id_user=$1 AND family<>$2`)).WithArgs(idUser, "").
+		WillReturnResult(sqlmock.NewResult(0, 5))
+	s.mock.ExpectExec(regexp.QuoteMeta(`UPDATE api_keys SET revoked_at = now() WHERE id_user = $1 AND revoked_at IS NULL;`)).WithArgs(idUser).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	s.mock.ExpectCommit()
+
+	revoked, err := s.persistent.RevokeUserSessions(ctx, idUser, "", true)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), int64(2), revoked)
+}
+
+func (s *Suite) TestDeleteExpiredSessions() {
+	s.mock.ExpectBegin()
+	s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "sessions" WHERE expires < now()`)).
+		WillReturnResult(sqlmock.NewResult(0, 7))
+	s.mock.ExpectCommit()
+
+	deleted, err := s.persistent.DeleteExpiredSessions(ctx)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), int64(7), deleted)
+}
+
+func (s *Suite) TestAddSecurityEvent() {
+	s.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO security_events (id_user, event, details) VALUES ($1, $2, $3)`)).WithArgs(idUser, "refresh_token_reuse", `{"family":"family"}`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	require.NoError(s.T(), s.persistent.AddSecurityEvent(ctx, idUser, "refresh_token_reuse", map[string]interface{}{"family": "family"}))
+}
+
+func (s *Suite) TestLoginAttempts() {
+	staleBefore := time.Unix(1637603397, 0)
+	lastFailure := time.Unix(1637689797, 0)
+	now := time.Unix(1637690000, 0)
+	s.mock.ExpectBegin()
+	for _, key := range []string{"account:test", "ip:192.0.2.1"} {
+		s.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO login_attempts (key, failures, last_failure) VALUES ($1, 0, 'epoch') ON CONFLICT (key) DO NOTHING;`)).
+			WithArgs(key).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT key, failures, last_failure FROM login_attempts WHERE key IN ($1,$2) ORDER BY key FOR UPDATE;`)).
+		WithArgs("account:test", "ip:192.0.2.1").
+		WillReturnRows(sqlmock.NewRows([]string{"key", "failures", "last_failure"}).
+			AddRow("account:test", 3, lastFailure).
+			AddRow("ip:192.0.2.1", 0, time.Unix(0, 0)))
+	s.mock.ExpectExec(regexp.QuoteMeta(`UPDATE login_attempts SET failures = $1, last_failure = $2 WHERE key = $3;`)).
+		WithArgs(1, now, "ip:192.0.2.1").WillReturnResult(sqlmock.NewResult(0, 1))
+	s.mock.ExpectExec(regexp.QuoteMeta(`UPDATE login_attempts SET failures = $1, last_failure = $2 WHERE key = $3;`)).
+		WithArgs(4, now, "account:test").WillReturnResult(sqlmock.NewResult(0, 1))
+	s.mock.ExpectCommit()
+	err := s.persistent.UpdateLoginAttempts(ctx, []string{"ip:192.0.2.1", "account:test"}, func(attempts []LoginAttempts) []LoginAttempts {
+		require.Equal(s.T(), "ip:192.0.2.1", attempts[0].Key, "attempts are in the order of the keys")
+		require.Equal(s.T(), LoginAttempts{Key: "account:test", Failures: 3, LastFailure: lastFailure}, attempts[1])
+		for i := range attempts {
+			attempts[i].Failures++
+			attempts[i].LastFailure = now
+		}
+		return attempts
+	})
+	require.NoError(s.T(), err)
+
+	s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM login_attempts WHERE key = $1;`)).WithArgs("account:test").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(s.T(), s.persistent.DeleteLoginAttempts(ctx, "account:test"))
+
+	s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM login_attempts WHERE last_failure < $1;`)).WithArgs(staleBefore).
+		WillReturnResult(sqlmock.NewResult(0, 4))
+	deleted, err := s.persistent.DeleteStaleLoginAttempts(ctx, staleBefore)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), int64(4), deleted)
+}
+
+func (s *Suite) TestSigningKeys() {
+	createdAt := time.Unix(1637603397, 0)
+	expiresAt := createdAt.Add(2 * time.Hour)
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT kid, algorithm, private_key, created_at, expires_at FROM "signing_keys" WHERE expires_at IS NULL OR expires_at > now() ORDER BY created_at`)).
+		WillReturnRows(sqlmock.NewRows([]string{"kid", "algorithm", "private_key", "created_at", "expires_at"}).
+			AddRow("old", "EdDSA", "PEM", createdAt, expiresAt).
+			AddRow("new", "EdDSA", "PEM", createdAt, nil))
+	keys, err := s.persistent.GetSigningKeys(ctx)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []SigningKey{
+		{Kid: "old", Algorithm: "EdDSA", PrivateKey: "PEM", CreatedAt: createdAt, ExpiresAt: &expiresAt},
+		{Kid: "new", Algorithm: "EdDSA", PrivateKey: "PEM", CreatedAt: createdAt},
+	}, keys)
+
+	s.mock.ExpectBegin()
+	s.mock.ExpectExec(regexp.QuoteMeta(`UPDATE signing_keys SET expires_at = $1 WHERE expires_at IS NULL;`)).WithArgs(expiresAt).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	s.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO signing_keys (kid, algorithm, private_key, created_at) VALUES ($1, $2, $3, $4);`)).
+		WithArgs("newer", "RS256", "PEM", createdAt).WillReturnResult(sqlmock.NewResult(0, 1))
+	s.mock.ExpectCommit()
+	require.NoError(s.T(), s.persistent.RotateSigningKey(ctx, SigningKey{Kid: "newer", Algorithm: "RS256", PrivateKey: "PEM", CreatedAt: createdAt}, expiresAt))
+
+	s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM signing_keys WHERE expires_at < now();`)).WillReturnResult(sqlmock.NewResult(0, 1))
+	deleted, err := s.persistent.DeleteExpiredSigningKeys(ctx)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), int64(1), deleted)
+}
+
+func (s *Suite) TestContextDeadline() {
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT sports.id_sport, sports.sport_type`)).WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"id_sport", "sport_type"}).AddRow(1, "football"))
+	deadline, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	_, err := s.persistent.GetSports(deadline)
+	require.Error(s.T(), err)
+	require.Less(s.T(), int64(time.Since(started)), int64(time.Second))
+}
+
+func (s *Suite) TestGetUser() {
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT id_user, username, role FROM "users" WHERE id_user=$1 LIMIT 1`)).WithArgs(idUser).
+		WillReturnRows(sqlmock.NewRows([]string{"id_user", "username", "role"}).AddRow(idUser, "test", "coach"))
+	u, err := s.persistent.GetUser(ctx, idUser)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "coach", u.GetRole())
+
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT id_user, username, role FROM "users" WHERE id_user=$1 LIMIT 1`)).WithArgs(idUser).
+		WillReturnRows(sqlmock.NewRows([]string{"id_user", "username", "role"}))
+	_, err = s.persistent.GetUser(ctx, idUser)
+	require.ErrorIs(s.T(), err, ErrUserNotFound)
+}
+
+func (s *Suite) TestSearchUsers() {
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "users" LEFT JOIN user_info ON user_info.id_user = users.id_user WHERE (users.username ILIKE $1 OR user_info.email ILIKE $2 OR user_info.name ILIKE $3 OR user_info.second_name ILIKE $4) AND users.role = $5`)).
+		WithArgs(`%100\%%`, `%100\%%`, `%100\%%`, `%100\%%`, "coach").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(21))
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT users.id_user, users.username, users.role, user_info.email, user_info.name, user_info.second_name, users.banned_at IS NOT NULL AND (users.banned_until IS NULL OR users.banned_until > now()) AS banned, users.banned_until, users.ban_reason FROM "users" LEFT JOIN user_info ON user_info.id_user = users.id_user WHERE (users.username ILIKE $1 OR user_info.email ILIKE $2 OR user_info.name ILIKE $3 OR user_info.second_name ILIKE $4) AND users.role = $5 ORDER BY users.id_user LIMIT 20 OFFSET 20`)).
+		WithArgs(`%100\%%`, `%100\%%`, `%100\%%`, `%100\%%`, "coach").
+		WillReturnRows(sqlmock.NewRows([]string{"id_user", "username", "role", "email", "name", "second_name", "banned", "banned_until", "ban_reason"}).
+			AddRow(idUser, username, "coach", nil, nil, nil, true, nil, "Spam"))
+
+	users, total, err := s.persistent.SearchUsers(ctx, UserSearch{Query: "100%", Role: "coach", Limit: 20, Offset: 20})
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), int64(21), total)
+	require.Equal(s.T(), []UserSummary{{IdUser: idUser, Username: username, Role: "coach", Banned: true, BanReason: "Spam"}}, users)
+}
+
+func (s *Suite) TestBans() {
+	query := regexp.QuoteMeta(`SELECT ban_reason, banned_until FROM "users" WHERE id_user = $1 AND banned_at IS NOT NULL AND (banned_until IS NULL OR banned_until > now()) LIMIT 1`)
+	s.mock.ExpectQuery(query).WithArgs(idUser).WillReturnRows(sqlmock.NewRows([]string{"ban_reason", "banned_until"}))
+	ban, err := s.persistent.GetBan(ctx, idUser)
+	require.NoError(s.T(), err)
+	require.Nil(s.T(), ban)
+
+	until := time.Date(2021, 12, 22, 0, 0, 0, 0, time.UTC)
+	s.mock.ExpectQuery(query).WithArgs(idUser).WillReturnRows(sqlmock.NewRows([]string{"ban_reason", "banned_until"}).AddRow("Spam", until))
+	ban, err = s.persistent.GetBan(ctx, idUser)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), &Ban{Reason: "Spam", Until: &until}, ban)
+
+	s.mock.ExpectExec(regexp.QuoteMeta(`UPDATE users SET banned_at = now(), banned_until = $1, ban_reason = $2 WHERE id_user = $3;`)).
+		WithArgs(nil, "Spam", idUser).WillReturnResult(sqlmock.NewResult(0, 0))
+	require.ErrorIs(s.T(), s.persistent.BanUser(ctx, idUser, Ban{Reason: "Spam"}), ErrUserNotFound)
+}
+
+func (s *Suite) TestRenameSport() {
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT sport_type FROM sports WHERE id_sport = $1 FOR UPDATE;`)).WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"sport_type"}).AddRow("footbal"))
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "sports" WHERE sport_type = $1 AND id_sport <> $2`)).WithArgs("football", 2).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	s.mock.ExpectRollback()
+	_, err := s.persistent.RenameSport(ctx, 2, "football")
+	require.ErrorIs(s.T(), err, ErrDuplicate)
+
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT sport_type FROM sports WHERE id_sport = $1 FOR UPDATE;`)).WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"sport_type"}))
+	s.mock.ExpectRollback()
+	_, err = s.persistent.RenameSport(ctx, 2, "football")
+	require.ErrorIs(s.T(), err, ErrNotFound)
+
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT sport_type FROM sports WHERE id_sport = $1 FOR UPDATE;`)).WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"sport_type"}).AddRow("footbal"))
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "sports" WHERE sport_type = $1 AND id_sport <> $2`)).WithArgs("football", 2).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	s.mock.ExpectExec(regexp.QuoteMeta(`UPDATE sports SET sport_type = $1 WHERE id_sport = $2;`)).WithArgs("football", 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	s.mock.ExpectCommit()
+	previous, err := s.persistent.RenameSport(ctx, 2, "football")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "footbal", previous)
+}
+
+func (s *Suite) TestMergeSports() {
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "sports" WHERE id_sport IN ($1,$2)`)).WithArgs(2, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	s.mock.ExpectRollback()
+	require.ErrorIs(s.T(), s.persistent.MergeSports(ctx, 2, 1), ErrNotFound)
+
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "sports" WHERE id_sport IN ($1,$2)`)).WithArgs(2, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	s.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO person_sports (id_user, id_sport) SELECT id_user, $1 FROM person_sports WHERE id_sport = $2 ON CONFLICT DO NOTHING;`)).
+		WithArgs(1, 2).WillReturnResult(sqlmock.NewResult(0, 4))
+	s.mock.ExpectExec(regexp.QuoteMeta(`UPDATE group_training SET id_sport = $1 WHERE id_sport = $2;`)).WithArgs(1, 2).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM sports WHERE id_sport = $1;`)).WithArgs(2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	s.mock.ExpectCommit()
+	require.NoError(s.T(), s.persistent.MergeSports(ctx, 2, 1))
+}
+
+func (s *Suite) TestAuditLog() {
+	s.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO audit_log (id_actor, impersonated_by, action, target_type, target_id, before, after, ip, request_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);`)).
+		WithArgs(idUser, nil, "user.role_changed", "user", 2, `{"role":"user"}`, `{"role":"coach"}`, "192.0.2.1", "req-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(s.T(), s.persistent.AddAuditEntry(ctx, AuditEntry{
+		IdActor:    &idUser,
+		Action:     "user.role_changed",
+		TargetType: "user",
+		TargetId:   2,
+		Before:     RawJSON(`{"role":"user"}`),
+		After:      RawJSON(`{"role":"coach"}`),
+		IP:         "192.0.2.1",
+		RequestId:  "req-1",
+	}))
+
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "audit_log" WHERE target_type = $1 AND target_id = $2`)).WithArgs("user", 2).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT id_entry, created_at, id_actor, impersonated_by, action, target_type, target_id, before, after, ip, request_id FROM "audit_log" WHERE target_type = $1 AND target_id = $2 ORDER BY id_entry DESC LIMIT 1 OFFSET 2`)).
+		WithArgs("user", 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id_entry", "created_at", "id_actor", "impersonated_by", "action", "target_type", "target_id", "before", "after", "ip", "request_id"}).
+			AddRow(1, time.Unix(1637603397, 0), nil, nil, "user.banned", "user", 2, nil, []byte(`{"reason":"Spam"}`), "", ""))
+	entries, total, err := s.persistent.GetAuditEntries(ctx, AuditFilter{TargetType: "user", TargetId: 2, Limit: 1, Offset: 2})
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), int64(3), total)
+	require.Len(s.T(), entries, 1)
+	require.Nil(s.T(), entries[0].IdActor)
+	require.Nil(s.T(), entries[0].Before)
+	require.JSONEq(s.T(), `{"reason":"Spam"}`, string(entries[0].After))
+
+	s.mock.ExpectBegin()
+	s.mock.ExpectExec(regexp.QuoteMeta(`SELECT set_config('sb.audit_retention', $1, true);`)).WithArgs("86400 seconds").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM audit_log WHERE created_at < now() - current_setting('sb.audit_retention')::interval;`)).
+		WillReturnResult(sqlmock.NewResult(0, 5))
+	s.mock.ExpectCommit()
+	deleted, err := s.persistent.DeleteAuditEntries(ctx, 24*time.Hour)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), int64(5), deleted)
+}
+
+func (s *Suite) TestIdentities() {
+	identity := Identity{Provider: "google", Subject: "sub", Email: "test@example.com", EmailVerified: true}
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT users.id_user, users.username, users.role FROM "user_identities" JOIN users ON users.id_user = user_identities.id_user WHERE user_identities.provider = $1 AND user_identities.subject = $2 LIMIT 1`)).
+		WithArgs("google", "sub").WillReturnRows(sqlmock.NewRows([]string{"id_user", "username", "role"}))
+	_, err := s.persistent.GetIdentityUser(ctx, "google", "sub")
+	require.ErrorIs(s.T(), err, ErrUserNotFound)
+
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO users (username, email_verified_at) VALUES ($1, $2) ON CONFLICT (username) DO NOTHING RETURNING id_user, username, role;`)).
+		WithArgs("test", sqlmock.AnyArg()).WillReturnRows(sqlmock.NewRows([]string{"id_user", "username", "role"}))
+	s.mock.ExpectRollback()
+	_, err = s.persistent.AddExternalUser(ctx, "test", identity)
+	require.ErrorIs(s.T(), err, ErrUsernameTaken)
+
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO users (username, email_verified_at) VALUES ($1, $2) ON CONFLICT (username) DO NOTHING RETURNING id_user, username, role;`)).
+		WithArgs("test-abcde", sqlmock.AnyArg()).WillReturnRows(sqlmock.NewRows([]string{"id_user", "username", "role"}).AddRow(idUser, "test-abcde", "user"))
+	s.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO user_info (id_user, email) VALUES ($1, $2);`)).
+		WithArgs(idUser, identity.Email).WillReturnResult(sqlmock.NewResult(0, 1))
+	s.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO user_identities (provider, subject, id_user, email) VALUES ($1, $2, $3, $4);`)).
+		WithArgs("google", "sub", idUser, identity.Email).WillReturnResult(sqlmock.NewResult(0, 1))
+	s.mock.ExpectCommit()
+	u, err := s.persistent.AddExternalUser(ctx, "test-abcde", identity)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "test-abcde", u.GetUsername())
+
+	s.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO user_identities (provider, subject, id_user, email) VALUES ($1, $2, $3, $4) ON CONFLICT (provider, subject) DO NOTHING;`)).
+		WithArgs("google", "sub", idUser, identity.Email).WillReturnResult(sqlmock.NewResult(0, 0))
+	require.ErrorIs(s.T(), s.persistent.LinkIdentity(ctx, idUser, identity), ErrIdentityLinked)
+}
+
+func (s *Suite) TestAPIKeys() {
+	createdAt := time.Unix(1637603397, 0)
+	key := APIKey{IdUser: idUser, Name: "Club website", Prefix: "sbk_m4zdgnbr", Hash: "hash", Scopes: "trainings:read", TwoFactor: true}
+	s.mock.ExpectBegin()
+	s.mock.ExpectExec(regexp.QuoteMeta(`SELECT id_user FROM users WHERE id_user = $1 FOR UPDATE;`)).WithArgs(idUser).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "api_keys" WHERE id_user = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())`)).
+		WithArgs(idUser).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	s.mock.ExpectRollback()
+	_, err := s.persistent.AddAPIKey(ctx, key, 2)
+	require.ErrorIs(s.T(), err, ErrTooManyAPIKeys)
+
+	s.mock.ExpectBegin()
+	s.mock.ExpectExec(regexp.QuoteMeta(`SELECT id_user FROM users WHERE id_user = $1 FOR UPDATE;`)).WithArgs(idUser).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "api_keys" WHERE id_user = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())`)).
+		WithArgs(idUser).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	s.mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO api_keys (id_user, name, prefix, hash, scopes, expires_at, two_factor) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id_key, created_at;`)).
+		WithArgs(idUser, "Club website", "sbk_m4zdgnbr", "hash", "trainings:read", nil, true).
+		WillReturnRows(sqlmock.NewRows([]string{"id_key", "created_at"}).AddRow(7, createdAt))
+	s.mock.ExpectCommit()
+	stored, err := s.persistent.AddAPIKey(ctx, key, 2)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), int64(7), stored.Id)
+	require.Equal(s.T(), createdAt, stored.CreatedAt)
+
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT api_keys.id_key, api_keys.id_user, api_keys.name, api_keys.prefix, api_keys.hash, api_keys.scopes, api_keys.created_at, api_keys.last_used_at, api_keys.expires_at, api_keys.two_factor, users.role FROM "api_keys" JOIN users ON users.id_user = api_keys.id_user WHERE api_keys.prefix = $1 AND api_keys.revoked_at IS NULL AND (users.banned_at IS NULL OR users.banned_until <= now()) LIMIT 1`)).
+		WithArgs("sbk_m4zdgnbr").WillReturnRows(sqlmock.NewRows([]string{"id_key", "id_user", "name", "prefix", "hash", "scopes", "created_at", "last_used_at", "expires_at", "two_factor", "role"}).
+		AddRow(7, idUser, "Club website", "sbk_m4zdgnbr", "hash", "trainings:read", createdAt, nil, nil, true, "coach"))
+	found, err := s.persistent.GetAPIKey(ctx, "sbk_m4zdgnbr")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "coach", found.Role)
+	require.True(s.T(), found.TwoFactor)
+	require.Nil(s.T(), found.LastUsedAt)
+
+	s.mock.ExpectExec(regexp.QuoteMeta(`UPDATE api_keys SET revoked_at = now() WHERE id_key = $1 AND id_user = $2 AND revoked_at IS NULL;`)).
+		WithArgs(7, idUser).WillReturnResult(sqlmock.NewResult(0, 0))
+	require.ErrorIs(s.T(), s.persistent.RevokeAPIKey(ctx, idUser, 7), ErrAPIKeyNotFound)
 }
 
 func (s *Suite) TestRemoveSessions() {
@@ -253,7 +826,7 @@ func (s *Suite) TestRemoveSessions() {
 	s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "sessions" WHERE token=$1`)).WithArgs(mockToken.Token).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	s.mock.ExpectCommit()
-	err := s.persistent.RemoveSession(mockToken.Token)
+	err := s.persistent.RemoveSession(ctx, mockToken.Token)
 	require.NoError(s.T(), err)
 }
 
@@ -271,7 +844,7 @@ person_sports.id_user=user_info.id_user left join sports on person_sports.id_spo
 			"height", "weight", "location", "about", "age", "sports"}).AddRow(mockFilteredProfile.IdUser, mockFilteredProfile.IdLevel, mockFilteredProfile.Name, mockFilteredProfile.SecondName, mockFilteredProfile.Sex,
 			mockFilteredProfile.Height, mockFilteredProfile.Weight, mockFilteredProfile.Location, mockFilteredProfile.About, mockFilteredProfile.Age, mockFilteredProfile.Sports))
 
-	res := s.persistent.GetFilteredProfiles(filter)
+	res := s.persistent.GetFilteredProfiles(ctx, filter)
 	require.Equal(s.T(), []FilteredUserProfileImpl{mockFilteredProfile}, res)
 }
 
@@ -279,10 +852,27 @@ func (s *Suite) TestGetUserSport() {
 	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT s.sport_type FROM "person_sports" join sports s on s.id_sport = person_sports.id_sport WHERE id_user=$1`)).WithArgs(sqlmock.AnyArg()).
 		WillReturnRows(sqlmock.NewRows([]string{"sport_type"}).AddRow("football"))
 
-	res := s.persistent.GetUserSport(idUser)
+	res := s.persistent.GetUserSport(ctx, idUser)
 	require.Equal(s.T(), mockSports, res)
 }
 
+func (s *Suite) TestGetGroupTraining() {
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT group_training.kind, group_training.id_training`)).WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"id_training"}))
+	_, err := s.persistent.GetGroupTraining(ctx, 3)
+	require.ErrorIs(s.T(), err, ErrNotFound)
+
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT group_training.kind, group_training.id_training`)).WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"id_training", "location"}).AddRow(3, "Park"))
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "member_training" WHERE id_training=$1`)).WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"id_training", "id_user", "training_owner"}).AddRow(3, idUser, true).AddRow(3, 2, false))
+	res, err := s.persistent.GetGroupTraining(ctx, 3)
+	require.NoError(s.T(), err)
+	training := res.(*groupTraining)
+	require.Equal(s.T(), idUser, training.Owner)
+	require.Equal(s.T(), []int64{idUser, 2}, training.ParticipantsIds)
+}
+
 func (s *Suite) TestGetGroupTrainings() {
 	filter := groupTrainingMockFilter{
 		Location: []string{"Avtovo"},
@@ -294,7 +884,7 @@ func (s *Suite) TestGetGroupTrainings() {
 			AddRow(mockGroupTraining.Kind, mockGroupTraining.IdTraining, mockGroupTraining.Location, mockGroupTraining.MeetDate, mockGroupTraining.Duration, mockGroupTraining.Sport, mockGroupTraining.IdLevel, mockGroupTraining.Comment, mockGroupTraining.Fee))
 	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "member_training" WHERE id_training=$1`)).WithArgs(mockGroupTraining.IdTraining).
 		WillReturnRows(sqlmock.NewRows([]string{"id_user", "id_training", "training_owner"}).AddRow(idUser, mockGroupTraining.IdTraining, true))
-	res := s.persistent.GetGroupTrainings(&filter)
+	res := s.persistent.GetGroupTrainings(ctx, &filter)
 	require.Equal(s.T(), []PersistentObject{&mockGroupTraining}, res)
 }
 
@@ -306,9 +896,22 @@ func (s *Suite) TestAddGroupTraining() {
 		WillReturnRows(sqlmock.NewRows([]string{"id_training"}).AddRow(mockGroupTraining.IdTraining))
 	s.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "member_training" ("id_user","id_training","training_owner") VALUES ($1,$2,$3)`)).WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
 		WillReturnResult(sqlmock.NewResult(idUser, 1))
-	res, err := s.persistent.AddGroupTraining(&mockGroupTraining)
+	s.mock.ExpectCommit()
+	res, err := s.persistent.AddGroupTraining(ctx, &mockGroupTraining)
 	require.NoError(s.T(), err)
 	require.Equal(s.T(), &mockGroupTraining, res)
+
+	invalid := mockGroupTraining
+	invalid.TrainingDuration = "long"
+	_, err = s.persistent.AddGroupTraining(ctx, &invalid)
+	require.Equal(s.T(), map[string]string{"training_duration": "must be a duration like 1h30m"}, errs.Fields(err))
+
+	invalid.TrainingDuration = "1h"
+	invalid.Sport = "chess"
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "sports" WHERE sport_type=$1`)).WithArgs("chess").
+		WillReturnRows(sqlmock.NewRows([]string{"id_sport", "sport_type"}))
+	_, err = s.persistent.AddGroupTraining(ctx, &invalid)
+	require.Equal(s.T(), map[string]string{"sport": "unknown sport"}, errs.Fields(err))
 }
 
 func (s *Suite) TestUpdateGroupTraining() {
@@ -321,7 +924,7 @@ func (s *Suite) TestUpdateGroupTraining() {
 	s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "member_training" WHERE id_training=$1 AND id_user NOT IN ($2) AND training_owner!=$3`)).WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 	s.mock.ExpectCommit()
-	res, err := s.persistent.UpdateGroupTraining(&mockGroupTraining)
+	res, err := s.persistent.UpdateGroupTraining(ctx, &mockGroupTraining)
 	require.NoError(s.T(), err)
 	require.Equal(s.T(), &mockGroupTraining, res)
 }
@@ -331,8 +934,14 @@ func (s *Suite) TestDeleteGroupTraining() {
 	s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "group_training" WHERE id_training=$1`)).WithArgs(sqlmock.AnyArg()).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	s.mock.ExpectCommit()
-	err := s.persistent.DeleteGroupTraining(mockGroupTraining.IdTraining)
+	err := s.persistent.DeleteGroupTraining(ctx, mockGroupTraining.IdTraining)
 	require.NoError(s.T(), err)
+	s.mock.ExpectBegin()
+	s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "group_training" WHERE id_training=$1`)).WithArgs(sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	s.mock.ExpectCommit()
+	err = s.persistent.DeleteGroupTraining(ctx, mockGroupTraining.IdTraining)
+	require.ErrorIs(s.T(), err, ErrNotFound)
 }
 
 func (s *Suite) TestGetUserTrainings() {
@@ -344,11 +953,17 @@ as gt join member_training on gt.id_training=member_training.id_training WHERE t
 		mockGroupTraining.IdLevel, mockGroupTraining.Fee, mockGroupTraining.Kind, mockGroupTraining.Duration, mockGroupTraining.Comment, idUser))
 	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "member_training" WHERE id_training=$1`)).WithArgs(sqlmock.AnyArg()).WillReturnRows(sqlmock.NewRows([]string{"id_user", "id_training", "training_owner"}).AddRow(idUser, mockGroupTraining.IdTraining, true))
 
-	trainings, err := s.persistent.GetUserTrainings(idUser)
+	trainings, err := s.persistent.GetUserTrainings(ctx, idUser)
 	require.NoError(s.T(), err)
 	require.Equal(s.T(), []PersistentObject{&mockGroupTraining}, trainings)
 }
 
+func (s *Suite) TestNotify() {
+	s.mock.ExpectExec(regexp.QuoteMeta(`SELECT pg_notify($1, $2);`)).WithArgs("sb_messenger", `{"users":[1]}`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(s.T(), s.persistent.Notify(ctx, "sb_messenger", `{"users":[1]}`))
+}
+
 func (s *Suite) AfterTest(_, _ string) {
 	require.NoError(s.T(), s.mock.ExpectationsWereMet())
 }
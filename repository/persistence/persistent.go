@@ -1,201 +1,466 @@
 package persistence
 
 import (
+	"SB/service/repository/errs"
+	"SB/service/repository/logging"
 	"encoding/json"
 	"errors"
 	"gorm.io/gorm/clause"
+	"sort"
 	"strings"
 	"time"
 
-	//"context"
+	"context"
 	//"database/sql"
 	//"errors"
 	"fmt"
-	"github.com/labstack/gommon/log"
 	"gorm.io/gorm"
 	//"gorm.io/gorm/schema"
 	//"strconv"
 )
 
+// ErrSessionRotated is returned when a refresh token has already been
+// exchanged for a new one
+var ErrSessionRotated = errors.New("session is already rotated")
+
+// ErrInvalidAccountToken is returned for unknown, used or expired tokens
+// sent by e-mail
+var ErrInvalidAccountToken = errors.New("invalid or expired token")
+
+// ErrUserNotFound is returned when there is no user with the login
+var ErrUserNotFound = errs.New(errs.ErrNotFound, "no such user")
+
+// ErrNoSession is returned when there is no active session to revoke
+var ErrNoSession = errs.New(errs.ErrNotFound, "no such session")
+
+// ErrTwoFactorEnabled is returned when a new TOTP secret is set while two-factor
+// authentication is already enabled
+var ErrTwoFactorEnabled = errs.New(errs.ErrConflict, "two-factor authentication is already enabled")
+
+// ErrUsernameTaken is returned when a user created from an external
+// identity gets a username that is already used
+var ErrUsernameTaken = errs.New(errs.ErrConflict, "username is already taken")
+
+// ErrIdentityLinked is returned when an external identity is already linked
+// to a user
+var ErrIdentityLinked = errs.New(errs.ErrConflict, "identity is already linked to a user")
+
+// likeEscaper escapes user input used in LIKE patterns
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// ErrNotFound is returned for unknown sports, levels, trainings and messages
+var ErrNotFound = errs.ErrNotFound
+
+// ErrDuplicate is returned when a dictionary already has an entry with the
+// same name
+var ErrDuplicate = errs.New(errs.ErrConflict, "already exists")
+
+// ErrInUse is returned when a sport referenced by profiles or trainings is
+// deleted, it has to be merged into another one instead
+var ErrInUse = errs.New(errs.ErrConflict, "still in use")
+
+// ErrAPIKeyNotFound is returned for unknown and revoked API keys
+var ErrAPIKeyNotFound = errs.New(errs.ErrNotFound, "no such API key")
+
+// ErrTooManyAPIKeys is returned when a user already has the maximum number
+// of active API keys
+var ErrTooManyAPIKeys = errs.New(errs.ErrConflict, "too many API keys")
+
+// Purposes of tokens sent by e-mail
+const (
+	PurposePasswordReset     = "password_reset"
+	PurposeEmailVerification = "email_verification"
+)
+
+const addSessionStatement = `INSERT INTO sessions (id_user, login_time, token, expires, family, device, user_agent, ip, two_factor) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);`
+
 type (
 	Persistent interface {
-		GetRole(id int64) string
-		GetUserAuthParams(login string) (User, error)
-		AddUser(login string, password string) (User, error)
-		DeleteUser(id int64) bool
-		GetUserProfile(id int64) (PersistentObject, error)
-		UpdateUserProfile(profile PersistentObject, sports ...string) bool
-		AddSession(token Token) bool
-		GetSession(id string) (Token, error)
-		RemoveSession(id string) error
-		CheckPassword(login, password string) (bool, error)
-		GetUserSport(id int64) []string
-		GetFilteredProfiles(filter Filter) []FilteredUserProfileImpl
-		GetGroupTrainings(filter Filter) []PersistentObject
-		GetGroupTraining(id int64) PersistentObject
-		AddGroupTraining(training PersistentObject) (PersistentObject, error)
-		UpdateGroupTraining(training PersistentObject) (PersistentObject, error)
-		DeleteGroupTraining(id int64) error
-		GetUserTrainings(idUser int64) ([]PersistentObject, error)
-		AddMessage(msg PersistentObject) error
-		AddRequest(request PersistentObject) error
-		UpdateRequest(request PersistentObject) (PersistentObject, error)
-		GetDialogs(idUser int64) ([]PersistentObject, error)
-		GetMessages(idUsers []int64, t time.Time) ([]PersistentObject, error)
+		GetRole(ctx context.Context, id int64) string
+		GetUserAuthParams(ctx context.Context, login string) (User, error)
+		GetUsername(ctx context.Context, id int64) (string, error)
+		GetUser(ctx context.Context, id int64) (User, error)
+		AddUser(ctx context.Context, login string, passwordHash string) (User, error)
+		// DeleteUser deletes the user with the trainings they own or returns
+		// ErrUserNotFound
+		DeleteUser(ctx context.Context, id int64) error
+		// GetUserProfile returns the profile or ErrUserNotFound
+		GetUserProfile(ctx context.Context, id int64) (PersistentObject, error)
+		// UpdateUserProfile returns ErrUserNotFound for users without a profile
+		UpdateUserProfile(ctx context.Context, profile PersistentObject, sports ...string) error
+		AddSession(ctx context.Context, token Token) error
+		GetSession(ctx context.Context, id string) (Token, error)
+		RemoveSession(ctx context.Context, id string) error
+		RotateSession(ctx context.Context, id string, next Token) error
+		RevokeSessionFamily(ctx context.Context, family string) error
+		GetSessions(ctx context.Context, idUser int64) ([]SessionInfo, error)
+		HasSession(ctx context.Context, idUser int64, family string) (bool, error)
+		RevokeSession(ctx context.Context, idUser int64, family string) error
+		RevokeUserSessions(ctx context.Context, idUser int64, except string, revokeKeys bool) (int64, error)
+		DeleteExpiredSessions(ctx context.Context) (int64, error)
+		AddSecurityEvent(ctx context.Context, idUser int64, event string, details map[string]interface{}) error
+		GetPasswordHash(ctx context.Context, login string) (string, error)
+		UpdatePasswordHash(ctx context.Context, login, hash string) error
+		AddAccountToken(ctx context.Context, idUser int64, purpose, tokenHash string, expires time.Time) error
+		ResetPassword(ctx context.Context, tokenHash, passwordHash string) (int64, error)
+		VerifyEmail(ctx context.Context, tokenHash string) (int64, error)
+		GetTOTP(ctx context.Context, idUser int64) (*TOTP, error)
+		SetTOTPSecret(ctx context.Context, idUser int64, secret string) error
+		EnableTOTP(ctx context.Context, idUser int64, step int64, recoveryCodeHashes []string) error
+		UseTOTPStep(ctx context.Context, idUser int64, step int64) (bool, error)
+		UseRecoveryCode(ctx context.Context, idUser int64, codeHash string) (bool, error)
+		DisableTOTP(ctx context.Context, idUser int64) error
+		AddTwoFactorChallenge(ctx context.Context, id string, idUser int64, expires time.Time) error
+		// AttemptTwoFactorChallenge counts an attempt to enter a code and
+		// returns false for unknown or expired challenges and after
+		// maxAttempts attempts
+		AttemptTwoFactorChallenge(ctx context.Context, id string, maxAttempts int) (bool, error)
+		// UseTwoFactorChallenge deletes the challenge and returns false if it
+		// was used or has expired
+		UseTwoFactorChallenge(ctx context.Context, id string) (bool, error)
+		DeleteExpiredTwoFactorChallenges(ctx context.Context) (int64, error)
+		// UpdateLoginAttempts locks the attempts of the keys and saves the
+		// ones returned by update in one transaction
+		UpdateLoginAttempts(ctx context.Context, keys []string, update func(attempts []LoginAttempts) []LoginAttempts) error
+		DeleteLoginAttempts(ctx context.Context, key string) error
+		DeleteStaleLoginAttempts(ctx context.Context, before time.Time) (int64, error)
+		GetSigningKeys(ctx context.Context) ([]SigningKey, error)
+		GetIdentityUser(ctx context.Context, provider, subject string) (User, error)
+		AddExternalUser(ctx context.Context, username string, identity Identity) (User, error)
+		LinkIdentity(ctx context.Context, idUser int64, identity Identity) error
+		SearchUsers(ctx context.Context, search UserSearch) ([]UserSummary, int64, error)
+		SetRole(ctx context.Context, idUser int64, role string) error
+		BanUser(ctx context.Context, idUser int64, ban Ban) error
+		UnbanUser(ctx context.Context, idUser int64) error
+		GetBan(ctx context.Context, idUser int64) (*Ban, error)
+		GetSports(ctx context.Context) ([]SportInfo, error)
+		AddSport(ctx context.Context, sportType string) (SportInfo, error)
+		RenameSport(ctx context.Context, idSport int64, sportType string) (string, error)
+		DeleteSport(ctx context.Context, idSport int64) error
+		MergeSports(ctx context.Context, from, into int64) error
+		GetLevels(ctx context.Context) ([]LevelInfo, error)
+		AddLevel(ctx context.Context, level LevelInfo) (LevelInfo, error)
+		UpdateLevel(ctx context.Context, level LevelInfo) (LevelInfo, error)
+		DeleteLevel(ctx context.Context, idLevel int64) error
+		DeleteMessage(ctx context.Context, idMessage int64) error
+		AddAuditEntry(ctx context.Context, entry AuditEntry) error
+		GetAuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, int64, error)
+		// DeleteAuditEntries deletes entries older than retention, the
+		// database refuses to delete any other entry
+		DeleteAuditEntries(ctx context.Context, retention time.Duration) (int64, error)
+		AddAPIKey(ctx context.Context, key APIKey, max int) (APIKey, error)
+		GetAPIKeys(ctx context.Context, idUser int64) ([]APIKey, error)
+		GetAPIKey(ctx context.Context, prefix string) (APIKey, error)
+		RevokeAPIKey(ctx context.Context, idUser int64, idKey int64) error
+		TouchAPIKey(ctx context.Context, idKey int64) error
+		RotateSigningKey(ctx context.Context, key SigningKey, retireAt time.Time) error
+		DeleteExpiredSigningKeys(ctx context.Context) (int64, error)
+		GetUserSport(ctx context.Context, id int64) []string
+		GetFilteredProfiles(ctx context.Context, filter Filter) []FilteredUserProfileImpl
+		GetGroupTrainings(ctx context.Context, filter Filter) []PersistentObject
+		// GetGroupTraining returns the training with its members or ErrNotFound
+		GetGroupTraining(ctx context.Context, id int64) (PersistentObject, error)
+		AddGroupTraining(ctx context.Context, training PersistentObject) (PersistentObject, error)
+		UpdateGroupTraining(ctx context.Context, training PersistentObject) (PersistentObject, error)
+		DeleteGroupTraining(ctx context.Context, id int64) error
+		GetUserTrainings(ctx context.Context, idUser int64) ([]PersistentObject, error)
+		AddMessage(ctx context.Context, msg PersistentObject) error
+		AddRequest(ctx context.Context, request PersistentObject) error
+		UpdateRequest(ctx context.Context, request PersistentObject) (PersistentObject, error)
+		GetDialogs(ctx context.Context, idUser int64) ([]PersistentObject, error)
+		GetMessages(ctx context.Context, idUsers []int64, t time.Time) ([]PersistentObject, error)
 		//GetLevel(id int64) (Level, error)
+		// Notify sends payload to the listeners of the channel on every
+		// connection
+		Notify(ctx context.Context, channel, payload string) error
+		// Ping checks the connection to the database
+		Ping(ctx context.Context) error
 	}
 
 	persistent struct {
-		db *gorm.DB
+		db     *gorm.DB
+		logger *logging.Logger
 		//db *sql.DB
 	}
 )
 
-func NewPersistent(dbConnection *gorm.DB) Persistent {
+func NewPersistent(dbConnection *gorm.DB, logger *logging.Logger) Persistent {
 	return &persistent{
-		db: dbConnection,
+		db:     dbConnection,
+		logger: logger,
+	}
+}
+
+func (persistent *persistent) Ping(ctx context.Context) error {
+	sqlDB, err := persistent.db.DB()
+	if err != nil {
+		return err
 	}
+	return sqlDB.PingContext(ctx)
 }
 
-func (persistent *persistent) GetRole(id int64) string {
+func (persistent *persistent) GetRole(ctx context.Context, id int64) string {
 	role := ""
-	res := persistent.db.Table(`users`).Select(`role`).Where(`id_user=?`, id).Find(&role)
+	res := persistent.db.WithContext(ctx).Table(`users`).Select(`role`).Where(`id_user=?`, id).Find(&role)
 	if res.Error == gorm.ErrRecordNotFound {
-		log.Error(fmt.Errorf("no user with id %d", id))
+		persistent.log(ctx).Warn("no such user", logging.Int("id_user", id))
 		return ""
 	} else if res.Error != nil {
-		log.Error(res.Error)
+		persistent.logError(ctx, "GetRole", res.Error)
 		return ""
 	}
 	return role
 }
 
-func (persistent *persistent) CheckPassword(login, password string) (bool, error) {
-	match := struct {
-		Pswmatch bool
-	}{}
-	res := persistent.db.Table(`user_auth_info`).Select(`(password = crypt(?, password)) AS pswmatch`, password).Where(`login=?`, login).Find(&match)
-	if err := res.Error; err == gorm.ErrRecordNotFound {
-		log.Errorf("no user with login %s", login)
-		return false, fmt.Errorf("no user with login %s", login)
-	} else if res.Error != nil {
-		log.Error(res.Error)
-		return false, errors.New("failed to check password")
+func (persistent *persistent) GetUsername(ctx context.Context, id int64) (string, error) {
+	u := user{}
+	res := persistent.db.WithContext(ctx).Table(`users`).Select(`username`).Where(`id_user=?`, id).Take(&u)
+	if err := res.Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", ErrUserNotFound
+	} else if err != nil {
+		persistent.logError(ctx, "GetUsername", err)
+		return "", errors.New("failed to get user")
+	}
+	return u.Username, nil
+}
+
+// GetUser returns the user or ErrUserNotFound
+func (persistent *persistent) GetUser(ctx context.Context, id int64) (User, error) {
+	u := user{}
+	res := persistent.db.WithContext(ctx).Table(`users`).Select(`id_user, username, role`).Where(`id_user=?`, id).Take(&u)
+	if err := res.Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	} else if err != nil {
+		persistent.logError(ctx, "GetUser", err)
+		return nil, errors.New("failed to get user")
 	}
+	return &u, nil
+}
+
+func (persistent *persistent) GetPasswordHash(ctx context.Context, login string) (string, error) {
+	auth := userAuthInfo{}
+	res := persistent.db.WithContext(ctx).Table(`user_auth_info`).Select(`password`).Where(`login=?`, login).Take(&auth)
+	if err := res.Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		persistent.log(ctx).Warn("no such user", logging.String("login", login))
+		return "", ErrUserNotFound
+	} else if err != nil {
+		persistent.logError(ctx, "GetPasswordHash", err)
+		return "", errors.New("failed to check password")
+	}
+
+	return auth.Password, nil
+}
+
+func (persistent *persistent) UpdatePasswordHash(ctx context.Context, login, hash string) error {
+	res := persistent.db.WithContext(ctx).Exec(`UPDATE user_auth_info SET password = ? WHERE login = ?;`, hash, login)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "UpdatePasswordHash", err)
+		return errors.New("failed to update password")
+	}
+	if res.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// AddAccountToken stores a token sent by e-mail, older unused tokens of the
+// user with the same purpose stop working
+func (persistent *persistent) AddAccountToken(ctx context.Context, idUser int64, purpose, tokenHash string, expires time.Time) error {
+	return persistent.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Exec(`DELETE FROM account_tokens WHERE id_user = ? AND purpose = ? AND used_at IS NULL;`, idUser, purpose)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "AddAccountToken", err)
+			return err
+		}
+		res = tx.Exec(`INSERT INTO account_tokens (token_hash, id_user, purpose, expires) VALUES (?, ?, ?, ?);`, tokenHash, idUser, purpose, expires)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "AddAccountToken", err)
+			return err
+		}
+		return nil
+	})
+}
+
+// useAccountToken marks a valid token as used and returns its user
+func (persistent *persistent) useAccountToken(tx *gorm.DB, purpose, tokenHash string) (int64, error) {
+	var idUser int64
+	res := tx.Raw(`UPDATE account_tokens SET used_at = now() WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires > now() RETURNING id_user;`,
+		tokenHash, purpose).Scan(&idUser)
+	if err := res.Error; err != nil {
+		persistent.logError(tx.Statement.Context, "useAccountToken", err)
+		return 0, err
+	}
+	if res.RowsAffected == 0 {
+		return 0, ErrInvalidAccountToken
+	}
+	return idUser, nil
+}
+
+// ResetPassword uses the password reset token, sets the new password, ends
+// all sessions of the user and revokes the API keys
+func (persistent *persistent) ResetPassword(ctx context.Context, tokenHash, passwordHash string) (idUser int64, err error) {
+	err = persistent.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		idUser, err = persistent.useAccountToken(tx, PurposePasswordReset, tokenHash)
+		if err != nil {
+			return err
+		}
+		res := tx.Exec(`UPDATE user_auth_info SET password = ? WHERE id_user = ?;`, passwordHash, idUser)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "ResetPassword", err)
+			return err
+		}
+		res = tx.Exec(`DELETE FROM sessions WHERE id_user = ?;`, idUser)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "ResetPassword", err)
+			return err
+		}
+		res = tx.Exec(`UPDATE api_keys SET revoked_at = now() WHERE id_user = ? AND revoked_at IS NULL;`, idUser)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "ResetPassword", err)
+			return err
+		}
+		return nil
+	})
+	return
+}
 
-	return match.Pswmatch, nil
+func (persistent *persistent) VerifyEmail(ctx context.Context, tokenHash string) (idUser int64, err error) {
+	err = persistent.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		idUser, err = persistent.useAccountToken(tx, PurposeEmailVerification, tokenHash)
+		if err != nil {
+			return err
+		}
+		res := tx.Exec(`UPDATE users SET email_verified_at = now() WHERE id_user = ? AND email_verified_at IS NULL;`, idUser)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "VerifyEmail", err)
+			return err
+		}
+		return nil
+	})
+	return
 }
 
-func (persistent *persistent) GetUserAuthParams(login string) (User, error) {
+func (persistent *persistent) GetUserAuthParams(ctx context.Context, login string) (User, error) {
 	params := user{
 		Username: login,
 	}
-	res := persistent.db.Table(`users`).Select(`id_user, role`).Where(`username=?`, &params.Username).Find(&params)
-	if res.Error == gorm.ErrRecordNotFound {
-		log.Error(fmt.Errorf("no user with login %s", login))
-		return nil, fmt.Errorf("no user with login %s", login)
-	} else if res.Error != nil {
-		log.Error(res.Error)
+	res := persistent.db.WithContext(ctx).Table(`users`).Select(`id_user, role`).Where(`username=?`, &params.Username).Take(&params)
+	if err := res.Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		persistent.log(ctx).Warn("no such user", logging.String("login", login))
+		return nil, ErrUserNotFound
+	} else if err != nil {
+		persistent.logError(ctx, "GetUserAuthParams", err)
 		return nil, errors.New("failed to get user auth params")
 	}
-	log.Info("user auth params ", params)
 	return &params, nil
 }
-func (persistent *persistent) AddUser(login string, password string) (userParams User, err error) {
-	log.Info("add user start")
+
+// AddUser creates a user with the password already hashed by password.Hasher
+func (persistent *persistent) AddUser(ctx context.Context, login string, passwordHash string) (userParams User, err error) {
 	params := user{
 		Username: login,
 	}
 	userParams = &params
-	tx := persistent.db.Begin()
+	tx := persistent.db.WithContext(ctx).Begin()
 	defer func(err error) {
 		if r := recover(); r != nil {
-			log.Error("rolling back")
+			persistent.log(ctx).Error("adding user panicked, rolling back", logging.Any("panic", r))
 			tx.Rollback()
 			err = errors.New("failed to create user")
 		}
 	}(err)
 
 	if err := tx.Error; err != nil {
-		log.Error(err)
+		persistent.logError(ctx, "AddUser", err)
 		return nil, errors.New("problem with database")
 	}
 
 	res := tx.Table(`users`).Select(`username`).Create(&params)
 	if err := res.Error; err != nil {
 		tx.Rollback()
-		log.Error(err)
+		persistent.logError(ctx, "AddUser", err)
 		return nil, errors.New("failed to create user")
 	}
 	params.Role = "user"
 
-	log.Info(params)
-
 	res = tx.Table(`user_info`).Select(`id_user`).Create(&params)
 	if err := res.Error; err != nil {
 		tx.Rollback()
-		log.Error(err)
+		persistent.logError(ctx, "AddUser", err)
 		return nil, errors.New("failed to create user")
 	}
 
-	res = tx.Exec(`INSERT INTO user_auth_info  (id_user, login, password) VALUES (?, ?,  crypt(?, gen_salt('md5')));`, params.IdUser, params.Username, password)
+	res = tx.Exec(`INSERT INTO user_auth_info  (id_user, login, password) VALUES (?, ?, ?);`, params.IdUser, params.Username, passwordHash)
 	if err := res.Error; err != nil || res.RowsAffected == 0 {
 		tx.Rollback()
-		log.Error(err)
+		persistent.logError(ctx, "AddUser", err)
 		return nil, errors.New("failed to create user")
 	}
 
 	if err := tx.Commit().Error; err != nil {
-		log.Error(err)
+		persistent.logError(ctx, "AddUser", err)
 		return nil, errors.New("failed to create user")
 	}
 	return
 }
 
-func (persistent *persistent) DeleteUser(idUser int64) bool {
-	tx := persistent.db.Begin()
+func (persistent *persistent) DeleteUser(ctx context.Context, idUser int64) error {
+	tx := persistent.db.WithContext(ctx).Begin()
 	subQuery := tx.Table(`member_training`).Select(`id_training`).Where(`id_user=? AND training_owner=true`, idUser)
 	res := tx.Table(`group_training`).Where(`id_training IN ?`, subQuery).Delete(&groupTraining{})
 	if err := res.Error; err != nil {
 		tx.Rollback()
-		log.Error(err)
-		return false
+		persistent.logError(ctx, "DeleteUser", err)
+		return errors.New("failed to delete user")
 	}
 	sqlStatement := `DELETE FROM users WHERE id_user = ?;`
 	res = tx.Exec(sqlStatement, idUser)
-	if err := res.Error; err != nil || res.RowsAffected == 0 {
+	if err := res.Error; err != nil {
 		tx.Rollback()
-		log.Error(err)
-		return false
+		persistent.logError(ctx, "DeleteUser", err)
+		return errors.New("failed to delete user")
 	}
-	tx.Commit()
-	return true
+	if res.RowsAffected == 0 {
+		tx.Rollback()
+		return ErrUserNotFound
+	}
+	if err := tx.Commit().Error; err != nil {
+		persistent.logError(ctx, "DeleteUser", err)
+		return errors.New("failed to delete user")
+	}
+	return nil
 }
 
-func (persistent *persistent) GetUserProfile(id int64) (PersistentObject, error) {
+func (persistent *persistent) GetUserProfile(ctx context.Context, id int64) (PersistentObject, error) {
 	var profile UserProfileImpl
 	profile.IdUser = id
-	res := persistent.db.Table(`user_info`).Where(`id_user=?`, profile.IdUser).First(&profile)
-	if err := res.Error; err != nil {
-		log.Error(err)
-		return nil, err
+	res := persistent.db.WithContext(ctx).Table(`user_info`).Where(`id_user=?`, profile.IdUser).First(&profile)
+	if err := res.Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	} else if err != nil {
+		persistent.logError(ctx, "GetUserProfile", err)
+		return nil, errors.New("failed to get profile")
 	}
 	return &profile, nil
 }
 
-func (persistent *persistent) UpdateUserProfile(profile PersistentObject, sports ...string) bool {
+func (persistent *persistent) UpdateUserProfile(ctx context.Context, profile PersistentObject, sports ...string) error {
 	p := UserProfileImpl{}
 	err := json.Unmarshal(profile.Serialize(), &p)
 	if err != nil {
-		log.Error(err)
-		return false
+		persistent.logError(ctx, "UpdateUserProfile", err)
+		return errors.New("failed to update profile")
 	}
-	tx := persistent.db.Begin()
+	tx := persistent.db.WithContext(ctx).Begin()
 	res := tx.Table(`user_info`).Where(`id_user=?`, p.IdUser).Updates(&p)
-	if err := res.Error; err != nil || res.RowsAffected == 0 {
-		log.Error(err)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "UpdateUserProfile", err)
 		tx.Rollback()
-		return false
+		return errors.New("failed to update profile")
+	}
+	if res.RowsAffected == 0 {
+		tx.Rollback()
+		return ErrUserNotFound
 	}
 
 	if len(sports) > 0 {
@@ -210,8 +475,8 @@ func (persistent *persistent) UpdateUserProfile(profile PersistentObject, sports
 		res = tx.Table(`sports`).Where(`sport_type IN ?`, sports).Find(&st)
 		if res.Error != nil {
 			tx.Rollback()
-			log.Error("cannot find sports ", sports)
-			return false
+			persistent.log(ctx).Error("failed to find sports", logging.Any("sports", sports), logging.Err(res.Error))
+			return errors.New("failed to update profile")
 		}
 
 		for _, s := range st {
@@ -223,8 +488,8 @@ func (persistent *persistent) UpdateUserProfile(profile PersistentObject, sports
 		res = tx.Table(`person_sports`).Clauses(clause.OnConflict{DoNothing: true}).Create(&sp)
 		if res.Error != nil {
 			tx.Rollback()
-			log.Error("error occurred while updating person's sports: ", res.Error)
-			return false
+			persistent.log(ctx).Error("failed to update sports of user", logging.Int("id_user", p.IdUser), logging.Err(res.Error))
+			return errors.New("failed to update profile")
 		}
 
 		for _, s := range sp {
@@ -233,73 +498,935 @@ func (persistent *persistent) UpdateUserProfile(profile PersistentObject, sports
 		res = tx.Table(`person_sports`).Where(`id_user=? AND id_sport NOT IN ?`, p.IdUser, sportIds).Delete(&personSports{})
 		if res.Error != nil {
 			tx.Rollback()
-			log.Error("error occurred while updating person's sports: ", res.Error)
-			return false
+			persistent.log(ctx).Error("failed to update sports of user", logging.Int("id_user", p.IdUser), logging.Err(res.Error))
+			return errors.New("failed to update profile")
 		}
 	} else {
 		res = tx.Table(`person_sports`).Where(`id_user=?`, p.IdUser).Delete(&sport{})
 		if res.Error != nil {
 			tx.Rollback()
-			log.Error("error occurred while updating person's sports: ", res.Error)
-			return false
+			persistent.log(ctx).Error("failed to update sports of user", logging.Int("id_user", p.IdUser), logging.Err(res.Error))
+			return errors.New("failed to update profile")
 		}
 	}
 
-	tx.Commit()
-	return true
+	if err := tx.Commit().Error; err != nil {
+		persistent.logError(ctx, "UpdateUserProfile", err)
+		return errors.New("failed to update profile")
+	}
+	return nil
 }
 
-func (persistent *persistent) AddSession(token Token) bool {
-	sqlStatement := `INSERT INTO sessions (id_user, login_time, token, expires) VALUES (?, ?, ?, ?);`
-	res := persistent.db.Exec(sqlStatement, token.GetUserId(), token.GetLoginDate(), token.GetId(), token.GetExpirationTime())
+func (persistent *persistent) AddSession(ctx context.Context, token Token) error {
+	client := token.GetClient()
+	res := persistent.db.WithContext(ctx).Exec(addSessionStatement, token.GetUserId(), token.GetLoginDate(), token.GetId(), token.GetExpirationTime(), token.GetFamily(),
+		client.Device, client.UserAgent, client.IP, token.IsTwoFactor())
 	if err := res.Error; err != nil || res.RowsAffected == 0 {
-		log.Error(err)
-		return false
+		persistent.logError(ctx, "AddSession", err)
+		return errors.New("failed to add session")
 	}
-	return true
+	return nil
 }
 
-func (persistent *persistent) GetSession(tknId string) (tokenResp Token, err error) {
+func (persistent *persistent) GetSession(ctx context.Context, tknId string) (tokenResp Token, err error) {
 	tkn := token{
 		Token: tknId,
 	}
-	res := persistent.db.Table(`sessions`).Select(` login_time, token, expires, sessions.id_user, username, role`).Joins(`join users u on u.id_user = sessions.id_user`).Where(&tkn).Take(&tkn)
+	res := persistent.db.WithContext(ctx).Table(`sessions`).Select(` login_time, token, expires, family, rotated_at, device, user_agent, ip, last_used, two_factor, sessions.id_user, username, role`).Joins(`join users u on u.id_user = sessions.id_user`).Where(&tkn).Take(&tkn)
 	if err = res.Error; err != nil {
-		log.Error(err)
+		persistent.logError(ctx, "GetSession", err)
 		return nil, err
 	}
 	return &tkn, err
 }
 
-func (persistent *persistent) RemoveSession(tknId string) error {
-	res := persistent.db.Table(`sessions`).Where("token=?", tknId).Delete(&token{})
+func (persistent *persistent) RemoveSession(ctx context.Context, tknId string) error {
+	res := persistent.db.WithContext(ctx).Table(`sessions`).Where("token=?", tknId).Delete(&token{})
 	if err := res.Error; err != nil || res.RowsAffected == 0 {
-		log.Error(err)
+		persistent.logError(ctx, "RemoveSession", err)
+		return err
+	}
+	persistent.log(ctx).Info("session deleted")
+	return nil
+}
+
+// RotateSession marks the session as rotated and adds the next session of the
+// family in one transaction, so a refresh token can be exchanged only once
+func (persistent *persistent) RotateSession(ctx context.Context, tknId string, next Token) error {
+	return persistent.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Exec(`UPDATE sessions SET rotated_at = now() WHERE token = ? AND rotated_at IS NULL;`, tknId)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "RotateSession", err)
+			return err
+		}
+		if res.RowsAffected == 0 {
+			return ErrSessionRotated
+		}
+		client := next.GetClient()
+		res = tx.Exec(addSessionStatement, next.GetUserId(), next.GetLoginDate(), next.GetId(), next.GetExpirationTime(), next.GetFamily(),
+			client.Device, client.UserAgent, client.IP, next.IsTwoFactor())
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "RotateSession", err)
+			return err
+		}
+		return nil
+	})
+}
+
+func (persistent *persistent) RevokeSessionFamily(ctx context.Context, family string) error {
+	res := persistent.db.WithContext(ctx).Table(`sessions`).Where("family=?", family).Delete(&token{})
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "RevokeSessionFamily", err)
+		return err
+	}
+	persistent.log(ctx).Info("session family revoked", logging.String("family", family), logging.Int("sessions", res.RowsAffected))
+	return nil
+}
+
+// GetSessions returns active sessions of the user, the most recently used first
+func (persistent *persistent) GetSessions(ctx context.Context, idUser int64) ([]SessionInfo, error) {
+	var sessions []SessionInfo
+	res := persistent.db.WithContext(ctx).Table(`sessions`).Select(`family, device, user_agent, ip, login_time, last_used`).
+		Where(`id_user = ? AND rotated_at IS NULL AND expires > now()`, idUser).Order(`last_used DESC`).Find(&sessions)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "GetSessions", err)
+		return nil, errors.New("failed to get sessions")
+	}
+	return sessions, nil
+}
+
+// HasSession reports whether the session family of the user is neither
+// revoked nor expired
+func (persistent *persistent) HasSession(ctx context.Context, idUser int64, family string) (bool, error) {
+	var count int64
+	res := persistent.db.WithContext(ctx).Table(`sessions`).Where(`id_user = ? AND family = ? AND expires > now()`, idUser, family).Count(&count)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "HasSession", err)
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (persistent *persistent) RevokeSession(ctx context.Context, idUser int64, family string) error {
+	res := persistent.db.WithContext(ctx).Table(`sessions`).Where(`id_user=? AND family=?`, idUser, family).Delete(&token{})
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "RevokeSession", err)
+		return err
+	}
+	if res.RowsAffected == 0 {
+		return ErrNoSession
+	}
+	persistent.log(ctx).Info("session revoked", logging.Int("id_user", idUser), logging.String("family", family))
+	return nil
+}
+
+// RevokeUserSessions deletes all sessions of the user except the given
+// family, with revokeKeys revokes the API keys as well and returns the number
+// of revoked sessions
+func (persistent *persistent) RevokeUserSessions(ctx context.Context, idUser int64, except string, revokeKeys bool) (int64, error) {
+	var revoked int64
+	err := persistent.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Table(`sessions`).Where(`id_user=? AND family<>? AND rotated_at IS NULL AND expires > now()`, idUser, except).Count(&revoked)
+		if res.Error != nil {
+			return res.Error
+		}
+		res = tx.Table(`sessions`).Where(`id_user=? AND family<>?`, idUser, except).Delete(&token{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if !revokeKeys {
+			return nil
+		}
+		return tx.Exec(`UPDATE api_keys SET revoked_at = now() WHERE id_user = ? AND revoked_at IS NULL;`, idUser).Error
+	})
+	if err != nil {
+		persistent.logError(ctx, "RevokeUserSessions", err)
+		return 0, err
+	}
+	persistent.log(ctx).Info("sessions of user revoked", logging.Int("id_user", idUser), logging.Int("sessions", revoked))
+	return revoked, nil
+}
+
+// DeleteExpiredSessions deletes sessions whose refresh tokens have expired
+// and returns the number of deleted rows
+func (persistent *persistent) DeleteExpiredSessions(ctx context.Context) (int64, error) {
+	res := persistent.db.WithContext(ctx).Table(`sessions`).Where(`expires < now()`).Delete(&token{})
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "DeleteExpiredSessions", err)
+		return 0, err
+	}
+	return res.RowsAffected, nil
+}
+
+func (persistent *persistent) AddSecurityEvent(ctx context.Context, idUser int64, event string, details map[string]interface{}) error {
+	content, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+	res := persistent.db.WithContext(ctx).Exec(`INSERT INTO security_events (id_user, event, details) VALUES (?, ?, ?);`, idUser, event, string(content))
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "AddSecurityEvent", err)
+		return err
+	}
+	return nil
+}
+
+// GetTOTP returns nil without an error if the user has never set up
+// two-factor authentication
+func (persistent *persistent) GetTOTP(ctx context.Context, idUser int64) (*TOTP, error) {
+	var totp TOTP
+	res := persistent.db.WithContext(ctx).Table(`user_totp`).Select(`id_user, secret, last_step, enabled_at`).Where(`id_user = ?`, idUser).Take(&totp)
+	if err := res.Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if err != nil {
+		persistent.logError(ctx, "GetTOTP", err)
+		return nil, errors.New("failed to get two-factor settings")
+	}
+	return &totp, nil
+}
+
+// SetTOTPSecret stores a secret waiting for confirmation, it replaces an
+// unconfirmed secret but returns ErrTwoFactorEnabled for an enabled one
+func (persistent *persistent) SetTOTPSecret(ctx context.Context, idUser int64, secret string) error {
+	res := persistent.db.WithContext(ctx).Exec(`INSERT INTO user_totp (id_user, secret) VALUES (?, ?)
+ON CONFLICT (id_user) DO UPDATE SET secret = EXCLUDED.secret, last_step = 0, created_at = now() WHERE user_totp.enabled_at IS NULL;`, idUser, secret)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "SetTOTPSecret", err)
+		return err
+	}
+	if res.RowsAffected == 0 {
+		return ErrTwoFactorEnabled
+	}
+	return nil
+}
+
+// EnableTOTP enables the confirmed secret and replaces recovery codes of the
+// user, step is the time step of the code used for confirmation
+func (persistent *persistent) EnableTOTP(ctx context.Context, idUser int64, step int64, recoveryCodeHashes []string) error {
+	return persistent.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Exec(`UPDATE user_totp SET enabled_at = now(), last_step = ? WHERE id_user = ? AND enabled_at IS NULL;`, step, idUser)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "EnableTOTP", err)
+			return err
+		}
+		if res.RowsAffected == 0 {
+			return ErrTwoFactorEnabled
+		}
+		res = tx.Exec(`DELETE FROM recovery_codes WHERE id_user = ?;`, idUser)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "EnableTOTP", err)
+			return err
+		}
+		for _, hash := range recoveryCodeHashes {
+			res = tx.Exec(`INSERT INTO recovery_codes (id_user, code_hash) VALUES (?, ?);`, idUser, hash)
+			if err := res.Error; err != nil {
+				persistent.logError(ctx, "EnableTOTP", err)
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UseTOTPStep records the time step of an accepted code and returns false if
+// a code of the same or a later step has already been used
+func (persistent *persistent) UseTOTPStep(ctx context.Context, idUser int64, step int64) (bool, error) {
+	res := persistent.db.WithContext(ctx).Exec(`UPDATE user_totp SET last_step = ? WHERE id_user = ? AND enabled_at IS NOT NULL AND last_step < ?;`, step, idUser, step)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "UseTOTPStep", err)
+		return false, err
+	}
+	return res.RowsAffected > 0, nil
+}
+
+// UseRecoveryCode marks the recovery code as used and returns false if there
+// is no such unused code
+func (persistent *persistent) UseRecoveryCode(ctx context.Context, idUser int64, codeHash string) (bool, error) {
+	res := persistent.db.WithContext(ctx).Exec(`UPDATE recovery_codes SET used_at = now() WHERE id_user = ? AND code_hash = ? AND used_at IS NULL;`, idUser, codeHash)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "UseRecoveryCode", err)
+		return false, err
+	}
+	return res.RowsAffected > 0, nil
+}
+
+func (persistent *persistent) AddTwoFactorChallenge(ctx context.Context, id string, idUser int64, expires time.Time) error {
+	res := persistent.db.WithContext(ctx).Exec(`INSERT INTO two_factor_challenges (id, id_user, expires) VALUES (?, ?, ?);`, id, idUser, expires)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "AddTwoFactorChallenge", err)
 		return err
 	}
-	log.Info("session ", tknId, " deleted")
 	return nil
 }
 
-func (persistent *persistent) GetFilteredProfiles(filter Filter) []FilteredUserProfileImpl {
+func (persistent *persistent) AttemptTwoFactorChallenge(ctx context.Context, id string, maxAttempts int) (bool, error) {
+	res := persistent.db.WithContext(ctx).Exec(`UPDATE two_factor_challenges SET attempts = attempts + 1 WHERE id = ? AND expires > now() AND attempts < ?;`, id, maxAttempts)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "AttemptTwoFactorChallenge", err)
+		return false, err
+	}
+	return res.RowsAffected > 0, nil
+}
+
+func (persistent *persistent) UseTwoFactorChallenge(ctx context.Context, id string) (bool, error) {
+	res := persistent.db.WithContext(ctx).Exec(`DELETE FROM two_factor_challenges WHERE id = ? AND expires > now();`, id)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "UseTwoFactorChallenge", err)
+		return false, err
+	}
+	return res.RowsAffected > 0, nil
+}
+
+func (persistent *persistent) DeleteExpiredTwoFactorChallenges(ctx context.Context) (int64, error) {
+	res := persistent.db.WithContext(ctx).Exec(`DELETE FROM two_factor_challenges WHERE expires <= now();`)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "DeleteExpiredTwoFactorChallenges", err)
+		return 0, err
+	}
+	return res.RowsAffected, nil
+}
+
+func (persistent *persistent) DisableTOTP(ctx context.Context, idUser int64) error {
+	return persistent.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Exec(`DELETE FROM recovery_codes WHERE id_user = ?;`, idUser)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "DisableTOTP", err)
+			return err
+		}
+		res = tx.Exec(`DELETE FROM user_totp WHERE id_user = ?;`, idUser)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "DisableTOTP", err)
+			return err
+		}
+		return nil
+	})
+}
+
+// UpdateLoginAttempts passes attempts in the order of the keys to update,
+// unknown keys have zero failures. Rows are created and locked in the order
+// of their keys, so concurrent updates of the same keys do not deadlock.
+func (persistent *persistent) UpdateLoginAttempts(ctx context.Context, keys []string, update func(attempts []LoginAttempts) []LoginAttempts) error {
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	err := persistent.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, key := range sorted {
+			res := tx.Exec(`INSERT INTO login_attempts (key, failures, last_failure) VALUES (?, 0, 'epoch') ON CONFLICT (key) DO NOTHING;`, key)
+			if res.Error != nil {
+				return res.Error
+			}
+		}
+		var rows []LoginAttempts
+		res := tx.Raw(`SELECT key, failures, last_failure FROM login_attempts WHERE key IN ? ORDER BY key FOR UPDATE;`, sorted).Scan(&rows)
+		if res.Error != nil {
+			return res.Error
+		}
+		byKey := make(map[string]LoginAttempts, len(rows))
+		for _, row := range rows {
+			byKey[row.Key] = row
+		}
+		attempts := make([]LoginAttempts, len(keys))
+		for i, key := range keys {
+			attempts[i] = byKey[key]
+			attempts[i].Key = key
+		}
+		for _, a := range update(attempts) {
+			res := tx.Exec(`UPDATE login_attempts SET failures = ?, last_failure = ? WHERE key = ?;`, a.Failures, a.LastFailure, a.Key)
+			if res.Error != nil {
+				return res.Error
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		persistent.logError(ctx, "UpdateLoginAttempts", err)
+		return err
+	}
+	return nil
+}
+
+func (persistent *persistent) DeleteLoginAttempts(ctx context.Context, key string) error {
+	res := persistent.db.WithContext(ctx).Exec(`DELETE FROM login_attempts WHERE key = ?;`, key)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "DeleteLoginAttempts", err)
+		return err
+	}
+	return nil
+}
+
+func (persistent *persistent) DeleteStaleLoginAttempts(ctx context.Context, before time.Time) (int64, error) {
+	res := persistent.db.WithContext(ctx).Exec(`DELETE FROM login_attempts WHERE last_failure < ?;`, before)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "DeleteStaleLoginAttempts", err)
+		return 0, err
+	}
+	return res.RowsAffected, nil
+}
+
+// GetSigningKeys returns keys that have not expired, the oldest first
+func (persistent *persistent) GetSigningKeys(ctx context.Context) ([]SigningKey, error) {
+	var keys []SigningKey
+	res := persistent.db.WithContext(ctx).Table(`signing_keys`).Select(`kid, algorithm, private_key, created_at, expires_at`).
+		Where(`expires_at IS NULL OR expires_at > now()`).Order(`created_at`).Find(&keys)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "GetSigningKeys", err)
+		return nil, errors.New("failed to get signing keys")
+	}
+	return keys, nil
+}
+
+// RotateSigningKey adds a key to sign new tokens, keys signing until now
+// expire at retireAt
+func (persistent *persistent) RotateSigningKey(ctx context.Context, key SigningKey, retireAt time.Time) error {
+	return persistent.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Exec(`UPDATE signing_keys SET expires_at = ? WHERE expires_at IS NULL;`, retireAt)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "RotateSigningKey", err)
+			return err
+		}
+		res = tx.Exec(`INSERT INTO signing_keys (kid, algorithm, private_key, created_at) VALUES (?, ?, ?, ?);`,
+			key.Kid, key.Algorithm, key.PrivateKey, key.CreatedAt)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "RotateSigningKey", err)
+			return err
+		}
+		return nil
+	})
+}
+
+func (persistent *persistent) DeleteExpiredSigningKeys(ctx context.Context) (int64, error) {
+	res := persistent.db.WithContext(ctx).Exec(`DELETE FROM signing_keys WHERE expires_at < now();`)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "DeleteExpiredSigningKeys", err)
+		return 0, err
+	}
+	return res.RowsAffected, nil
+}
+
+// GetIdentityUser returns the user the external identity is linked to or
+// ErrUserNotFound
+func (persistent *persistent) GetIdentityUser(ctx context.Context, provider, subject string) (User, error) {
+	u := user{}
+	res := persistent.db.WithContext(ctx).Table(`user_identities`).Select(`users.id_user, users.username, users.role`).
+		Joins(`JOIN users ON users.id_user = user_identities.id_user`).
+		Where(`user_identities.provider = ? AND user_identities.subject = ?`, provider, subject).Take(&u)
+	if err := res.Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	} else if err != nil {
+		persistent.logError(ctx, "GetIdentityUser", err)
+		return nil, errors.New("failed to get user")
+	}
+	return &u, nil
+}
+
+// AddExternalUser creates a user without password on the first login with
+// an external identity, the e-mail is verified if the provider says so
+func (persistent *persistent) AddExternalUser(ctx context.Context, username string, identity Identity) (User, error) {
+	var verifiedAt *time.Time
+	if identity.EmailVerified {
+		now := time.Now().UTC()
+		verifiedAt = &now
+	}
+	u := user{}
+	err := persistent.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Raw(`INSERT INTO users (username, email_verified_at) VALUES (?, ?) ON CONFLICT (username) DO NOTHING RETURNING id_user, username, role;`,
+			username, verifiedAt).Scan(&u)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "AddExternalUser", err)
+			return err
+		}
+		if u.IdUser == 0 {
+			return ErrUsernameTaken
+		}
+		res = tx.Exec(`INSERT INTO user_info (id_user, email) VALUES (?, ?);`, u.IdUser, identity.Email)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "AddExternalUser", err)
+			return err
+		}
+		res = tx.Exec(`INSERT INTO user_identities (provider, subject, id_user, email) VALUES (?, ?, ?, ?);`,
+			identity.Provider, identity.Subject, u.IdUser, identity.Email)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "AddExternalUser", err)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (persistent *persistent) LinkIdentity(ctx context.Context, idUser int64, identity Identity) error {
+	res := persistent.db.WithContext(ctx).Exec(`INSERT INTO user_identities (provider, subject, id_user, email) VALUES (?, ?, ?, ?) ON CONFLICT (provider, subject) DO NOTHING;`,
+		identity.Provider, identity.Subject, idUser, identity.Email)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "LinkIdentity", err)
+		return err
+	}
+	if res.RowsAffected == 0 {
+		return ErrIdentityLinked
+	}
+	return nil
+}
+
+// SearchUsers returns a page of users ordered by id and the number of all
+// users matching the search
+func (persistent *persistent) SearchUsers(ctx context.Context, search UserSearch) ([]UserSummary, int64, error) {
+	query := func() *gorm.DB {
+		q := persistent.db.WithContext(ctx).Table(`users`).Joins(`LEFT JOIN user_info ON user_info.id_user = users.id_user`)
+		if search.Query != "" {
+			like := "%" + likeEscaper.Replace(search.Query) + "%"
+			q = q.Where(`users.username ILIKE ? OR user_info.email ILIKE ? OR user_info.name ILIKE ? OR user_info.second_name ILIKE ?`, like, like, like, like)
+		}
+		if search.Role != "" {
+			q = q.Where(`users.role = ?`, search.Role)
+		}
+		return q
+	}
+	var total int64
+	if err := query().Count(&total).Error; err != nil {
+		persistent.logError(ctx, "SearchUsers", err)
+		return nil, 0, errors.New("failed to search users")
+	}
+	var users []UserSummary
+	res := query().Select(`users.id_user, users.username, users.role, user_info.email, user_info.name, user_info.second_name, ` +
+		`users.banned_at IS NOT NULL AND (users.banned_until IS NULL OR users.banned_until > now()) AS banned, users.banned_until, users.ban_reason`).
+		Order(`users.id_user`).Limit(search.Limit).Offset(search.Offset).Find(&users)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "SearchUsers", err)
+		return nil, 0, errors.New("failed to search users")
+	}
+	return users, total, nil
+}
+
+func (persistent *persistent) SetRole(ctx context.Context, idUser int64, role string) error {
+	res := persistent.db.WithContext(ctx).Exec(`UPDATE users SET role = ? WHERE id_user = ?;`, role, idUser)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "SetRole", err)
+		return err
+	}
+	if res.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// BanUser replaces the current ban of the user if there is one
+func (persistent *persistent) BanUser(ctx context.Context, idUser int64, ban Ban) error {
+	res := persistent.db.WithContext(ctx).Exec(`UPDATE users SET banned_at = now(), banned_until = ?, ban_reason = ? WHERE id_user = ?;`, ban.Until, ban.Reason, idUser)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "BanUser", err)
+		return err
+	}
+	if res.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (persistent *persistent) UnbanUser(ctx context.Context, idUser int64) error {
+	res := persistent.db.WithContext(ctx).Exec(`UPDATE users SET banned_at = NULL, banned_until = NULL, ban_reason = NULL WHERE id_user = ?;`, idUser)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "UnbanUser", err)
+		return err
+	}
+	if res.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// GetBan returns nil without an error if the user is not banned or the ban
+// has expired
+func (persistent *persistent) GetBan(ctx context.Context, idUser int64) (*Ban, error) {
+	var ban struct {
+		BanReason   string
+		BannedUntil *time.Time
+	}
+	res := persistent.db.WithContext(ctx).Table(`users`).Select(`ban_reason, banned_until`).
+		Where(`id_user = ? AND banned_at IS NOT NULL AND (banned_until IS NULL OR banned_until > now())`, idUser).Take(&ban)
+	if err := res.Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if err != nil {
+		persistent.logError(ctx, "GetBan", err)
+		return nil, errors.New("failed to get ban")
+	}
+	return &Ban{Reason: ban.BanReason, Until: ban.BannedUntil}, nil
+}
+
+func (persistent *persistent) GetSports(ctx context.Context) ([]SportInfo, error) {
+	var sports []SportInfo
+	res := persistent.db.WithContext(ctx).Raw(`SELECT sports.id_sport, sports.sport_type,
+(SELECT count(*) FROM person_sports WHERE person_sports.id_sport = sports.id_sport) AS users,
+(SELECT count(*) FROM group_training WHERE group_training.id_sport = sports.id_sport) AS trainings
+FROM sports ORDER BY sports.sport_type;`).Scan(&sports)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "GetSports", err)
+		return nil, errors.New("failed to get sports")
+	}
+	return sports, nil
+}
+
+func (persistent *persistent) AddSport(ctx context.Context, sportType string) (SportInfo, error) {
+	var s SportInfo
+	res := persistent.db.WithContext(ctx).Raw(`INSERT INTO sports (sport_type) VALUES (?) ON CONFLICT (sport_type) DO NOTHING RETURNING id_sport, sport_type;`, sportType).Scan(&s)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "AddSport", err)
+		return SportInfo{}, err
+	}
+	if s.IdSport == 0 {
+		return SportInfo{}, ErrDuplicate
+	}
+	return s, nil
+}
+
+// RenameSport returns the previous name of the sport
+func (persistent *persistent) RenameSport(ctx context.Context, idSport int64, sportType string) (string, error) {
+	var previous string
+	err := persistent.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Raw(`SELECT sport_type FROM sports WHERE id_sport = ? FOR UPDATE;`, idSport).Scan(&previous)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "RenameSport", err)
+			return err
+		}
+		if previous == "" {
+			return ErrNotFound
+		}
+		var taken int64
+		res = tx.Table(`sports`).Where(`sport_type = ? AND id_sport <> ?`, sportType, idSport).Count(&taken)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "RenameSport", err)
+			return err
+		}
+		if taken > 0 {
+			return ErrDuplicate
+		}
+		res = tx.Exec(`UPDATE sports SET sport_type = ? WHERE id_sport = ?;`, sportType, idSport)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "RenameSport", err)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return previous, nil
+}
+
+// DeleteSport deletes only sports no profile or training refers to
+func (persistent *persistent) DeleteSport(ctx context.Context, idSport int64) error {
+	return persistent.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var used int64
+		res := tx.Raw(`SELECT (SELECT count(*) FROM person_sports WHERE id_sport = ?) + (SELECT count(*) FROM group_training WHERE id_sport = ?);`,
+			idSport, idSport).Scan(&used)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "DeleteSport", err)
+			return err
+		}
+		if used > 0 {
+			return ErrInUse
+		}
+		res = tx.Exec(`DELETE FROM sports WHERE id_sport = ?;`, idSport)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "DeleteSport", err)
+			return err
+		}
+		if res.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+// MergeSports moves profiles and trainings of a duplicate sport to another
+// one and deletes the duplicate
+func (persistent *persistent) MergeSports(ctx context.Context, from, into int64) error {
+	return persistent.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var found int64
+		res := tx.Table(`sports`).Where(`id_sport IN ?`, []int64{from, into}).Count(&found)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "MergeSports", err)
+			return err
+		}
+		if found != 2 {
+			return ErrNotFound
+		}
+		res = tx.Exec(`INSERT INTO person_sports (id_user, id_sport) SELECT id_user, ? FROM person_sports WHERE id_sport = ? ON CONFLICT DO NOTHING;`, into, from)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "MergeSports", err)
+			return err
+		}
+		res = tx.Exec(`UPDATE group_training SET id_sport = ? WHERE id_sport = ?;`, into, from)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "MergeSports", err)
+			return err
+		}
+		// remaining person_sports rows of the duplicate are deleted by cascade
+		res = tx.Exec(`DELETE FROM sports WHERE id_sport = ?;`, from)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "MergeSports", err)
+			return err
+		}
+		persistent.log(ctx).Info("sport merged", logging.Int("from", from), logging.Int("into", into))
+		return nil
+	})
+}
+
+func (persistent *persistent) GetLevels(ctx context.Context) ([]LevelInfo, error) {
+	var levels []LevelInfo
+	res := persistent.db.WithContext(ctx).Table(`levels`).Select(`id_level, level, description`).Order(`level`).Find(&levels)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "GetLevels", err)
+		return nil, errors.New("failed to get levels")
+	}
+	return levels, nil
+}
+
+func (persistent *persistent) AddLevel(ctx context.Context, level LevelInfo) (LevelInfo, error) {
+	var l LevelInfo
+	res := persistent.db.WithContext(ctx).Raw(`INSERT INTO levels (level, description) VALUES (?, ?) ON CONFLICT (level) DO NOTHING RETURNING id_level, level, description;`,
+		level.Level, level.Description).Scan(&l)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "AddLevel", err)
+		return LevelInfo{}, err
+	}
+	if l.IdLevel == 0 {
+		return LevelInfo{}, ErrDuplicate
+	}
+	return l, nil
+}
+
+// UpdateLevel returns the level as it was before the update
+func (persistent *persistent) UpdateLevel(ctx context.Context, level LevelInfo) (LevelInfo, error) {
+	var previous LevelInfo
+	err := persistent.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Raw(`SELECT id_level, level, description FROM levels WHERE id_level = ? FOR UPDATE;`, level.IdLevel).Scan(&previous)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "UpdateLevel", err)
+			return err
+		}
+		if previous.IdLevel == 0 {
+			return ErrNotFound
+		}
+		var taken int64
+		res = tx.Table(`levels`).Where(`level = ? AND id_level <> ?`, level.Level, level.IdLevel).Count(&taken)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "UpdateLevel", err)
+			return err
+		}
+		if taken > 0 {
+			return ErrDuplicate
+		}
+		res = tx.Exec(`UPDATE levels SET level = ?, description = ? WHERE id_level = ?;`, level.Level, level.Description, level.IdLevel)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "UpdateLevel", err)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return LevelInfo{}, err
+	}
+	return previous, nil
+}
+
+// DeleteLevel clears the level of profiles and trainings using it
+func (persistent *persistent) DeleteLevel(ctx context.Context, idLevel int64) error {
+	res := persistent.db.WithContext(ctx).Exec(`DELETE FROM levels WHERE id_level = ?;`, idLevel)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "DeleteLevel", err)
+		return err
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (persistent *persistent) DeleteMessage(ctx context.Context, idMessage int64) error {
+	res := persistent.db.WithContext(ctx).Exec(`DELETE FROM messages WHERE id_mes = ?;`, idMessage)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "DeleteMessage", err)
+		return err
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (persistent *persistent) AddAuditEntry(ctx context.Context, entry AuditEntry) error {
+	res := persistent.db.WithContext(ctx).Exec(`INSERT INTO audit_log (id_actor, impersonated_by, action, target_type, target_id, before, after, ip, request_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);`,
+		entry.IdActor, entry.ImpersonatedBy, entry.Action, entry.TargetType, entry.TargetId, entry.Before, entry.After, entry.IP, entry.RequestId)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "AddAuditEntry", err)
+		return err
+	}
+	return nil
+}
+
+// GetAuditEntries returns the newest entries matching the filter and the
+// number of all matching entries
+func (persistent *persistent) GetAuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, int64, error) {
+	query := func() *gorm.DB {
+		q := persistent.db.WithContext(ctx).Table(`audit_log`)
+		if filter.IdActor != 0 {
+			q = q.Where(`id_actor = ?`, filter.IdActor)
+		}
+		if filter.Action != "" {
+			q = q.Where(`action = ?`, filter.Action)
+		}
+		if filter.TargetType != "" {
+			q = q.Where(`target_type = ?`, filter.TargetType)
+		}
+		if filter.TargetId != 0 {
+			q = q.Where(`target_id = ?`, filter.TargetId)
+		}
+		if filter.From != nil {
+			q = q.Where(`created_at >= ?`, *filter.From)
+		}
+		if filter.To != nil {
+			q = q.Where(`created_at < ?`, *filter.To)
+		}
+		return q
+	}
+	var total int64
+	if err := query().Count(&total).Error; err != nil {
+		persistent.logError(ctx, "GetAuditEntries", err)
+		return nil, 0, errors.New("failed to get audit log")
+	}
+	var entries []AuditEntry
+	res := query().Select(`id_entry, created_at, id_actor, impersonated_by, action, target_type, target_id, before, after, ip, request_id`).
+		Order(`id_entry DESC`).Limit(filter.Limit).Offset(filter.Offset).Find(&entries)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "GetAuditEntries", err)
+		return nil, 0, errors.New("failed to get audit log")
+	}
+	return entries, total, nil
+}
+
+func (persistent *persistent) DeleteAuditEntries(ctx context.Context, retention time.Duration) (int64, error) {
+	var deleted int64
+	err := persistent.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// the trigger of audit_log checks the entries against the setting
+		res := tx.Exec(`SELECT set_config('sb.audit_retention', ?, true);`, fmt.Sprintf("%d seconds", int64(retention.Seconds())))
+		if res.Error != nil {
+			return res.Error
+		}
+		res = tx.Exec(`DELETE FROM audit_log WHERE created_at < now() - current_setting('sb.audit_retention')::interval;`)
+		deleted = res.RowsAffected
+		return res.Error
+	})
+	if err != nil {
+		persistent.logError(ctx, "DeleteAuditEntries", err)
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// AddAPIKey stores a key unless the user already has max active keys. The
+// row of the user is locked so concurrent requests cannot exceed max.
+func (persistent *persistent) AddAPIKey(ctx context.Context, key APIKey, max int) (APIKey, error) {
+	err := persistent.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Exec(`SELECT id_user FROM users WHERE id_user = ? FOR UPDATE;`, key.IdUser)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "AddAPIKey", err)
+			return err
+		}
+		var active int64
+		res = tx.Table(`api_keys`).Where(`id_user = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())`, key.IdUser).Count(&active)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "AddAPIKey", err)
+			return err
+		}
+		if active >= int64(max) {
+			return ErrTooManyAPIKeys
+		}
+		res = tx.Raw(`INSERT INTO api_keys (id_user, name, prefix, hash, scopes, expires_at, two_factor) VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING id_key, created_at;`,
+			key.IdUser, key.Name, key.Prefix, key.Hash, key.Scopes, key.ExpiresAt, key.TwoFactor).Scan(&key)
+		if err := res.Error; err != nil {
+			persistent.logError(ctx, "AddAPIKey", err)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return APIKey{}, err
+	}
+	return key, nil
+}
+
+// GetAPIKeys returns keys of the user which are not revoked, the newest first
+func (persistent *persistent) GetAPIKeys(ctx context.Context, idUser int64) ([]APIKey, error) {
+	var keys []APIKey
+	res := persistent.db.WithContext(ctx).Table(`api_keys`).Select(`id_key, id_user, name, prefix, scopes, created_at, last_used_at, expires_at`).
+		Where(`id_user = ? AND revoked_at IS NULL`, idUser).Order(`created_at DESC`).Find(&keys)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "GetAPIKeys", err)
+		return nil, errors.New("failed to get API keys")
+	}
+	return keys, nil
+}
+
+// GetAPIKey returns a key which is not revoked with the current role of its
+// owner or ErrAPIKeyNotFound
+func (persistent *persistent) GetAPIKey(ctx context.Context, prefix string) (APIKey, error) {
+	var key APIKey
+	res := persistent.db.WithContext(ctx).Table(`api_keys`).
+		Select(`api_keys.id_key, api_keys.id_user, api_keys.name, api_keys.prefix, api_keys.hash, api_keys.scopes, api_keys.created_at, api_keys.last_used_at, api_keys.expires_at, api_keys.two_factor, users.role`).
+		Joins(`JOIN users ON users.id_user = api_keys.id_user`).
+		Where(`api_keys.prefix = ? AND api_keys.revoked_at IS NULL AND (users.banned_at IS NULL OR users.banned_until <= now())`, prefix).Take(&key)
+	if err := res.Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return APIKey{}, ErrAPIKeyNotFound
+	} else if err != nil {
+		persistent.logError(ctx, "GetAPIKey", err)
+		return APIKey{}, errors.New("failed to get API key")
+	}
+	return key, nil
+}
+
+func (persistent *persistent) RevokeAPIKey(ctx context.Context, idUser int64, idKey int64) error {
+	res := persistent.db.WithContext(ctx).Exec(`UPDATE api_keys SET revoked_at = now() WHERE id_key = ? AND id_user = ? AND revoked_at IS NULL;`, idKey, idUser)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "RevokeAPIKey", err)
+		return err
+	}
+	if res.RowsAffected == 0 {
+		return ErrAPIKeyNotFound
+	}
+	persistent.log(ctx).Info("API key revoked", logging.Int("id_key", idKey), logging.Int("id_user", idUser))
+	return nil
+}
+
+func (persistent *persistent) TouchAPIKey(ctx context.Context, idKey int64) error {
+	res := persistent.db.WithContext(ctx).Exec(`UPDATE api_keys SET last_used_at = now() WHERE id_key = ?;`, idKey)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "TouchAPIKey", err)
+		return err
+	}
+	return nil
+}
+
+func (persistent *persistent) GetFilteredProfiles(ctx context.Context, filter Filter) []FilteredUserProfileImpl {
 	var filtered []FilteredUserProfileImpl
 	var res *gorm.DB
-	sub := persistent.db.Table(`user_info`).Select(`user_info.id_user,user_info.id_level,
+	sub := persistent.db.WithContext(ctx).Table(`user_info`).Select(`user_info.id_user,user_info.id_level,
 user_info.name,user_info.second_name,user_info.sex,user_info.height,
 user_info.weight,user_info.location, user_info.about,
 extract(year from age(now(), user_info.date_of_birth)) as age, array_agg(sports.sport_type) as sports`).Joins(`left join person_sports on 
 person_sports.id_user=user_info.id_user left join sports on person_sports.id_sport=sports.id_sport`).Group(`user_info.id_user`)
 	q, m := filter.BuildMapAndQuery()
 	if len(m) != 0 {
-		res = persistent.db.Table(`(?) as u`, sub).Where(q, m).Find(&filtered)
+		res = persistent.db.WithContext(ctx).Table(`(?) as u`, sub).Where(q, m).Find(&filtered)
 	} else {
-		res = persistent.db.Table(`(?) as u`, sub).Find(&filtered)
+		res = persistent.db.WithContext(ctx).Table(`(?) as u`, sub).Find(&filtered)
 	}
 	if res.Error == gorm.ErrRecordNotFound {
-		log.Error("no user with such parameters")
+		persistent.log(ctx).Info("no user with such parameters")
 		return nil
 	} else if res.Error != nil {
-		log.Error(res.Error)
+		persistent.logError(ctx, "GetFilteredProfiles", res.Error)
 		return nil
 	}
 	var sports []string
@@ -330,36 +1457,32 @@ person_sports.id_user=user_info.id_user left join sports on person_sports.id_spo
 	return result
 }
 
-func (persistent *persistent) GetUserSport(id int64) []string {
+func (persistent *persistent) GetUserSport(ctx context.Context, id int64) []string {
 	var sportType []string
-	res := persistent.db.Table(`person_sports`).Select(`s.sport_type`).Joins(`join sports s on s.id_sport = person_sports.id_sport`).Where(`id_user=?`, id).Find(&sportType)
+	res := persistent.db.WithContext(ctx).Table(`person_sports`).Select(`s.sport_type`).Joins(`join sports s on s.id_sport = person_sports.id_sport`).Where(`id_user=?`, id).Find(&sportType)
 	if res.Error == gorm.ErrRecordNotFound {
-		log.Error(fmt.Errorf("no user with id %d", id))
+		persistent.log(ctx).Warn("no such user", logging.Int("id_user", id))
 		return nil
 	} else if res.Error != nil {
-		log.Error(res.Error)
+		persistent.logError(ctx, "GetUserSport", res.Error)
 		return nil
 	}
 	return sportType
 }
-func (persistent *persistent) GetGroupTraining(idTraining int64) PersistentObject {
+func (persistent *persistent) GetGroupTraining(ctx context.Context, idTraining int64) (PersistentObject, error) {
 	result := groupTraining{}
-	res := persistent.db.Table(`group_training`).Select(`group_training.kind, group_training.id_training, group_training.location, group_training.meet_date, group_training.duration, s.sport_type as sport, group_training.id_level, group_training.comment, group_training.fee`).Joins(`JOIN sports s on group_training.id_sport = s.id_sport`).Where(`id_training=?`, idTraining).Find(&result)
-	if res.Error == gorm.ErrRecordNotFound {
-		log.Error("no training with id ", idTraining)
-		return nil
-	} else if res.Error != nil {
-		log.Error(res.Error)
-		return nil
+	res := persistent.db.WithContext(ctx).Table(`group_training`).Select(`group_training.kind, group_training.id_training, group_training.location, group_training.meet_date, group_training.duration, s.sport_type as sport, group_training.id_level, group_training.comment, group_training.fee`).Joins(`JOIN sports s on group_training.id_sport = s.id_sport`).Where(`id_training=?`, idTraining).Find(&result)
+	if res.Error != nil {
+		persistent.logError(ctx, "GetGroupTraining", res.Error)
+		return nil, errors.New("failed to get training")
+	} else if res.RowsAffected == 0 {
+		return nil, ErrNotFound
 	}
 	var mts []memberTraining
-	res = persistent.db.Table(`member_training`).Where(`id_training=?`, result.IdTraining).Find(&mts)
-	if res.Error == gorm.ErrRecordNotFound {
-		log.Errorf("no members in training with id %s", result.IdTraining)
-		return nil
-	} else if res.Error != nil {
-		log.Error(res.Error)
-		return nil
+	res = persistent.db.WithContext(ctx).Table(`member_training`).Where(`id_training=?`, result.IdTraining).Find(&mts)
+	if res.Error != nil {
+		persistent.logError(ctx, "GetGroupTraining", res.Error)
+		return nil, errors.New("failed to get training")
 	}
 	for _, mt := range mts {
 		result.ParticipantsIds = append(result.ParticipantsIds, mt.IdUser)
@@ -368,41 +1491,41 @@ func (persistent *persistent) GetGroupTraining(idTraining int64) PersistentObjec
 		}
 	}
 	result.TrainingDuration = time.Duration(result.Duration).String()
-	return &result
+	return &result, nil
 }
-func (persistent *persistent) GetGroupTrainings(filter Filter) []PersistentObject {
+func (persistent *persistent) GetGroupTrainings(ctx context.Context, filter Filter) []PersistentObject {
 	var result []PersistentObject
 	var filtered []groupTraining
 	var res *gorm.DB
-	subQuery := persistent.db.Table(`group_training`).Select(`group_training.kind, group_training.id_training, group_training.location, group_training.meet_date, group_training.duration, s.sport_type as sport, group_training.id_level, group_training.comment, group_training.fee`).Joins(`JOIN sports s on group_training.id_sport = s.id_sport`).Where(`meet_date > now() AND kind = 'group'`)
+	subQuery := persistent.db.WithContext(ctx).Table(`group_training`).Select(`group_training.kind, group_training.id_training, group_training.location, group_training.meet_date, group_training.duration, s.sport_type as sport, group_training.id_level, group_training.comment, group_training.fee`).Joins(`JOIN sports s on group_training.id_sport = s.id_sport`).Where(`meet_date > now() AND kind = 'group'`)
 	q, m := filter.BuildMapAndQuery()
 	if len(m) > 0 {
-		res = persistent.db.Table(`(?) as t`, subQuery).Where(q, m).Order(`meet_date DESC`).Find(&filtered)
+		res = persistent.db.WithContext(ctx).Table(`(?) as t`, subQuery).Where(q, m).Order(`meet_date DESC`).Find(&filtered)
 		if res.Error == gorm.ErrRecordNotFound {
-			log.Error("no training with such parameters")
+			persistent.log(ctx).Info("no training with such parameters")
 			return nil
 		} else if res.Error != nil {
-			log.Error(res.Error)
+			persistent.logError(ctx, "GetGroupTrainings", res.Error)
 			return nil
 		}
 	} else {
-		res = persistent.db.Table(`(?) as t`, subQuery).Order(`meet_date DESC`).Find(&filtered)
+		res = persistent.db.WithContext(ctx).Table(`(?) as t`, subQuery).Order(`meet_date DESC`).Find(&filtered)
 		if res.Error == gorm.ErrRecordNotFound {
-			log.Error("no training with such parameters")
+			persistent.log(ctx).Info("no training with such parameters")
 			return nil
 		} else if res.Error != nil {
-			log.Error(res.Error)
+			persistent.logError(ctx, "GetGroupTrainings", res.Error)
 			return nil
 		}
 	}
 	for i, t := range filtered {
 		var mts []memberTraining
-		res = persistent.db.Table(`member_training`).Where(`id_training=?`, t.IdTraining).Find(&mts)
+		res = persistent.db.WithContext(ctx).Table(`member_training`).Where(`id_training=?`, t.IdTraining).Find(&mts)
 		if res.Error == gorm.ErrRecordNotFound {
-			log.Errorf("no members in training with id %s", t.IdTraining)
+			persistent.log(ctx).Warn("no members in training", logging.Int("id_training", t.IdTraining))
 			return nil
 		} else if res.Error != nil {
-			log.Error(res.Error)
+			persistent.logError(ctx, "GetGroupTrainings", res.Error)
 			return nil
 		}
 		for _, mt := range mts {
@@ -417,27 +1540,28 @@ func (persistent *persistent) GetGroupTrainings(filter Filter) []PersistentObjec
 	return result
 }
 
-func (persistent *persistent) AddGroupTraining(training PersistentObject) (PersistentObject, error) {
+func (persistent *persistent) AddGroupTraining(ctx context.Context, training PersistentObject) (PersistentObject, error) {
 	var gt groupTraining
 	err := json.Unmarshal(training.Serialize(), &gt)
 	if err != nil {
-		log.Errorf("failed to unmarshal group training: %s", err)
+		persistent.log(ctx).Error("failed to unmarshal group training", logging.Err(err))
 		return nil, fmt.Errorf("failed to unmarshal group training: %s", err)
 	}
 	d, err := time.ParseDuration(gt.TrainingDuration)
-	if err == nil {
-		gt.Duration = Duration(d)
+	if err != nil {
+		return nil, errs.Invalid("training_duration", "must be a duration like 1h30m")
 	}
-	s, err := persistent.getSport(gt.Sport)
+	gt.Duration = Duration(d)
+	s, err := persistent.getSport(ctx, gt.Sport)
 	if err != nil {
 		return nil, err
 	}
 	gt.IdSport = s.IdSport
-	tx := persistent.db.Begin()
+	tx := persistent.db.WithContext(ctx).Begin()
 	res := tx.Table(`group_training`).Select(`meet_date`, `location`, `id_sport`, `id_level`, `duration`, `comment`, `fee`, `kind`).Create(&gt)
 	if err := res.Error; err != nil || res.RowsAffected == 0 {
 		tx.Rollback()
-		log.Error(err)
+		persistent.logError(ctx, "AddGroupTraining", err)
 		return nil, fmt.Errorf("failed to add group training: %s", err)
 	}
 	mt := memberTraining{
@@ -448,36 +1572,40 @@ func (persistent *persistent) AddGroupTraining(training PersistentObject) (Persi
 	res = tx.Table(`member_training`).Create(&mt)
 	if err := res.Error; err != nil || res.RowsAffected == 0 {
 		tx.Rollback()
-		log.Error(err)
+		persistent.logError(ctx, "AddGroupTraining", err)
 		return nil, fmt.Errorf("failed to add group training: %s", err)
 	}
 	gt.ParticipantsIds = []int64{gt.Owner}
-	tx.Commit()
+	if err := tx.Commit().Error; err != nil {
+		persistent.logError(ctx, "AddGroupTraining", err)
+		return nil, fmt.Errorf("failed to add group training: %w", err)
+	}
 	gt.TrainingDuration = time.Duration(gt.Duration).String()
 	return &gt, nil
 }
 
-func (persistent *persistent) UpdateGroupTraining(training PersistentObject) (PersistentObject, error) {
+func (persistent *persistent) UpdateGroupTraining(ctx context.Context, training PersistentObject) (PersistentObject, error) {
 	var gt groupTraining
 	err := json.Unmarshal(training.Serialize(), &gt)
 	if err != nil {
-		log.Errorf("failed to unmarshal group training: %s", err)
+		persistent.log(ctx).Error("failed to unmarshal group training", logging.Err(err))
 		return nil, fmt.Errorf("failed to unmarshal group training: %s", err)
 	}
 	d, err := time.ParseDuration(gt.TrainingDuration)
-	if err == nil {
-		gt.Duration = Duration(d)
+	if err != nil {
+		return nil, errs.Invalid("training_duration", "must be a duration like 1h30m")
 	}
-	s, err := persistent.getSport(gt.Sport)
+	gt.Duration = Duration(d)
+	s, err := persistent.getSport(ctx, gt.Sport)
 	if err != nil {
 		return nil, err
 	}
 	gt.IdSport = s.IdSport
-	tx := persistent.db.Begin()
+	tx := persistent.db.WithContext(ctx).Begin()
 	res := tx.Table(`group_training`).Select(`meet_date`, `location`, `id_sport`, `id_level`, `duration`, `comment`, `fee`, `kind`).Updates(&gt)
 	if err := res.Error; err != nil || res.RowsAffected == 0 {
 		tx.Rollback()
-		log.Error(err)
+		persistent.logError(ctx, "UpdateGroupTraining", err)
 		return nil, errors.New("nothing changed")
 	}
 	var mt []memberTraining
@@ -500,108 +1628,115 @@ func (persistent *persistent) UpdateGroupTraining(training PersistentObject) (Pe
 	}
 	if gt.Owner == 0 || !trainingOwner {
 		tx.Rollback()
-		log.Error("no owner provided or trying to delete owner from participants")
+		persistent.log(ctx).Warn("no owner provided or trying to delete owner from participants")
 		return nil, errors.New("no owner provided or trying to delete owner from participants")
 	}
 	res = tx.Table(`member_training`).Clauses(clause.OnConflict{DoNothing: true}).Create(&mt)
 	if err := res.Error; err != nil {
 		tx.Rollback()
-		log.Error(err)
+		persistent.logError(ctx, "UpdateGroupTraining", err)
 		return nil, fmt.Errorf("failed to add group training: %s", err)
 	}
 	res = tx.Table(`member_training`).Where(`id_training=? AND id_user NOT IN ? AND training_owner!=?`, gt.IdTraining, gt.ParticipantsIds, trainingOwner).Delete(&memberTraining{})
 	if err = res.Error; err != nil {
 		tx.Rollback()
-		log.Error(err)
+		persistent.logError(ctx, "UpdateGroupTraining", err)
 		return nil, fmt.Errorf("failed to add group training: %s", err)
 	}
-	tx.Commit()
+	if err := tx.Commit().Error; err != nil {
+		persistent.logError(ctx, "UpdateGroupTraining", err)
+		return nil, fmt.Errorf("failed to update group training: %w", err)
+	}
 	gt.TrainingDuration = time.Duration(gt.Duration).String()
 	return &gt, nil
 }
 
-func (persistent *persistent) DeleteGroupTraining(idTraining int64) error {
-	res := persistent.db.Table(`group_training`).Where(`id_training=?`, idTraining).Delete(&groupTraining{})
-	if err := res.Error; err != nil || res.RowsAffected == 0 {
-		log.Error(err)
+func (persistent *persistent) DeleteGroupTraining(ctx context.Context, idTraining int64) error {
+	res := persistent.db.WithContext(ctx).Table(`group_training`).Where(`id_training=?`, idTraining).Delete(&groupTraining{})
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "DeleteGroupTraining", err)
 		return err
 	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
 	return nil
 }
 
-func (persistent *persistent) getSport(s string) (sport, error) {
+func (persistent *persistent) getSport(ctx context.Context, s string) (sport, error) {
 	resSport := sport{SportType: s}
-	res := persistent.db.Table(`sports`).Where(`sport_type=?`, resSport.SportType).First(&resSport)
+	res := persistent.db.WithContext(ctx).Table(`sports`).Where(`sport_type=?`, resSport.SportType).First(&resSport)
 	if res.Error == gorm.ErrRecordNotFound {
-		log.Errorf("no sport with name %s", s)
-		return sport{}, fmt.Errorf("no sport with name %s", s)
+		persistent.log(ctx).Info("no such sport", logging.String("sport", s))
+		return sport{}, errs.Invalid("sport", "unknown sport")
 	} else if res.Error != nil {
-		log.Errorf("failed to get sport: %s", res.Error)
+		persistent.logError(ctx, "getSport", res.Error)
 		return sport{}, fmt.Errorf("failed to get sport: %s", res.Error)
 	}
 	return resSport, nil
 }
 
-func (persistent *persistent) GetUserTrainings(idUser int64) ([]PersistentObject, error) {
+func (persistent *persistent) GetUserTrainings(ctx context.Context, idUser int64) ([]PersistentObject, error) {
 	var gt []groupTraining
 	var result []PersistentObject
-	subQuery := persistent.db.Table(`group_training`).Select(`group_training.id_training, meet_date, location, sport_type as sport, id_level, fee, kind, duration, comment`).
+	subQuery := persistent.db.WithContext(ctx).Table(`group_training`).Select(`group_training.id_training, meet_date, location, sport_type as sport, id_level, fee, kind, duration, comment`).
 		Joins(`join member_training mt on group_training.id_training = mt.id_training join sports s on group_training.id_sport = s.id_sport`).Where(`id_user=?`, idUser)
-	res := persistent.db.Table(`(?) as gt`, subQuery).Select(`member_training.id_training, meet_date, location, sport, id_level, fee, kind, duration, comment, member_training.id_user as owner `).
+	res := persistent.db.WithContext(ctx).Table(`(?) as gt`, subQuery).Select(`member_training.id_training, meet_date, location, sport, id_level, fee, kind, duration, comment, member_training.id_user as owner `).
 		Joins(`join member_training on gt.id_training=member_training.id_training`).Where(`training_owner=true`).Find(&gt)
 	if res.Error == gorm.ErrRecordNotFound {
 		return nil, nil
 	} else if res.Error != nil {
-		log.Errorf("failed to get trainings: %s", res.Error)
+		persistent.logError(ctx, "GetUserTrainings", res.Error)
 		return nil, fmt.Errorf("failed to get trainings: %s", res.Error)
 	}
 
-	for _, t := range gt {
+	for i := range gt {
 		var mts []memberTraining
-		res = persistent.db.Table(`member_training`).Where(`id_training=?`, t.IdTraining).Find(&mts)
+		res = persistent.db.WithContext(ctx).Table(`member_training`).Where(`id_training=?`, gt[i].IdTraining).Find(&mts)
 		if res.Error == gorm.ErrRecordNotFound {
-			log.Errorf("no members in training with id %s", t.IdTraining)
+			persistent.log(ctx).Warn("no members in training", logging.Int("id_training", gt[i].IdTraining))
 			return nil, nil
 		} else if err := res.Error; err != nil {
-			log.Error(err)
+			persistent.logError(ctx, "GetUserTrainings", err)
 			return nil, err
 		}
 		for _, mt := range mts {
-			t.ParticipantsIds = append(t.ParticipantsIds, mt.IdUser)
+			gt[i].ParticipantsIds = append(gt[i].ParticipantsIds, mt.IdUser)
+			if mt.TrainingOwner {
+				gt[i].Owner = mt.IdUser
+			}
 		}
 
-		t.TrainingDuration = time.Duration(t.Duration).String()
-		result = append(result, &t)
+		gt[i].TrainingDuration = time.Duration(gt[i].Duration).String()
+		result = append(result, &gt[i])
 	}
 	return result, nil
 }
 
-func (persistent *persistent) AddMessage(msg PersistentObject) error {
+func (persistent *persistent) AddMessage(ctx context.Context, msg PersistentObject) error {
 	var m message
 	err := json.Unmarshal(msg.Serialize(), &m)
 	if err != nil {
-		log.Error(err)
+		persistent.logError(ctx, "AddMessage", err)
 		return fmt.Errorf("failed to unmarshal message: %s", err.Error())
 	}
-	res := persistent.db.Table(`messages`).Create(&m)
+	res := persistent.db.WithContext(ctx).Table(`messages`).Create(&m)
 	if res.Error != nil || res.RowsAffected == 0 {
 		err = fmt.Errorf("failed to add message to db: err")
-		log.Error(err)
+		persistent.logError(ctx, "AddMessage", err)
 		return err
 	}
 	return nil
 }
 
-func (persistent *persistent) GetDialogs(idUser int64) ([]PersistentObject, error) {
+func (persistent *persistent) GetDialogs(ctx context.Context, idUser int64) ([]PersistentObject, error) {
 	var dialogs []dialog
-	log.Info("id_user", idUser)
-	res := persistent.db.Table(`relationships`).Where(`(id_to=? OR id_from=?) AND ((status='declined' AND seen=false) OR status!='declined')`, idUser, idUser).Order(`created_at DESC`).Find(&dialogs)
+	res := persistent.db.WithContext(ctx).Table(`relationships`).Where(`(id_to=? OR id_from=?) AND ((status='declined' AND seen=false) OR status!='declined')`, idUser, idUser).Order(`created_at DESC`).Find(&dialogs)
 	if res.Error != nil {
 		err := fmt.Errorf("failed to get dialogs: %s", res.Error)
-		log.Error(err)
+		persistent.logError(ctx, "GetDialogs", err)
 		return nil, err
 	}
-	log.Info(dialogs)
 	var result = make([]PersistentObject, len(dialogs))
 	for i := range dialogs {
 		result[i] = &dialogs[i]
@@ -609,7 +1744,7 @@ func (persistent *persistent) GetDialogs(idUser int64) ([]PersistentObject, erro
 	return result, nil
 }
 
-func (persistent *persistent) AddRequest(request PersistentObject) error {
+func (persistent *persistent) AddRequest(ctx context.Context, request PersistentObject) error {
 	var req dialog
 	err := json.Unmarshal(request.Serialize(), &req)
 	if err != nil {
@@ -617,34 +1752,34 @@ func (persistent *persistent) AddRequest(request PersistentObject) error {
 	}
 	req.Status = "request"
 	req.Seen = false
-	res := persistent.db.Table(`relationships`).Create(&req)
+	res := persistent.db.WithContext(ctx).Table(`relationships`).Create(&req)
 	if res.Error != nil || res.RowsAffected == 0 {
 		err = fmt.Errorf("failed to add request: %s", res.Error)
-		log.Error(err)
+		persistent.logError(ctx, "AddRequest", err)
 		return err
 	}
 	return nil
 }
 
-func (persistent *persistent) UpdateRequest(request PersistentObject) (PersistentObject, error) {
+func (persistent *persistent) UpdateRequest(ctx context.Context, request PersistentObject) (PersistentObject, error) {
 	var req dialog
 	err := json.Unmarshal(request.Serialize(), &req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal request: %s", err.Error())
 	}
-	res := persistent.db.Table(`relationships`).Where(`id_to=? AND id_from=?`, &req.IdTo, &req.IdFrom).Updates(&req)
+	res := persistent.db.WithContext(ctx).Table(`relationships`).Where(`id_to=? AND id_from=?`, &req.IdTo, &req.IdFrom).Updates(&req)
 	if res.Error != nil || res.RowsAffected == 0 {
 		err = fmt.Errorf("failed to update request: %s", res.Error)
-		log.Error(err)
+		persistent.logError(ctx, "UpdateRequest", err)
 		return nil, err
 	}
-	res = persistent.db.Table(`relationships`).Where(`id_to=? AND id_from=?`, &req.IdTo, &req.IdFrom).Find(&req)
+	res = persistent.db.WithContext(ctx).Table(`relationships`).Where(`id_to=? AND id_from=?`, &req.IdTo, &req.IdFrom).Find(&req)
 	return &req, nil
 }
 
-func (persistent *persistent) GetMessages(idUsers []int64, t time.Time) ([]PersistentObject, error) {
+func (persistent *persistent) GetMessages(ctx context.Context, idUsers []int64, t time.Time) ([]PersistentObject, error) {
 	var msg []message
-	res := persistent.db.Table(`messages`).Where(`id_from IN ? AND id_to IN ? AND created_at<=?`, idUsers, idUsers, t).Order(`created_at DESC`).Limit(20).Find(&msg)
+	res := persistent.db.WithContext(ctx).Table(`messages`).Where(`id_from IN ? AND id_to IN ? AND created_at<=?`, idUsers, idUsers, t).Order(`created_at DESC`).Limit(20).Find(&msg)
 	if res.Error != nil {
 		err := fmt.Errorf("failed to get messaged: %s", res.Error)
 		return nil, err
@@ -655,3 +1790,22 @@ func (persistent *persistent) GetMessages(idUsers []int64, t time.Time) ([]Persi
 	}
 	return result, nil
 }
+
+func (persistent *persistent) Notify(ctx context.Context, channel, payload string) error {
+	res := persistent.db.WithContext(ctx).Exec(`SELECT pg_notify(?, ?);`, channel, payload)
+	if err := res.Error; err != nil {
+		persistent.logError(ctx, "Notify", err)
+		return err
+	}
+	return nil
+}
+
+// log returns the logger of the request or job of ctx
+func (persistent *persistent) log(ctx context.Context) *logging.Logger {
+	return persistent.logger.For(ctx)
+}
+
+// logError logs a failed statement of an operation with the request of ctx
+func (persistent *persistent) logError(ctx context.Context, operation string, err error) {
+	persistent.log(ctx).Error("database operation failed", logging.String("operation", operation), logging.Err(err))
+}
@@ -0,0 +1,160 @@
+package pubsub
+
+import (
+	"SB/service/repository/logging"
+	"SB/service/repository/persistence"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// maxPayload is the limit of NOTIFY payloads of postgres in bytes
+	maxPayload = 8000
+	// the listener reconnects after the minimal interval, doubled after
+	// every failure
+	minReconnectInterval = time.Second
+	maxReconnectInterval = time.Minute
+	// pingInterval is how often the connection of the listener is checked,
+	// a connection lost silently is noticed and reconnected
+	pingInterval = time.Minute
+)
+
+// ErrTooLarge is returned for events whose payload and fallback do not fit
+// a NOTIFY
+var ErrTooLarge = errors.New("event is too large to be published")
+
+type (
+	// notifier sends NOTIFY, it is implemented by persistence.Persistent
+	notifier interface {
+		Notify(ctx context.Context, channel, payload string) error
+	}
+
+	postgresPubSub struct {
+		handlers
+		notifier notifier
+		channel  string
+		// node is a random id telling the events of this node apart
+		node     string
+		listener *pq.Listener
+		done     chan struct{}
+		logger   *logging.Logger
+	}
+)
+
+// NewPostgres shares events between nodes using the same database with
+// LISTEN/NOTIFY on the channel. Events are published with the connections
+// of persistent and received on a connection of its own to dsn.
+func NewPostgres(persistent persistence.Persistent, dsn, channel string, logger *logging.Logger) (PubSub, error) {
+	node, err := newNodeId()
+	if err != nil {
+		return nil, err
+	}
+	ps := &postgresPubSub{
+		notifier: persistent,
+		channel:  channel,
+		node:     node,
+		done:     make(chan struct{}),
+		logger:   logger,
+	}
+	ps.listener = pq.NewListener(dsn, minReconnectInterval, maxReconnectInterval, ps.event)
+	if err := ps.listener.Listen(channel); err != nil {
+		_ = ps.listener.Close()
+		return nil, err
+	}
+	go ps.receive()
+	return ps, nil
+}
+
+// Publish notifies all nodes of the event. An event too large for a NOTIFY
+// is delivered by this node, the other nodes get its fallback.
+func (ps *postgresPubSub) Publish(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if len(payload) < maxPayload {
+		return ps.notifier.Notify(ctx, ps.channel, string(payload))
+	}
+	if len(event.Fallback) == 0 {
+		return ErrTooLarge
+	}
+	payload, err = json.Marshal(Event{Users: event.Users, Except: event.Except, Payload: event.Fallback, Node: ps.node})
+	if err != nil {
+		return err
+	}
+	if len(payload) >= maxPayload {
+		return ErrTooLarge
+	}
+	ps.dispatch(event)
+	return ps.notifier.Notify(ctx, ps.channel, string(payload))
+}
+
+// Close stops the listener and waits until the events received are handled
+func (ps *postgresPubSub) Close() error {
+	err := ps.listener.Close()
+	<-ps.done
+	return err
+}
+
+func (ps *postgresPubSub) receive() {
+	defer close(ps.done)
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case notification, ok := <-ps.listener.Notify:
+			if !ok {
+				return
+			}
+			ps.handle(notification)
+		case <-ticker.C:
+			go func() {
+				if err := ps.listener.Ping(); err != nil {
+					ps.logger.Warn("messenger listener is not connected", logging.Err(err))
+				}
+			}()
+		}
+	}
+}
+
+// handle dispatches a notification, nil is sent after the listener
+// reconnected
+func (ps *postgresPubSub) handle(notification *pq.Notification) {
+	if notification == nil {
+		ps.logger.Warn("messenger listener reconnected, events published meanwhile are lost")
+		return
+	}
+	var event Event
+	if err := json.Unmarshal([]byte(notification.Extra), &event); err != nil {
+		ps.logger.Error("invalid messenger event", logging.String("channel", notification.Channel), logging.Err(err))
+		return
+	}
+	if event.Node != "" && event.Node == ps.node {
+		return
+	}
+	ps.dispatch(event)
+}
+
+// newNodeId returns 64 random bits
+func newNodeId() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (ps *postgresPubSub) event(event pq.ListenerEventType, err error) {
+	switch event {
+	case pq.ListenerEventDisconnected:
+		ps.logger.Warn("messenger listener disconnected", logging.Err(err))
+	case pq.ListenerEventConnectionAttemptFailed:
+		ps.logger.Warn("messenger listener failed to connect", logging.Err(err))
+	}
+}
@@ -0,0 +1,117 @@
+package pubsub
+
+import (
+	"SB/service/config"
+	"SB/service/repository/logging"
+	"SB/service/repository/persistence"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+type (
+	// Event is delivered to the messenger sessions of the users on every
+	// node
+	Event struct {
+		Users []int64 `json:"users"`
+		// Except is the id of the session the event came from, it is not
+		// delivered to that session
+		Except  string          `json:"except,omitempty"`
+		Payload json.RawMessage `json:"payload"`
+		// Fallback is delivered by other nodes instead of a payload too large
+		// to be published, the node publishing the event delivers the payload
+		Fallback json.RawMessage `json:"-"`
+		// Node is the id of the node that has delivered the event already
+		Node string `json:"node,omitempty"`
+		// Revoke closes the sessions of the users instead of delivering a
+		// payload
+		Revoke *Revocation `json:"revoke,omitempty"`
+	}
+
+	// Revocation selects the messenger sessions opened with the access
+	// tokens of revoked sessions
+	Revocation struct {
+		// Family is the revoked session, every session is revoked when it is
+		// empty
+		Family string `json:"family,omitempty"`
+		// Except is the session kept when every session is revoked
+		Except string `json:"except,omitempty"`
+	}
+
+	// Handler delivers an event to the sessions of the node
+	Handler func(event Event)
+
+	// PubSub fans events out to all nodes of the service. Events are
+	// delivered at most once, nodes that are not connected miss them.
+	PubSub interface {
+		// Publish sends the event to the handlers of every node, this one
+		// included
+		Publish(ctx context.Context, event Event) error
+		// Subscribe adds a handler of the events of all nodes
+		Subscribe(handler Handler)
+		// Close stops receiving events
+		Close() error
+	}
+
+	// handlers are the subscribers of a node
+	handlers struct {
+		mu       sync.RWMutex
+		handlers []Handler
+	}
+
+	memoryPubSub struct {
+		handlers
+	}
+)
+
+// Revokes reports whether a messenger session opened with an access token
+// of the session family is revoked
+func (r Revocation) Revokes(family string) bool {
+	if r.Family != "" {
+		return family == r.Family
+	}
+	return r.Except == "" || family != r.Except
+}
+
+// New creates the pub/sub selected in the configuration, dsn is the
+// database listened to by postgres
+func New(persistent persistence.Persistent, dsn string, cfg config.Messenger, logger *logging.Logger) (PubSub, error) {
+	switch cfg.PubSub {
+	case "memory":
+		return NewMemory(), nil
+	case "postgres":
+		return NewPostgres(persistent, dsn, cfg.Channel, logger)
+	default:
+		return nil, fmt.Errorf("unknown messenger pubsub %q", cfg.PubSub)
+	}
+}
+
+// NewMemory delivers events to the handlers of a single node
+func NewMemory() PubSub {
+	return &memoryPubSub{}
+}
+
+func (ps *memoryPubSub) Publish(ctx context.Context, event Event) error {
+	ps.dispatch(event)
+	return nil
+}
+
+func (ps *memoryPubSub) Close() error {
+	return nil
+}
+
+func (h *handlers) Subscribe(handler Handler) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.handlers = append(h.handlers, handler)
+}
+
+func (h *handlers) dispatch(event Event) {
+	h.mu.RLock()
+	handlers := h.handlers
+	h.mu.RUnlock()
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
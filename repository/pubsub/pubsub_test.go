@@ -0,0 +1,102 @@
+package pubsub
+
+import (
+	"SB/service/config"
+	"SB/service/repository/logging"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+var ctx = context.Background()
+
+type notifications struct {
+	channel  string
+	payloads []string
+}
+
+func (n *notifications) Notify(ctx context.Context, channel, payload string) error {
+	n.channel = channel
+	n.payloads = append(n.payloads, payload)
+	return nil
+}
+
+func TestMemory(t *testing.T) {
+	ps := NewMemory()
+	var first, second []Event
+	ps.Subscribe(func(event Event) { first = append(first, event) })
+	ps.Subscribe(func(event Event) { second = append(second, event) })
+
+	event := Event{Users: []int64{1, 2}, Except: "abc", Payload: json.RawMessage(`{"content":"Hello!"}`)}
+	require.NoError(t, ps.Publish(ctx, event))
+	require.Equal(t, []Event{event}, first)
+	require.Equal(t, []Event{event}, second, "every subscriber gets the event")
+	require.NoError(t, ps.Close())
+}
+
+func TestPostgres(t *testing.T) {
+	n := &notifications{}
+	ps := &postgresPubSub{notifier: n, channel: "sb_messenger", logger: logging.Discard()}
+	var received []Event
+	ps.Subscribe(func(event Event) { received = append(received, event) })
+
+	event := Event{Users: []int64{1}, Payload: json.RawMessage(`{"content":"Hello!"}`)}
+	require.NoError(t, ps.Publish(ctx, event))
+	require.Equal(t, "sb_messenger", n.channel)
+	require.Equal(t, []string{`{"users":[1],"payload":{"content":"Hello!"}}`}, n.payloads)
+	require.Empty(t, received, "events are delivered when they are received from the listener")
+
+	ps.handle(&pq.Notification{Channel: "sb_messenger", Extra: n.payloads[0]})
+	ps.handle(&pq.Notification{Channel: "sb_messenger", Extra: "not json"})
+	ps.handle(nil)
+	require.Equal(t, []Event{event}, received)
+
+	large := Event{Users: []int64{1}, Payload: json.RawMessage(`"` + strings.Repeat("a", maxPayload) + `"`)}
+	require.ErrorIs(t, ps.Publish(ctx, large), ErrTooLarge)
+	require.Len(t, n.payloads, 1)
+	require.Len(t, received, 1, "events that are not published are not delivered")
+}
+
+func TestPostgresFallback(t *testing.T) {
+	n := &notifications{}
+	ps := &postgresPubSub{notifier: n, channel: "sb_messenger", node: "a1", logger: logging.Discard()}
+	other := &postgresPubSub{notifier: n, channel: "sb_messenger", node: "b2", logger: logging.Discard()}
+	var received, otherReceived []Event
+	ps.Subscribe(func(event Event) { received = append(received, event) })
+	other.Subscribe(func(event Event) { otherReceived = append(otherReceived, event) })
+
+	large := Event{Users: []int64{1}, Payload: json.RawMessage(`"` + strings.Repeat("a", maxPayload) + `"`), Fallback: json.RawMessage(`{"event":"dialog_updated"}`)}
+	require.NoError(t, ps.Publish(ctx, large))
+	require.Equal(t, []Event{large}, received, "the node publishing the event delivers the payload")
+	require.Equal(t, []string{`{"users":[1],"payload":{"event":"dialog_updated"},"node":"a1"}`}, n.payloads)
+
+	ps.handle(&pq.Notification{Channel: "sb_messenger", Extra: n.payloads[0]})
+	require.Len(t, received, 1, "the node does not deliver the event twice")
+	other.handle(&pq.Notification{Channel: "sb_messenger", Extra: n.payloads[0]})
+	require.Equal(t, []Event{{Users: []int64{1}, Payload: json.RawMessage(`{"event":"dialog_updated"}`), Node: "a1"}}, otherReceived)
+}
+
+func TestNew(t *testing.T) {
+	cfg := config.Default().Messenger
+	ps, err := New(nil, "", cfg, logging.Discard())
+	require.NoError(t, err)
+	require.IsType(t, &memoryPubSub{}, ps)
+
+	cfg.PubSub = "redis"
+	_, err = New(nil, "", cfg, logging.Discard())
+	require.Error(t, err)
+}
+
+func TestRevocation(t *testing.T) {
+	require.True(t, Revocation{Family: "a"}.Revokes("a"))
+	require.False(t, Revocation{Family: "a"}.Revokes("b"))
+	require.False(t, Revocation{Family: "a"}.Revokes(""), "sessions of API keys are kept")
+	require.True(t, Revocation{}.Revokes("a"))
+	require.True(t, Revocation{}.Revokes(""), "every session is revoked")
+	require.False(t, Revocation{Except: "a"}.Revokes("a"), "the current session is kept")
+	require.True(t, Revocation{Except: "a"}.Revokes("b"))
+}
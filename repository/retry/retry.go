@@ -0,0 +1,45 @@
+// Package retry runs operations that fail while a dependency is starting,
+// like connecting to the database, until they succeed
+package retry
+
+import (
+	"SB/service/repository/logging"
+	"context"
+	"time"
+)
+
+// maxWait caps the doubled wait between attempts
+const maxWait = 30 * time.Second
+
+// Backoff makes Attempts attempts, the wait between them starts at Wait and
+// doubles after every attempt up to 30 seconds
+type Backoff struct {
+	Attempts int
+	Wait     time.Duration
+	// Logger writes the failed attempts
+	Logger *logging.Logger
+}
+
+// Do runs fn until it succeeds or all attempts fail and returns the last
+// error. It stops waiting and returns the error of fn when ctx is done.
+func (b Backoff) Do(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	wait := b.Wait
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || attempt >= b.Attempts {
+			return err
+		}
+		b.Logger.For(ctx).Warn(name+" failed, retrying", logging.Int("attempt", int64(attempt)), logging.Int("attempts", int64(b.Attempts)),
+			logging.Duration("wait", wait), logging.Err(err))
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		if wait *= 2; wait > maxWait {
+			wait = maxWait
+		}
+	}
+}
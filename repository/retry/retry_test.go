@@ -0,0 +1,49 @@
+package retry
+
+import (
+	"SB/service/repository/logging"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDo(t *testing.T) {
+	ctx := context.Background()
+	refused := errors.New("connection refused")
+	backoff := Backoff{Attempts: 3, Wait: time.Millisecond, Logger: logging.Discard()}
+
+	calls := 0
+	err := backoff.Do(ctx, "connect", func(ctx context.Context) error {
+		if calls++; calls < 3 {
+			return refused
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, calls, "the last attempt succeeds")
+
+	calls = 0
+	err = backoff.Do(ctx, "connect", func(ctx context.Context) error {
+		calls++
+		return refused
+	})
+	require.Equal(t, refused, err)
+	require.Equal(t, 3, calls)
+}
+
+func TestDoCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	started := time.Now()
+	err := Backoff{Attempts: 10, Wait: time.Hour, Logger: logging.Discard()}.Do(ctx, "connect", func(ctx context.Context) error {
+		calls++
+		cancel()
+		return errors.New("connection refused")
+	})
+	require.Error(t, err)
+	require.Equal(t, 1, calls)
+	require.Less(t, int64(time.Since(started)), int64(time.Second), "the wait stops when ctx is done")
+}
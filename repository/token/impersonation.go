@@ -0,0 +1,126 @@
+package token
+
+import (
+	"SB/service/repository/audit"
+	"SB/service/repository/errs"
+	"SB/service/repository/logging"
+	"SB/service/repository/persistence"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// ErrImpersonationDenied is returned when an admin tries to impersonate
+// themselves or another admin
+var ErrImpersonationDenied = errs.New(errs.ErrForbidden, "user cannot be impersonated")
+
+// ImpersonatedRequest is written to the audit log
+type ImpersonatedRequest struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+}
+
+// ErrImpersonationEnded is returned for impersonation tokens whose session
+// was revoked
+var ErrImpersonationEnded = errors.New("impersonation session has ended")
+
+func (mgr *TokenManagerImpl) Impersonate(ctx context.Context, actor audit.Actor, idUser int64, twoFactor bool, client persistence.ClientInfo) (persistence.Token, error) {
+	if actor.IdUser == idUser {
+		return nil, ErrImpersonationDenied
+	}
+	user, err := mgr.db.GetUser(ctx, idUser)
+	if err != nil {
+		return nil, err
+	}
+	if user.GetRole() == RoleAdmin {
+		return nil, ErrImpersonationDenied
+	}
+
+	// the token is bound to a session of the user which is revoked like
+	// any other, no refresh token of it is ever issued
+	family, err := GenerateTokenID()
+	if err != nil {
+		return nil, err
+	}
+	sessionId, err := GenerateTokenID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	expires := now.Add(mgr.config.ImpersonationExpiration)
+	claims := CustomizedClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        fmt.Sprintf("%d", idUser),
+			ExpiresAt: expires.Unix(),
+		},
+		Role:      user.GetRole(),
+		SessionId: family,
+		TwoFactor: twoFactor,
+		Actor:     &Actor{Subject: fmt.Sprintf("%d", actor.IdUser)},
+	}
+	signed, err := SignAccessToken(mgr.keys, &claims)
+	if err != nil {
+		return nil, err
+	}
+
+	client.Device = fmt.Sprintf("Impersonation by admin %d", actor.IdUser)
+	err = mgr.db.AddSession(ctx, &tokenImpl{
+		Id:        sessionId,
+		Username:  user.GetUsername(),
+		UserId:    idUser,
+		Role:      user.GetRole(),
+		LoginDate: now,
+		Expires:   expires,
+		Family:    family,
+		Client:    client,
+		TwoFactor: twoFactor,
+	})
+	if err != nil {
+		return nil, err
+	}
+	mgr.logger.For(ctx).Warn("admin impersonates user", logging.Int("id_admin", actor.IdUser), logging.Int("id_user", idUser))
+	mgr.audit.Record(ctx, audit.Actor{
+		IdUser:         idUser,
+		ImpersonatedBy: actor.IdUser,
+		IP:             actor.IP,
+		RequestId:      actor.RequestId,
+	}, audit.ActionImpersonationStarted, audit.TargetUser, idUser, nil, map[string]interface{}{
+		"session_id": family,
+		"expires":    expires,
+	})
+	return &tokenImpl{
+		Id:        signed,
+		Username:  user.GetUsername(),
+		UserId:    idUser,
+		Role:      user.GetRole(),
+		Expires:   time.Unix(claims.ExpiresAt, 0),
+		Family:    family,
+		TwoFactor: twoFactor,
+	}, nil
+}
+
+// checkImpersonation returns ErrImpersonationEnded if the session of an
+// impersonation token is revoked
+func (mgr *TokenManagerImpl) checkImpersonation(ctx context.Context, claims *CustomizedClaims) error {
+	idUser, err := strconv.ParseInt(claims.Id, 10, 64)
+	if err != nil {
+		return err
+	}
+	active, err := mgr.db.HasSession(ctx, idUser, claims.SessionId)
+	if err != nil {
+		return err
+	}
+	if !active {
+		return ErrImpersonationEnded
+	}
+	return nil
+}
+
+func (mgr *TokenManagerImpl) AuditImpersonation(ctx context.Context, actor audit.Actor, request ImpersonatedRequest) {
+	mgr.audit.Record(ctx, actor, audit.ActionImpersonatedRequest, audit.TargetUser, actor.IdUser, nil, request)
+}
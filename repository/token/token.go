@@ -1,10 +1,10 @@
 package token
 
 import (
+	"SB/service/repository/persistence"
 	"crypto/rand"
 	"encoding/base32"
 	"github.com/dgrijalva/jwt-go"
-	"github.com/labstack/gommon/log"
 	"time"
 )
 
@@ -17,16 +17,39 @@ type (
 		Role      string
 		LoginDate time.Time
 		Expires   time.Time
+		Family    string
+		Client    persistence.ClientInfo
+		TwoFactor bool
 	}
 
 	CustomizedClaims struct {
 		jwt.StandardClaims
 		Role string `json:"role"`
+		// SessionId is the family of the refresh token the access token was
+		// issued with or the id of a two-factor challenge
+		SessionId string `json:"sid,omitempty"`
+		// TwoFactor is set when the session was started with a second factor
+		TwoFactor bool `json:"mfa,omitempty"`
+		// Actor is the admin impersonating the user
+		Actor *Actor `json:"act,omitempty"`
 	}
+
+	// Actor is the party acting on behalf of the subject of a token (RFC 8693)
+	Actor struct {
+		// Subject is the id of the acting user
+		Subject string `json:"sub"`
+	}
+)
+
+const (
+	RoleUser      = "user"
+	RoleCoach     = "coach"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
 )
 
-const admin = "admin"
-const user = "user"
+// Roles lists every role a user can have
+var Roles = []string{RoleUser, RoleCoach, RoleModerator, RoleAdmin}
 
 func (token *tokenImpl) GetId() string {
 	return token.Id
@@ -52,6 +75,23 @@ func (token *tokenImpl) GetUsername() string {
 	return token.Username
 }
 
+func (token *tokenImpl) GetFamily() string {
+	return token.Family
+}
+
+func (token *tokenImpl) GetClient() persistence.ClientInfo {
+	return token.Client
+}
+
+func (token *tokenImpl) IsTwoFactor() bool {
+	return token.TwoFactor
+}
+
+// IsRotated is always false, tokens are rotated only in the database
+func (token *tokenImpl) IsRotated() bool {
+	return false
+}
+
 //func (token *tokenImpl) GetLoginDateFormatted() string {
 //	tm := time.Unix(int64(token.LoginDate), 0)
 //	return tm.Format("2006-01-02 15:04:05")
@@ -63,7 +103,6 @@ func GenerateTokenID() (string, error) {
 	b := make([]byte, size)
 	_, err := rand.Read(b)
 	if err != nil {
-		log.Error("failed to create token", err)
 		return "", err
 	}
 
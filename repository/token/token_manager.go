@@ -2,54 +2,115 @@ package token
 
 import (
 	"SB/service/config"
+	"SB/service/repository/audit"
+	"SB/service/repository/keys"
+	"SB/service/repository/logging"
 	"SB/service/repository/persistence"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
 	"time"
 )
 
+const EventRefreshTokenReuse = "refresh_token_reuse"
+
+const (
+	// AccessType is the typ header of access tokens (RFC 9068), the other
+	// tokens signed with the keys published in the JWKS have the typ JWT
+	AccessType = "at+jwt"
+	// AccessAudience is the audience of access tokens
+	AccessAudience = "api"
+	// challengeAudience marks tokens that prove only the password of a user
+	// and can be exchanged for a session with a second factor
+	challengeAudience = "2fa"
+)
+
+// ErrRefreshTokenReused means the session family is revoked and the user
+// has to log in again
+var ErrRefreshTokenReused = errors.New("refresh token reuse detected")
+
 type (
 	TokenManager interface {
-		GenerateNewToken(userId int64, role string, username string) (accessToken persistence.Token, refreshToken persistence.Token, err error)
-		Add(token persistence.Token) error
-		Get(id string) (persistence.Token, error)
-		//GetAll() ([]Token, error)
-		Remove(id string) error
-		Refresh(tokenId string) (accessTkn persistence.Token, refreshTkn persistence.Token, err error)
-		//RemoveAllTokens() error
-		//WatchExpired() (error)
+		GenerateNewToken(ctx context.Context, userId int64, role string, username string, client persistence.ClientInfo, twoFactor bool) (accessToken persistence.Token, refreshToken persistence.Token, err error)
+		Add(ctx context.Context, token persistence.Token) error
+		Get(ctx context.Context, id string) (persistence.Token, error)
+		GetSessions(ctx context.Context, userId int64) ([]persistence.SessionInfo, error)
+		Remove(ctx context.Context, id string) (persistence.Token, error)
+		RemoveSession(ctx context.Context, userId int64, sessionId string) error
+		RemoveAllSessions(ctx context.Context, userId int64, except string, revokeKeys bool) (int64, error)
+		Refresh(ctx context.Context, tokenId string, client persistence.ClientInfo) (accessTkn persistence.Token, refreshTkn persistence.Token, err error)
+		ParseAccessToken(ctx context.Context, accessToken string) (*CustomizedClaims, error)
+		NewChallenge(user persistence.User, id string, expiration time.Duration) (string, error)
+		ParseChallenge(ctx context.Context, challenge string) (*CustomizedClaims, error)
+		RemoveExpired(ctx context.Context) (int64, error)
+		// Impersonate issues an access token of the user for an admin, it
+		// carries the admin in the act claim, has no refresh token and is
+		// bound to a session of the user listed with the other sessions. The
+		// start is recorded in the audit log, actor is the admin.
+		Impersonate(ctx context.Context, actor audit.Actor, idUser int64, twoFactor bool, client persistence.ClientInfo) (persistence.Token, error)
+		// AuditImpersonation records a request made with an impersonation
+		// token in the audit log, actor is the user acted as by the admin
+		AuditImpersonation(ctx context.Context, actor audit.Actor, request ImpersonatedRequest)
+		// JWKS returns public keys verifying access tokens
+		JWKS() keys.JWKS
 		//KeepAlive(id TokenID) error
 	}
 
 	TokenManagerImpl struct {
-		db persistence.Persistent
+		db     persistence.Persistent
+		keys   keys.Ring
+		config config.Token
+		audit  audit.Log
+		logger *logging.Logger
 	}
 )
 
-func NewTokenManager(persistent persistence.Persistent) TokenManager {
+// NewTokenManager signs tokens with the current key of the ring, tokens are
+// verified by the key named in their kid header
+func NewTokenManager(persistent persistence.Persistent, ring keys.Ring, cfg config.Token, auditLog audit.Log, logger *logging.Logger) TokenManager {
 	return &TokenManagerImpl{
-		db: persistent,
+		db:     persistent,
+		keys:   ring,
+		config: cfg,
+		audit:  auditLog,
+		logger: logger,
 	}
 }
 
-func (mgr *TokenManagerImpl) GenerateNewToken(userId int64, role string, username string) (accessTkn persistence.Token, refreshTkn persistence.Token, err error) {
-	//claims := CustomizedClaims{
-	//	StandardClaims: jwt.StandardClaims{
-	//		Id:        fmt.Sprintf("%d", userId),
-	//		ExpiresAt: time.Now().UTC().Add(config.AccessTokenExpiration).Unix(),
-	//	},
-	//	Role: role,
-	//}
-
-	claims := jwt.StandardClaims{
-		Id:        fmt.Sprintf("%d", userId),
-		ExpiresAt: time.Now().UTC().Add(time.Hour).Unix(),
+// GenerateNewToken starts a new session family on login, twoFactor tells
+// whether the user has entered a second factor
+func (mgr *TokenManagerImpl) GenerateNewToken(ctx context.Context, userId int64, role string, username string, client persistence.ClientInfo, twoFactor bool) (accessTkn persistence.Token, refreshTkn persistence.Token, err error) {
+	family, err := GenerateTokenID()
+	if err != nil {
+		return nil, nil, err
+	}
+	accessTkn, refreshTkn, err = mgr.newTokens(userId, role, username, family, time.Now().UTC(), client, twoFactor)
+	if err != nil {
+		return nil, nil, err
 	}
+	err = mgr.Add(ctx, refreshTkn)
+	if err != nil {
+		return nil, nil, err
+	}
+	return
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &claims)
+func (mgr *TokenManagerImpl) newTokens(userId int64, role string, username string, family string, loginDate time.Time, client persistence.ClientInfo, twoFactor bool) (accessTkn persistence.Token, refreshTkn persistence.Token, err error) {
+	claims := CustomizedClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        fmt.Sprintf("%d", userId),
+			ExpiresAt: time.Now().UTC().Add(mgr.config.AccessTokenExpiration).Unix(),
+		},
+		Role:      role,
+		SessionId: family,
+		TwoFactor: twoFactor,
+	}
 
-	accessTokenId, err := token.SignedString([]byte(config.Secret))
+	accessTokenId, err := SignAccessToken(mgr.keys, &claims)
+	if err != nil {
+		return nil, nil, err
+	}
 	refreshTokenId, err := GenerateTokenID()
 	if err != nil {
 		return nil, nil, err
@@ -59,61 +120,215 @@ func (mgr *TokenManagerImpl) GenerateNewToken(userId int64, role string, usernam
 		Id:        refreshTokenId,
 		UserId:    userId,
 		Role:      role,
-		LoginDate: time.Now().UTC(),
-		Expires:   time.Now().UTC().Add(config.RefreshTokenExpiration),
-	}
-	err = mgr.Add(refreshTkn)
-	if err != nil {
-		return nil, nil, err
+		LoginDate: loginDate,
+		Expires:   time.Now().UTC().Add(mgr.config.RefreshTokenExpiration),
+		Family:    family,
+		Client:    client,
+		TwoFactor: twoFactor,
 	}
 	accessTkn = &tokenImpl{
 		Username:  username,
 		Role:      role,
 		Id:        accessTokenId,
 		Expires:   time.Unix(claims.ExpiresAt, 0),
-		LoginDate: time.Now().UTC(),
+		LoginDate: loginDate,
 		UserId:    userId,
+		Family:    family,
+		Client:    client,
+		TwoFactor: twoFactor,
 	}
 	return
 }
 
-func (mgr *TokenManagerImpl) Add(token persistence.Token) error {
-	added := mgr.db.AddSession(token)
-	if !added {
-		return errors.New("failed to add token")
-	}
-	return nil
+func (mgr *TokenManagerImpl) Add(ctx context.Context, token persistence.Token) error {
+	return mgr.db.AddSession(ctx, token)
 }
-func (mgr *TokenManagerImpl) Get(tokenId string) (persistence.Token, error) {
-	return mgr.db.GetSession(tokenId)
+func (mgr *TokenManagerImpl) Get(ctx context.Context, tokenId string) (persistence.Token, error) {
+	return mgr.db.GetSession(ctx, tokenId)
 }
 
-func (mgr *TokenManagerImpl) Refresh(tokenId string) (accessTkn persistence.Token, refreshTkn persistence.Token, err error) {
-	tkn, err := mgr.db.GetSession(tokenId)
+// Refresh exchanges a refresh token for a new pair of tokens of the same
+// family. A token that has already been exchanged is a sign it was stolen,
+// so the whole family is revoked and ErrRefreshTokenReused is returned.
+func (mgr *TokenManagerImpl) Refresh(ctx context.Context, tokenId string, client persistence.ClientInfo) (accessTkn persistence.Token, refreshTkn persistence.Token, err error) {
+	tkn, err := mgr.db.GetSession(ctx, tokenId)
 	if err != nil {
 		return nil, nil, err
 	}
-	err = mgr.db.RemoveSession(tokenId)
-	if err != nil {
-		return nil, nil, err
+	if tkn.IsRotated() {
+		return nil, nil, mgr.revokeReusedFamily(ctx, tkn)
 	}
 	if tkn.GetExpirationTime().Unix() < time.Now().UTC().Unix() {
+		err = mgr.db.RevokeSessionFamily(ctx, tkn.GetFamily())
+		if err != nil {
+			return nil, nil, err
+		}
 		return nil, nil, errors.New("refresh token expired")
 	}
-	return mgr.GenerateNewToken(tkn.GetUserId(), tkn.GetRole(), tkn.GetUsername())
+	if client.Device == "" {
+		client.Device = tkn.GetClient().Device
+	}
+	accessTkn, refreshTkn, err = mgr.newTokens(tkn.GetUserId(), tkn.GetRole(), tkn.GetUsername(), tkn.GetFamily(), tkn.GetLoginDate(), client, tkn.IsTwoFactor())
+	if err != nil {
+		return nil, nil, err
+	}
+	err = mgr.db.RotateSession(ctx, tokenId, refreshTkn)
+	if errors.Is(err, persistence.ErrSessionRotated) {
+		// another request has exchanged the token in the meantime
+		return nil, nil, mgr.revokeReusedFamily(ctx, tkn)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return
+}
+
+func (mgr *TokenManagerImpl) revokeReusedFamily(ctx context.Context, tkn persistence.Token) error {
+	mgr.logger.For(ctx).Warn("refresh token reuse detected, revoking session family", logging.Int("id_user", tkn.GetUserId()),
+		logging.String("family", tkn.GetFamily()))
+	err := mgr.db.RevokeSessionFamily(ctx, tkn.GetFamily())
+	if err != nil {
+		return err
+	}
+	err = mgr.db.AddSecurityEvent(ctx, tkn.GetUserId(), EventRefreshTokenReuse, map[string]interface{}{
+		"family":     tkn.GetFamily(),
+		"login_time": tkn.GetLoginDate(),
+	})
+	if err != nil {
+		mgr.logger.For(ctx).Error("failed to record security event", logging.Int("id_user", tkn.GetUserId()), logging.Err(err))
+	}
+	return ErrRefreshTokenReused
+}
+
+// SignAccessToken signs the claims as an access token with the typ header
+// and the audience of access tokens
+func SignAccessToken(ring keys.Ring, claims *CustomizedClaims) (string, error) {
+	claims.Audience = AccessAudience
+	return keys.SignType(ring, AccessType, claims)
+}
+
+// ParseAccessToken checks signature and expiration of an access token and
+// returns its claims, the role in claims is trusted without a database lookup
+// but impersonation tokens are checked against their session
+func (mgr *TokenManagerImpl) ParseAccessToken(ctx context.Context, accessToken string) (*CustomizedClaims, error) {
+	claims, header, err := mgr.parse(ctx, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	if !isAccessToken(claims, header) {
+		return nil, errors.New("not an access token")
+	}
+	if claims.Role == "" {
+		return nil, errors.New("token has no role")
+	}
+	if claims.Actor != nil {
+		if err := mgr.checkImpersonation(ctx, claims); err != nil {
+			return nil, err
+		}
+	}
+	return claims, nil
+}
+
+// NewChallenge signs a short-lived token for a user who has entered the
+// password but not yet the second factor, it is not accepted as an access
+// token. The id names the challenge stored by the caller.
+func (mgr *TokenManagerImpl) NewChallenge(user persistence.User, id string, expiration time.Duration) (string, error) {
+	claims := CustomizedClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        fmt.Sprintf("%d", user.GetId()),
+			Subject:   user.GetUsername(),
+			Audience:  challengeAudience,
+			ExpiresAt: time.Now().UTC().Add(expiration).Unix(),
+		},
+		Role:      user.GetRole(),
+		SessionId: id,
+	}
+	return mgr.sign(&claims)
+}
+
+func (mgr *TokenManagerImpl) ParseChallenge(ctx context.Context, challenge string) (*CustomizedClaims, error) {
+	claims, _, err := mgr.parse(ctx, challenge)
+	if err != nil {
+		return nil, err
+	}
+	if !claims.VerifyAudience(challengeAudience, true) {
+		return nil, errors.New("not a two-factor challenge")
+	}
+	return claims, nil
+}
+
+func (mgr *TokenManagerImpl) sign(claims *CustomizedClaims) (string, error) {
+	return keys.Sign(mgr.keys, claims)
+}
+
+func (mgr *TokenManagerImpl) parse(ctx context.Context, tkn string) (*CustomizedClaims, map[string]interface{}, error) {
+	claims := &CustomizedClaims{}
+	parsed, err := jwt.ParseWithClaims(tkn, claims, func(token *jwt.Token) (interface{}, error) {
+		return mgr.verificationKey(ctx, token)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return claims, parsed.Header, nil
+}
+
+// isAccessToken checks the typ header and the audience, legacy HS256 tokens
+// without kid had neither
+func isAccessToken(claims *CustomizedClaims, header map[string]interface{}) bool {
+	if kid, _ := header["kid"].(string); kid == "" {
+		return claims.Audience == ""
+	}
+	typ, _ := header["typ"].(string)
+	return typ == AccessType && claims.Audience == AccessAudience
+}
+
+// verificationKey returns the key named by the kid header, tokens without
+// kid are legacy HS256 tokens accepted only while the secret is configured
+func (mgr *TokenManagerImpl) verificationKey(ctx context.Context, token *jwt.Token) (interface{}, error) {
+	if kid, _ := token.Header["kid"].(string); kid != "" {
+		return keys.KeyFunc(ctx, mgr.keys)(token)
+	}
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok || mgr.config.Secret == "" {
+		return nil, fmt.Errorf("unexpected signing method %v without key id", token.Header["alg"])
+	}
+	return []byte(mgr.config.Secret), nil
 }
 
-// TODO: implement all tokens method
-//func (mgr *TokenManagerImpl) GetAll() ([]Token, error) {
-//
-//}
+func (mgr *TokenManagerImpl) JWKS() keys.JWKS {
+	return mgr.keys.JWKS()
+}
+
+// Remove ends the session of the refresh token together with the tokens
+// it was rotated from and returns the refresh token
+func (mgr *TokenManagerImpl) Remove(ctx context.Context, id string) (persistence.Token, error) {
+	tkn, err := mgr.db.GetSession(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return tkn, mgr.db.RevokeSessionFamily(ctx, tkn.GetFamily())
+}
 
-func (mgr *TokenManagerImpl) Remove(id string) error {
-	return mgr.db.RemoveSession(id)
+func (mgr *TokenManagerImpl) GetSessions(ctx context.Context, userId int64) ([]persistence.SessionInfo, error) {
+	return mgr.db.GetSessions(ctx, userId)
 }
 
-//func (mgr *TokenManagerImpl) RemoveAllTokens() error{}
-//func (mgr *TokenManagerImpl) WatchExpired() (error){}
+// RemoveSession revokes refresh tokens of the session, access tokens already
+// issued stay valid until they expire
+func (mgr *TokenManagerImpl) RemoveSession(ctx context.Context, userId int64, sessionId string) error {
+	return mgr.db.RevokeSession(ctx, userId, sessionId)
+}
+
+// RemoveAllSessions revokes every session of the user except the given one
+// and with revokeKeys all API keys, pass an empty session id to revoke every
+// session
+func (mgr *TokenManagerImpl) RemoveAllSessions(ctx context.Context, userId int64, except string, revokeKeys bool) (int64, error) {
+	return mgr.db.RevokeUserSessions(ctx, userId, except, revokeKeys)
+}
+
+// RemoveExpired deletes expired refresh tokens, it is run periodically by
+// the jobs scheduler
+func (mgr *TokenManagerImpl) RemoveExpired(ctx context.Context) (int64, error) {
+	return mgr.db.DeleteExpiredSessions(ctx)
+}
 
 // TODO: implement expired token monitoring
 //func (mgr *TokenManagerImpl) KeepAlive(id TokenID) error{}
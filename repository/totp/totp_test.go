@@ -0,0 +1,63 @@
+package totp
+
+import (
+	"encoding/base32"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// secret of the RFC 6238 test vectors for SHA-1
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	// the RFC lists 8 digit codes, authenticator apps use the last 6
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, expected := range vectors {
+		code, err := Code(rfcSecret, Step(time.Unix(unix, 0)))
+		require.NoError(t, err)
+		require.Equal(t, expected, code, "time %d", unix)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	require.NoError(t, err)
+	now := time.Unix(1637603397, 0)
+
+	code, err := Code(secret, Step(now)-1)
+	require.NoError(t, err)
+	step, ok, err := Validate(secret, code, now)
+	require.NoError(t, err)
+	require.True(t, ok, "previous step is accepted")
+	require.Equal(t, Step(now)-1, step)
+
+	code, err = Code(secret, Step(now)+2)
+	require.NoError(t, err)
+	_, ok, err = Validate(secret, code, now)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	_, ok, err = Validate(secret, "12345", now)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestURI(t *testing.T) {
+	u, err := url.Parse(URI("Sport Buddy", "test@example.com", "JBSWY3DPEHPK3PXP"))
+	require.NoError(t, err)
+	require.Equal(t, "otpauth", u.Scheme)
+	require.Equal(t, "totp", u.Host)
+	require.Equal(t, "/Sport Buddy:test@example.com", u.Path)
+	require.Equal(t, "JBSWY3DPEHPK3PXP", u.Query().Get("secret"))
+	require.Equal(t, "Sport Buddy", u.Query().Get("issuer"))
+}
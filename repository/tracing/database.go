@@ -0,0 +1,68 @@
+package tracing
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+const spanKeyName = "tracing:span"
+
+// databasePlugin is a gorm plugin starting a span for every statement
+type databasePlugin struct{}
+
+// DatabasePlugin returns a gorm plugin tracing statements as children of
+// the span of their context. The SQL has placeholders for values, so it is
+// recorded without the data of users.
+func DatabasePlugin() gorm.Plugin {
+	return databasePlugin{}
+}
+
+func (databasePlugin) Name() string {
+	return "tracing"
+}
+
+func (databasePlugin) Initialize(db *gorm.DB) error {
+	start := func(operation string) func(*gorm.DB) {
+		return func(db *gorm.DB) {
+			_, span := Start(db.Statement.Context, "db."+operation, KindClient,
+				String("db.system", "postgresql"), String("db.operation", operation))
+			if span != nil {
+				db.InstanceSet(spanKeyName, span)
+			}
+		}
+	}
+	finish := func(db *gorm.DB) {
+		v, ok := db.InstanceGet(spanKeyName)
+		if !ok {
+			return
+		}
+		span := v.(*Span)
+		span.SetAttributes(String("db.sql.table", db.Statement.Table), String("db.statement", db.Statement.SQL.String()),
+			Int("db.rows_affected", db.RowsAffected))
+		if !errors.Is(db.Error, gorm.ErrRecordNotFound) {
+			span.SetError(db.Error)
+		}
+		span.End()
+	}
+	callbacks := db.Callback()
+	for _, err := range []error{
+		callbacks.Create().Before("gorm:create").Register("tracing:before_create", start("create")),
+		callbacks.Create().After("gorm:create").Register("tracing:after_create", finish),
+		callbacks.Query().Before("gorm:query").Register("tracing:before_query", start("query")),
+		callbacks.Query().After("gorm:query").Register("tracing:after_query", finish),
+		callbacks.Update().Before("gorm:update").Register("tracing:before_update", start("update")),
+		callbacks.Update().After("gorm:update").Register("tracing:after_update", finish),
+		callbacks.Delete().Before("gorm:delete").Register("tracing:before_delete", start("delete")),
+		callbacks.Delete().After("gorm:delete").Register("tracing:after_delete", finish),
+		callbacks.Row().Before("gorm:row").Register("tracing:before_row", start("row")),
+		callbacks.Row().After("gorm:row").Register("tracing:after_row", finish),
+		callbacks.Raw().Before("gorm:raw").Register("tracing:before_raw", start("raw")),
+		callbacks.Raw().After("gorm:raw").Register("tracing:after_raw", finish),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
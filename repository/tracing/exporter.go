@@ -0,0 +1,178 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Exporter sends ended spans to a backend
+type Exporter interface {
+	Export(ctx context.Context, spans []SpanData) error
+}
+
+type (
+	// stdoutExporter writes a JSON line per span
+	stdoutExporter struct {
+		mu      sync.Mutex
+		encoder *json.Encoder
+		service string
+	}
+
+	stdoutSpan struct {
+		Service    string                 `json:"service"`
+		TraceID    string                 `json:"trace_id"`
+		SpanID     string                 `json:"span_id"`
+		ParentID   string                 `json:"parent_id,omitempty"`
+		Name       string                 `json:"name"`
+		Kind       string                 `json:"kind"`
+		Start      time.Time              `json:"start"`
+		DurationMs float64                `json:"duration_ms"`
+		Attributes map[string]interface{} `json:"attributes,omitempty"`
+		Error      string                 `json:"error,omitempty"`
+	}
+
+	// otlpExporter posts spans to the OTLP/HTTP endpoint of a collector in
+	// the JSON encoding
+	otlpExporter struct {
+		endpoint string
+		service  string
+		client   *http.Client
+	}
+)
+
+func NewStdoutExporter(w io.Writer, service string) Exporter {
+	return &stdoutExporter{encoder: json.NewEncoder(w), service: service}
+}
+
+func (e *stdoutExporter) Export(ctx context.Context, spans []SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, s := range spans {
+		out := stdoutSpan{
+			Service:    e.service,
+			TraceID:    s.Context.TraceID.String(),
+			SpanID:     s.Context.SpanID.String(),
+			Name:       s.Name,
+			Kind:       s.Kind,
+			Start:      s.Start.UTC(),
+			DurationMs: float64(s.End.Sub(s.Start)) / float64(time.Millisecond),
+			Error:      s.Error,
+		}
+		if s.Parent != (SpanID{}) {
+			out.ParentID = s.Parent.String()
+		}
+		if len(s.Attributes) > 0 {
+			out.Attributes = make(map[string]interface{}, len(s.Attributes))
+			for _, a := range s.Attributes {
+				out.Attributes[a.Key] = a.Value
+			}
+		}
+		if err := e.encoder.Encode(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewOTLPExporter exports to the traces endpoint of a collector, e.g.
+// http://localhost:4318/v1/traces
+func NewOTLPExporter(endpoint, service string) Exporter {
+	return &otlpExporter{endpoint: endpoint, service: service, client: &http.Client{Timeout: exportTimeout}}
+}
+
+func (e *otlpExporter) Export(ctx context.Context, spans []SpanData) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("collector responded %s: %s", res.Status, message)
+	}
+	return nil
+}
+
+// OTLP span kinds and status codes
+var otlpKinds = map[string]int{KindInternal: 1, KindServer: 2, KindClient: 3}
+
+const otlpStatusError = 2
+
+type (
+	object = map[string]interface{}
+	array  = []interface{}
+)
+
+// request builds an ExportTraceServiceRequest, ids are hex and 64 bit
+// integers are strings in its JSON encoding
+func (e *otlpExporter) request(spans []SpanData) object {
+	out := make(array, 0, len(spans))
+	for _, s := range spans {
+		span := object{
+			"traceId":           s.Context.TraceID.String(),
+			"spanId":            s.Context.SpanID.String(),
+			"name":              s.Name,
+			"kind":              otlpKinds[s.Kind],
+			"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.Attributes),
+		}
+		if s.Parent != (SpanID{}) {
+			span["parentSpanId"] = s.Parent.String()
+		}
+		if s.Context.TraceState != "" {
+			span["traceState"] = s.Context.TraceState
+		}
+		if s.Error != "" {
+			span["status"] = object{"code": otlpStatusError, "message": s.Error}
+		}
+		out = append(out, span)
+	}
+	return object{"resourceSpans": array{object{
+		"resource": object{"attributes": otlpAttributes([]Attribute{String("service.name", e.service)})},
+		"scopeSpans": array{object{
+			"scope": object{"name": "SB/service"},
+			"spans": out,
+		}},
+	}}}
+}
+
+func otlpAttributes(attributes []Attribute) array {
+	out := make(array, 0, len(attributes))
+	for _, a := range attributes {
+		var value object
+		switch v := a.Value.(type) {
+		case string:
+			value = object{"stringValue": v}
+		case int64:
+			value = object{"intValue": strconv.FormatInt(v, 10)}
+		case int:
+			value = object{"intValue": strconv.Itoa(v)}
+		case float64:
+			value = object{"doubleValue": v}
+		case bool:
+			value = object{"boolValue": v}
+		default:
+			value = object{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, object{"key": a.Key, "value": value})
+	}
+	return out
+}
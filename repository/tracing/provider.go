@@ -0,0 +1,125 @@
+package tracing
+
+import (
+	"SB/service/repository/logging"
+	"context"
+	"encoding/binary"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// spans ended while the queue is full are dropped
+	queueSize      = 2048
+	batchSize      = 512
+	exportInterval = 5 * time.Second
+	exportTimeout  = 10 * time.Second
+)
+
+// Provider exports ended spans in batches in the background
+type Provider struct {
+	exporter Exporter
+	// threshold is compared with the lower 63 bits of trace ids started
+	// here, traces below it are sampled
+	threshold uint64
+	queue     chan SpanData
+	stop      chan struct{}
+	done      chan struct{}
+	once      sync.Once
+	dropped   int64
+	logger    *logging.Logger
+}
+
+// NewProvider samples the share sampleRatio, from 0 to 1, of the traces
+// started by the service, failed exports are logged with logger
+func NewProvider(exporter Exporter, sampleRatio float64, logger *logging.Logger) *Provider {
+	p := &Provider{
+		exporter:  exporter,
+		threshold: uint64(math.Max(0, math.Min(1, sampleRatio)) * (1 << 63)),
+		queue:     make(chan SpanData, queueSize),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		logger:    logger,
+	}
+	go p.run()
+	return p
+}
+
+// Shutdown exports the queued spans and stops, spans ended later are dropped
+func (p *Provider) Shutdown(ctx context.Context) error {
+	p.once.Do(func() {
+		close(p.stop)
+	})
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sample decides whether a trace started here is recorded. Like the trace
+// id ratio sampler of OpenTelemetry it looks at the random lower bits of the
+// id, so every service with the same ratio decides the same.
+func (p *Provider) sample(id TraceID) bool {
+	return binary.BigEndian.Uint64(id[8:])>>1 < p.threshold
+}
+
+func (p *Provider) enqueue(data SpanData) {
+	select {
+	case <-p.stop:
+		return
+	default:
+	}
+	select {
+	case p.queue <- data:
+	default:
+		if atomic.AddInt64(&p.dropped, 1)%queueSize == 1 {
+			p.logger.Warn("span queue is full, spans are dropped")
+		}
+	}
+}
+
+func (p *Provider) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	var batch []SpanData
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+		defer cancel()
+		if err := p.exporter.Export(ctx, batch); err != nil {
+			p.logger.Error("failed to export spans", logging.Int("spans", int64(len(batch))), logging.Err(err))
+		}
+		batch = nil
+	}
+	add := func(data SpanData) {
+		if batch = append(batch, data); len(batch) >= batchSize {
+			export()
+		}
+	}
+	for {
+		select {
+		case data := <-p.queue:
+			add(data)
+		case <-ticker.C:
+			export()
+		case <-p.stop:
+			for {
+				select {
+				case data := <-p.queue:
+					add(data)
+				default:
+					export()
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,297 @@
+// Package tracing records spans of requests, database statements and
+// messenger messages and exports them to an OpenTelemetry collector or
+// stdout. Trace contexts are propagated in the W3C traceparent and
+// tracestate headers.
+//
+// Spans are only recorded while a Provider is set, otherwise Start returns
+// a nil *Span whose methods do nothing, so code is traced unconditionally.
+// Sampling is parent based: traces continued from a caller follow its
+// decision, traces started here are recorded at the ratio of the Provider.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Kinds of spans
+const (
+	KindInternal = "internal"
+	KindServer   = "server"
+	KindClient   = "client"
+)
+
+const (
+	traceparentHeader = "traceparent"
+	tracestateHeader  = "tracestate"
+	// maxTracestate is the length of the tracestate header a vendor must
+	// propagate, longer headers are dropped
+	maxTracestate = 512
+	// maxTracestateMembers is the number of list members of a tracestate
+	maxTracestateMembers = 32
+)
+
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+
+	// SpanContext identifies a span across processes
+	SpanContext struct {
+		TraceID TraceID
+		SpanID  SpanID
+		Sampled bool
+		// TraceState is the tracestate header of the caller, it is passed on
+		// unchanged
+		TraceState string
+	}
+
+	// Attribute describes a span, values are strings, integers, floats or
+	// booleans
+	Attribute struct {
+		Key   string
+		Value interface{}
+	}
+
+	// SpanData is an ended span passed to exporters
+	SpanData struct {
+		Name       string
+		Kind       string
+		Context    SpanContext
+		Parent     SpanID
+		Start      time.Time
+		End        time.Time
+		Attributes []Attribute
+		// Error is the message of the error the operation failed with
+		Error string
+	}
+
+	// Span is an operation of a trace, it is exported when it ends
+	Span struct {
+		mu       sync.Mutex
+		data     SpanData
+		provider *Provider
+		ended    bool
+	}
+
+	spanKey   struct{}
+	remoteKey struct{}
+)
+
+var current atomic.Value
+
+// SetProvider records spans with p, nil stops recording
+func SetProvider(p *Provider) {
+	current.Store(&p)
+}
+
+func provider() *Provider {
+	if p, ok := current.Load().(**Provider); ok {
+		return *p
+	}
+	return nil
+}
+
+// String returns an attribute
+func String(key, value string) Attribute {
+	return Attribute{key, value}
+}
+
+// Int returns an attribute
+func Int(key string, value int64) Attribute {
+	return Attribute{key, value}
+}
+
+// Start starts a span, a child of the span of ctx or of the remote span
+// extracted into ctx. It returns a nil span if spans are not recorded or the
+// trace is not sampled, by the caller or by the ratio of a trace started
+// here.
+func Start(ctx context.Context, name, kind string, attributes ...Attribute) (context.Context, *Span) {
+	p := provider()
+	if p == nil {
+		return ctx, nil
+	}
+	parent := SpanContextFromContext(ctx)
+	if parent.Valid() && !parent.Sampled {
+		return ctx, nil
+	}
+	if !parent.Valid() {
+		parent.TraceID = newTraceID()
+		if !p.sample(parent.TraceID) {
+			// the children and the callees of the span skip the trace too
+			return context.WithValue(ctx, remoteKey{}, SpanContext{TraceID: parent.TraceID, SpanID: newSpanID()}), nil
+		}
+	}
+	span := &Span{
+		provider: p,
+		data: SpanData{
+			Name:       name,
+			Kind:       kind,
+			Context:    SpanContext{TraceID: parent.TraceID, SpanID: newSpanID(), Sampled: true, TraceState: parent.TraceState},
+			Parent:     parent.SpanID,
+			Start:      time.Now(),
+			Attributes: attributes,
+		},
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SpanContextFromContext returns the context of the span of ctx or of the
+// remote parent extracted into ctx, it is invalid if there is none
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if span, ok := ctx.Value(spanKey{}).(*Span); ok && span != nil {
+		return span.data.Context
+	}
+	if sc, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		return sc
+	}
+	return SpanContext{}
+}
+
+// SetAttributes adds attributes to the span
+func (s *Span) SetAttributes(attributes ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Attributes = append(s.data.Attributes, attributes...)
+}
+
+// SetError marks the span failed with err, a nil err is ignored
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Error = err.Error()
+}
+
+// End ends the span and queues it for export, later calls do nothing
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+	s.provider.enqueue(data)
+}
+
+// Valid reports whether sc identifies a span
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Extract returns ctx with the remote parent span of the traceparent and
+// tracestate headers, a missing or malformed traceparent starts a new trace
+func Extract(ctx context.Context, header http.Header) context.Context {
+	sc, ok := parseTraceparent(header.Get(traceparentHeader))
+	if !ok {
+		return ctx
+	}
+	sc.TraceState = parseTracestate(header.Values(tracestateHeader))
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Inject sets the traceparent and tracestate headers to the span of ctx
+func Inject(ctx context.Context, header http.Header) {
+	sc := SpanContextFromContext(ctx)
+	if !sc.Valid() {
+		return
+	}
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	header.Set(traceparentHeader, fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags))
+	if sc.TraceState != "" {
+		header.Set(tracestateHeader, sc.TraceState)
+	}
+}
+
+// parseTraceparent parses version 00 of the header, later versions may
+// only append fields
+func parseTraceparent(h string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	if !decodeHex(sc.TraceID[:], parts[1]) || !decodeHex(sc.SpanID[:], parts[2]) || len(parts[3]) != 2 {
+		return sc, false
+	}
+	var flags [1]byte
+	if !decodeHex(flags[:], parts[3]) {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.Valid()
+}
+
+// parseTracestate joins the tracestate headers, a header that is too long
+// or has malformed list members is dropped
+func parseTracestate(headers []string) string {
+	var members []string
+	for _, h := range headers {
+		for _, member := range strings.Split(h, ",") {
+			if member = strings.TrimSpace(member); member == "" {
+				continue
+			}
+			if i := strings.IndexByte(member, '='); i <= 0 || i == len(member)-1 {
+				return ""
+			}
+			members = append(members, member)
+		}
+	}
+	state := strings.Join(members, ",")
+	if len(members) > maxTracestateMembers || len(state) > maxTracestate {
+		return ""
+	}
+	return state
+}
+
+func decodeHex(dst []byte, s string) bool {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for id == (TraceID{}) {
+		_, _ = rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for id == (SpanID{}) {
+		_, _ = rand.Read(id[:])
+	}
+	return id
+}
@@ -0,0 +1,224 @@
+package tracing
+
+import (
+	"SB/service/repository/logging"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+type recorder struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func (r *recorder) Export(ctx context.Context, spans []SpanData) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+// record sets a provider exporting to a recorder and sampling every trace,
+// the spans are complete after the returned function is called
+func record(t *testing.T) (*recorder, func()) {
+	return recordRatio(t, 1)
+}
+
+func recordRatio(t *testing.T, sampleRatio float64) (*recorder, func()) {
+	r := &recorder{}
+	p := NewProvider(r, sampleRatio, logging.Discard())
+	SetProvider(p)
+	t.Cleanup(func() {
+		SetProvider(nil)
+	})
+	return r, func() {
+		require.NoError(t, p.Shutdown(context.Background()))
+	}
+}
+
+func TestStart(t *testing.T) {
+	ctx, span := Start(context.Background(), "unrecorded", KindInternal)
+	require.Nil(t, span, "spans are not recorded without a provider")
+	span.SetAttributes(String("key", "value"))
+	span.SetError(errors.New("failed"))
+	span.End()
+	require.False(t, SpanContextFromContext(ctx).Valid())
+
+	r, flush := record(t)
+	ctx, parent := Start(context.Background(), "GET /training", KindServer, String("http.method", "GET"))
+	_, child := Start(ctx, "db.query", KindClient)
+	child.SetError(errors.New("timeout"))
+	child.End()
+	parent.End()
+	parent.End()
+	flush()
+
+	require.Len(t, r.spans, 2)
+	db, server := r.spans[0], r.spans[1]
+	require.Equal(t, "GET /training", server.Name)
+	require.Equal(t, []Attribute{{"http.method", "GET"}}, server.Attributes)
+	require.Equal(t, SpanID{}, server.Parent)
+	require.Equal(t, server.Context.TraceID, db.Context.TraceID)
+	require.Equal(t, server.Context.SpanID, db.Parent)
+	require.Equal(t, "timeout", db.Error)
+	require.False(t, server.End.Before(server.Start))
+}
+
+func TestPropagation(t *testing.T) {
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := Extract(context.Background(), header)
+	sc := SpanContextFromContext(ctx)
+	require.True(t, sc.Valid())
+	require.True(t, sc.Sampled)
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+
+	r, flush := record(t)
+	ctx, span := Start(ctx, "GET /training", KindServer)
+	out := http.Header{}
+	Inject(ctx, out)
+	span.End()
+	flush()
+	require.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+r.spans[0].Context.SpanID.String()+"-01", out.Get("traceparent"))
+	require.Equal(t, "00f067aa0ba902b7", r.spans[0].Parent.String())
+
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	_, span = Start(Extract(context.Background(), header), "GET /training", KindServer)
+	require.Nil(t, span, "traces the caller did not sample are not recorded")
+
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	header.Set("tracestate", "congo=t61rcWkgMzE")
+	header.Add("tracestate", "rojo=00f067aa0ba902b7")
+	ctx, span = Start(Extract(context.Background(), header), "GET /training", KindServer)
+	out = http.Header{}
+	Inject(ctx, out)
+	require.Equal(t, "congo=t61rcWkgMzE,rojo=00f067aa0ba902b7", out.Get("tracestate"), "tracestate is passed on")
+	span.End()
+
+	header.Set("tracestate", "congo")
+	require.Empty(t, SpanContextFromContext(Extract(context.Background(), header)).TraceState, "malformed tracestate is dropped")
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		header.Set("traceparent", invalid)
+		require.False(t, SpanContextFromContext(Extract(context.Background(), header)).Valid(), invalid)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	r, flush := recordRatio(t, 0)
+	ctx, span := Start(context.Background(), "GET /training", KindServer)
+	require.Nil(t, span, "traces started here are sampled at the ratio")
+	_, child := Start(ctx, "db.query", KindClient)
+	require.Nil(t, child, "children follow the decision of their root")
+	out := http.Header{}
+	Inject(ctx, out)
+	require.True(t, strings.HasSuffix(out.Get("traceparent"), "-00"), "callees are told the trace is not sampled")
+
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	_, span = Start(Extract(context.Background(), header), "GET /training", KindServer)
+	require.NotNil(t, span, "traces the caller sampled are recorded whatever the ratio")
+	span.End()
+	flush()
+	require.Len(t, r.spans, 1)
+
+	p := NewProvider(&recorder{}, 0.5, logging.Discard())
+	defer p.Shutdown(context.Background())
+	require.True(t, p.sample(TraceID{8: 0x7f, 9: 0xff}))
+	require.False(t, p.sample(TraceID{8: 0x80}))
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body map[string]interface{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		data, _ := ioutil.ReadAll(r.Body)
+		require.NoError(t, json.Unmarshal(data, &body))
+	}))
+	defer collector.Close()
+
+	r, flush := record(t)
+	_, span := Start(context.Background(), "messenger.message", KindServer, Int("message.length", 5))
+	span.SetError(errors.New("invalid message"))
+	span.End()
+	flush()
+	require.NoError(t, NewOTLPExporter(collector.URL, "sport-buddy").Export(context.Background(), r.spans))
+
+	resource := body["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	require.Equal(t, []interface{}{map[string]interface{}{"key": "service.name", "value": map[string]interface{}{"stringValue": "sport-buddy"}}},
+		resource["resource"].(map[string]interface{})["attributes"])
+	spans := resource["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	exported := spans[0].(map[string]interface{})
+	require.Equal(t, r.spans[0].Context.TraceID.String(), exported["traceId"])
+	require.Equal(t, float64(2), exported["kind"])
+	require.Equal(t, map[string]interface{}{"code": float64(2), "message": "invalid message"}, exported["status"])
+	require.Equal(t, []interface{}{map[string]interface{}{"key": "message.length", "value": map[string]interface{}{"intValue": "5"}}}, exported["attributes"])
+	require.NotContains(t, exported, "parentSpanId")
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	require.Error(t, NewOTLPExporter(failing.URL, "sport-buddy").Export(context.Background(), r.spans))
+}
+
+func TestStdoutExporter(t *testing.T) {
+	r, flush := record(t)
+	_, span := Start(context.Background(), "GET /training", KindServer, String("http.route", "/training"))
+	span.End()
+	flush()
+
+	var buf bytes.Buffer
+	require.NoError(t, NewStdoutExporter(&buf, "sport-buddy").Export(context.Background(), r.spans))
+	var line map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	require.Equal(t, "sport-buddy", line["service"])
+	require.Equal(t, "GET /training", line["name"])
+	require.Equal(t, map[string]interface{}{"http.route": "/training"}, line["attributes"])
+	require.NotContains(t, line, "parent_id")
+}
+
+func TestDatabasePlugin(t *testing.T) {
+	sqlDB, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.Use(DatabasePlugin()))
+
+	r, flush := record(t)
+	ctx, request := Start(context.Background(), "GET /training", KindServer)
+	mock.ExpectQuery(`SELECT "id_user" FROM "users" WHERE id_user = \$1`).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id_user"}).AddRow(1))
+	var ids []int64
+	require.NoError(t, db.WithContext(ctx).Table("users").Where("id_user = ?", 1).Pluck("id_user", &ids).Error)
+	request.End()
+	flush()
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	require.Len(t, r.spans, 2)
+	query := r.spans[0]
+	require.Equal(t, "db.query", query.Name)
+	require.Equal(t, request.data.Context.SpanID, query.Parent)
+	require.Contains(t, query.Attributes, String("db.sql.table", "users"))
+	require.Contains(t, query.Attributes, String("db.statement", `SELECT "id_user" FROM "users" WHERE id_user = $1`))
+}
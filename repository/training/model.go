@@ -8,18 +8,22 @@ import (
 
 type (
 	GroupTraining struct {
-		IdTraining       int64         `json:"id_training,omitempty"`
-		Owner            int64         `json:"owner"`
-		MeetDate         time.Time     `json:"meet_date"`
-		TrainingDuration string        `json:"training_duration"`
+		IdTraining int64 `json:"id_training,omitempty"`
+		Owner      int64 `json:"owner"`
+		// Time of the meeting, must be in the future when the training is
+		// added
+		MeetDate time.Time `json:"meet_date" validate:"required,future"`
+		// Duration like 1h30m
+		TrainingDuration string        `json:"training_duration" validate:"required,duration" example:"1h30m"`
 		Duration         time.Duration `json:"-"`
-		Location         string        `json:"location"`
-		Sport            string        `json:"sport"`
-		IdLevel          int64         `json:"id_level,omitempty"`
-		Comment          string        `json:"comment,omitempty"`
-		Fee              int64         `json:"fee,omitempty"`
+		Location         string        `json:"location" validate:"required" maxLength:"100"`
+		Sport            string        `json:"sport" validate:"required" maxLength:"100"`
+		IdLevel          int64         `json:"id_level,omitempty" minimum:"1"`
+		Comment          string        `json:"comment,omitempty" maxLength:"1000"`
+		Fee              int64         `json:"fee,omitempty" minimum:"0"`
 		ParticipantsIds  []int64       `json:"participants_ids"`
-		Kind             string        `json:"kind"`
+		// Kind of the training, group if not set
+		Kind string `json:"kind" enums:"group,personal"`
 	}
 
 	GroupTrainingFilter struct {
@@ -29,6 +33,13 @@ type (
 	}
 )
 
+// setDefaults fills the optional fields which are not set
+func (gt *GroupTraining) setDefaults() {
+	if gt.Kind == "" {
+		gt.Kind = "group"
+	}
+}
+
 func (gt *GroupTraining) Serialize() []byte {
 	res, _ := json.Marshal(gt)
 	return res
@@ -1,59 +1,78 @@
 package training
 
 import (
+	"SB/service/repository/audit"
+	"SB/service/repository/metrics"
 	"SB/service/repository/persistence"
+	"context"
 	"fmt"
 )
 
+var trainingsCreated = metrics.NewCounter("sb_trainings_created_total", "Group trainings created")
+
 type (
 	trainingManager struct {
 		persistent persistence.Persistent
+		audit      audit.Log
 	}
 
 	TrainingManager interface {
-		GetTrainings(filter GroupTrainingFilter) []persistence.PersistentObject
-		AddTraining(training GroupTraining) (persistence.PersistentObject, error)
-		UpdateTraining(training GroupTraining) (persistence.PersistentObject, error)
-		GetTraining(id int64) persistence.PersistentObject
-		DeleteTraining(id int64) error
+		GetTrainings(ctx context.Context, filter GroupTrainingFilter) []persistence.PersistentObject
+		AddTraining(ctx context.Context, training GroupTraining) (persistence.PersistentObject, error)
+		UpdateTraining(ctx context.Context, actor audit.Actor, training GroupTraining) (persistence.PersistentObject, error)
+		// GetTraining returns persistence.ErrNotFound for unknown trainings
+		GetTraining(ctx context.Context, id int64) (persistence.PersistentObject, error)
+		DeleteTraining(ctx context.Context, actor audit.Actor, id int64) error
 	}
 )
 
-func NewTrainingManager(persistent persistence.Persistent) TrainingManager {
+func NewTrainingManager(persistent persistence.Persistent, auditLog audit.Log) TrainingManager {
 	return &trainingManager{
 		persistent: persistent,
+		audit:      auditLog,
 	}
 }
 
-func (tm *trainingManager) GetTrainings(filter GroupTrainingFilter) []persistence.PersistentObject {
-	gt := tm.persistent.GetGroupTrainings(&filter)
+func (tm *trainingManager) GetTrainings(ctx context.Context, filter GroupTrainingFilter) []persistence.PersistentObject {
+	gt := tm.persistent.GetGroupTrainings(ctx, &filter)
 	return gt
 }
 
-func (tm *trainingManager) GetTraining(id int64) persistence.PersistentObject {
-	gt := tm.persistent.GetGroupTraining(id)
-	return gt
+func (tm *trainingManager) GetTraining(ctx context.Context, id int64) (persistence.PersistentObject, error) {
+	return tm.persistent.GetGroupTraining(ctx, id)
 }
 
-func (tm *trainingManager) AddTraining(training GroupTraining) (persistence.PersistentObject, error) {
-	t, err := tm.persistent.AddGroupTraining(&training)
+func (tm *trainingManager) AddTraining(ctx context.Context, training GroupTraining) (persistence.PersistentObject, error) {
+	training.setDefaults()
+	t, err := tm.persistent.AddGroupTraining(ctx, &training)
 	if err != nil {
-		return nil, fmt.Errorf("failed to add training: %s", err)
+		return nil, fmt.Errorf("failed to add training: %w", err)
 	}
+	trainingsCreated.Inc()
 	return t, err
 }
 
-func (tm *trainingManager) UpdateTraining(training GroupTraining) (persistence.PersistentObject, error) {
-	t, err := tm.persistent.UpdateGroupTraining(&training)
+func (tm *trainingManager) UpdateTraining(ctx context.Context, actor audit.Actor, training GroupTraining) (persistence.PersistentObject, error) {
+	before, err := tm.persistent.GetGroupTraining(ctx, training.IdTraining)
+	if err != nil {
+		return nil, err
+	}
+	training.setDefaults()
+	t, err := tm.persistent.UpdateGroupTraining(ctx, &training)
 	if err != nil {
 		return nil, err
 	}
+	tm.audit.Record(ctx, actor, audit.ActionTrainingUpdated, audit.TargetTraining, training.IdTraining, before, t)
 	return t, err
 }
-func (tm *trainingManager) DeleteTraining(id int64) error {
-	err := tm.persistent.DeleteGroupTraining(id)
+func (tm *trainingManager) DeleteTraining(ctx context.Context, actor audit.Actor, id int64) error {
+	before, err := tm.persistent.GetGroupTraining(ctx, id)
 	if err != nil {
-		return fmt.Errorf("failed to delete training: %s", err)
+		return err
+	}
+	if err := tm.persistent.DeleteGroupTraining(ctx, id); err != nil {
+		return fmt.Errorf("failed to delete training: %w", err)
 	}
+	tm.audit.Record(ctx, actor, audit.ActionTrainingDeleted, audit.TargetTraining, id, before, nil)
 	return nil
 }
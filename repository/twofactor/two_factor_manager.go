@@ -0,0 +1,340 @@
+package twofactor
+
+import (
+	"SB/service/config"
+	"SB/service/repository/logging"
+	"SB/service/repository/persistence"
+	"SB/service/repository/token"
+	"SB/service/repository/totp"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const EventRecoveryCodeUsed = "two_factor_recovery_code_used"
+
+var (
+	// ErrInvalidCode is returned for wrong, reused or expired codes
+	ErrInvalidCode = errors.New("invalid two-factor code")
+	// ErrNotSetUp is returned when a code is checked for a user without a
+	// TOTP secret
+	ErrNotSetUp = errors.New("two-factor authentication is not set up")
+	// ErrRequired is returned when a user tries to disable two-factor
+	// authentication required for the role
+	ErrRequired = errors.New("two-factor authentication is required for the role")
+	// ErrInvalidChallenge is returned for forged, expired or used challenges
+	// and after too many wrong codes
+	ErrInvalidChallenge = errors.New("invalid or expired two-factor challenge")
+)
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type (
+	// TwoFactorManager enrolls users in TOTP two-factor authentication and
+	// checks their codes. A code is either a TOTP code or a recovery code,
+	// both can be used only once.
+	TwoFactorManager interface {
+		// Setup creates a new secret, it is not used until Confirm
+		Setup(ctx context.Context, idUser int64) (Enrollment, error)
+		// Confirm enables two-factor authentication if the code matches the
+		// secret from Setup and returns new recovery codes
+		Confirm(ctx context.Context, idUser int64, code string) ([]string, error)
+		Disable(ctx context.Context, idUser int64, role string, code string) error
+		Enabled(ctx context.Context, idUser int64) (bool, error)
+		// Required tells whether the role must use two-factor authentication
+		Required(role string) bool
+		// Challenge is issued after the password check to users with
+		// two-factor authentication enabled, it is stored until it is
+		// exchanged or expires
+		Challenge(ctx context.Context, user persistence.User) (string, error)
+		// ChallengeUser returns the user of a valid challenge or
+		// ErrInvalidChallenge
+		ChallengeUser(ctx context.Context, challenge string) (persistence.User, error)
+		// Exchange checks the code for the user of the challenge. A challenge
+		// is used up by the right code or by too many wrong ones.
+		Exchange(ctx context.Context, challenge, code string) (persistence.User, error)
+		// Sweep deletes expired challenges
+		Sweep(ctx context.Context) (int64, error)
+	}
+
+	Enrollment struct {
+		Secret string
+		URI    string
+	}
+
+	twoFactorManager struct {
+		persistent persistence.Persistent
+		tokens     token.TokenManager
+		config     config.TwoFactor
+		required   map[string]bool
+		now        func() time.Time
+		logger     *logging.Logger
+	}
+
+	challengeUser struct {
+		// challenge is the id of the stored challenge
+		challenge string
+		id        int64
+		username  string
+		role      string
+	}
+)
+
+// NewTwoFactorManager fails if the configuration requires two-factor
+// authentication for an unknown role
+func NewTwoFactorManager(persistent persistence.Persistent, tokens token.TokenManager, cfg config.TwoFactor, logger *logging.Logger) (TwoFactorManager, error) {
+	required := make(map[string]bool)
+	for _, role := range cfg.RequiredRoles {
+		if !knownRole(role) {
+			return nil, fmt.Errorf("two-factor authentication is required for unknown role %q", role)
+		}
+		required[role] = true
+	}
+	return &twoFactorManager{
+		persistent: persistent,
+		tokens:     tokens,
+		config:     cfg,
+		required:   required,
+		now:        time.Now,
+		logger:     logger,
+	}, nil
+}
+
+func (mgr *twoFactorManager) Setup(ctx context.Context, idUser int64) (Enrollment, error) {
+	username, err := mgr.persistent.GetUsername(ctx, idUser)
+	if err != nil {
+		return Enrollment{}, err
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return Enrollment{}, err
+	}
+	if err := mgr.persistent.SetTOTPSecret(ctx, idUser, secret); err != nil {
+		return Enrollment{}, err
+	}
+	return Enrollment{
+		Secret: secret,
+		URI:    totp.URI(mgr.config.Issuer, username, secret),
+	}, nil
+}
+
+func (mgr *twoFactorManager) Confirm(ctx context.Context, idUser int64, code string) ([]string, error) {
+	secret, err := mgr.persistent.GetTOTP(ctx, idUser)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, ErrNotSetUp
+	}
+	if secret.IsEnabled() {
+		return nil, persistence.ErrTwoFactorEnabled
+	}
+	step, ok, err := totp.Validate(secret.Secret, normalize(code), mgr.now())
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	codes := make([]string, mgr.config.RecoveryCodes)
+	hashes := make([]string, len(codes))
+	for i := range codes {
+		codes[i], err = newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		hashes[i] = hashCode(codes[i])
+	}
+	if err := mgr.persistent.EnableTOTP(ctx, idUser, step, hashes); err != nil {
+		return nil, err
+	}
+	mgr.logger.For(ctx).Info("two-factor authentication enabled", logging.Int("id_user", idUser))
+	return codes, nil
+}
+
+// Disable requires a valid code, so a stolen access token is not enough to
+// turn two-factor authentication off
+func (mgr *twoFactorManager) Disable(ctx context.Context, idUser int64, role string, code string) error {
+	if mgr.Required(role) {
+		return ErrRequired
+	}
+	if err := mgr.verify(ctx, idUser, code); err != nil {
+		return err
+	}
+	if err := mgr.persistent.DisableTOTP(ctx, idUser); err != nil {
+		return err
+	}
+	mgr.logger.For(ctx).Info("two-factor authentication disabled", logging.Int("id_user", idUser))
+	return nil
+}
+
+func (mgr *twoFactorManager) Enabled(ctx context.Context, idUser int64) (bool, error) {
+	secret, err := mgr.persistent.GetTOTP(ctx, idUser)
+	if err != nil {
+		return false, err
+	}
+	return secret != nil && secret.IsEnabled(), nil
+}
+
+func (mgr *twoFactorManager) Required(role string) bool {
+	return mgr.required[role]
+}
+
+func (mgr *twoFactorManager) Challenge(ctx context.Context, user persistence.User) (string, error) {
+	id, err := token.GenerateTokenID()
+	if err != nil {
+		return "", err
+	}
+	expires := mgr.now().Add(mgr.config.ChallengeExpiration)
+	if err := mgr.persistent.AddTwoFactorChallenge(ctx, id, user.GetId(), expires); err != nil {
+		return "", err
+	}
+	return mgr.tokens.NewChallenge(user, id, mgr.config.ChallengeExpiration)
+}
+
+func (mgr *twoFactorManager) ChallengeUser(ctx context.Context, challenge string) (persistence.User, error) {
+	user, err := mgr.parseChallenge(ctx, challenge)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (mgr *twoFactorManager) parseChallenge(ctx context.Context, challenge string) (*challengeUser, error) {
+	claims, err := mgr.tokens.ParseChallenge(ctx, challenge)
+	if err != nil {
+		mgr.logger.For(ctx).Warn("invalid two-factor challenge", logging.Err(err))
+		return nil, ErrInvalidChallenge
+	}
+	idUser, err := strconv.ParseInt(claims.Id, 10, 64)
+	if err != nil || claims.SessionId == "" {
+		return nil, ErrInvalidChallenge
+	}
+	return &challengeUser{challenge: claims.SessionId, id: idUser, username: claims.Subject, role: claims.Role}, nil
+}
+
+func (mgr *twoFactorManager) Exchange(ctx context.Context, challenge, code string) (persistence.User, error) {
+	user, err := mgr.parseChallenge(ctx, challenge)
+	if err != nil {
+		return nil, err
+	}
+	// the attempt is counted before the code is checked so that parallel
+	// requests cannot exceed the limit
+	ok, err := mgr.persistent.AttemptTwoFactorChallenge(ctx, user.challenge, mgr.config.ChallengeAttempts)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		mgr.logger.For(ctx).Warn("used up two-factor challenge", logging.Int("id_user", user.id))
+		return nil, ErrInvalidChallenge
+	}
+	if err := mgr.verify(ctx, user.id, code); err != nil {
+		return nil, err
+	}
+	used, err := mgr.persistent.UseTwoFactorChallenge(ctx, user.challenge)
+	if err != nil {
+		return nil, err
+	}
+	if !used {
+		return nil, ErrInvalidChallenge
+	}
+	return user, nil
+}
+
+func (mgr *twoFactorManager) Sweep(ctx context.Context) (int64, error) {
+	return mgr.persistent.DeleteExpiredTwoFactorChallenges(ctx)
+}
+
+// verify accepts a TOTP code newer than the last one used or an unused
+// recovery code
+func (mgr *twoFactorManager) verify(ctx context.Context, idUser int64, code string) error {
+	secret, err := mgr.persistent.GetTOTP(ctx, idUser)
+	if err != nil {
+		return err
+	}
+	if secret == nil || !secret.IsEnabled() {
+		return ErrNotSetUp
+	}
+
+	code = normalize(code)
+	if len(code) == totp.Digits {
+		step, ok, err := totp.Validate(secret.Secret, code, mgr.now())
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrInvalidCode
+		}
+		fresh, err := mgr.persistent.UseTOTPStep(ctx, idUser, step)
+		if err != nil {
+			return err
+		}
+		if !fresh {
+			mgr.logger.For(ctx).Warn("reused two-factor code", logging.Int("id_user", idUser))
+			return ErrInvalidCode
+		}
+		return nil
+	}
+
+	used, err := mgr.persistent.UseRecoveryCode(ctx, idUser, hashCode(code))
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidCode
+	}
+	err = mgr.persistent.AddSecurityEvent(ctx, idUser, EventRecoveryCodeUsed, map[string]interface{}{})
+	if err != nil {
+		mgr.logger.For(ctx).Error("failed to record security event", logging.Int("id_user", idUser), logging.Err(err))
+	}
+	return nil
+}
+
+// newRecoveryCode returns 40 random bits formatted as xxxx-xxxx
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(recoveryEncoding.EncodeToString(b))
+	return code[:4] + "-" + code[4:], nil
+}
+
+// normalize lets users type codes with spaces, dashes and in any case
+func normalize(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+func hashCode(code string) string {
+	sum := sha256.Sum256([]byte(normalize(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+func knownRole(role string) bool {
+	for _, r := range token.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (user *challengeUser) GetId() int64 {
+	return user.id
+}
+
+func (user *challengeUser) GetRole() string {
+	return user.role
+}
+
+func (user *challengeUser) GetUsername() string {
+	return user.username
+}
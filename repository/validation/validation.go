@@ -0,0 +1,244 @@
+// Package validation checks request bodies against the constraints declared
+// in struct tags. It reads the tags swag puts into the API docs, so the docs
+// cannot drift from the checks:
+//
+//	validate:"required,future"  rules, required fields must not be empty
+//	enums:"group,personal"      allowed values
+//	minimum:"1" maximum:"300"   bounds of numbers
+//	minLength:"1" maxLength:"5" bounds of string lengths in characters
+//
+// Besides required the validate tag takes future for times, duration for
+// strings like 1h30m and email. Constraints of a slice apply to its items.
+// Empty optional fields are not checked. Future applies to new resources
+// only, Update skips it so stored resources stay editable once they are past.
+//
+// An unknown rule or a malformed bound is a mistake in the declaration, it
+// is returned as a plain error and answered as an internal error.
+package validation
+
+import (
+	"SB/service/repository/errs"
+	"fmt"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Validator is the echo.Validator of the API
+type Validator struct{}
+
+// New returns a Validator for echo.Echo
+func New() *Validator {
+	return &Validator{}
+}
+
+// Validate checks a struct or a pointer to one with Struct
+func (v *Validator) Validate(i interface{}) error {
+	return Struct(i)
+}
+
+// Struct checks all fields of a new struct or a pointer to one and returns
+// every invalid field in one *errs.ValidationError keyed by the JSON name
+func Struct(s interface{}) error {
+	return validate(s, false)
+}
+
+// Update checks the fields of a struct changing a stored resource like
+// Struct, rules of new resources only are skipped
+func Update(s interface{}) error {
+	return validate(s, true)
+}
+
+func validate(s interface{}, update bool) error {
+	value := reflect.Indirect(reflect.ValueOf(s))
+	if value.Kind() != reflect.Struct {
+		return fmt.Errorf("validation: cannot validate %T", s)
+	}
+	fields := map[string]string{}
+	if err := checkStruct(value, update, fields); err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return &errs.ValidationError{Fields: fields}
+}
+
+func checkStruct(value reflect.Value, update bool, fields map[string]string) error {
+	t := value.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			if err := checkStruct(value.Field(i), update, fields); err != nil {
+				return err
+			}
+			continue
+		}
+		name := jsonName(field)
+		if field.PkgPath != "" || name == "-" {
+			continue
+		}
+		reason, err := checkField(field.Tag, value.Field(i), update)
+		if err != nil {
+			return fmt.Errorf("validation: field %s of %s: %s", field.Name, t, err)
+		}
+		if reason != "" {
+			fields[name] = reason
+		}
+	}
+	return nil
+}
+
+// jsonName returns the name of a field in JSON bodies
+func jsonName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// checkField returns the reason a field is invalid or "" if it is valid, an
+// error is returned for a malformed declaration
+func checkField(tag reflect.StructTag, value reflect.Value, update bool) (string, error) {
+	var rules []string
+	if validate := tag.Get("validate"); validate != "" {
+		rules = strings.Split(validate, ",")
+	}
+	if isEmpty(value) {
+		for _, rule := range rules {
+			if rule == "required" {
+				return "is required", nil
+			}
+		}
+		return "", nil
+	}
+	if value.Kind() == reflect.Slice {
+		for i := 0; i < value.Len(); i++ {
+			if reason, err := checkValue(tag, rules, value.Index(i), update); reason != "" || err != nil {
+				return reason, err
+			}
+		}
+		return "", nil
+	}
+	return checkValue(tag, rules, value, update)
+}
+
+func checkValue(tag reflect.StructTag, rules []string, value reflect.Value, update bool) (string, error) {
+	for _, rule := range rules {
+		if reason, err := checkRule(rule, value, update); reason != "" || err != nil {
+			return reason, err
+		}
+	}
+	if enums := tag.Get("enums"); enums != "" {
+		allowed := strings.Split(enums, ",")
+		actual := fmt.Sprint(value.Interface())
+		found := false
+		for _, a := range allowed {
+			found = found || a == actual
+		}
+		if !found {
+			return "must be one of " + strings.Join(allowed, ", "), nil
+		}
+	}
+	if number, ok := toFloat(value); ok {
+		min, ok, err := tagFloat(tag, "minimum")
+		if err != nil {
+			return "", err
+		}
+		if ok && number < min {
+			return "must be at least " + tag.Get("minimum"), nil
+		}
+		max, ok, err := tagFloat(tag, "maximum")
+		if err != nil {
+			return "", err
+		}
+		if ok && number > max {
+			return "must be at most " + tag.Get("maximum"), nil
+		}
+	}
+	if value.Kind() == reflect.String {
+		length := float64(utf8.RuneCountInString(value.String()))
+		min, ok, err := tagFloat(tag, "minLength")
+		if err != nil {
+			return "", err
+		}
+		if ok && length < min {
+			return "must be at least " + tag.Get("minLength") + " characters long", nil
+		}
+		max, ok, err := tagFloat(tag, "maxLength")
+		if err != nil {
+			return "", err
+		}
+		if ok && length > max {
+			return "must be at most " + tag.Get("maxLength") + " characters long", nil
+		}
+	}
+	return "", nil
+}
+
+// checkRule checks a rule of the validate tag, an unknown rule is a mistake
+// in the declaration and returned as an error
+func checkRule(rule string, value reflect.Value, update bool) (string, error) {
+	switch rule {
+	case "required":
+	case "future":
+		t, ok := value.Interface().(time.Time)
+		if !ok {
+			return "", fmt.Errorf("future applies to times, not %s", value.Type())
+		}
+		if !update && !t.After(time.Now()) {
+			return "must be in the future", nil
+		}
+	case "duration":
+		d, err := time.ParseDuration(value.String())
+		if value.Kind() != reflect.String || err != nil || d <= 0 {
+			return "must be a duration like 1h30m", nil
+		}
+	case "email":
+		if _, err := mail.ParseAddress(value.String()); value.Kind() != reflect.String || err != nil {
+			return "must be an e-mail address", nil
+		}
+	default:
+		return "", fmt.Errorf("unknown rule %q", rule)
+	}
+	return "", nil
+}
+
+func isEmpty(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Slice, reflect.Map:
+		return value.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return value.IsNil()
+	}
+	return value.IsZero()
+}
+
+func toFloat(value reflect.Value) (float64, bool) {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), true
+	}
+	return 0, false
+}
+
+// tagFloat returns the number of a bound tag and whether it is set
+func tagFloat(tag reflect.StructTag, key string) (float64, bool, error) {
+	v, ok := tag.Lookup(key)
+	if !ok {
+		return 0, false, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid %s %q", key, v)
+	}
+	return f, true, nil
+}
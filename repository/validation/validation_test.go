@@ -0,0 +1,98 @@
+package validation
+
+import (
+	"SB/service/repository/errs"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type (
+	base struct {
+		Id int64 `json:"id" validate:"required"`
+	}
+
+	event struct {
+		base
+		Name     string    `json:"name,omitempty" validate:"required" minLength:"2" maxLength:"5"`
+		Date     time.Time `json:"date" validate:"required,future"`
+		Duration string    `json:"duration" validate:"duration"`
+		Email    string    `json:"email" validate:"email"`
+		Kind     string    `json:"kind" enums:"group,personal"`
+		Fee      int64     `json:"fee" minimum:"0" maximum:"1000"`
+		Tags     []string  `json:"tags" maxLength:"3"`
+		Ignored  string    `json:"-" validate:"required"`
+		internal string
+	}
+)
+
+func TestStruct(t *testing.T) {
+	valid := event{
+		base:     base{Id: 1},
+		Name:     "Run",
+		Date:     time.Now().Add(time.Hour),
+		Duration: "1h30m",
+		Email:    "andrey@gmail.com",
+		Kind:     "group",
+		Tags:     []string{"fun"},
+	}
+	require.NoError(t, Struct(valid))
+	require.NoError(t, New().Validate(&valid))
+
+	invalid := event{
+		Name:     "Marathon",
+		Date:     time.Now().Add(-time.Hour),
+		Duration: "-1h",
+		Email:    "andrey",
+		Kind:     "solo",
+		Fee:      -1,
+		Tags:     []string{"fun", "long"},
+	}
+	err := Struct(&invalid)
+	require.True(t, errors.Is(err, errs.ErrValidation))
+	require.Equal(t, map[string]string{
+		"id":       "is required",
+		"name":     "must be at most 5 characters long",
+		"date":     "must be in the future",
+		"duration": "must be a duration like 1h30m",
+		"email":    "must be an e-mail address",
+		"kind":     "must be one of group, personal",
+		"fee":      "must be at least 0",
+		"tags":     "must be at most 3 characters long",
+	}, errs.Fields(err))
+
+	require.Equal(t, map[string]string{"id": "is required", "name": "is required", "date": "is required"}, errs.Fields(Struct(event{})))
+	require.Equal(t, "must be at most 1000", errs.Fields(Struct(event{Fee: 1001}))["fee"])
+	require.Equal(t, "must be at least 2 characters long", errs.Fields(Struct(event{Name: "Ю"}))["name"])
+	require.Error(t, Struct("event"))
+}
+
+func TestUpdate(t *testing.T) {
+	past := event{base: base{Id: 1}, Name: "Run", Date: time.Now().Add(-time.Hour)}
+	require.Equal(t, map[string]string{"date": "must be in the future"}, errs.Fields(Struct(past)))
+	require.NoError(t, Update(past), "past events stay editable")
+	require.Equal(t, map[string]string{"date": "is required"}, errs.Fields(Update(event{base: base{Id: 1}, Name: "Run"})))
+}
+
+func TestMalformedDeclaration(t *testing.T) {
+	for _, s := range []interface{}{
+		struct {
+			Name string `validate:"uppercase"`
+		}{Name: "name"},
+		struct {
+			Fee int64 `maximum:"a lot"`
+		}{Fee: 1},
+		struct {
+			Name string `maxLength:"5.5.5"`
+		}{Name: "name"},
+		struct {
+			Date string `validate:"future"`
+		}{Date: "tomorrow"},
+	} {
+		err := Struct(s)
+		require.Error(t, err, "%T", s)
+		require.False(t, errors.Is(err, errs.ErrValidation), "a malformed declaration is not the fault of the client: %s", err)
+	}
+}
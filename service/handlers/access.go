@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// RequireRole allows a request only if the authenticated user has one of
+// the roles and has entered a second factor if the role requires it.
+// It must run after AccessMiddleware.
+func (handler *handler) RequireRole(roles ...string) echo.MiddlewareFunc {
+	single := handler.RequireRoleSingleFactor(roles...)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return single(handler.requireTwoFactor(next))
+	}
+}
+
+// RequireRoleSingleFactor is RequireRole without the two-factor requirement,
+// it lets users of such roles set up two-factor authentication
+func (handler *handler) RequireRoleSingleFactor(roles ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !handler.hasRole(c, roles...) {
+				return echo.NewHTTPError(http.StatusForbidden, "Access denied")
+			}
+			return next(c)
+		}
+	}
+}
+
+// RequireScope allows requests authenticated by an API key only if the key
+// has the scope, routes with an empty scope are closed to API keys. Requests
+// with access tokens are not restricted. It must run after AccessMiddleware.
+func (handler *handler) RequireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			scopes, ok := c.Get("scopes").([]string)
+			if !ok {
+				return next(c)
+			}
+			for _, s := range scopes {
+				if scope != "" && s == scope {
+					return next(c)
+				}
+			}
+			if scope == "" {
+				return echo.NewHTTPError(http.StatusForbidden, "API keys cannot be used here")
+			}
+			return echo.NewHTTPError(http.StatusForbidden, "API key lacks scope "+scope)
+		}
+	}
+}
+
+// RequireSelfOrRole allows a request if the user id in the path parameter
+// belongs to the authenticated user or the user has one of the roles
+func (handler *handler) RequireSelfOrRole(param string, roles ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			idFromPath, err := strconv.ParseInt(c.Param(param), 10, 64)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "Invalid user id")
+			}
+			idUser, ok := c.Get("id_user").(string)
+			if ok && idUser == strconv.FormatInt(idFromPath, 10) {
+				return handler.requireTwoFactor(next)(c)
+			}
+			if !handler.hasRole(c, roles...) {
+				return echo.NewHTTPError(http.StatusForbidden, "Access denied")
+			}
+			return handler.requireTwoFactor(next)(c)
+		}
+	}
+}
+
+// requireTwoFactor rejects sessions started without a second factor if the
+// role of the user requires two-factor authentication
+func (handler *handler) requireTwoFactor(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		role, _ := c.Get("role").(string)
+		twoFactor, _ := c.Get("two_factor").(bool)
+		if handler.twoFactor.Required(role) && !twoFactor {
+			return echo.NewHTTPError(http.StatusForbidden, "Two-factor authentication is required, set it up and log in again")
+		}
+		return next(c)
+	}
+}
+
+func (handler *handler) hasRole(c echo.Context, roles ...string) bool {
+	role, ok := c.Get("role").(string)
+	if !ok {
+		return false
+	}
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
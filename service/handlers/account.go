@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"SB/service/repository/logging"
+	"SB/service/repository/password"
+	"SB/service/repository/persistence"
+	"SB/service/repository/pubsub"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+// ForgotPasswordHandler godoc
+// @Summary Request a password reset e-mail
+// @Description The e-mail is sent after the response, which is the same whether the account exists or not
+// @ID authForgotPassword
+// @Tags Auth
+// @Accept  json
+// @Param Body body ForgotPasswordParams true "E-mail of the account"
+// @Success 200 {string} string "Password reset e-mail sent"
+// @Failure 400,422 {object} ErrorResponse
+// @Router /auth/password/forgot [post]
+func (handler *handler) ForgotPasswordHandler(c echo.Context) error {
+	var params ForgotPasswordParams
+	if err := c.Bind(&params); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid e-mail")
+	}
+	if err := c.Validate(&params); err != nil {
+		return err
+	}
+	handler.account.RequestPasswordReset(c.Request().Context(), params.Email)
+	return c.JSON(http.StatusOK, "Password reset e-mail sent")
+}
+
+// ResetPasswordHandler godoc
+// @Summary Set a new password with the token from the password reset e-mail
+// @Description All sessions of the user are ended, its messenger websockets closed and its API keys revoked
+// @ID authResetPassword
+// @Tags Auth
+// @Accept  json
+// @Param Body body ResetPasswordParams true "Token and the new password"
+// @Success 200 {string} string "Password changed"
+// @Failure 400,422,500 {object} ErrorResponse
+// @Router /auth/password/reset [post]
+func (handler *handler) ResetPasswordHandler(c echo.Context) error {
+	var params ResetPasswordParams
+	if err := c.Bind(&params); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid password reset parameters")
+	}
+	if err := c.Validate(&params); err != nil {
+		return err
+	}
+	idUser, err := handler.account.ResetPassword(c.Request().Context(), params.Token, params.Password)
+	var policyErr *password.PolicyError
+	if errors.As(err, &policyErr) {
+		return echo.NewHTTPError(http.StatusBadRequest, policyErr.Reason)
+	} else if errors.Is(err, persistence.ErrInvalidAccountToken) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Password reset link is invalid or expired")
+	} else if err != nil {
+		logger(c).Error("failed to reset password", logging.Err(err))
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to reset password")
+	}
+	handler.disconnect(c.Request().Context(), idUser, pubsub.Revocation{})
+	return c.JSON(http.StatusOK, "Password changed")
+}
+
+// VerifyEmailHandler godoc
+// @Summary Confirm the e-mail with the token from the verification e-mail
+// @ID authVerifyEmail
+// @Tags Auth
+// @Accept  json
+// @Param Body body VerifyEmailParams true "Token from the e-mail"
+// @Success 200 {string} string "E-mail verified"
+// @Failure 400,500 {object} ErrorResponse
+// @Router /auth/verify-email [post]
+func (handler *handler) VerifyEmailHandler(c echo.Context) error {
+	var params VerifyEmailParams
+	if err := c.Bind(&params); err != nil || params.Token == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid verification parameters")
+	}
+	err := handler.account.VerifyEmail(c.Request().Context(), params.Token)
+	if errors.Is(err, persistence.ErrInvalidAccountToken) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Verification link is invalid or expired")
+	} else if err != nil {
+		logger(c).Error("failed to verify e-mail", logging.Err(err))
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to verify e-mail")
+	}
+	return c.JSON(http.StatusOK, "E-mail verified")
+}
@@ -0,0 +1,427 @@
+package handlers
+
+import (
+	"SB/service/repository/audit"
+	"SB/service/repository/errs"
+	"SB/service/repository/logging"
+	"SB/service/repository/persistence"
+	"SB/service/repository/pubsub"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+)
+
+// SearchUsersHandler godoc
+// @Summary Search users
+// @Description Users are ordered by id, the query matches username, e-mail, name and second name
+// @ID adminSearchUsers
+// @Tags Admin
+// @Produce  json
+// @Param query query string false "Part of username, e-mail or name"
+// @Param role query string false "Role of the users"
+// @Param page query int false "Page starting from 1"
+// @Param per_page query int false "Users per page, 20 by default and 100 at most"
+// @Success 200 {object} UsersPage
+// @Failure 400,401,403,422,500 {object} ErrorResponse
+// @Router /admin/users [get]
+func (handler *handler) SearchUsersHandler(c echo.Context) error {
+	page, err := queryInt(c, "page", 1)
+	if err != nil || page < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid page")
+	}
+	perPage, err := queryInt(c, "per_page", defaultPerPage)
+	if err != nil || perPage < 1 || perPage > maxPerPage {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid number of users per page")
+	}
+	users, total, err := handler.admin.SearchUsers(c.Request().Context(), persistence.UserSearch{
+		Query:  c.QueryParam("query"),
+		Role:   c.QueryParam("role"),
+		Limit:  perPage,
+		Offset: (page - 1) * perPage,
+	})
+	if err != nil {
+		return err
+	}
+	if users == nil {
+		users = []persistence.UserSummary{}
+	}
+	return c.JSON(http.StatusOK, UsersPage{Users: users, Total: total, Page: page, PerPage: perPage})
+}
+
+// SetRoleHandler godoc
+// @Summary Change the role of a user
+// @Description The new role applies to access tokens issued after the change, admins cannot change their own role
+// @ID adminSetRole
+// @Tags Admin
+// @Accept  json
+// @Param id path int true "User id"
+// @Param Body body SetRoleParams true "The new role"
+// @Success 200 {string} string "Role changed"
+// @Failure 400,401,403,404,422,500 {object} ErrorResponse
+// @Router /admin/users/{id}/role [put]
+func (handler *handler) SetRoleHandler(c echo.Context) error {
+	actor, id, err := handler.actorAndParam(c, "Invalid user id")
+	if err != nil {
+		return err
+	}
+	var params SetRoleParams
+	if err := c.Bind(&params); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid role parameters")
+	}
+	if err := handler.admin.SetRole(c.Request().Context(), actor, id, params.Role); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, "Role changed")
+}
+
+// BanUserHandler godoc
+// @Summary Ban a user
+// @Description Banned users cannot log in and their API keys stop working. All sessions of the user are revoked and its messenger websockets closed. Banning a banned user replaces the ban.
+// @Description Access tokens are not checked against bans: tokens issued before the ban keep full access until they expire, for up to token.access_token_expiration (1h by default). The ban takes full effect once they have expired.
+// @ID adminBanUser
+// @Tags Admin
+// @Accept  json
+// @Param id path int true "User id"
+// @Param Body body BanParams true "Reason and end of the ban"
+// @Success 200 {string} string "User banned"
+// @Failure 400,401,403,404,422,500 {object} ErrorResponse
+// @Router /admin/users/{id}/ban [post]
+func (handler *handler) BanUserHandler(c echo.Context) error {
+	actor, id, err := handler.actorAndParam(c, "Invalid user id")
+	if err != nil {
+		return err
+	}
+	var params BanParams
+	if err := c.Bind(&params); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ban parameters")
+	}
+	if err := handler.admin.Ban(c.Request().Context(), actor, id, persistence.Ban{Reason: params.Reason, Until: params.Until}); err != nil {
+		return err
+	}
+	handler.disconnect(c.Request().Context(), id, pubsub.Revocation{})
+	return c.JSON(http.StatusOK, "User banned")
+}
+
+// UnbanUserHandler godoc
+// @Summary Lift the ban of a user
+// @ID adminUnbanUser
+// @Tags Admin
+// @Param id path int true "User id"
+// @Success 200 {string} string "User unbanned"
+// @Failure 400,401,403,404,500 {object} ErrorResponse
+// @Router /admin/users/{id}/ban [delete]
+func (handler *handler) UnbanUserHandler(c echo.Context) error {
+	actor, id, err := handler.actorAndParam(c, "Invalid user id")
+	if err != nil {
+		return err
+	}
+	if err := handler.admin.Unban(c.Request().Context(), actor, id); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, "User unbanned")
+}
+
+// GetSportsHandler godoc
+// @Summary Get the sports dictionary
+// @Description Sports are listed with the number of profiles and trainings using them
+// @ID adminGetSports
+// @Tags Admin
+// @Produce  json
+// @Success 200 {array} persistence.SportInfo
+// @Failure 401,403,500 {object} ErrorResponse
+// @Router /admin/sports [get]
+func (handler *handler) GetSportsHandler(c echo.Context) error {
+	sports, err := handler.admin.GetSports(c.Request().Context())
+	if err != nil {
+		logger(c).Error("failed to get sports", logging.Err(err))
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get sports")
+	}
+	if sports == nil {
+		sports = []persistence.SportInfo{}
+	}
+	return c.JSON(http.StatusOK, sports)
+}
+
+// AddSportHandler godoc
+// @Summary Add a sport
+// @ID adminAddSport
+// @Tags Admin
+// @Accept  json
+// @Produce  json
+// @Param Body body SportParams true "Name of the sport"
+// @Success 201 {object} persistence.SportInfo
+// @Failure 400,401,403,409,422,500 {object} ErrorResponse
+// @Router /admin/sports [post]
+func (handler *handler) AddSportHandler(c echo.Context) error {
+	actor, err := handler.auditActor(c)
+	if err != nil {
+		return err
+	}
+	var params SportParams
+	if err := c.Bind(&params); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid sport parameters")
+	}
+	sport, err := handler.admin.AddSport(c.Request().Context(), actor, params.Name)
+	if err != nil {
+		return dictionaryError(c, err, "sport", "Failed to add sport")
+	}
+	return c.JSON(http.StatusCreated, sport)
+}
+
+// RenameSportHandler godoc
+// @Summary Rename a sport
+// @ID adminRenameSport
+// @Tags Admin
+// @Accept  json
+// @Param id path int true "Sport id"
+// @Param Body body SportParams true "New name of the sport"
+// @Success 200 {string} string "Sport renamed"
+// @Failure 400,401,403,404,409,422,500 {object} ErrorResponse
+// @Router /admin/sports/{id} [put]
+func (handler *handler) RenameSportHandler(c echo.Context) error {
+	actor, id, err := handler.actorAndParam(c, "Invalid sport id")
+	if err != nil {
+		return err
+	}
+	var params SportParams
+	if err := c.Bind(&params); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid sport parameters")
+	}
+	if err := handler.admin.RenameSport(c.Request().Context(), actor, id, params.Name); err != nil {
+		return dictionaryError(c, err, "sport", "Failed to rename sport")
+	}
+	return c.JSON(http.StatusOK, "Sport renamed")
+}
+
+// DeleteSportHandler godoc
+// @Summary Delete a sport
+// @Description Sports used by profiles or trainings cannot be deleted, they have to be merged into another sport
+// @ID adminDeleteSport
+// @Tags Admin
+// @Param id path int true "Sport id"
+// @Success 200 {string} string "Sport deleted"
+// @Failure 400,401,403,404,409,500 {object} ErrorResponse
+// @Router /admin/sports/{id} [delete]
+func (handler *handler) DeleteSportHandler(c echo.Context) error {
+	actor, id, err := handler.actorAndParam(c, "Invalid sport id")
+	if err != nil {
+		return err
+	}
+	if err := handler.admin.DeleteSport(c.Request().Context(), actor, id); err != nil {
+		return dictionaryError(c, err, "sport", "Failed to delete sport")
+	}
+	return c.JSON(http.StatusOK, "Sport deleted")
+}
+
+// MergeSportsHandler godoc
+// @Summary Merge a duplicate sport into another one
+// @Description Profiles and trainings of the sport are moved to the other sport and the sport is deleted
+// @ID adminMergeSports
+// @Tags Admin
+// @Accept  json
+// @Param id path int true "Id of the duplicate sport"
+// @Param Body body MergeSportsParams true "Sport to merge into"
+// @Success 200 {string} string "Sports merged"
+// @Failure 400,401,403,404,422,500 {object} ErrorResponse
+// @Router /admin/sports/{id}/merge [post]
+func (handler *handler) MergeSportsHandler(c echo.Context) error {
+	actor, id, err := handler.actorAndParam(c, "Invalid sport id")
+	if err != nil {
+		return err
+	}
+	var params MergeSportsParams
+	if err := c.Bind(&params); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid merge parameters")
+	}
+	if err := handler.admin.MergeSports(c.Request().Context(), actor, id, params.Into); err != nil {
+		return dictionaryError(c, err, "sport", "Failed to merge sports")
+	}
+	return c.JSON(http.StatusOK, "Sports merged")
+}
+
+// GetLevelsHandler godoc
+// @Summary Get the levels dictionary
+// @ID adminGetLevels
+// @Tags Admin
+// @Produce  json
+// @Success 200 {array} persistence.LevelInfo
+// @Failure 401,403,500 {object} ErrorResponse
+// @Router /admin/levels [get]
+func (handler *handler) GetLevelsHandler(c echo.Context) error {
+	levels, err := handler.admin.GetLevels(c.Request().Context())
+	if err != nil {
+		logger(c).Error("failed to get levels", logging.Err(err))
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get levels")
+	}
+	if levels == nil {
+		levels = []persistence.LevelInfo{}
+	}
+	return c.JSON(http.StatusOK, levels)
+}
+
+// AddLevelHandler godoc
+// @Summary Add a level
+// @ID adminAddLevel
+// @Tags Admin
+// @Accept  json
+// @Produce  json
+// @Param Body body LevelParams true "Level and its description"
+// @Success 201 {object} persistence.LevelInfo
+// @Failure 400,401,403,409,422,500 {object} ErrorResponse
+// @Router /admin/levels [post]
+func (handler *handler) AddLevelHandler(c echo.Context) error {
+	actor, err := handler.auditActor(c)
+	if err != nil {
+		return err
+	}
+	var params LevelParams
+	if err := c.Bind(&params); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid level parameters")
+	}
+	level, err := handler.admin.AddLevel(c.Request().Context(), actor, persistence.LevelInfo{Level: params.Level, Description: params.Description})
+	if err != nil {
+		return dictionaryError(c, err, "level", "Failed to add level")
+	}
+	return c.JSON(http.StatusCreated, level)
+}
+
+// UpdateLevelHandler godoc
+// @Summary Update a level
+// @ID adminUpdateLevel
+// @Tags Admin
+// @Accept  json
+// @Param id path int true "Level id"
+// @Param Body body LevelParams true "Level and its description"
+// @Success 200 {string} string "Level updated"
+// @Failure 400,401,403,404,409,422,500 {object} ErrorResponse
+// @Router /admin/levels/{id} [put]
+func (handler *handler) UpdateLevelHandler(c echo.Context) error {
+	actor, id, err := handler.actorAndParam(c, "Invalid level id")
+	if err != nil {
+		return err
+	}
+	var params LevelParams
+	if err := c.Bind(&params); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid level parameters")
+	}
+	err = handler.admin.UpdateLevel(c.Request().Context(), actor, persistence.LevelInfo{IdLevel: id, Level: params.Level, Description: params.Description})
+	if err != nil {
+		return dictionaryError(c, err, "level", "Failed to update level")
+	}
+	return c.JSON(http.StatusOK, "Level updated")
+}
+
+// DeleteLevelHandler godoc
+// @Summary Delete a level
+// @Description Profiles and trainings of the level are left without a level
+// @ID adminDeleteLevel
+// @Tags Admin
+// @Param id path int true "Level id"
+// @Success 200 {string} string "Level deleted"
+// @Failure 400,401,403,404,500 {object} ErrorResponse
+// @Router /admin/levels/{id} [delete]
+func (handler *handler) DeleteLevelHandler(c echo.Context) error {
+	actor, id, err := handler.actorAndParam(c, "Invalid level id")
+	if err != nil {
+		return err
+	}
+	if err := handler.admin.DeleteLevel(c.Request().Context(), actor, id); err != nil {
+		return dictionaryError(c, err, "level", "Failed to delete level")
+	}
+	return c.JSON(http.StatusOK, "Level deleted")
+}
+
+// AdminDeleteTrainingHandler godoc
+// @Summary Delete any training
+// @ID adminDeleteTraining
+// @Tags Admin
+// @Param id path int true "Training id"
+// @Success 200 {string} string "Training deleted"
+// @Failure 400,401,403,404,500 {object} ErrorResponse
+// @Router /admin/trainings/{id} [delete]
+func (handler *handler) AdminDeleteTrainingHandler(c echo.Context) error {
+	actor, id, err := handler.actorAndParam(c, "Invalid training id")
+	if err != nil {
+		return err
+	}
+	err = handler.admin.DeleteTraining(c.Request().Context(), actor, id)
+	if errors.Is(err, persistence.ErrNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "No such training")
+	} else if err != nil {
+		logger(c).Error("failed to delete training", logging.Err(err))
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete training")
+	}
+	return c.JSON(http.StatusOK, "Training deleted")
+}
+
+// AdminDeleteMessageHandler godoc
+// @Summary Delete any message
+// @ID adminDeleteMessage
+// @Tags Admin
+// @Param id path int true "Message id"
+// @Success 200 {string} string "Message deleted"
+// @Failure 400,401,403,404,500 {object} ErrorResponse
+// @Router /admin/messages/{id} [delete]
+func (handler *handler) AdminDeleteMessageHandler(c echo.Context) error {
+	actor, id, err := handler.actorAndParam(c, "Invalid message id")
+	if err != nil {
+		return err
+	}
+	err = handler.admin.DeleteMessage(c.Request().Context(), actor, id)
+	if errors.Is(err, persistence.ErrNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "No such message")
+	} else if err != nil {
+		logger(c).Error("failed to delete message", logging.Err(err))
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete message")
+	}
+	return c.JSON(http.StatusOK, "Message deleted")
+}
+
+// bannedResponse refuses a login of a banned user
+func bannedResponse(c echo.Context, ban *persistence.Ban) error {
+	return c.JSON(http.StatusForbidden, BannedResponse{Code: "banned", Message: "Account is banned", Reason: ban.Reason, Until: ban.Until})
+}
+
+// actorAndParam returns the acting admin and the id from the path
+func (handler *handler) actorAndParam(c echo.Context, invalid string) (audit.Actor, int64, error) {
+	actor, err := handler.auditActor(c)
+	if err != nil {
+		return audit.Actor{}, 0, err
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return audit.Actor{}, 0, echo.NewHTTPError(http.StatusBadRequest, invalid)
+	}
+	return actor, id, nil
+}
+
+// dictionaryError responds to errors of changes to the sports and levels
+// dictionaries
+func dictionaryError(c echo.Context, err error, entry string, failed string) error {
+	switch {
+	case errors.Is(err, errs.ErrValidation):
+		return err
+	case errors.Is(err, persistence.ErrNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "No such "+entry)
+	case errors.Is(err, persistence.ErrDuplicate):
+		return echo.NewHTTPError(http.StatusConflict, "The "+entry+" already exists")
+	case errors.Is(err, persistence.ErrInUse):
+		return echo.NewHTTPError(http.StatusConflict, "The "+entry+" is in use, merge it into another one instead")
+	}
+	logger(c).Error(failed, logging.Err(err))
+	return echo.NewHTTPError(http.StatusInternalServerError, failed)
+}
+
+func queryInt(c echo.Context, name string, def int) (int, error) {
+	value := c.QueryParam(name)
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
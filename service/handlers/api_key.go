@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"SB/service/repository/errs"
+	"SB/service/repository/logging"
+	"SB/service/repository/persistence"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// GetAPIKeysHandler godoc
+// @Summary Get API keys of the user
+// @Description Revoked keys are not listed, expired keys are listed until they are revoked
+// @ID authGetAPIKeys
+// @Tags Auth
+// @Produce  json
+// @Success 200 {array} APIKeyResponse
+// @Failure 401,403,500 {object} ErrorResponse
+// @Router /auth/api-keys [get]
+func (handler *handler) GetAPIKeysHandler(c echo.Context) error {
+	id, err := handler.getIdFromContext(c)
+	if err != nil {
+		return err
+	}
+	keys, err := handler.apiKeys.List(c.Request().Context(), id)
+	if err != nil {
+		logger(c).Error("failed to get API keys", logging.Err(err))
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get API keys")
+	}
+	resp := make([]APIKeyResponse, len(keys))
+	for i, key := range keys {
+		resp[i] = apiKeyResponse(key)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// CreateAPIKeyHandler godoc
+// @Summary Create an API key
+// @Description The key acts as the user with the granted scopes only, it is sent in the X-API-Key header instead of X-Auth-Token. The key is returned only once. Keys are revoked when the password is reset, the user is banned or an admin revokes all sessions of the user.
+// @ID authCreateAPIKey
+// @Tags Auth
+// @Accept  json
+// @Produce  json
+// @Param Body body CreateAPIKeyParams true "Name and scopes of the key"
+// @Success 201 {object} CreatedAPIKeyResponse
+// @Failure 400,401,403,409,422,500 {object} ErrorResponse
+// @Router /auth/api-keys [post]
+func (handler *handler) CreateAPIKeyHandler(c echo.Context) error {
+	id, err := handler.getIdFromContext(c)
+	if err != nil {
+		return err
+	}
+	var params CreateAPIKeyParams
+	if err := c.Bind(&params); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid API key parameters")
+	}
+	twoFactor, _ := c.Get("two_factor").(bool)
+	key, stored, err := handler.apiKeys.Create(c.Request().Context(), id, params.Name, params.Scopes, params.ExpiresAt, twoFactor)
+	switch {
+	case errors.Is(err, errs.ErrValidation):
+		return err
+	case errors.Is(err, persistence.ErrTooManyAPIKeys):
+		return echo.NewHTTPError(http.StatusConflict, "Too many API keys, revoke unused ones first")
+	case err != nil:
+		logger(c).Error("failed to create API key", logging.Err(err))
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create API key")
+	}
+	return c.JSON(http.StatusCreated, CreatedAPIKeyResponse{APIKeyResponse: apiKeyResponse(stored), Key: key})
+}
+
+// RevokeAPIKeyHandler godoc
+// @Summary Revoke an API key
+// @ID authRevokeAPIKey
+// @Tags Auth
+// @Param id path int true "API key id"
+// @Success 200 {string} string "API key revoked"
+// @Failure 400,401,403,404,500 {object} ErrorResponse
+// @Router /auth/api-keys/{id} [delete]
+func (handler *handler) RevokeAPIKeyHandler(c echo.Context) error {
+	id, err := handler.getIdFromContext(c)
+	if err != nil {
+		return err
+	}
+	idKey, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid API key id")
+	}
+	err = handler.apiKeys.Revoke(c.Request().Context(), id, idKey)
+	if errors.Is(err, persistence.ErrAPIKeyNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "No such API key")
+	} else if err != nil {
+		logger(c).Error("failed to revoke API key", logging.Err(err))
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to revoke API key")
+	}
+	return c.JSON(http.StatusOK, "API key revoked")
+}
+
+// apiKeyAccess authenticates a request by an API key. A key counts as a
+// two-factor session only if it was created in one.
+func (handler *handler) apiKeyAccess(c echo.Context, key string, next echo.HandlerFunc) error {
+	stored, err := handler.apiKeys.Authenticate(c.Request().Context(), key)
+	if err != nil {
+		logger(c).Warn("API key authentication failed", logging.Err(err))
+		return echo.NewHTTPError(http.StatusUnauthorized, "Failed to authenticate API key")
+	}
+	c.Set("id_user", strconv.FormatInt(stored.IdUser, 10))
+	c.Set("role", stored.Role)
+	c.Set("two_factor", stored.TwoFactor)
+	c.Set("scopes", strings.Fields(stored.Scopes))
+	return next(c)
+}
+
+func apiKeyResponse(key persistence.APIKey) APIKeyResponse {
+	return APIKeyResponse{
+		Id:         key.Id,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     strings.Fields(key.Scopes),
+		CreatedAt:  key.CreatedAt,
+		LastUsedAt: key.LastUsedAt,
+		ExpiresAt:  key.ExpiresAt,
+	}
+}
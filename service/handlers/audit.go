@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"SB/service/repository/audit"
+	"SB/service/repository/logging"
+	"SB/service/repository/persistence"
+	"encoding/csv"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GetAuditLogHandler godoc
+// @Summary Search the audit log
+// @Description Entries are ordered from the newest, before and after hold only the changed fields of the target
+// @ID adminGetAuditLog
+// @Tags Admin
+// @Produce  json
+// @Param actor query int false "Id of the user who made the changes"
+// @Param action query string false "Action like user.role_changed"
+// @Param target_type query string false "Type of the changed target: user, training, message, sport or level"
+// @Param target_id query int false "Id of the changed target"
+// @Param from query string false "Earliest time of entries in RFC 3339"
+// @Param to query string false "Time entries are older than in RFC 3339"
+// @Param page query int false "Page starting from 1"
+// @Param per_page query int false "Entries per page, 20 by default and 100 at most"
+// @Success 200 {object} AuditPage
+// @Failure 400,401,403,500 {object} ErrorResponse
+// @Router /admin/audit [get]
+func (handler *handler) GetAuditLogHandler(c echo.Context) error {
+	filter, ok := auditFilter(c)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid audit log filter")
+	}
+	page, err := queryInt(c, "page", 1)
+	if err != nil || page < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid page")
+	}
+	perPage, err := queryInt(c, "per_page", defaultPerPage)
+	if err != nil || perPage < 1 || perPage > maxPerPage {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid number of entries per page")
+	}
+	filter.Limit = perPage
+	filter.Offset = (page - 1) * perPage
+	entries, total, err := handler.audit.Search(c.Request().Context(), filter)
+	if err != nil {
+		logger(c).Error("failed to search audit log", logging.Err(err))
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get audit log")
+	}
+	if entries == nil {
+		entries = []persistence.AuditEntry{}
+	}
+	return c.JSON(http.StatusOK, AuditPage{Entries: entries, Total: total, Page: page, PerPage: perPage})
+}
+
+// ExportAuditLogHandler godoc
+// @Summary Export the audit log as CSV
+// @Description Takes the filters of /admin/audit and exports up to 10000 newest entries
+// @ID adminExportAuditLog
+// @Tags Admin
+// @Produce  text/csv
+// @Param actor query int false "Id of the user who made the changes"
+// @Param action query string false "Action like user.role_changed"
+// @Param target_type query string false "Type of the changed target"
+// @Param target_id query int false "Id of the changed target"
+// @Param from query string false "Earliest time of entries in RFC 3339"
+// @Param to query string false "Time entries are older than in RFC 3339"
+// @Success 200 {string} string "CSV with a header row"
+// @Failure 400,401,403,500 {object} ErrorResponse
+// @Router /admin/audit/export [get]
+func (handler *handler) ExportAuditLogHandler(c echo.Context) error {
+	filter, ok := auditFilter(c)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid audit log filter")
+	}
+	entries, err := handler.audit.Export(c.Request().Context(), filter)
+	if err != nil {
+		logger(c).Error("failed to export audit log", logging.Err(err))
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to export audit log")
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="audit.csv"`)
+	c.Response().WriteHeader(http.StatusOK)
+	w := csv.NewWriter(c.Response())
+	if err := w.Write([]string{"id", "created_at", "id_actor", "impersonated_by", "action", "target_type", "target_id", "before", "after", "ip", "request_id"}); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		err := w.Write([]string{
+			strconv.FormatInt(e.Id, 10),
+			e.CreatedAt.UTC().Format(time.RFC3339),
+			optionalId(e.IdActor),
+			optionalId(e.ImpersonatedBy),
+			csvText(e.Action),
+			csvText(e.TargetType),
+			strconv.FormatInt(e.TargetId, 10),
+			csvText(string(e.Before)),
+			csvText(string(e.After)),
+			csvText(e.IP),
+			csvText(e.RequestId),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// auditActor returns the user of the request for the audit log
+func (handler *handler) auditActor(c echo.Context) (audit.Actor, error) {
+	id, err := handler.getIdFromContext(c)
+	if err != nil {
+		return audit.Actor{}, err
+	}
+	actor := audit.Actor{
+		IdUser:    id,
+		IP:        c.RealIP(),
+		RequestId: c.Response().Header().Get(echo.HeaderXRequestID),
+	}
+	if impersonator, ok := c.Get("actor").(string); ok {
+		actor.ImpersonatedBy, _ = strconv.ParseInt(impersonator, 10, 64)
+	}
+	return actor, nil
+}
+
+// auditFilter reads filters of the audit log from the query
+func auditFilter(c echo.Context) (persistence.AuditFilter, bool) {
+	filter := persistence.AuditFilter{
+		Action:     c.QueryParam("action"),
+		TargetType: c.QueryParam("target_type"),
+	}
+	var err error
+	if v := c.QueryParam("actor"); v != "" {
+		if filter.IdActor, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return filter, false
+		}
+	}
+	if v := c.QueryParam("target_id"); v != "" {
+		if filter.TargetId, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return filter, false
+		}
+	}
+	for name, t := range map[string]**time.Time{"from": &filter.From, "to": &filter.To} {
+		if v := c.QueryParam(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return filter, false
+			}
+			*t = &parsed
+		}
+	}
+	return filter, true
+}
+
+// csvText keeps spreadsheets from evaluating a cell as a formula by quoting
+// it with a leading apostrophe
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func optionalId(id *int64) string {
+	if id == nil {
+		return ""
+	}
+	return strconv.FormatInt(*id, 10)
+}
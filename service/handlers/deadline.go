@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"context"
+	"github.com/labstack/echo/v4"
+	"time"
+)
+
+// Deadline bounds the context of a request by the timeout. Managers pass the
+// context down to the database, so queries of a request stop at the deadline
+// and when the client disconnects. Websocket connections outlive any deadline
+// and keep the context of the connection.
+func Deadline(timeout time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.IsWebSocket() {
+				return next(c)
+			}
+			ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+			defer cancel()
+			c.SetRequest(c.Request().WithContext(ctx))
+			return next(c)
+		}
+	}
+}
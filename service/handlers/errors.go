@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"SB/service/repository/errs"
+	"SB/service/repository/logging"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strings"
+)
+
+// errorCodes are the codes of statuses that differ from the status text
+var errorCodes = map[int]string{
+	http.StatusUnprocessableEntity: "validation_failed",
+	http.StatusInternalServerError: "internal_error",
+}
+
+// ErrorHandler is the HTTPErrorHandler of the API. Errors returned by handlers
+// and middlewares are sent as ErrorResponse: an echo.HTTPError keeps its
+// status and message, domain errors get the status of their kind and any
+// other error is an internal error with its details only logged. Errors of
+// requests past their deadline are reported as timeouts. Errors are logged
+// with the logger of the request or base.
+func ErrorHandler(base *logging.Logger) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		if c.Response().Committed {
+			return
+		}
+		l := base.For(c.Request().Context())
+		status, response := errorResponse(err)
+		if status >= http.StatusInternalServerError && errors.Is(c.Request().Context().Err(), context.DeadlineExceeded) {
+			status = http.StatusServiceUnavailable
+			response = ErrorResponse{Code: errorCode(status), Message: "Request timed out"}
+		}
+		if status >= http.StatusInternalServerError {
+			l.Error("request failed", logging.Err(err))
+		}
+		if c.Request().Method == http.MethodHead {
+			err = c.NoContent(status)
+		} else {
+			err = c.JSON(status, response)
+		}
+		if err != nil {
+			l.Error("failed to send error response", logging.Err(err))
+		}
+	}
+}
+
+func errorResponse(err error) (int, ErrorResponse) {
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		message, ok := httpErr.Message.(string)
+		if !ok {
+			message = fmt.Sprint(httpErr.Message)
+		}
+		return httpErr.Code, ErrorResponse{Code: errorCode(httpErr.Code), Message: message}
+	}
+
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, errs.ErrValidation):
+		status = http.StatusUnprocessableEntity
+	case errors.Is(err, errs.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, errs.ErrConflict):
+		status = http.StatusConflict
+	case errors.Is(err, errs.ErrForbidden):
+		status = http.StatusForbidden
+	default:
+		return status, ErrorResponse{Code: errorCode(status), Message: "Internal server error"}
+	}
+	return status, ErrorResponse{Code: errorCode(status), Message: err.Error(), Fields: errs.Fields(err)}
+}
+
+// errorCode returns the code of a status like not_found
+func errorCode(status int) string {
+	if code, ok := errorCodes[status]; ok {
+		return code
+	}
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
@@ -2,16 +2,28 @@ package handlers
 
 import (
 	"SB/service/config"
+	"SB/service/repository/account"
+	"SB/service/repository/admin"
+	"SB/service/repository/apikey"
+	"SB/service/repository/audit"
 	"SB/service/repository/db"
+	"SB/service/repository/health"
+	"SB/service/repository/lockout"
+	"SB/service/repository/logging"
 	"SB/service/repository/messenger"
+	"SB/service/repository/oidc"
+	"SB/service/repository/password"
+	"SB/service/repository/persistence"
+	"SB/service/repository/pubsub"
 	"SB/service/repository/token"
 	"SB/service/repository/training"
+	"SB/service/repository/twofactor"
+	"SB/service/repository/validation"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/dgrijalva/jwt-go"
 	"github.com/labstack/echo/v4"
-	"github.com/labstack/gommon/log"
+	"gopkg.in/olahol/melody.v1"
 	"net/http"
 	"strconv"
 	"time"
@@ -21,20 +33,82 @@ type (
 	handler struct {
 		userManager db.UserManager
 		token       token.TokenManager
+		account     account.AccountManager
+		twoFactor   twofactor.TwoFactorManager
+		lockout     lockout.Guard
+		oidc        oidc.Manager
+		apiKeys     apikey.Manager
+		admin       admin.AdminManager
+		audit       audit.Log
 		trainingMgr training.TrainingManager
 		messenger   messenger.Messenger
+		health      health.Checker
+		// sessions of the messenger websockets
+		melody *melody.Melody
+		hub    *hub
+		// pubSub delivers events to the sessions of all nodes
+		pubSub pubsub.PubSub
+		// logger writes lines outside requests, Logger derives the loggers
+		// of requests from it
+		logger *logging.Logger
 	}
 
 	Handler interface {
 		LoginHandler(c echo.Context) error
+		LoginTwoFactorHandler(c echo.Context) error
 		LogoutHandler(c echo.Context) error
 		SignupHandler(c echo.Context) error
 		DeleteUserHandler(c echo.Context) error
 		AccessMiddleware(next echo.HandlerFunc) echo.HandlerFunc
+		RequireRole(roles ...string) echo.MiddlewareFunc
+		RequireSelfOrRole(param string, roles ...string) echo.MiddlewareFunc
+		RequireRoleSingleFactor(roles ...string) echo.MiddlewareFunc
+		RequireScope(scope string) echo.MiddlewareFunc
+		DenyImpersonation(access echo.MiddlewareFunc) echo.MiddlewareFunc
 		GetUserProfileHandler(c echo.Context) error
 		GetProfilesHandler(c echo.Context) error
 		UpdateUserProfileHandler(c echo.Context) error
 		RefreshToken(c echo.Context) error
+		ForgotPasswordHandler(c echo.Context) error
+		ResetPasswordHandler(c echo.Context) error
+		VerifyEmailHandler(c echo.Context) error
+		TwoFactorSetupHandler(c echo.Context) error
+		TwoFactorConfirmHandler(c echo.Context) error
+		TwoFactorDisableHandler(c echo.Context) error
+		GetSessionsHandler(c echo.Context) error
+		RevokeSessionHandler(c echo.Context) error
+		LogoutAllHandler(c echo.Context) error
+		GetUserSessionsHandler(c echo.Context) error
+		RevokeUserSessionHandler(c echo.Context) error
+		RevokeUserSessionsHandler(c echo.Context) error
+		UnlockUserHandler(c echo.Context) error
+		ImpersonateHandler(c echo.Context) error
+		SearchUsersHandler(c echo.Context) error
+		SetRoleHandler(c echo.Context) error
+		BanUserHandler(c echo.Context) error
+		UnbanUserHandler(c echo.Context) error
+		GetSportsHandler(c echo.Context) error
+		AddSportHandler(c echo.Context) error
+		RenameSportHandler(c echo.Context) error
+		DeleteSportHandler(c echo.Context) error
+		MergeSportsHandler(c echo.Context) error
+		GetLevelsHandler(c echo.Context) error
+		AddLevelHandler(c echo.Context) error
+		UpdateLevelHandler(c echo.Context) error
+		DeleteLevelHandler(c echo.Context) error
+		AdminDeleteTrainingHandler(c echo.Context) error
+		AdminDeleteMessageHandler(c echo.Context) error
+		GetAuditLogHandler(c echo.Context) error
+		ExportAuditLogHandler(c echo.Context) error
+		JWKSHandler(c echo.Context) error
+		OIDCProvidersHandler(c echo.Context) error
+		OIDCAuthorizeHandler(c echo.Context) error
+		OIDCCallbackHandler(c echo.Context) error
+		OIDCLinkHandler(c echo.Context) error
+		OIDCLinkCallbackHandler(c echo.Context) error
+		GetAPIKeysHandler(c echo.Context) error
+		CreateAPIKeyHandler(c echo.Context) error
+		RevokeAPIKeyHandler(c echo.Context) error
 		GetGroupTrainingsHandler(c echo.Context) error
 		GetTrainingHandler(c echo.Context) error
 		AddGroupTrainingHandler(c echo.Context) error
@@ -47,52 +121,176 @@ type (
 		ReplyToRequestHandler(c echo.Context) error
 		DeclinedRequestSeenHandler(c echo.Context) error
 		GetMessagesHandler(c echo.Context) error
+		// CloseSessions closes the messenger websockets with a going away
+		// close frame, new connections are refused afterwards
+		CloseSessions() error
+		HealthHandler(c echo.Context) error
+		ReadyHandler(c echo.Context) error
 	}
 )
 
-func NewHandler(usrMgr db.UserManager, tknMgr token.TokenManager, trainingMgr training.TrainingManager, messenger messenger.Messenger) Handler {
-	return &handler{
+func NewHandler(usrMgr db.UserManager, tknMgr token.TokenManager, accountMgr account.AccountManager, twoFactorMgr twofactor.TwoFactorManager,
+	guard lockout.Guard, oidcMgr oidc.Manager, apiKeyMgr apikey.Manager, adminMgr admin.AdminManager, auditLog audit.Log, trainingMgr training.TrainingManager, messenger messenger.Messenger, checker health.Checker, pubSub pubsub.PubSub, messengerCfg config.Messenger, logger *logging.Logger) Handler {
+	h := &handler{
 		userManager: usrMgr,
 		token:       tknMgr,
+		account:     accountMgr,
+		twoFactor:   twoFactorMgr,
+		lockout:     guard,
+		oidc:        oidcMgr,
+		apiKeys:     apiKeyMgr,
+		admin:       adminMgr,
+		audit:       auditLog,
 		messenger:   messenger,
 		trainingMgr: trainingMgr,
-	}
+		health:      checker,
+		melody:      melody.New(),
+		hub:         newHub(),
+		pubSub:      pubSub,
+		logger:      logger,
+	}
+	// melody pings every session and closes it when no pong arrives in time
+	h.melody.Config.PingPeriod = messengerCfg.PingInterval
+	h.melody.Config.PongWait = messengerCfg.IdleTimeout
+	h.melody.Config.WriteWait = messengerCfg.WriteTimeout
+	h.melody.Config.MaxMessageSize = int64(messengerCfg.MaxMessageSize)
+	h.melody.HandleConnect(h.handleConnection)
+	h.melody.HandleDisconnect(h.handleDisconnect)
+	h.melody.HandleMessage(h.handleMessage)
+	h.pubSub.Subscribe(h.deliver)
+	return h
 }
 
-//TODO: add api for admin to administrate data
-
 // LoginHandler godoc
 // @Summary Login a user
+// @Description Users with two-factor authentication get a challenge instead of tokens, it is exchanged at /auth/login/2fa
 // @ID authLogin
 // @Tags Auth
 // @Accept  json
 // @Produce  json
 // @Param Body body UserLoginParams true "The body to login a user"
 // @Success 200 {object} LoginResponse
-// @Failure 400,401,500 {object} ErrorResponse
+// @Failure 400,401,422,429,500 {object} ErrorResponse
 // @Router /auth/login [post]
 func (handler *handler) LoginHandler(c echo.Context) error {
 	loginParams := new(UserLoginParams)
 	err := c.Bind(&loginParams)
 	if err != nil {
-		log.Error(err)
-		return c.JSON(http.StatusBadRequest, ErrorResponse{"Invalid login parameters"})
+		logger(c).Warn("invalid login parameters", logging.Err(err))
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid login parameters")
+	}
+	if err := c.Validate(loginParams); err != nil {
+		return err
+	}
+	logger(c).Info("login", logging.String("login", loginParams.Username))
+	ip := c.RealIP()
+	// the attempt is counted as failed until the password is accepted
+	if err := handler.lockout.Attempt(c.Request().Context(), loginParams.Username, ip); err != nil {
+		loginsTotal.Inc(loginPassword, loginLocked)
+		return lockedResponse(c, err)
+	}
+	user, err := handler.userManager.Authenticate(c.Request().Context(), loginParams.Username, loginParams.Password)
+	if errors.Is(err, db.ErrInvalidCredentials) {
+		loginsTotal.Inc(loginPassword, loginFailure)
+		logger(c).Warn("login failed", logging.Err(err))
+		return echo.NewHTTPError(http.StatusUnauthorized, "Failed to login")
+	} else if err != nil {
+		logger(c).Error("login failed", logging.Err(err))
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to login")
+	}
+	loginsTotal.Inc(loginPassword, loginSuccess)
+	if err := handler.lockout.Succeed(c.Request().Context(), loginParams.Username, ip); err != nil {
+		logger(c).Error("failed to reset failed logins", logging.Err(err))
+	}
+	return handler.finishLogin(c, user, loginParams.Device)
+}
+
+// finishLogin starts a session of an authenticated user or returns a
+// challenge if the user has to enter a second factor
+func (handler *handler) finishLogin(c echo.Context, user persistence.User, device string) error {
+	enabled, err := handler.twoFactor.Enabled(c.Request().Context(), user.GetId())
+	if err != nil {
+		logger(c).Error("failed to check two-factor authentication", logging.Err(err))
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to login")
+	}
+	if enabled {
+		challenge, err := handler.twoFactor.Challenge(c.Request().Context(), user)
+		if err != nil {
+			logger(c).Error("failed to issue two-factor challenge", logging.Err(err))
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to login")
+		}
+		return c.JSON(http.StatusOK, LoginResponse{TwoFactorRequired: true, Challenge: challenge})
+	}
+	return handler.startSession(c, user, device, false)
+}
+
+// LoginTwoFactorHandler godoc
+// @Summary Finish login with a two-factor code
+// @ID authLoginTwoFactor
+// @Tags Auth
+// @Accept  json
+// @Produce  json
+// @Param Body body TwoFactorLoginParams true "Challenge from the login response and a TOTP or recovery code"
+// @Success 200 {object} LoginResponse
+// @Failure 400,401,422,429,500 {object} ErrorResponse
+// @Router /auth/login/2fa [post]
+func (handler *handler) LoginTwoFactorHandler(c echo.Context) error {
+	var params TwoFactorLoginParams
+	if err := c.Bind(&params); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid login parameters")
+	}
+	if err := c.Validate(&params); err != nil {
+		return err
 	}
-	log.Info("login ", loginParams.Username)
-	user, err := handler.userManager.Authenticate(loginParams.Username, loginParams.Password)
+	user, err := handler.twoFactor.ChallengeUser(c.Request().Context(), params.Challenge)
 	if err != nil {
-		log.Error("login failed: ", err)
-		return c.JSON(http.StatusUnauthorized, ErrorResponse{"Failed to login"})
+		return echo.NewHTTPError(http.StatusUnauthorized, "Login expired, please enter the password again")
+	}
+	// wrong codes count against the account as well as the IP address
+	ip := c.RealIP()
+	if err := handler.lockout.Attempt(c.Request().Context(), user.GetUsername(), ip); err != nil {
+		loginsTotal.Inc(loginTwoFactor, loginLocked)
+		return lockedResponse(c, err)
+	}
+	user, err = handler.twoFactor.Exchange(c.Request().Context(), params.Challenge, params.Code)
+	if errors.Is(err, twofactor.ErrInvalidChallenge) {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Login expired, please enter the password again")
+	} else if err != nil {
+		loginsTotal.Inc(loginTwoFactor, loginFailure)
+		logger(c).Warn("two-factor login failed", logging.Err(err))
+		return echo.NewHTTPError(http.StatusUnauthorized, "Invalid code")
+	}
+	loginsTotal.Inc(loginTwoFactor, loginSuccess)
+	if err := handler.lockout.Succeed(c.Request().Context(), user.GetUsername(), ip); err != nil {
+		logger(c).Error("failed to reset failed logins", logging.Err(err))
+	}
+	return handler.startSession(c, user, params.Device, true)
+}
+
+// startSession issues tokens for a new session and sends them to the client,
+// banned users are refused
+func (handler *handler) startSession(c echo.Context, user persistence.User, device string, twoFactor bool) error {
+	ban, err := handler.admin.GetBan(c.Request().Context(), user.GetId())
+	if err != nil {
+		logger(c).Error("failed to check ban", logging.Err(err))
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to login")
+	}
+	if ban != nil {
+		return bannedResponse(c, ban)
 	}
-	accessTkn, refreshTkn, err := handler.token.GenerateNewToken(user.GetId(), user.GetRole(), user.GetUsername())
+	accessTkn, refreshTkn, err := handler.token.GenerateNewToken(c.Request().Context(), user.GetId(), user.GetRole(), user.GetUsername(), clientInfo(c, device), twoFactor)
 	if err != nil {
-		log.Error("failed to generate token", err)
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{"Failed to generate token"})
+		logger(c).Error("failed to generate token", logging.Err(err))
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to generate token")
 	}
+	return sendTokens(c, accessTkn, refreshTkn)
+}
 
+// sendTokens returns the access token in the body and sets the refresh token cookie
+func sendTokens(c echo.Context, accessTkn, refreshTkn persistence.Token) error {
 	resp := LoginResponse{
-		IdUser:      user.GetId(),
-		Username:    user.GetUsername(),
+		IdUser:      accessTkn.GetUserId(),
+		Username:    accessTkn.GetUsername(),
 		AccessToken: accessTkn.GetId(),
 	}
 
@@ -118,16 +316,16 @@ func (handler *handler) LoginHandler(c echo.Context) error {
 func (handler *handler) LogoutHandler(c echo.Context) error {
 	cookie, err := c.Cookie(refreshToken)
 	if err != nil {
-		log.Error("failed to get refresh token from cookie: ", err)
-		return c.JSON(http.StatusUnauthorized, ErrorResponse{"Failed to logout"})
+		logger(c).Warn("failed to get refresh token from cookie", logging.Err(err))
+		return echo.NewHTTPError(http.StatusUnauthorized, "Failed to logout")
 	}
-	log.Info("logout ", cookie.Value)
 
-	err = handler.token.Remove(cookie.Value)
+	tkn, err := handler.token.Remove(c.Request().Context(), cookie.Value)
 	if err != nil {
-		log.Error("failed to logout", err)
-		return c.JSON(http.StatusNotFound, ErrorResponse{"No such token"})
+		logger(c).Warn("failed to logout", logging.Err(err))
+		return echo.NewHTTPError(http.StatusNotFound, "No such token")
 	}
+	handler.disconnect(c.Request().Context(), tkn.GetUserId(), pubsub.Revocation{Family: tkn.GetFamily()})
 	cookie.MaxAge = -1
 	c.SetCookie(cookie)
 	return c.JSON(http.StatusOK, "Logout successfully")
@@ -141,74 +339,67 @@ func (handler *handler) LogoutHandler(c echo.Context) error {
 // @Produce  json
 // @Param Body body UserLoginParams true "The body to sign up a user"
 // @Success 200 {object} LoginResponse
-// @Failure 400,401,500 {object} ErrorResponse
+// @Failure 400,401,422,429,500 {object} ErrorResponse
 // @Router /auth/signup [post]
 func (handler *handler) SignupHandler(c echo.Context) error {
 	var signUpParams UserLoginParams
 	err := c.Bind(&signUpParams)
 	if err != nil {
-		log.Error("failed to sign up: ", err)
-		return c.JSON(http.StatusBadRequest, ErrorResponse{"Invalid sign up parameters"})
+		logger(c).Warn("failed to sign up", logging.Err(err))
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid sign up parameters")
 	}
-	log.Info("sign up ", signUpParams.Username)
-	user, err := handler.userManager.AddUser(signUpParams.Username, signUpParams.Password)
-	if err != nil {
-		log.Error("failed to sign up: ", err)
-		return c.JSON(http.StatusBadRequest, ErrorResponse{"Failed to sign up: invalid user parameters or user already exists"})
+	if err := c.Validate(&signUpParams); err != nil {
+		return err
 	}
-
-	accessTkn, refreshTkn, err := handler.token.GenerateNewToken(user.GetId(), user.GetRole(), user.GetUsername())
-	if err != nil {
-		log.Error("failed: to generate token", err)
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{"Failed to generate token"})
+	logger(c).Info("sign up", logging.String("login", signUpParams.Username))
+	// failed sign ups may probe for registered logins, they are counted
+	// against the IP address
+	ip := c.RealIP()
+	if err := handler.lockout.Attempt(c.Request().Context(), "", ip); err != nil {
+		return lockedResponse(c, err)
 	}
-
-	resp := LoginResponse{
-		IdUser:      user.GetId(),
-		Username:    user.GetUsername(),
-		AccessToken: accessTkn.GetId(),
+	user, err := handler.userManager.AddUser(c.Request().Context(), signUpParams.Username, signUpParams.Password)
+	var policyErr *password.PolicyError
+	if errors.As(err, &policyErr) {
+		handler.forgiveAttempt(c, ip)
+		return echo.NewHTTPError(http.StatusBadRequest, policyErr.Reason)
+	} else if err != nil {
+		logger(c).Warn("failed to sign up", logging.Err(err))
+		return echo.NewHTTPError(http.StatusBadRequest, "Failed to sign up: invalid user parameters or user already exists")
 	}
-
-	cookie := &http.Cookie{
-		Name:     refreshToken,
-		Value:    refreshTkn.GetId(),
-		Expires:  refreshTkn.GetExpirationTime(),
-		Path:     "/auth",
-		HttpOnly: true,
+	handler.forgiveAttempt(c, ip)
+	if err := handler.account.SendVerificationEmail(c.Request().Context(), user.GetId(), user.GetUsername()); err != nil {
+		logger(c).Error("failed to send verification e-mail", logging.Err(err))
 	}
 
-	c.SetCookie(cookie)
-	return c.JSON(http.StatusOK, resp)
+	return handler.startSession(c, user, signUpParams.Device, false)
 }
 
+// AccessMiddleware authenticates a request by the access token or an API
+// key, any failure is reported as 401, access rules are checked by
+// RequireScope and RequireRole afterwards
 func (handler *handler) AccessMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		log.Info("check token")
 		jwtFromHeader := c.Request().Header.Get(xAuthToken)
-		tkn, err := jwt.ParseWithClaims(
-			jwtFromHeader,
-			&jwt.StandardClaims{},
-			func(token *jwt.Token) (interface{}, error) {
-				return []byte(config.Secret), nil
-			},
-		)
-		if err != nil {
-			log.Error(err)
-			return c.JSON(http.StatusUnauthorized, ErrorResponse{"Failed to authenticate user"})
+		if key := c.Request().Header.Get(xAPIKey); jwtFromHeader == "" && key != "" {
+			return handler.apiKeyAccess(c, key, next)
 		}
-		//claims, ok := tkn.Claims.(*token.CustomizedClaims)
-		claims, ok := tkn.Claims.(*jwt.StandardClaims)
-
-		if !ok {
-			log.Error(errors.New("couldn't parse claims"))
-			return c.JSON(http.StatusForbidden, ErrorResponse{Message: "Failed to parse token claims"})
+		if jwtFromHeader == "" {
+			return echo.NewHTTPError(http.StatusUnauthorized, "Authentication required")
 		}
-		if claims.ExpiresAt < time.Now().UTC().Unix() {
-			log.Error(errors.New("jwt is expired"))
-			return c.JSON(http.StatusForbidden, ErrorResponse{Message: "JWT is expired"})
+		claims, err := handler.token.ParseAccessToken(c.Request().Context(), jwtFromHeader)
+		if err != nil {
+			logger(c).Warn("failed to authenticate user", logging.Err(err))
+			return echo.NewHTTPError(http.StatusUnauthorized, "Failed to authenticate user")
 		}
 		c.Set("id_user", claims.Id)
-		//c.Set("role", claims.Role)
+		c.Set("role", claims.Role)
+		c.Set("session_id", claims.SessionId)
+		c.Set("two_factor", claims.TwoFactor)
+		c.Set("expires_at", time.Unix(claims.ExpiresAt, 0))
+		if claims.Actor != nil {
+			return handler.impersonated(c, claims, next)
+		}
 		return next(c)
 	}
 }
@@ -224,31 +415,19 @@ func (handler *handler) AccessMiddleware(next echo.HandlerFunc) echo.HandlerFunc
 func (handler *handler) RefreshToken(c echo.Context) error {
 	cookie, err := c.Cookie(refreshToken)
 	if err != nil {
-		log.Error("failed to auth: ", err)
-		return c.JSON(http.StatusBadRequest, ErrorResponse{"Failed to refresh token"})
-	}
-	accessTkn, refreshTkn, err := handler.token.Refresh(cookie.Value)
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, ErrorResponse{"Failed to refresh token"})
+		logger(c).Warn("failed to auth", logging.Err(err))
+		return echo.NewHTTPError(http.StatusBadRequest, "Failed to refresh token")
 	}
-
-	resp := LoginResponse{
-		Username:    accessTkn.GetUsername(),
-		IdUser:      accessTkn.GetUserId(),
-		AccessToken: accessTkn.GetId(),
+	accessTkn, refreshTkn, err := handler.token.Refresh(c.Request().Context(), cookie.Value, clientInfo(c, ""))
+	if errors.Is(err, token.ErrRefreshTokenReused) {
+		cookie.MaxAge = -1
+		c.SetCookie(cookie)
+		return echo.NewHTTPError(http.StatusUnauthorized, "Session is revoked, please log in again")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Failed to refresh token")
 	}
 
-	cookie = &http.Cookie{
-		Name:     refreshToken,
-		Value:    refreshTkn.GetId(),
-		Expires:  refreshTkn.GetExpirationTime(),
-		Path:     "/auth",
-		HttpOnly: true,
-	}
-
-	c.SetCookie(cookie)
-
-	return c.JSON(http.StatusOK, resp)
+	return sendTokens(c, accessTkn, refreshTkn)
 }
 
 // GetUserProfileHandler godoc
@@ -257,20 +436,18 @@ func (handler *handler) RefreshToken(c echo.Context) error {
 // @Tags Profile
 // @Produce  json
 // @Success 200 {object} db.UserProfile
-// @Failure 400,401 {object} ErrorResponse
+// @Failure 400,401,404,500 {object} ErrorResponse
 // @Router /user/profile/{id} [get]
 func (handler *handler) GetUserProfileHandler(c echo.Context) error {
 	paramId := c.Param("id")
 	id, err := strconv.ParseInt(paramId, 10, 64)
 	if err != nil {
-		log.Error(err)
-		return c.JSON(http.StatusBadRequest,
-			ErrorResponse{"Invalid user id"})
+		logger(c).Warn("invalid user id", logging.Err(err))
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid user id")
 	}
-	profile, err := handler.userManager.GetUserProfile(id)
+	profile, err := handler.userManager.GetUserProfile(c.Request().Context(), id)
 	if err != nil {
-		log.Error(err)
-		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: fmt.Sprintf("Failed to get profile: user with id %d does no exist", id)})
+		return err
 	}
 	return c.JSON(http.StatusOK, profile)
 }
@@ -283,7 +460,7 @@ func (handler *handler) GetUserProfileHandler(c echo.Context) error {
 // @Produce  json
 // @Param Body body db.UserProfile true "The body to update user profile"
 // @Success 200 {string} string "user profile successfully updated"
-// @Failure 400,401 {object} ErrorResponse
+// @Failure 400,401,403,404,422,500 {object} ErrorResponse
 // @Router /user/profile [put]
 // TODO: get user id from token
 func (handler *handler) UpdateUserProfileHandler(c echo.Context) error {
@@ -294,20 +471,22 @@ func (handler *handler) UpdateUserProfileHandler(c echo.Context) error {
 	var userProfile db.UserProfile
 	err = c.Bind(&userProfile)
 	if err != nil {
-		log.Error(err)
-		return c.JSON(http.StatusBadRequest, ErrorResponse{"Invalid profile parameters"})
+		logger(c).Warn("invalid profile parameters", logging.Err(err))
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid profile parameters")
+	}
+	if err := c.Validate(&userProfile); err != nil {
+		return err
 	}
 	if id != userProfile.IdUser {
-		if !handler.checkForAdminPrivileges(id) {
-			return c.JSON(http.StatusForbidden, ErrorResponse{"No rights to configure users"})
+		if !handler.checkForAdminPrivileges(c) {
+			return echo.NewHTTPError(http.StatusForbidden, "No rights to configure users")
 		}
 	}
-	err = handler.userManager.UpdateUserProfile(&userProfile, userProfile.Sport...)
+	err = handler.userManager.UpdateUserProfile(c.Request().Context(), &userProfile, userProfile.Sport...)
 	if err != nil {
-		log.Error(err)
-		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: "Failed to update user profile"})
+		return err
 	}
-	return c.JSON(http.StatusOK, ErrorResponse{"User profile successfully updated"})
+	return c.JSON(http.StatusOK, "User profile successfully updated")
 }
 
 // DeleteUserHandler godoc
@@ -315,29 +494,24 @@ func (handler *handler) UpdateUserProfileHandler(c echo.Context) error {
 // @ID userDeleteProfile
 // @Tags Profile
 // @Success 200 {string} string "user successfully deleted"
-// @Failure 400,401 {object} ErrorResponse
+// @Failure 400,401,403,404,500 {object} ErrorResponse
 // @Router /user/{id} [delete]
 func (handler *handler) DeleteUserHandler(c echo.Context) error {
-	id, err := handler.getIdFromContext(c)
-	if err != nil {
-		return err
-	}
 	paramId := c.Param("id")
 	idFromPath, err := strconv.ParseInt(paramId, 10, 64)
 	if err != nil {
-		log.Error(err)
-		return c.JSON(http.StatusBadRequest,
-			ErrorResponse{"Invalid user id"})
+		logger(c).Warn("invalid user id", logging.Err(err))
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid user id")
 	}
-	if id != idFromPath {
-		if !handler.checkForAdminPrivileges(id) {
-			return c.JSON(http.StatusForbidden, ErrorResponse{"No rights to configure users"})
-		}
+	actor, err := handler.auditActor(c)
+	if err != nil {
+		return err
 	}
-	err = handler.userManager.DeleteUser(id)
+	err = handler.userManager.DeleteUser(c.Request().Context(), actor, idFromPath)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, ErrorResponse{fmt.Sprintf("Failed to delete user: %s", err)})
+		return err
 	}
+	handler.disconnect(c.Request().Context(), idFromPath, pubsub.Revocation{})
 	return c.JSON(http.StatusOK, "User successfully deleted")
 }
 
@@ -355,10 +529,10 @@ func (handler *handler) GetProfilesHandler(c echo.Context) error {
 	var filterParams db.UserProfileFilterParams
 	err := c.Bind(&filterParams)
 	if err != nil {
-		log.Error(err)
-		return c.JSON(http.StatusBadRequest, ErrorResponse{"Invalid filter parameters"})
+		logger(c).Warn("invalid filter parameters", logging.Err(err))
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid filter parameters")
 	}
-	profiles := handler.userManager.GetProfiles(filterParams)
+	profiles := handler.userManager.GetProfiles(c.Request().Context(), filterParams)
 	return c.JSON(http.StatusOK, profiles)
 }
 
@@ -375,10 +549,9 @@ func (handler *handler) GetProfilesHandler(c echo.Context) error {
 func (handler *handler) GetGroupTrainingsHandler(c echo.Context) error {
 	var filter training.GroupTrainingFilter
 	if err := c.Bind(&filter); err != nil {
-		return c.JSON(http.StatusBadRequest,
-			ErrorResponse{"Invalid filter parameters"})
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid filter parameters")
 	}
-	trainings := handler.trainingMgr.GetTrainings(filter)
+	trainings := handler.trainingMgr.GetTrainings(c.Request().Context(), filter)
 	return c.JSON(http.StatusOK, trainings)
 }
 
@@ -389,17 +562,19 @@ func (handler *handler) GetGroupTrainingsHandler(c echo.Context) error {
 // @Consumes json
 // @Produce  json
 // @Success 200 {object} training.GroupTraining
-// @Failure 400,401 {object} ErrorResponse
+// @Failure 400,401,404,500 {object} ErrorResponse
 // @Router /training/{id} [get]
 func (handler *handler) GetTrainingHandler(c echo.Context) error {
 	paramId := c.Param("id")
 	idFromPath, err := strconv.ParseInt(paramId, 10, 64)
 	if err != nil {
-		log.Error(err)
-		return c.JSON(http.StatusBadRequest,
-			ErrorResponse{"Invalid training id"})
+		logger(c).Warn("invalid training id", logging.Err(err))
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid training id")
+	}
+	t, err := handler.trainingMgr.GetTraining(c.Request().Context(), idFromPath)
+	if err != nil {
+		return err
 	}
-	t := handler.trainingMgr.GetTraining(idFromPath)
 	return c.JSON(http.StatusOK, t)
 }
 
@@ -411,18 +586,20 @@ func (handler *handler) GetTrainingHandler(c echo.Context) error {
 // @Produce  json
 // @Param Body body training.GroupTraining true "The body to add a group training"
 // @Success 200 {object} object training.GroupTraining
-// @Failure 400,401 {object} ErrorResponse
+// @Failure 400,401,422,500 {object} ErrorResponse
 // @Router /training [post]
 func (handler *handler) AddGroupTrainingHandler(c echo.Context) error {
 	var gt training.GroupTraining
 	if err := c.Bind(&gt); err != nil {
-		log.Error(err)
-		return c.JSON(http.StatusBadRequest,
-			ErrorResponse{"Invalid training parameters"})
+		logger(c).Warn("invalid training parameters", logging.Err(err))
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid training parameters")
+	}
+	if err := c.Validate(&gt); err != nil {
+		return err
 	}
-	t, err := handler.trainingMgr.AddTraining(gt)
+	t, err := handler.trainingMgr.AddTraining(c.Request().Context(), gt)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{fmt.Sprintf("Failed to add training %s", err)})
+		return err
 	}
 	return c.JSON(http.StatusOK, t)
 }
@@ -435,21 +612,29 @@ func (handler *handler) AddGroupTrainingHandler(c echo.Context) error {
 // @Produce  json
 // @Param Body body training.GroupTraining true "The body to update a group training"
 // @Success 200 {object} object training.GroupTraining
-// @Failure 400,401 {object} ErrorResponse
+// @Failure 400,401,403,404,422,500 {object} ErrorResponse
 // @Router /training/{id} [put]
 func (handler *handler) UpdateGroupTrainingHandler(c echo.Context) error {
-	code, resp := handler.checkForTrainingOwnership(c)
-	if code != http.StatusOK {
-		return c.JSON(code, resp)
+	if err := handler.checkForTrainingOwnership(c); err != nil {
+		return err
 	}
 	trainingStruct := training.GroupTraining{}
 	err := c.Bind(&trainingStruct)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{"Invalid training parameters"})
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid training parameters")
 	}
-	t, err := handler.trainingMgr.UpdateTraining(trainingStruct)
+	// the meeting of a stored training may be past already
+	if err := validation.Update(&trainingStruct); err != nil {
+		return err
+	}
+	trainingStruct.IdTraining = c.Get("training_id").(int64)
+	actor, err := handler.auditActor(c)
+	if err != nil {
+		return err
+	}
+	t, err := handler.trainingMgr.UpdateTraining(c.Request().Context(), actor, trainingStruct)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{fmt.Sprintf("Failed to update training: %s", err)})
+		return err
 	}
 	return c.JSON(http.StatusOK, t)
 }
@@ -459,17 +644,20 @@ func (handler *handler) UpdateGroupTrainingHandler(c echo.Context) error {
 // @ID deleteGroupTraining
 // @Tags Training
 // @Success 200 {string} string
-// @Failure 400,401 {object} ErrorResponse
+// @Failure 400,401,403,404,500 {object} ErrorResponse
 // @Router /training/{id} [delete]
 func (handler *handler) DeleteGroupTrainingHandler(c echo.Context) error {
-	code, resp := handler.checkForTrainingOwnership(c)
-	if code != http.StatusOK {
-		return c.JSON(code, resp)
+	if err := handler.checkForTrainingOwnership(c); err != nil {
+		return err
 	}
 	id := c.Get("training_id").(int64)
-	err := handler.trainingMgr.DeleteTraining(id)
+	actor, err := handler.auditActor(c)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, ErrorResponse{fmt.Sprintf("Failed to delete training: %s", err)})
+		return err
+	}
+	err = handler.trainingMgr.DeleteTraining(c.Request().Context(), actor, id)
+	if err != nil {
+		return err
 	}
 	return c.JSON(http.StatusOK, "Training successfully deleted")
 }
@@ -480,27 +668,18 @@ func (handler *handler) DeleteGroupTrainingHandler(c echo.Context) error {
 // @Tags Calendar
 // @Produce  json
 // @Success 200 {object} training.GroupTraining
-// @Failure 400,401 {object} ErrorResponse
+// @Failure 400,401,403,500 {object} ErrorResponse
 // @Router /user/{id}/trainings [get]
 func (handler *handler) GetUserTrainingsHandler(c echo.Context) error {
-	idUser, err := handler.getIdFromContext(c)
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, ErrorResponse{err.Error()})
-	}
 	idUserFromPath := c.Param("id")
 	numId, err := strconv.ParseInt(idUserFromPath, 10, 64)
 	if err != nil {
-		log.Error(err)
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{"Failed to parse id from path"})
+		logger(c).Warn("failed to parse id from path", logging.Err(err))
+		return echo.NewHTTPError(http.StatusBadRequest, "Failed to parse id from path")
 	}
-	if idUser != numId {
-		if !handler.checkForAdminPrivileges(idUser) {
-			return c.JSON(http.StatusForbidden, ErrorResponse{"Access denied"})
-		}
-	}
-	trainings, err := handler.userManager.GetUserTrainings(numId)
+	trainings, err := handler.userManager.GetUserTrainings(c.Request().Context(), numId)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, ErrorResponse{err.Error()})
+		return err
 	}
 	return c.JSON(http.StatusOK, trainings)
 }
@@ -515,52 +694,47 @@ func (handler *handler) GetUserTrainingsHandler(c echo.Context) error {
 // @Router /user/contacts/{id} [delete]
 // TODO: get user id from token
 func (handler *handler) RemoveFromContactsHandler(c echo.Context) error {
-	return c.JSON(http.StatusNotImplemented, "Method is not implemented")
+	return echo.NewHTTPError(http.StatusNotImplemented, "Method is not implemented")
 }
 
-func (handler *handler) checkForAdminPrivileges(id int64) bool {
-	role := handler.userManager.GetRole(id)
-	if role == admin {
-		return true
-	}
-	return false
+func (handler *handler) checkForAdminPrivileges(c echo.Context) bool {
+	return handler.hasRole(c, token.RoleAdmin)
 }
 
 func (handler *handler) getIdFromContext(c echo.Context) (int64, error) {
 	id, ok := c.Get("id_user").(string)
 	if !ok {
-		log.Error("incorrect id ", c.Get("id_user"))
-		return 0, c.JSON(http.StatusInternalServerError, "Failed to parse id from token")
+		return 0, fmt.Errorf("incorrect id %v in context", c.Get("id_user"))
 	}
 	numId, err := strconv.ParseInt(id, 10, 64)
 	if err != nil {
-		log.Error(err)
-		return 0, c.JSON(http.StatusInternalServerError, "Failed to parse id from token")
+		return 0, fmt.Errorf("failed to parse id from token: %w", err)
 	}
 	return numId, nil
 }
 
-func (handler *handler) checkForTrainingOwnership(c echo.Context) (int, ErrorResponse) {
-	paramId := c.Param("id")
-	idFromPath, err := strconv.ParseInt(paramId, 10, 64)
+// checkForTrainingOwnership lets owners, moderators and admins change the
+// training from the path and keeps its id as training_id
+func (handler *handler) checkForTrainingOwnership(c echo.Context) error {
+	idFromPath, err := strconv.ParseInt(c.Param("id"), 10, 64)
 	if err != nil {
-		log.Error(err)
-		return http.StatusBadRequest,
-			ErrorResponse{"Invalid training id"}
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid training id")
 	}
-	t := handler.trainingMgr.GetTraining(idFromPath)
 	userId, err := handler.getIdFromContext(c)
-	trainingStruct := training.GroupTraining{}
-	err = json.Unmarshal(t.Serialize(), &trainingStruct)
 	if err != nil {
-		return http.StatusInternalServerError, ErrorResponse{"Failed to get training owner"}
+		return err
 	}
-	log.Info(trainingStruct)
-	if userId != trainingStruct.Owner {
-		if !handler.checkForAdminPrivileges(userId) {
-			return http.StatusForbidden, ErrorResponse{"No rights to configure trainings"}
-		}
+	t, err := handler.trainingMgr.GetTraining(c.Request().Context(), idFromPath)
+	if err != nil {
+		return err
+	}
+	trainingStruct := training.GroupTraining{}
+	if err := json.Unmarshal(t.Serialize(), &trainingStruct); err != nil {
+		return fmt.Errorf("failed to get training owner: %w", err)
+	}
+	if userId != trainingStruct.Owner && !handler.hasRole(c, token.RoleModerator, token.RoleAdmin) {
+		return echo.NewHTTPError(http.StatusForbidden, "No rights to configure trainings")
 	}
 	c.Set("training_id", idFromPath)
-	return http.StatusOK, ErrorResponse{}
+	return nil
 }
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"SB/service/repository/logging"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+const (
+	statusOK          = "ok"
+	statusUnavailable = "unavailable"
+)
+
+// HealthHandler godoc
+// @Summary Check that the service is alive
+// @Description Liveness probe, it does not check dependencies so a restart cannot fix their outage
+// @ID healthz
+// @Tags Health
+// @Produce  json
+// @Success 200 {object} HealthResponse
+// @Router /healthz [get]
+func (handler *handler) HealthHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, HealthResponse{Status: statusOK})
+}
+
+// ReadyHandler godoc
+// @Summary Check that the service can serve requests
+// @Description Readiness probe, it checks the database connection
+// @ID readyz
+// @Tags Health
+// @Produce  json
+// @Success 200 {object} HealthResponse
+// @Failure 503 {object} HealthResponse
+// @Router /readyz [get]
+func (handler *handler) ReadyHandler(c echo.Context) error {
+	response := HealthResponse{Status: statusOK, Checks: map[string]string{}}
+	for name, err := range handler.health.Ready(c.Request().Context()) {
+		response.Checks[name] = statusOK
+		if err != nil {
+			logger(c).Error("readiness check failed", logging.String("check", name), logging.Err(err))
+			response.Checks[name] = statusUnavailable
+			response.Status = statusUnavailable
+		}
+	}
+	if response.Status != statusOK {
+		return c.JSON(http.StatusServiceUnavailable, response)
+	}
+	return c.JSON(http.StatusOK, response)
+}
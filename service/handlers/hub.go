@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"SB/service/repository/pubsub"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"gopkg.in/olahol/melody.v1"
+	"sync"
+	"time"
+)
+
+const (
+	// sessionUserKey is the key of the id of the user of a messenger session,
+	// it is set from the access token when the websocket is upgraded
+	sessionUserKey = "id_user"
+	// sessionIdKey is the key of the random id of a messenger session, it
+	// tells other nodes which session an event came from
+	sessionIdKey = "id_session"
+	// sessionFamilyKey is the key of the session of the access token a
+	// messenger session was opened with, it is empty for API keys
+	sessionFamilyKey = "family"
+	// sessionExpiresKey is the key of the expiry of the access token, the
+	// messenger session is closed then
+	sessionExpiresKey = "expires_at"
+)
+
+// hub keeps the open messenger sessions of every user, a user may be
+// connected from several devices at once. Every session has a timer
+// closing it when its access token expires.
+type hub struct {
+	mu       sync.RWMutex
+	sessions map[int64]map[*melody.Session]*time.Timer
+}
+
+func newHub() *hub {
+	return &hub{sessions: make(map[int64]map[*melody.Session]*time.Timer)}
+}
+
+func (h *hub) add(idUser int64, session *melody.Session) {
+	var timer *time.Timer
+	if expires, ok := sessionExpires(session); ok {
+		timer = time.AfterFunc(time.Until(expires), func() {
+			_ = closeSession(session, "token expired")
+		})
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sessions, ok := h.sessions[idUser]
+	if !ok {
+		sessions = make(map[*melody.Session]*time.Timer)
+		h.sessions[idUser] = sessions
+	}
+	sessions[session] = timer
+}
+
+func (h *hub) remove(idUser int64, session *melody.Session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if timer := h.sessions[idUser][session]; timer != nil {
+		timer.Stop()
+	}
+	delete(h.sessions[idUser], session)
+	if len(h.sessions[idUser]) == 0 {
+		delete(h.sessions, idUser)
+	}
+}
+
+// send writes msg to every session of the user but the session with the id
+// except, which may be empty, and returns the number of sessions written to.
+// Writes are queued by melody, so the lock is not held while the network is
+// slow.
+func (h *hub) send(idUser int64, msg []byte, except string) int {
+	h.mu.RLock()
+	sessions := make([]*melody.Session, 0, len(h.sessions[idUser]))
+	for session := range h.sessions[idUser] {
+		if except == "" || sessionId(session) != except {
+			sessions = append(sessions, session)
+		}
+	}
+	h.mu.RUnlock()
+
+	sent := 0
+	for _, session := range sessions {
+		if write(session, msg) == nil {
+			sent++
+		}
+	}
+	return sent
+}
+
+// close closes the sessions of the user opened with the revoked session and
+// returns the number of sessions closed
+func (h *hub) close(idUser int64, revocation pubsub.Revocation) int {
+	h.mu.RLock()
+	sessions := make([]*melody.Session, 0, len(h.sessions[idUser]))
+	for session := range h.sessions[idUser] {
+		if revocation.Revokes(sessionFamily(session)) {
+			sessions = append(sessions, session)
+		}
+	}
+	h.mu.RUnlock()
+
+	closed := 0
+	for _, session := range sessions {
+		if closeSession(session, "session revoked") == nil {
+			closed++
+		}
+	}
+	return closed
+}
+
+// write queues msg on the session. Melody checks that a session is open
+// before it sends to its queue but closes the queue without waiting for
+// the send, so a session closing concurrently may panic with a send on a
+// closed channel. The session is gone then, it is removed by the
+// disconnect handler.
+func write(session *melody.Session, msg []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("write to closing session: %v", r)
+		}
+	}()
+	return session.Write(msg)
+}
+
+// closeSession tells the client why its session is closed, the session is
+// removed by the disconnect handler. A session closing concurrently may
+// panic like in write.
+func closeSession(session *melody.Session, reason string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("close closing session: %v", r)
+		}
+	}()
+	return session.CloseWithMsg(melody.FormatCloseMessage(websocket.ClosePolicyViolation, reason))
+}
+
+// sessionUser returns the id of the user of a session
+func sessionUser(session *melody.Session) (int64, bool) {
+	value, ok := session.Get(sessionUserKey)
+	if !ok {
+		return 0, false
+	}
+	idUser, ok := value.(int64)
+	return idUser, ok
+}
+
+// sessionId returns the id of a session, it is unique across nodes
+func sessionId(session *melody.Session) string {
+	value, _ := session.Get(sessionIdKey)
+	id, _ := value.(string)
+	return id
+}
+
+// sessionFamily returns the session of the access token of a messenger
+// session
+func sessionFamily(session *melody.Session) string {
+	value, _ := session.Get(sessionFamilyKey)
+	family, _ := value.(string)
+	return family
+}
+
+// sessionExpires returns the expiry of the access token of a messenger
+// session, sessions of API keys do not expire
+func sessionExpires(session *melody.Session) (time.Time, bool) {
+	value, ok := session.Get(sessionExpiresKey)
+	if !ok {
+		return time.Time{}, false
+	}
+	expires, ok := value.(time.Time)
+	return expires, ok
+}
+
+// newSessionId returns 128 random bits
+func newSessionId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
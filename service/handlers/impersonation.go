@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"SB/service/repository/logging"
+	"SB/service/repository/persistence"
+	"SB/service/repository/token"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// impersonationField is the field of the banner in JSON objects
+const impersonationField = "impersonation"
+
+// ImpersonateHandler godoc
+// @Summary Act as a user to reproduce an issue
+// @Description Issues a short-lived access token of the user carrying the admin in the act claim. The start and every request with it are recorded in the audit log with impersonated_by set, routes changing credentials or deleting data are denied. Admins cannot be impersonated.
+// @Description The token is bound to a new session of the user, revoking the session ends the impersonation. JSON objects answering requests with the token carry an ImpersonationBanner in the impersonation field.
+// @ID adminImpersonate
+// @Tags Admin
+// @Produce  json
+// @Param id path int true "User id"
+// @Success 200 {object} ImpersonationResponse
+// @Failure 400,401,403,404,500 {object} ErrorResponse
+// @Router /admin/impersonate/{id} [post]
+func (handler *handler) ImpersonateHandler(c echo.Context) error {
+	actor, err := handler.auditActor(c)
+	if err != nil {
+		return err
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid user id")
+	}
+	twoFactor, _ := c.Get("two_factor").(bool)
+	tkn, err := handler.token.Impersonate(c.Request().Context(), actor, id, twoFactor, clientInfo(c, ""))
+	switch {
+	case errors.Is(err, token.ErrImpersonationDenied):
+		return echo.NewHTTPError(http.StatusForbidden, "User cannot be impersonated")
+	case errors.Is(err, persistence.ErrUserNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "No such user")
+	case err != nil:
+		logger(c).Error("failed to impersonate user", logging.Err(err))
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to impersonate user")
+	}
+	return c.JSON(http.StatusOK, ImpersonationResponse{
+		IdUser:         tkn.GetUserId(),
+		Username:       tkn.GetUsername(),
+		AccessToken:    tkn.GetId(),
+		ExpiresAt:      tkn.GetExpirationTime(),
+		ImpersonatedBy: actor.IdUser,
+		SessionId:      tkn.GetFamily(),
+	})
+}
+
+// DenyImpersonation rejects requests made with impersonation tokens before
+// access is checked, it guards routes changing credentials or deleting data
+func (handler *handler) DenyImpersonation(access echo.MiddlewareFunc) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		guarded := access(next)
+		return func(c echo.Context) error {
+			if _, ok := c.Get("actor").(string); ok {
+				return echo.NewHTTPError(http.StatusForbidden, "Not allowed while impersonating a user")
+			}
+			return guarded(c)
+		}
+	}
+}
+
+// impersonated marks the response of a request made with an impersonation
+// token and records the request once it is handled
+func (handler *handler) impersonated(c echo.Context, claims *token.CustomizedClaims, next echo.HandlerFunc) error {
+	c.Set("actor", claims.Actor.Subject)
+	c.Response().Header().Set(HeaderImpersonatedBy, claims.Actor.Subject)
+	actor, err := handler.auditActor(c)
+	if err != nil {
+		return err
+	}
+	c.Set(impersonationField, ImpersonationBanner{
+		ImpersonatedBy: actor.ImpersonatedBy,
+		IdUser:         actor.IdUser,
+		Message:        fmt.Sprintf("Admin %d is acting as user %d", actor.ImpersonatedBy, actor.IdUser),
+		ExpiresAt:      time.Unix(claims.ExpiresAt, 0).UTC(),
+	})
+	err = next(c)
+	status := c.Response().Status
+	if he, ok := err.(*echo.HTTPError); ok {
+		status = he.Code
+	}
+	handler.token.AuditImpersonation(c.Request().Context(), actor, token.ImpersonatedRequest{
+		Method: c.Request().Method,
+		Path:   c.Request().URL.Path,
+		Status: status,
+	})
+	return err
+}
+
+// JSONSerializer adds the impersonation banner to JSON objects answering
+// requests made with an impersonation token, other values are marked by the
+// X-Impersonated-By header only
+type JSONSerializer struct {
+	echo.DefaultJSONSerializer
+}
+
+func (s JSONSerializer) Serialize(c echo.Context, i interface{}, indent string) error {
+	banner, ok := c.Get(impersonationField).(ImpersonationBanner)
+	if !ok {
+		return s.DefaultJSONSerializer.Serialize(c, i, indent)
+	}
+	body, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	if len(body) < 2 || body[0] != '{' {
+		return s.DefaultJSONSerializer.Serialize(c, i, indent)
+	}
+	field, err := json.Marshal(banner)
+	if err != nil {
+		return err
+	}
+	out := append([]byte{}, body[:len(body)-1]...)
+	if len(body) > 2 {
+		out = append(out, ',')
+	}
+	out = append(out, `"`+impersonationField+`":`...)
+	out = append(out, field...)
+	out = append(out, '}')
+	if indent != "" {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, out, "", indent); err != nil {
+			return err
+		}
+		out = indented.Bytes()
+	}
+	_, err = c.Response().Write(append(out, '\n'))
+	return err
+}
@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+// JWKSHandler godoc
+// @Summary Get public keys verifying access tokens
+// @Description Access tokens have the typ at+jwt and the audience api and name their key in the kid header. New keys are listed for the max-age before they sign, keys rotated recently are listed until they expire.
+// @ID jwks
+// @Tags Auth
+// @Produce  json
+// @Success 200 {object} keys.JWKS
+// @Router /.well-known/jwks.json [get]
+func (handler *handler) JWKSHandler(c echo.Context) error {
+	// verifiers fetch the set again when they meet an unknown key id, new
+	// keys are published for the max-age before they sign tokens
+	jwks := handler.token.JWKS()
+	c.Response().Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwks.MaxAge.Seconds())))
+	return c.JSON(http.StatusOK, jwks)
+}
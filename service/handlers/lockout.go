@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"SB/service/repository/lockout"
+	"SB/service/repository/logging"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// UnlockUserHandler godoc
+// @Summary Unlock an account locked after failed logins
+// @Description Failures of IP addresses the logins came from are kept
+// @ID adminUnlockUser
+// @Tags Admin
+// @Param id path int true "User id"
+// @Success 200 {string} string "Account unlocked"
+// @Failure 400,401,403,404,500 {object} ErrorResponse
+// @Router /admin/users/{id}/unlock [post]
+func (handler *handler) UnlockUserHandler(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid user id")
+	}
+	username, err := handler.userManager.GetUsername(c.Request().Context(), id)
+	if err != nil {
+		logger(c).Error("failed to get user", logging.Err(err))
+		return echo.NewHTTPError(http.StatusNotFound, "No such user")
+	}
+	if err := handler.lockout.Unlock(c.Request().Context(), username); err != nil {
+		logger(c).Error("failed to unlock account", logging.Err(err))
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to unlock account")
+	}
+	return c.JSON(http.StatusOK, "Account unlocked")
+}
+
+// lockedResponse tells the client when to retry after too many failed
+// attempts, the response is the same for existing and unknown accounts
+func lockedResponse(c echo.Context, err error) error {
+	var locked *lockout.LockedError
+	if !errors.As(err, &locked) {
+		logger(c).Error("failed to check failed attempts", logging.Err(err))
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to login")
+	}
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(locked.RetryAfter.Seconds()))))
+	return echo.NewHTTPError(http.StatusTooManyRequests, "Too many failed attempts, try again later")
+}
+
+// forgiveAttempt takes back an attempt of the IP address that did not probe
+// for accounts
+func (handler *handler) forgiveAttempt(c echo.Context, ip string) {
+	if err := handler.lockout.Succeed(c.Request().Context(), "", ip); err != nil {
+		logger(c).Error("failed to reset failed attempt", logging.Err(err))
+	}
+}
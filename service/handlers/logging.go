@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"SB/service/repository/logging"
+	"github.com/labstack/echo/v4"
+	"time"
+)
+
+// loggerKey is the key of the request logger in echo contexts
+const loggerKey = "logger"
+
+// Logger puts a logger derived from base with the id set by RequestID into
+// the context of every request, managers and persistence log with it, so all
+// lines of a request have its id. Requests are logged when they are served
+// without their query, which may have tokens. Errors are handled here to get
+// their status.
+func Logger(base *logging.Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			l := base.With(logging.String("request_id", c.Response().Header().Get(echo.HeaderXRequestID)))
+			if id := req.Header.Get(echo.HeaderXRequestID); id != "" {
+				l = l.With(logging.String("client_request_id", id))
+			}
+			c.Set(loggerKey, l)
+			c.SetRequest(req.WithContext(logging.NewContext(req.Context(), l)))
+			started := time.Now()
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+			l.Info("request served",
+				logging.String("method", req.Method),
+				logging.String("route", routeName(c)),
+				logging.String("path", req.URL.Path),
+				logging.Int("status", int64(c.Response().Status)),
+				logging.Duration("duration", time.Since(started)),
+				logging.String("remote_ip", c.RealIP()),
+				logging.Int("bytes_out", c.Response().Size))
+			return err
+		}
+	}
+}
+
+// logger returns the logger of the request set by Logger
+func logger(c echo.Context) *logging.Logger {
+	return c.Get(loggerKey).(*logging.Logger)
+}
@@ -1,35 +1,35 @@
 package handlers
 
 import (
+	"SB/service/repository/logging"
+	"SB/service/repository/pubsub"
+	"SB/service/repository/tracing"
+	"SB/service/repository/validation"
+	"context"
 	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
-	"github.com/labstack/gommon/log"
 	"gopkg.in/olahol/melody.v1"
 	"net/http"
-	"sync"
 	"time"
 )
 
-var once sync.Once
-var m *melody.Melody
-var sessionCollection = make(map[int64]*melody.Session)
-var ctx echo.Context
-
 type (
 	Message struct {
-		IdTo      int64     `json:"id_to" example:"123"`
-		IdFrom    int64     `json:"id_from" example:"321"`
-		Content   string    `json:"content,omitempty" example:"Hello!"`
+		IdTo      int64     `json:"id_to" validate:"required" minimum:"1" example:"123"`
+		IdFrom    int64     `json:"id_from" validate:"required" minimum:"1" example:"321"`
+		Content   string    `json:"content,omitempty" validate:"required" maxLength:"4096" example:"Hello!"`
 		CreatedAt time.Time `json:"created_at,omitempty" example:"2021-11-29T00:16:01.367333+03:00"`
-		Type      string    `json:"type" example:"personal"`
+		Type      string    `json:"type" enums:"personal,group" example:"personal"`
 	}
 
 	Request struct {
-		IdTo      int64     `json:"id_to" example:"123"`
-		IdFrom    int64     `json:"id_from" example:"321"`
-		Type      string    `json:"type" example:"personal"`
+		IdTo      int64     `json:"id_to" validate:"required" minimum:"1" example:"123"`
+		IdFrom    int64     `json:"id_from" validate:"required" minimum:"1" example:"321"`
+		Type      string    `json:"type" enums:"personal,group" example:"personal"`
 		CreatedAt time.Time `json:"created_at,omitempty" example:"2021-11-29T00:16:01.367333+03:00"`
-		Status    string    `json:"status,omitempty" example:"declined"`
+		Status    string    `json:"status,omitempty" enums:"request,accepted,declined" example:"declined"`
 		Seen      bool      `json:"seen,omitempty" example:"false"`
 	}
 
@@ -40,6 +40,15 @@ type (
 		Status string `json:"status"`
 	}
 
+	// DialogUpdate is sent instead of a message too large to be shared
+	// between nodes, clients fetch the new messages of the dialog
+	DialogUpdate struct {
+		Event  string `json:"event" example:"dialog_updated"`
+		IdTo   int64  `json:"id_to" example:"123"`
+		IdFrom int64  `json:"id_from" example:"321"`
+		Type   string `json:"type" enums:"personal,group" example:"personal"`
+	}
+
 	MessagesFilter struct {
 		IdUsers      []int64   `json:"id_users"`
 		CreatedAfter time.Time `json:"created_after,omitempty"`
@@ -48,20 +57,37 @@ type (
 
 // MessengerHandler godoc
 // @Summary Send message to a user
+// @Description Upgrades to a websocket of the authenticated user. Messages sent over it are delivered to all
+// @Description devices of the recipient and the other devices of the sender, id_from is set to the user.
+// @Description Devices connected to other nodes get a DialogUpdate instead of messages too large to be shared
+// @Description between nodes and fetch the messages of the dialog. The websocket is closed with the code 1008 when
+// @Description the access token expires or its session is revoked.
 // @ID sendMessage
 // @Tags Messenger
-// @Failure 500 {object} ErrorResponse
-// @Router /messenger/dialogs [any]
+// @Failure 401,500 {object} ErrorResponse
+// @Router /messenger [get]
 func (handler *handler) MessengerHandler(c echo.Context) error {
-	once.Do(func() {
-		m = melody.New()
-	})
-	ctx = c
-	m.HandleConnect(handler.handleConnection)
-	m.HandleClose(handler.handleClose)
-	m.HandleMessage(handler.handleMessage)
+	idUser, err := handler.getIdFromContext(c)
+	if err != nil {
+		return err
+	}
+	idSession, err := newSessionId()
+	if err != nil {
+		return err
+	}
+	// the user is bound to the session before any message is read
+	keys := map[string]interface{}{sessionUserKey: idUser, sessionIdKey: idSession}
+	if family, ok := c.Get("session_id").(string); ok {
+		keys[sessionFamilyKey] = family
+	}
+	if expires, ok := c.Get("expires_at").(time.Time); ok {
+		keys[sessionExpiresKey] = expires
+	}
+	return handler.melody.HandleRequestWithKeys(c.Response().Writer, c.Request(), keys)
+}
 
-	return m.HandleRequest(c.Response().Writer, c.Request())
+func (handler *handler) CloseSessions() error {
+	return handler.melody.CloseWithMsg(melody.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down"))
 }
 
 func (msg *Message) Serialize() []byte {
@@ -74,47 +100,123 @@ func (dialog *Dialog) Serialize() []byte {
 	return res
 }
 
+func (update *DialogUpdate) Serialize() []byte {
+	res, _ := json.Marshal(update)
+	return res
+}
+
 func (req *Request) Serialize() []byte {
 	res, _ := json.Marshal(req)
 	return res
 }
 
 func (handler *handler) handleConnection(session *melody.Session) {
-	idUser, err := handler.getIdFromContext(ctx)
-	if err == nil {
-		session.Keys = make(map[string]interface{})
-		session.Keys["id_user"] = idUser
-		sessionCollection[idUser] = session
-	} else {
-		log.Error("failed to get id user")
-	}
+	messengerSessions.Add(1)
+	idUser, _ := sessionUser(session)
+	handler.hub.add(idUser, session)
+	handler.logger.For(session.Request.Context()).Debug("messenger session opened", logging.Int("id_user", idUser))
 }
 
-func (handler *handler) handleClose(session *melody.Session, code int, msg string) error {
-	delete(sessionCollection, session.Keys["id_user"].(int64))
-	return ctx.JSON(code, msg)
+func (handler *handler) handleDisconnect(session *melody.Session) {
+	messengerSessions.Add(-1)
+	idUser, _ := sessionUser(session)
+	handler.hub.remove(idUser, session)
+	handler.logger.For(session.Request.Context()).Debug("messenger session closed", logging.Int("id_user", idUser))
 }
 
 func (handler *handler) handleMessage(session *melody.Session, msg []byte) {
+	// the context of the upgrade request ends when the connection closes,
+	// messages continue the trace the client connected with
+	req := session.Request
+	ctx, span := tracing.Start(tracing.Extract(req.Context(), req.Header), "messenger.message", tracing.KindServer)
+	defer span.End()
+	idUser, _ := sessionUser(session)
 	var message Message
 	err := json.Unmarshal(msg, &message)
 	if err != nil {
-		log.Error(err)
+		handler.logger.For(ctx).Warn("invalid message", logging.Err(err))
+		span.SetError(err)
 		return
 	}
+	if message.IdFrom != 0 && message.IdFrom != idUser {
+		err := errors.New("message from another user")
+		handler.logger.For(ctx).Warn("invalid message", logging.Int("id_user", idUser), logging.Err(err))
+		span.SetError(err)
+		return
+	}
+	message.IdFrom = idUser
+	if err := validation.Struct(&message); err != nil {
+		handler.logger.For(ctx).Warn("invalid message", logging.Err(err))
+		span.SetError(err)
+		return
+	}
+	span.SetAttributes(tracing.String("message.type", message.Type))
 	message.CreatedAt = time.Now()
-	err = handler.messenger.AddMessage(&message)
+	err = handler.messenger.AddMessage(ctx, &message)
+	if err != nil {
+		handler.logger.For(ctx).Error("failed to add message", logging.Err(err))
+		span.SetError(err)
+		return
+	}
+	// other devices of the sender show the message in the dialog too
+	update := DialogUpdate{Event: "dialog_updated", IdTo: message.IdTo, IdFrom: message.IdFrom, Type: message.Type}
+	if err := handler.publish(ctx, message.Serialize(), update.Serialize(), sessionId(session), message.IdTo, message.IdFrom); err != nil {
+		span.SetError(err)
+	}
+}
+
+// notify sends payload to all devices of the users, the request is served
+// whether or not they are notified
+func (handler *handler) notify(c echo.Context, payload []byte, idUsers ...int64) {
+	_ = handler.publish(c.Request().Context(), payload, nil, "", idUsers...)
+}
+
+// publish sends payload to all devices of the users on every node but the
+// session with the id except, other nodes get fallback instead of a payload
+// too large to be shared
+func (handler *handler) publish(ctx context.Context, payload, fallback []byte, except string, idUsers ...int64) error {
+	users := make([]int64, 0, len(idUsers))
+	for _, idUser := range idUsers {
+		if !containsId(users, idUser) {
+			users = append(users, idUser)
+		}
+	}
+	err := handler.pubSub.Publish(ctx, pubsub.Event{Users: users, Except: except, Payload: payload, Fallback: fallback})
+	if err != nil {
+		handler.logger.For(ctx).Error("failed to publish messenger event", logging.Err(err))
+	}
+	return err
+}
+
+// disconnect closes the messenger sessions of the user on every node that
+// were opened with access tokens of revoked sessions
+func (handler *handler) disconnect(ctx context.Context, idUser int64, revocation pubsub.Revocation) {
+	err := handler.pubSub.Publish(ctx, pubsub.Event{Users: []int64{idUser}, Revoke: &revocation})
 	if err != nil {
-		log.Error(err)
+		handler.logger.For(ctx).Error("failed to close messenger sessions", logging.Int("id_user", idUser), logging.Err(err))
+	}
+}
+
+// deliver writes an event of any node to the sessions of this node
+func (handler *handler) deliver(event pubsub.Event) {
+	if event.Revoke != nil {
+		for _, idUser := range event.Users {
+			handler.hub.close(idUser, *event.Revoke)
+		}
 		return
 	}
-	s, ok := sessionCollection[message.IdTo]
-	if ok {
-		m.BroadcastMultiple(message.Serialize(), []*melody.Session{s})
-	} else {
-		log.Error("failed to get recipient session")
-		log.Info(sessionCollection)
+	for _, idUser := range event.Users {
+		handler.hub.send(idUser, event.Payload, event.Except)
+	}
+}
+
+func containsId(ids []int64, id int64) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
 	}
+	return false
 }
 
 // GetDialogsHandler godoc
@@ -123,16 +225,16 @@ func (handler *handler) handleMessage(session *melody.Session, msg []byte) {
 // @Tags Messenger
 // @Produce json
 // @Success 200 {object} []Request
-// @Failure 400,401 {object} ErrorResponse
+// @Failure 401,500 {object} ErrorResponse
 // @Router /messenger/dialogs [get]
 func (handler *handler) GetDialogsHandler(c echo.Context) error {
 	idUser, err := handler.getIdFromContext(c)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{err.Error()})
+		return err
 	}
-	dialogs, err := handler.messenger.GetDialogs(idUser)
+	dialogs, err := handler.messenger.GetDialogs(c.Request().Context(), idUser)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, ErrorResponse{err.Error()})
+		return err
 	}
 	return c.JSON(http.StatusOK, dialogs)
 }
@@ -145,33 +247,34 @@ func (handler *handler) GetDialogsHandler(c echo.Context) error {
 // @Produce json
 // @Param Body body Request true "The body of a request"
 // @Success 200 {string} string
-// @Failure 400,401,403,500 {object} ErrorResponse
+// @Failure 400,401,403,422,500 {object} ErrorResponse
 // @Router /user/requests [post]
 func (handler *handler) SendRequestHandler(c echo.Context) error {
 	idUser, err := handler.getIdFromContext(c)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{err.Error()})
+		return err
 	}
 	var req Request
 	err = c.Bind(&req)
 	if err != nil {
-		log.Errorf("failed to unmarshal request: %s", err.Error())
-		return c.JSON(http.StatusBadRequest, ErrorResponse{"Invalid request"})
+		logger(c).Warn("failed to unmarshal request", logging.Err(err))
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request")
+	}
+	if err := c.Validate(&req); err != nil {
+		return err
 	}
 	if idUser != req.IdFrom {
-		return c.JSON(http.StatusForbidden, ErrorResponse{"Cannot send request from another user"})
+		return echo.NewHTTPError(http.StatusForbidden, "Cannot send request from another user")
 	}
 	nullTime := time.Time{}
 	if req.CreatedAt == nullTime {
 		req.CreatedAt = time.Now()
 	}
-	err = handler.messenger.AddRequest(&req)
+	err = handler.messenger.AddRequest(c.Request().Context(), &req)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{err.Error()})
-	}
-	if s, ok := sessionCollection[req.IdTo]; ok {
-		_ = m.BroadcastOthers(req.Serialize(), s)
+		return err
 	}
+	handler.notify(c, req.Serialize(), req.IdTo, req.IdFrom)
 	return c.JSON(http.StatusOK, "Request has been sent")
 }
 
@@ -183,29 +286,30 @@ func (handler *handler) SendRequestHandler(c echo.Context) error {
 // @Consume json
 // @Produce json
 // @Success 200 {string} string
-// @Failure 400,401,500,403 {object} ErrorResponse
+// @Failure 400,401,403,422,500 {object} ErrorResponse
 // @Router /messenger/request/reply [put]
 func (handler *handler) ReplyToRequestHandler(c echo.Context) error {
 	idUser, err := handler.getIdFromContext(c)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{err.Error()})
+		return err
 	}
 	var req Request
 	err = c.Bind(&req)
 	if err != nil {
-		log.Errorf("failed to unmarshal request: %s", err.Error())
-		return c.JSON(http.StatusBadRequest, ErrorResponse{"Invalid request"})
+		logger(c).Warn("failed to unmarshal request", logging.Err(err))
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request")
+	}
+	if err := c.Validate(&req); err != nil {
+		return err
 	}
 	if idUser != req.IdTo {
-		return c.JSON(http.StatusForbidden, ErrorResponse{"Cannot reply to request of another user"})
+		return echo.NewHTTPError(http.StatusForbidden, "Cannot reply to request of another user")
 	}
-	res, err := handler.messenger.UpdateRequest(&req)
+	res, err := handler.messenger.UpdateRequest(c.Request().Context(), &req)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{err.Error()})
-	}
-	if s, ok := sessionCollection[req.IdTo]; ok {
-		_ = m.BroadcastOthers(res.Serialize(), s)
+		return err
 	}
+	handler.notify(c, res.Serialize(), req.IdFrom, req.IdTo)
 	return c.JSON(http.StatusOK, "Request has been updated")
 }
 
@@ -217,27 +321,30 @@ func (handler *handler) ReplyToRequestHandler(c echo.Context) error {
 // @Consume json
 // @Produce json
 // @Success 200 {string} string
-// @Failure 400,401,403,500 {object} ErrorResponse
+// @Failure 400,401,403,422,500 {object} ErrorResponse
 // @Router /messenger/request/seen [put]
 func (handler *handler) DeclinedRequestSeenHandler(c echo.Context) error {
 	idUser, err := handler.getIdFromContext(c)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{err.Error()})
+		return err
 	}
 	var req Request
 	err = c.Bind(&req)
 	if err != nil {
-		log.Errorf("failed to unmarshal request: %s", err.Error())
-		return c.JSON(http.StatusBadRequest, ErrorResponse{"Invalid request"})
+		logger(c).Warn("failed to unmarshal request", logging.Err(err))
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request")
+	}
+	if err := c.Validate(&req); err != nil {
+		return err
 	}
 	if idUser != req.IdFrom {
-		return c.JSON(http.StatusForbidden, ErrorResponse{"Cannot modify request of another user"})
+		return echo.NewHTTPError(http.StatusForbidden, "Cannot modify request of another user")
 	}
 	req.Seen = true
 	req.Status = "declined"
-	_, err = handler.messenger.UpdateRequest(&req)
+	_, err = handler.messenger.UpdateRequest(c.Request().Context(), &req)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{err.Error()})
+		return err
 	}
 	return c.JSON(http.StatusOK, "Request has been updated")
 }
@@ -255,23 +362,23 @@ func (handler *handler) DeclinedRequestSeenHandler(c echo.Context) error {
 func (handler *handler) GetMessagesHandler(c echo.Context) error {
 	idUser, err := handler.getIdFromContext(c)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{err.Error()})
+		return err
 	}
 	var filter MessagesFilter
 	err = c.Bind(&filter)
 	if err != nil {
-		log.Errorf("failed to unmarshal message filter: %s", err.Error())
-		return c.JSON(http.StatusBadRequest, ErrorResponse{"Invalid request"})
+		logger(c).Warn("failed to unmarshal message filter", logging.Err(err))
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request")
 	}
 	if len(filter.IdUsers) != 2 {
-		return c.JSON(http.StatusBadRequest, ErrorResponse{"You have to provide two user's IDs"})
+		return echo.NewHTTPError(http.StatusBadRequest, "You have to provide two user's IDs")
 	}
 	if idUser != filter.IdUsers[0] && idUser != filter.IdUsers[1] {
-		return c.JSON(http.StatusForbidden, ErrorResponse{"Access denied"})
+		return echo.NewHTTPError(http.StatusForbidden, "Access denied")
 	}
-	msg, err := handler.messenger.GetMessages(filter.IdUsers, filter.CreatedAfter)
+	msg, err := handler.messenger.GetMessages(c.Request().Context(), filter.IdUsers, filter.CreatedAfter)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{err.Error()})
+		return err
 	}
 
 	return c.JSON(http.StatusOK, msg)
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"SB/service/repository/metrics"
+	"crypto/subtle"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// login methods and results of loginsTotal
+const (
+	loginPassword  = "password"
+	loginTwoFactor = "two_factor"
+	loginOIDC      = "oidc"
+	loginSuccess   = "success"
+	loginFailure   = "failure"
+	loginLocked    = "locked"
+)
+
+var (
+	requestDuration = metrics.NewHistogram("sb_http_request_duration_seconds", "Time to serve HTTP requests by route and status",
+		metrics.DefaultBuckets, "method", "route", "status")
+	loginsTotal       = metrics.NewCounter("sb_logins_total", "Login attempts by method and result", "method", "result")
+	messengerSessions = metrics.NewGauge("sb_messenger_sessions", "Open messenger websockets")
+)
+
+// Metrics measures the time to serve requests by their route, so paths
+// with ids fall into one series. Errors
+// are handled here to get their status. Websockets are not measured, they
+// last as long as the connection.
+func Metrics() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.IsWebSocket() {
+				return next(c)
+			}
+			started := time.Now()
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+			requestDuration.Observe(time.Since(started).Seconds(),
+				c.Request().Method, routeName(c), strconv.Itoa(c.Response().Status))
+			return err
+		}
+	}
+}
+
+// knownRoutes caches the paths of the routes of every echo.Echo, they are
+// registered before the first request
+var knownRoutes sync.Map
+
+// routeName returns the path of the route of a request like /training/:id or
+// "unmatched" for unknown paths, which echo reports as they are
+func routeName(c echo.Context) string {
+	routes, ok := knownRoutes.Load(c.Echo())
+	if !ok {
+		paths := make(map[string]bool)
+		for _, r := range c.Echo().Routes() {
+			paths[r.Path] = true
+		}
+		routes, _ = knownRoutes.LoadOrStore(c.Echo(), paths)
+	}
+	if path := c.Path(); routes.(map[string]bool)[path] {
+		return path
+	}
+	return "unmatched"
+}
+
+// MetricsHandler serves the metrics of registry in the Prometheus text
+// format. Scrapers have to send the token as a bearer token if it is set.
+// @Summary Get metrics in the Prometheus text format
+// @Description Requires the server.metrics_token as a bearer token if it is configured. Served on server.metrics_address instead of the API port if it is set.
+// @ID metrics
+// @Tags Health
+// @Produce plain
+// @Success 200 {string} string
+// @Failure 401 {object} ErrorResponse
+// @Router /metrics [get]
+func MetricsHandler(registry *metrics.Registry, token string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if token != "" {
+			sent := c.Request().Header.Get(echo.HeaderAuthorization)
+			if subtle.ConstantTimeCompare([]byte(sent), []byte("Bearer "+token)) != 1 {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Invalid metrics token")
+			}
+		}
+		c.Response().Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+		c.Response().WriteHeader(http.StatusOK)
+		return registry.Write(c.Response())
+	}
+}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"SB/service/repository/logging"
+	"SB/service/repository/oidc"
+	"SB/service/repository/persistence"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+// OIDCProvidersHandler godoc
+// @Summary Get identity providers users can log in with
+// @ID authOIDCProviders
+// @Tags Auth
+// @Produce  json
+// @Success 200 {array} string
+// @Router /auth/oidc [get]
+func (handler *handler) OIDCProvidersHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, handler.oidc.Providers())
+}
+
+// OIDCAuthorizeHandler godoc
+// @Summary Start a login with an identity provider
+// @Description Sets a cookie with the state of the login, the code the provider returns to the web application is sent to the callback with it
+// @ID authOIDCAuthorize
+// @Tags Auth
+// @Produce  json
+// @Param provider path string true "Provider name"
+// @Success 200 {object} OIDCAuthorizationResponse
+// @Failure 404,502 {object} ErrorResponse
+// @Router /auth/oidc/{provider}/authorize [post]
+func (handler *handler) OIDCAuthorizeHandler(c echo.Context) error {
+	return handler.authorize(c, 0)
+}
+
+// OIDCCallbackHandler godoc
+// @Summary Finish a login with an identity provider
+// @Description A user is created on the first login. Users with two-factor authentication get a challenge instead of tokens.
+// @ID authOIDCCallback
+// @Tags Auth
+// @Accept  json
+// @Produce  json
+// @Param provider path string true "Provider name"
+// @Param Body body OIDCCallbackParams true "Code and state from the redirect of the provider"
+// @Success 200 {object} LoginResponse
+// @Failure 400,401,404,500 {object} ErrorResponse
+// @Router /auth/oidc/{provider}/callback [post]
+func (handler *handler) OIDCCallbackHandler(c echo.Context) error {
+	callback, params, failed := handler.callback(c)
+	if failed != nil {
+		return failed
+	}
+	user, err := handler.oidc.Login(c.Request().Context(), c.Param("provider"), callback)
+	if err != nil {
+		loginsTotal.Inc(loginOIDC, loginFailure)
+		return oidcError(c, err, "Failed to login")
+	}
+	loginsTotal.Inc(loginOIDC, loginSuccess)
+	return handler.finishLogin(c, user, params.Device)
+}
+
+// OIDCLinkHandler godoc
+// @Summary Start linking an identity provider account to the user
+// @ID authOIDCLink
+// @Tags Auth
+// @Produce  json
+// @Param provider path string true "Provider name"
+// @Success 200 {object} OIDCAuthorizationResponse
+// @Failure 401,404,502 {object} ErrorResponse
+// @Router /auth/oidc/{provider}/link [post]
+func (handler *handler) OIDCLinkHandler(c echo.Context) error {
+	id, err := handler.getIdFromContext(c)
+	if err != nil {
+		return err
+	}
+	return handler.authorize(c, id)
+}
+
+// OIDCLinkCallbackHandler godoc
+// @Summary Link an identity provider account to the user
+// @ID authOIDCLinkCallback
+// @Tags Auth
+// @Accept  json
+// @Param provider path string true "Provider name"
+// @Param Body body OIDCCallbackParams true "Code and state from the redirect of the provider"
+// @Success 200 {string} string "Identity linked"
+// @Failure 400,401,404,409,500 {object} ErrorResponse
+// @Router /auth/oidc/{provider}/link/callback [post]
+func (handler *handler) OIDCLinkCallbackHandler(c echo.Context) error {
+	id, err := handler.getIdFromContext(c)
+	if err != nil {
+		return err
+	}
+	callback, _, failed := handler.callback(c)
+	if failed != nil {
+		return failed
+	}
+	err = handler.oidc.Link(c.Request().Context(), c.Param("provider"), id, callback)
+	if errors.Is(err, persistence.ErrIdentityLinked) {
+		return echo.NewHTTPError(http.StatusConflict, "The account is already linked to a user")
+	} else if err != nil {
+		return oidcError(c, err, "Failed to link the account")
+	}
+	return c.JSON(http.StatusOK, "Identity linked")
+}
+
+// authorize sends the provider page to the client and keeps the state in a
+// cookie sent only to the callbacks
+func (handler *handler) authorize(c echo.Context, idUser int64) error {
+	auth, err := handler.oidc.Authorize(c.Request().Context(), c.Param("provider"), idUser)
+	if errors.Is(err, oidc.ErrUnknownProvider) {
+		return echo.NewHTTPError(http.StatusNotFound, "No such identity provider")
+	} else if err != nil {
+		logger(c).Error("failed to start OpenID Connect login", logging.Err(err))
+		return echo.NewHTTPError(http.StatusBadGateway, "Identity provider is unavailable")
+	}
+	c.SetCookie(&http.Cookie{
+		Name:     oidcState,
+		Value:    auth.State,
+		Expires:  auth.Expires,
+		Path:     "/auth/oidc",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return c.JSON(http.StatusOK, OIDCAuthorizationResponse{AuthorizationURL: auth.URL})
+}
+
+// callback reads the code and the state, the state cookie is removed since
+// a code can be redeemed only once
+func (handler *handler) callback(c echo.Context) (oidc.Callback, OIDCCallbackParams, error) {
+	var params OIDCCallbackParams
+	if err := c.Bind(&params); err != nil || params.Code == "" || params.State == "" {
+		return oidc.Callback{}, params, echo.NewHTTPError(http.StatusBadRequest, "Invalid callback parameters")
+	}
+	cookie, err := c.Cookie(oidcState)
+	if err != nil {
+		return oidc.Callback{}, params, echo.NewHTTPError(http.StatusBadRequest, "Login expired, please start again")
+	}
+	c.SetCookie(&http.Cookie{Name: oidcState, Path: "/auth/oidc", MaxAge: -1, HttpOnly: true})
+	return oidc.Callback{Code: params.Code, State: params.State, StateToken: cookie.Value}, params, nil
+}
+
+func oidcError(c echo.Context, err error, message string) error {
+	switch {
+	case errors.Is(err, oidc.ErrUnknownProvider):
+		return echo.NewHTTPError(http.StatusNotFound, "No such identity provider")
+	case errors.Is(err, oidc.ErrInvalidState):
+		return echo.NewHTTPError(http.StatusBadRequest, "Login expired, please start again")
+	default:
+		logger(c).Warn("OpenID Connect login failed", logging.Err(err))
+		return echo.NewHTTPError(http.StatusUnauthorized, message)
+	}
+}
@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/labstack/echo/v4"
+)
+
+// RequestID gives every request an id generated by the server and sends it
+// in X-Request-ID, the logs and the audit log record it. An X-Request-ID of
+// the client is logged as client_request_id only, clients can send any id.
+func RequestID() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Response().Header().Set(echo.HeaderXRequestID, newRequestId())
+			return next(c)
+		}
+	}
+}
+
+// newRequestId returns 128 random bits
+func newRequestId() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
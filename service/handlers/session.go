@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"SB/service/repository/logging"
+	"SB/service/repository/persistence"
+	"SB/service/repository/pubsub"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+)
+
+// GetSessionsHandler godoc
+// @Summary Get active sessions of the user
+// @ID authGetSessions
+// @Tags Auth
+// @Produce  json
+// @Success 200 {array} persistence.SessionInfo
+// @Failure 401,500 {object} ErrorResponse
+// @Router /auth/sessions [get]
+func (handler *handler) GetSessionsHandler(c echo.Context) error {
+	id, err := handler.getIdFromContext(c)
+	if err != nil {
+		return err
+	}
+	return handler.sessions(c, id)
+}
+
+// RevokeSessionHandler godoc
+// @Summary Revoke a session of the user
+// @Description Refresh tokens of the session are revoked at once and its messenger websockets are closed, its access token stays valid until it expires
+// @ID authRevokeSession
+// @Tags Auth
+// @Param id path string true "Session id"
+// @Success 200 {string} string "Session revoked"
+// @Failure 401,404,500 {object} ErrorResponse
+// @Router /auth/sessions/{id} [delete]
+func (handler *handler) RevokeSessionHandler(c echo.Context) error {
+	id, err := handler.getIdFromContext(c)
+	if err != nil {
+		return err
+	}
+	return handler.revokeSession(c, id, c.Param("id"))
+}
+
+// LogoutAllHandler godoc
+// @Summary Logout from all other devices
+// @Description Revokes every session of the user except the one of the access token, API keys stay valid
+// @ID authLogoutAll
+// @Tags Auth
+// @Produce  json
+// @Success 200 {object} RevokedSessionsResponse
+// @Failure 401,500 {object} ErrorResponse
+// @Router /auth/logout-all [post]
+func (handler *handler) LogoutAllHandler(c echo.Context) error {
+	id, err := handler.getIdFromContext(c)
+	if err != nil {
+		return err
+	}
+	current, _ := c.Get("session_id").(string)
+	return handler.revokeSessions(c, id, current, false)
+}
+
+// GetUserSessionsHandler godoc
+// @Summary Get active sessions of a user
+// @ID adminGetUserSessions
+// @Tags Admin
+// @Produce  json
+// @Param id path int true "User id"
+// @Success 200 {array} persistence.SessionInfo
+// @Failure 400,401,403,500 {object} ErrorResponse
+// @Router /admin/users/{id}/sessions [get]
+func (handler *handler) GetUserSessionsHandler(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid user id")
+	}
+	return handler.sessions(c, id)
+}
+
+// RevokeUserSessionHandler godoc
+// @Summary Revoke a session of a user
+// @ID adminRevokeUserSession
+// @Tags Admin
+// @Param id path int true "User id"
+// @Param session path string true "Session id"
+// @Success 200 {string} string "Session revoked"
+// @Failure 400,401,403,404,500 {object} ErrorResponse
+// @Router /admin/users/{id}/sessions/{session} [delete]
+func (handler *handler) RevokeUserSessionHandler(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid user id")
+	}
+	return handler.revokeSession(c, id, c.Param("session"))
+}
+
+// RevokeUserSessionsHandler godoc
+// @Summary Revoke all sessions of a user
+// @Description API keys of the user are revoked too
+// @ID adminRevokeUserSessions
+// @Tags Admin
+// @Produce  json
+// @Param id path int true "User id"
+// @Success 200 {object} RevokedSessionsResponse
+// @Failure 400,401,403,500 {object} ErrorResponse
+// @Router /admin/users/{id}/sessions [delete]
+func (handler *handler) RevokeUserSessionsHandler(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid user id")
+	}
+	return handler.revokeSessions(c, id, "", true)
+}
+
+func (handler *handler) sessions(c echo.Context, idUser int64) error {
+	sessions, err := handler.token.GetSessions(c.Request().Context(), idUser)
+	if err != nil {
+		logger(c).Error("failed to get sessions", logging.Err(err))
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get sessions")
+	}
+	current, _ := c.Get("session_id").(string)
+	for i := range sessions {
+		sessions[i].Current = current != "" && sessions[i].Id == current
+	}
+	if sessions == nil {
+		sessions = []persistence.SessionInfo{}
+	}
+	return c.JSON(http.StatusOK, sessions)
+}
+
+func (handler *handler) revokeSession(c echo.Context, idUser int64, sessionId string) error {
+	err := handler.token.RemoveSession(c.Request().Context(), idUser, sessionId)
+	if errors.Is(err, persistence.ErrNoSession) {
+		return echo.NewHTTPError(http.StatusNotFound, "No such session")
+	} else if err != nil {
+		logger(c).Error("failed to revoke session", logging.Err(err))
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to revoke session")
+	}
+	handler.disconnect(c.Request().Context(), idUser, pubsub.Revocation{Family: sessionId})
+	return c.JSON(http.StatusOK, "Session revoked")
+}
+
+func (handler *handler) revokeSessions(c echo.Context, idUser int64, except string, revokeKeys bool) error {
+	revoked, err := handler.token.RemoveAllSessions(c.Request().Context(), idUser, except, revokeKeys)
+	if err != nil {
+		logger(c).Error("failed to revoke sessions", logging.Err(err))
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to revoke sessions")
+	}
+	handler.disconnect(c.Request().Context(), idUser, pubsub.Revocation{Except: except})
+	return c.JSON(http.StatusOK, RevokedSessionsResponse{Revoked: revoked})
+}
+
+// clientInfo describes the client of the request for the list of sessions
+func clientInfo(c echo.Context, device string) persistence.ClientInfo {
+	return persistence.ClientInfo{
+		Device:    device,
+		UserAgent: c.Request().UserAgent(),
+		IP:        c.RealIP(),
+	}
+}
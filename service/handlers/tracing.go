@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"SB/service/repository/tracing"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+// Tracing starts a server span for every request, a child of the span of the
+// caller sent in the traceparent header. The span is the parent of the spans
+// of the database statements of the request. Errors are handled here to get
+// their status. Websockets are traced per message instead.
+func Tracing() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.IsWebSocket() {
+				return next(c)
+			}
+			req := c.Request()
+			route := routeName(c)
+			ctx, span := tracing.Start(tracing.Extract(req.Context(), req.Header), req.Method+" "+route, tracing.KindServer,
+				tracing.String("http.method", req.Method), tracing.String("http.route", route))
+			defer span.End()
+			c.SetRequest(req.WithContext(ctx))
+
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+			status := c.Response().Status
+			span.SetAttributes(tracing.Int("http.status_code", int64(status)))
+			if status >= http.StatusInternalServerError {
+				span.SetError(fmt.Errorf("%d %s", status, http.StatusText(status)))
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"SB/service/repository/logging"
+	"SB/service/repository/persistence"
+	"SB/service/repository/twofactor"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+// TwoFactorSetupHandler godoc
+// @Summary Start two-factor authentication setup
+// @Description Creates a TOTP secret, it is used only after it is confirmed with a code. A repeated setup replaces an unconfirmed secret.
+// @ID authTwoFactorSetup
+// @Tags Auth
+// @Produce  json
+// @Success 200 {object} TwoFactorSetupResponse
+// @Failure 401,409,500 {object} ErrorResponse
+// @Router /auth/2fa/setup [post]
+func (handler *handler) TwoFactorSetupHandler(c echo.Context) error {
+	id, err := handler.getIdFromContext(c)
+	if err != nil {
+		return err
+	}
+	enrollment, err := handler.twoFactor.Setup(c.Request().Context(), id)
+	if errors.Is(err, persistence.ErrTwoFactorEnabled) {
+		return echo.NewHTTPError(http.StatusConflict, "Two-factor authentication is already enabled")
+	} else if err != nil {
+		logger(c).Error("failed to set up two-factor authentication", logging.Err(err))
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to set up two-factor authentication")
+	}
+	return c.JSON(http.StatusOK, TwoFactorSetupResponse{Secret: enrollment.Secret, URI: enrollment.URI})
+}
+
+// TwoFactorConfirmHandler godoc
+// @Summary Enable two-factor authentication
+// @Description Confirms the secret from setup with a TOTP code and returns recovery codes. Sessions keep working, new logins require a code.
+// @ID authTwoFactorConfirm
+// @Tags Auth
+// @Accept  json
+// @Produce  json
+// @Param Body body TwoFactorCodeParams true "TOTP code from the authenticator app"
+// @Success 200 {object} RecoveryCodesResponse
+// @Failure 400,401,409,422,500 {object} ErrorResponse
+// @Router /auth/2fa/confirm [post]
+func (handler *handler) TwoFactorConfirmHandler(c echo.Context) error {
+	id, err := handler.getIdFromContext(c)
+	if err != nil {
+		return err
+	}
+	var params TwoFactorCodeParams
+	if err := c.Bind(&params); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid code")
+	}
+	if err := c.Validate(&params); err != nil {
+		return err
+	}
+	codes, err := handler.twoFactor.Confirm(c.Request().Context(), id, params.Code)
+	switch {
+	case errors.Is(err, twofactor.ErrInvalidCode):
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid code")
+	case errors.Is(err, twofactor.ErrNotSetUp):
+		return echo.NewHTTPError(http.StatusBadRequest, "Two-factor authentication is not set up")
+	case errors.Is(err, persistence.ErrTwoFactorEnabled):
+		return echo.NewHTTPError(http.StatusConflict, "Two-factor authentication is already enabled")
+	case err != nil:
+		logger(c).Error("failed to enable two-factor authentication", logging.Err(err))
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to enable two-factor authentication")
+	}
+	return c.JSON(http.StatusOK, RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// TwoFactorDisableHandler godoc
+// @Summary Disable two-factor authentication
+// @Description Requires a TOTP or recovery code. Not allowed for roles that must use two-factor authentication.
+// @ID authTwoFactorDisable
+// @Tags Auth
+// @Accept  json
+// @Param Body body TwoFactorCodeParams true "TOTP or recovery code"
+// @Success 200 {string} string "Two-factor authentication disabled"
+// @Failure 400,401,403,422,500 {object} ErrorResponse
+// @Router /auth/2fa/disable [post]
+func (handler *handler) TwoFactorDisableHandler(c echo.Context) error {
+	id, err := handler.getIdFromContext(c)
+	if err != nil {
+		return err
+	}
+	var params TwoFactorCodeParams
+	if err := c.Bind(&params); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid code")
+	}
+	if err := c.Validate(&params); err != nil {
+		return err
+	}
+	role, _ := c.Get("role").(string)
+	err = handler.twoFactor.Disable(c.Request().Context(), id, role, params.Code)
+	switch {
+	case errors.Is(err, twofactor.ErrRequired):
+		return echo.NewHTTPError(http.StatusForbidden, "Two-factor authentication is required for your role")
+	case errors.Is(err, twofactor.ErrInvalidCode):
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid code")
+	case errors.Is(err, twofactor.ErrNotSetUp):
+		return echo.NewHTTPError(http.StatusBadRequest, "Two-factor authentication is not enabled")
+	case err != nil:
+		logger(c).Error("failed to disable two-factor authentication", logging.Err(err))
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to disable two-factor authentication")
+	}
+	return c.JSON(http.StatusOK, "Two-factor authentication disabled")
+}
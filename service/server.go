@@ -1,44 +1,95 @@
 package service
 
 import (
+	"SB/service/config"
+	"SB/service/repository/account"
+	"SB/service/repository/admin"
+	"SB/service/repository/apikey"
+	"SB/service/repository/audit"
 	"SB/service/repository/db"
+	"SB/service/repository/health"
+	"SB/service/repository/lockout"
+	"SB/service/repository/logging"
 	"SB/service/repository/messenger"
+	"SB/service/repository/metrics"
+	"SB/service/repository/oidc"
+	"SB/service/repository/pubsub"
 	"SB/service/repository/token"
 	"SB/service/repository/training"
+	"SB/service/repository/twofactor"
+	"SB/service/repository/validation"
 	_ "SB/service/service/docs" // docs generated by Swag CLI
 	"SB/service/service/handlers"
+	"context"
+	"errors"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	echoSwagger "github.com/swaggo/echo-swagger"
+	"net"
+	"net/http"
+	"time"
 )
 
+// anyMethod registers a route for all HTTP methods
+const anyMethod = "*"
+
 type (
 	serverImpl struct {
 		serverApi *echo.Echo
-		address   string
-		port      string
-		handler   handlers.Handler
+		// metricsApi serves /metrics on its own listener, it is nil if the
+		// API serves it
+		metricsApi     *echo.Echo
+		config         config.Server
+		requestTimeout time.Duration
+		handler        handlers.Handler
+		// logger is the base of the loggers of requests
+		logger *logging.Logger
 	}
 
 	Server interface {
-		Start()
-		Stop()
+		// Start serves the API until Stop is called, it returns nil then
+		Start() error
+		// Stop stops accepting connections, waits for the requests being
+		// served until ctx is done and closes the websockets
+		Stop(ctx context.Context) error
 		ServerApi() *echo.Echo
 	}
+
+	// route describes an endpoint and who may call it. Routes with nil
+	// access are public, otherwise the request is authenticated by
+	// AccessMiddleware and then checked by access. API keys may call only
+	// routes with a scope the key has.
+	route struct {
+		method  string
+		path    string
+		handler echo.HandlerFunc
+		access  echo.MiddlewareFunc
+		scope   string
+	}
 )
 
-func NewServer(address string, port string, usrMgr db.UserManager, tknMgr token.TokenManager, trainingMgr training.TrainingManager, messenger messenger.Messenger) Server {
-	handler := handlers.NewHandler(usrMgr, tknMgr, trainingMgr, messenger)
-	return &serverImpl{
-		address: address,
-		port:    port,
-		handler: handler,
+func NewServer(cfg *config.Config, usrMgr db.UserManager, tknMgr token.TokenManager, accountMgr account.AccountManager, twoFactorMgr twofactor.TwoFactorManager,
+	guard lockout.Guard, oidcMgr oidc.Manager, apiKeyMgr apikey.Manager, adminMgr admin.AdminManager, auditLog audit.Log, trainingMgr training.TrainingManager, messenger messenger.Messenger, checker health.Checker, pubSub pubsub.PubSub, logger *logging.Logger) Server {
+	handler := handlers.NewHandler(usrMgr, tknMgr, accountMgr, twoFactorMgr, guard, oidcMgr, apiKeyMgr, adminMgr, auditLog, trainingMgr, messenger, checker, pubSub, cfg.Messenger, logger)
+	srv := &serverImpl{
+		config:         cfg.Server,
+		requestTimeout: cfg.Database.RequestTimeout,
+		handler:        handler,
+		logger:         logger,
+	}
+	srv.serverApi = srv.newApi()
+	if cfg.Server.MetricsAddress != "" {
+		srv.metricsApi = srv.newMetricsApi()
 	}
+	return srv
 }
 
 //Start run REST server
-func startServer(e *echo.Echo, address string, port string) {
-	e.Logger.Fatal(e.Start(address + ":" + port))
+func startServer(e *echo.Echo, address string) error {
+	if err := e.Start(address); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
 }
 
 // @title SB API
@@ -46,49 +97,203 @@ func startServer(e *echo.Echo, address string, port string) {
 
 // @host localhost:3000
 // @BasePath /
-func (srv *serverImpl) Start() {
+func (srv *serverImpl) Start() error {
+	address := srv.config.Address + ":" + srv.config.Port
+	if srv.metricsApi == nil {
+		return startServer(srv.serverApi, address)
+	}
+	errs := make(chan error, 2)
+	go func() {
+		errs <- startServer(srv.metricsApi, srv.config.MetricsAddress)
+	}()
+	go func() {
+		errs <- startServer(srv.serverApi, address)
+	}()
+	// a listener failing fails the server, Stop stops the other one
+	if err := <-errs; err != nil {
+		return err
+	}
+	return <-errs
+}
+
+// ipExtractor takes the client IP address from X-Forwarded-For only if the
+// request came through one of the proxies, echo would trust any private
+// address by default
+func ipExtractor(proxies []string) echo.IPExtractor {
+	if len(proxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, proxy := range proxies {
+		// validated with the configuration
+		_, ipRange, _ := net.ParseCIDR(proxy)
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+func (srv *serverImpl) newApi() *echo.Echo {
 	e := echo.New()
+	e.HTTPErrorHandler = handlers.ErrorHandler(srv.logger)
+	// the lockout and the audit log key on the client IP address
+	e.IPExtractor = ipExtractor(srv.config.TrustedProxies)
+	e.Validator = validation.New()
+	// responses to impersonated requests carry a banner
+	e.JSONSerializer = handlers.JSONSerializer{}
 
-	e.Use(middleware.Logger())
+	// the request id is recorded in the audit log
+	e.Use(handlers.RequestID())
+	e.Use(handlers.Logger(srv.logger))
 	e.Use(middleware.Recover())
+	e.Use(handlers.Tracing())
+	e.Use(handlers.Deadline(srv.requestTimeout))
+	e.Use(handlers.Metrics())
 
-	e.Use(middleware.CORS())
+	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins:  srv.config.CorsOrigins,
+		ExposeHeaders: []string{handlers.HeaderImpersonatedBy, echo.HeaderXRequestID},
+	}))
 	e.GET("/swagger/*", echoSwagger.WrapHandler)
+	if srv.config.MetricsAddress == "" {
+		e.GET("/metrics", handlers.MetricsHandler(metrics.Default, srv.config.MetricsToken))
+	}
+
+	for _, r := range srv.routes() {
+		var m []echo.MiddlewareFunc
+		if r.access != nil {
+			m = append(m, srv.handler.AccessMiddleware, srv.handler.RequireScope(r.scope), r.access)
+		}
+		if r.method == anyMethod {
+			e.Any(r.path, r.handler, m...)
+		} else {
+			e.Add(r.method, r.path, r.handler, m...)
+		}
+	}
+	return e
+}
+
+// routes is the permission table of the API
+func (srv *serverImpl) routes() []route {
+	h := srv.handler
+	var (
+		public    echo.MiddlewareFunc
+		anyRole   = h.RequireRole(token.Roles...)
+		// routes a user has to reach to set up a required second factor
+		enrolling = h.RequireRoleSingleFactor(token.Roles...)
+		admin     = h.RequireRole(token.RoleAdmin)
+		selfAdmin = h.RequireSelfOrRole("id", token.RoleAdmin)
+		selfCoach = h.RequireSelfOrRole("id", token.RoleCoach, token.RoleAdmin)
+		// routes changing credentials or deleting data, admins impersonating
+		// a user cannot call them
+		personal          = h.DenyImpersonation(anyRole)
+		personalEnrolling = h.DenyImpersonation(enrolling)
+	)
+	// routes API keys cannot call
+	const noKeys = ""
+
+	return []route{
+		{http.MethodPost, "/auth/login", h.LoginHandler, public, noKeys},
+		{http.MethodPost, "/auth/login/2fa", h.LoginTwoFactorHandler, public, noKeys},
+		{http.MethodPost, "/auth/logout", h.LogoutHandler, personalEnrolling, noKeys},
+		{http.MethodPost, "/auth/signup", h.SignupHandler, public, noKeys},
+		// refresh is authenticated by the refresh token cookie
+		{anyMethod, "/auth/refresh", h.RefreshToken, public, noKeys},
+		{http.MethodPost, "/auth/password/forgot", h.ForgotPasswordHandler, public, noKeys},
+		{http.MethodPost, "/auth/password/reset", h.ResetPasswordHandler, public, noKeys},
+		{http.MethodPost, "/auth/verify-email", h.VerifyEmailHandler, public, noKeys},
+		{http.MethodPost, "/auth/2fa/setup", h.TwoFactorSetupHandler, personalEnrolling, noKeys},
+		{http.MethodPost, "/auth/2fa/confirm", h.TwoFactorConfirmHandler, personalEnrolling, noKeys},
+		{http.MethodPost, "/auth/2fa/disable", h.TwoFactorDisableHandler, personal, noKeys},
+		{http.MethodGet, "/auth/oidc", h.OIDCProvidersHandler, public, noKeys},
+		{http.MethodPost, "/auth/oidc/:provider/authorize", h.OIDCAuthorizeHandler, public, noKeys},
+		{http.MethodPost, "/auth/oidc/:provider/callback", h.OIDCCallbackHandler, public, noKeys},
+		{http.MethodPost, "/auth/oidc/:provider/link", h.OIDCLinkHandler, personal, noKeys},
+		{http.MethodPost, "/auth/oidc/:provider/link/callback", h.OIDCLinkCallbackHandler, personal, noKeys},
+		// keys cannot manage keys, so a leaked key cannot create new ones
+		{http.MethodGet, "/auth/api-keys", h.GetAPIKeysHandler, anyRole, noKeys},
+		{http.MethodPost, "/auth/api-keys", h.CreateAPIKeyHandler, personal, noKeys},
+		{http.MethodDelete, "/auth/api-keys/:id", h.RevokeAPIKeyHandler, personal, noKeys},
+		{http.MethodGet, "/auth/sessions", h.GetSessionsHandler, anyRole, noKeys},
+		{http.MethodDelete, "/auth/sessions/:id", h.RevokeSessionHandler, personal, noKeys},
+		{http.MethodPost, "/auth/logout-all", h.LogoutAllHandler, personal, noKeys},
+		// other services verify access tokens with these keys
+		{http.MethodGet, "/.well-known/jwks.json", h.JWKSHandler, public, noKeys},
+		// probes of load balancers and orchestrators
+		{http.MethodGet, "/healthz", h.HealthHandler, public, noKeys},
+		{http.MethodGet, "/readyz", h.ReadyHandler, public, noKeys},
 
-	e.POST("/auth/login", srv.handler.LoginHandler)
-	e.POST("/auth/logout", srv.handler.LogoutHandler, srv.handler.AccessMiddleware)
-	e.POST("/auth/signup", srv.handler.SignupHandler)
-	e.Any("/auth/refresh", srv.handler.RefreshToken)
-
-	user := e.Group("/user")
-	user.DELETE("/:id", srv.handler.DeleteUserHandler, srv.handler.AccessMiddleware)
-
-	profile := user.Group("/profile")
-	profile.GET("/:id", srv.handler.GetUserProfileHandler, srv.handler.AccessMiddleware)
-	profile.PUT("", srv.handler.UpdateUserProfileHandler, srv.handler.AccessMiddleware)
-
-	groupTraining := e.Group("/training")
-	groupTraining.GET("/profiles", srv.handler.GetProfilesHandler, srv.handler.AccessMiddleware)
-	groupTraining.GET("", srv.handler.GetGroupTrainingsHandler, srv.handler.AccessMiddleware)
-	groupTraining.POST("", srv.handler.AddGroupTrainingHandler, srv.handler.AccessMiddleware)
-	groupTraining.GET("/:id", srv.handler.GetTrainingHandler, srv.handler.AccessMiddleware)
-	groupTraining.PUT("/:id", srv.handler.UpdateGroupTrainingHandler, srv.handler.AccessMiddleware)
-	groupTraining.DELETE("/:id", srv.handler.DeleteGroupTrainingHandler, srv.handler.AccessMiddleware)
-
-	msg := e.Group("/messenger")
-	msg.Any("", srv.handler.MessengerHandler, srv.handler.AccessMiddleware)
-	msg.GET("/dialogs", srv.handler.GetDialogsHandler, srv.handler.AccessMiddleware)
-	msg.GET("/messages", srv.handler.GetMessagesHandler, srv.handler.AccessMiddleware)
-	msg.POST("/request", srv.handler.SendRequestHandler, srv.handler.AccessMiddleware)
-	msg.PUT("/request/reply", srv.handler.ReplyToRequestHandler, srv.handler.AccessMiddleware)
-	msg.PUT("/request/seen", srv.handler.DeclinedRequestSeenHandler, srv.handler.AccessMiddleware)
-
-	srv.serverApi = e
-	startServer(e, srv.address, srv.port)
+		{http.MethodDelete, "/user/:id", h.DeleteUserHandler, h.DenyImpersonation(selfAdmin), noKeys},
+		{http.MethodGet, "/user/:id/trainings", h.GetUserTrainingsHandler, selfCoach, apikey.ScopeTrainingsRead},
+		{http.MethodGet, "/user/profile/:id", h.GetUserProfileHandler, anyRole, apikey.ScopeProfileRead},
+		// users may only update their own profile unless they are admins,
+		// the id is taken from the body and checked by the handler
+		{http.MethodPut, "/user/profile", h.UpdateUserProfileHandler, anyRole, apikey.ScopeProfileWrite},
+
+		{http.MethodGet, "/training/profiles", h.GetProfilesHandler, anyRole, apikey.ScopeProfileRead},
+		{http.MethodGet, "/training", h.GetGroupTrainingsHandler, anyRole, apikey.ScopeTrainingsRead},
+		{http.MethodPost, "/training", h.AddGroupTrainingHandler, anyRole, apikey.ScopeTrainingsWrite},
+		{http.MethodGet, "/training/:id", h.GetTrainingHandler, anyRole, apikey.ScopeTrainingsRead},
+		// owners, moderators and admins, ownership is checked by the handler
+		{http.MethodPut, "/training/:id", h.UpdateGroupTrainingHandler, anyRole, apikey.ScopeTrainingsWrite},
+		{http.MethodDelete, "/training/:id", h.DeleteGroupTrainingHandler, personal, apikey.ScopeTrainingsWrite},
+
+		{http.MethodGet, "/admin/users/:id/sessions", h.GetUserSessionsHandler, admin, noKeys},
+		{http.MethodDelete, "/admin/users/:id/sessions", h.RevokeUserSessionsHandler, admin, noKeys},
+		{http.MethodDelete, "/admin/users/:id/sessions/:session", h.RevokeUserSessionHandler, admin, noKeys},
+		{http.MethodPost, "/admin/users/:id/unlock", h.UnlockUserHandler, admin, noKeys},
+		{http.MethodPost, "/admin/impersonate/:id", h.ImpersonateHandler, admin, noKeys},
+		{http.MethodGet, "/admin/users", h.SearchUsersHandler, admin, noKeys},
+		{http.MethodPut, "/admin/users/:id/role", h.SetRoleHandler, admin, noKeys},
+		{http.MethodPost, "/admin/users/:id/ban", h.BanUserHandler, admin, noKeys},
+		{http.MethodDelete, "/admin/users/:id/ban", h.UnbanUserHandler, admin, noKeys},
+		{http.MethodGet, "/admin/sports", h.GetSportsHandler, admin, noKeys},
+		{http.MethodPost, "/admin/sports", h.AddSportHandler, admin, noKeys},
+		{http.MethodPut, "/admin/sports/:id", h.RenameSportHandler, admin, noKeys},
+		{http.MethodDelete, "/admin/sports/:id", h.DeleteSportHandler, admin, noKeys},
+		{http.MethodPost, "/admin/sports/:id/merge", h.MergeSportsHandler, admin, noKeys},
+		{http.MethodGet, "/admin/levels", h.GetLevelsHandler, admin, noKeys},
+		{http.MethodPost, "/admin/levels", h.AddLevelHandler, admin, noKeys},
+		{http.MethodPut, "/admin/levels/:id", h.UpdateLevelHandler, admin, noKeys},
+		{http.MethodDelete, "/admin/levels/:id", h.DeleteLevelHandler, admin, noKeys},
+		{http.MethodDelete, "/admin/trainings/:id", h.AdminDeleteTrainingHandler, admin, noKeys},
+		{http.MethodDelete, "/admin/messages/:id", h.AdminDeleteMessageHandler, admin, noKeys},
+		{http.MethodGet, "/admin/audit", h.GetAuditLogHandler, admin, noKeys},
+		{http.MethodGet, "/admin/audit/export", h.ExportAuditLogHandler, admin, noKeys},
+
+		{anyMethod, "/messenger", h.MessengerHandler, anyRole, apikey.ScopeMessagesWrite},
+		{http.MethodGet, "/messenger/dialogs", h.GetDialogsHandler, anyRole, apikey.ScopeMessagesRead},
+		{http.MethodGet, "/messenger/messages", h.GetMessagesHandler, anyRole, apikey.ScopeMessagesRead},
+		{http.MethodPost, "/messenger/request", h.SendRequestHandler, anyRole, apikey.ScopeMessagesWrite},
+		{http.MethodPut, "/messenger/request/reply", h.ReplyToRequestHandler, anyRole, apikey.ScopeMessagesWrite},
+		{http.MethodPut, "/messenger/request/seen", h.DeclinedRequestSeenHandler, anyRole, apikey.ScopeMessagesWrite},
+	}
 }
 
-func (srv *serverImpl) Stop() {
-	srv.serverApi.Close()
+func (srv *serverImpl) Stop(ctx context.Context) error {
+	if srv.metricsApi != nil {
+		// scrapes are short, they are not waited for
+		_ = srv.metricsApi.Close()
+	}
+	// websockets are hijacked connections, Shutdown does not wait for them
+	err := srv.serverApi.Shutdown(ctx)
+	if closeErr := srv.handler.CloseSessions(); closeErr != nil {
+		srv.logger.Error("failed to close websockets", logging.Err(closeErr))
+	}
+	if err != nil {
+		// requests still running when ctx is done are dropped
+		_ = srv.serverApi.Close()
+	}
+	return err
+}
+
+// newMetricsApi serves /metrics only, scrapes are not counted in the
+// request metrics of the API
+func (srv *serverImpl) newMetricsApi() *echo.Echo {
+	e := echo.New()
+	e.HTTPErrorHandler = handlers.ErrorHandler(srv.logger)
+	e.Use(middleware.Recover())
+	e.GET("/metrics", handlers.MetricsHandler(metrics.Default, srv.config.MetricsToken))
+	return e
 }
 
 func (srv *serverImpl) ServerApi() *echo.Echo {
@@ -0,0 +1,90 @@
+package tests
+
+import (
+	"SB/service/repository/persistence"
+	"SB/service/service/tests/mocks"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+)
+
+var linkPattern = regexp.MustCompile(`https?://\S+`)
+
+// tokenFromMail extracts the token from the link in the last sent e-mail
+func tokenFromMail(t *testing.T, env *environment) string {
+	link, err := url.Parse(linkPattern.FindString(env.mailer.Last().Body))
+	assert.NoError(t, err)
+	return link.Query().Get("token")
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestPasswordReset(t *testing.T) {
+	env, teardown := configureEnvironment(t)
+	defer teardown()
+
+	t.Run("unknown e-mail", func(t *testing.T) {
+		env.mock.ExpectQuery(regexp.QuoteMeta(`SELECT id_user, role FROM "users" WHERE username=$1`)).WithArgs("nobody@example.com").
+			WillReturnRows(env.mock.NewRows([]string{"id_user", "role"}))
+
+		response := post(env.api, "/auth/password/forgot", JSON{"email": "nobody@example.com"})
+		assert.Equal(t, http.StatusOK, response.Code)
+		env.account.Wait()
+		assert.Empty(t, env.mailer.Sent)
+	})
+
+	var token string
+	t.Run("forgot", func(t *testing.T) {
+		mocks.ExpectMockGetUserAuthParams(env.mock)
+		mocks.ExpectAddAccountToken(env.mock, 1, persistence.PurposePasswordReset)
+
+		response := post(env.api, "/auth/password/forgot", JSON{"email": "test@example.com"})
+		assert.Equal(t, http.StatusOK, response.Code)
+		env.account.Wait()
+		assert.Equal(t, "test@example.com", env.mailer.Last().To)
+		token = tokenFromMail(t, env)
+		assert.NotEmpty(t, token)
+	})
+	t.Run("weak password", func(t *testing.T) {
+		response := post(env.api, "/auth/password/reset", JSON{"token": token, "password": "123"})
+		assert.Equal(t, http.StatusBadRequest, response.Code)
+	})
+	t.Run("reset", func(t *testing.T) {
+		mocks.ExpectUseAccountToken(env.mock, hashToken(token), persistence.PurposePasswordReset, 1)
+		mocks.ExpectResetPassword(env.mock, 1)
+
+		response := post(env.api, "/auth/password/reset", JSON{"token": token, "password": "correct horse"})
+		assert.Equal(t, http.StatusOK, response.Code)
+	})
+	t.Run("token is single-use", func(t *testing.T) {
+		mocks.ExpectUseAccountToken(env.mock, hashToken(token), persistence.PurposePasswordReset)
+		env.mock.ExpectRollback()
+
+		response := post(env.api, "/auth/password/reset", JSON{"token": token, "password": "correct horse"})
+		assert.Equal(t, http.StatusBadRequest, response.Code)
+	})
+}
+
+func TestVerifyEmail(t *testing.T) {
+	env, teardown := configureEnvironment(t)
+	defer teardown()
+
+	mocks.ExpectUseAccountToken(env.mock, hashToken("token"), persistence.PurposeEmailVerification, 1)
+	env.mock.ExpectExec(regexp.QuoteMeta(`UPDATE users SET email_verified_at = now()`)).WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	env.mock.ExpectCommit()
+
+	response := post(env.api, "/auth/verify-email", JSON{"token": "token"})
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	response = post(env.api, "/auth/verify-email", JSON{})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
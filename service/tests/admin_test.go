@@ -0,0 +1,156 @@
+package tests
+
+import (
+	"SB/service/repository/audit"
+	"SB/service/repository/token"
+	"SB/service/service/tests/mocks"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAdminUsers(t *testing.T) {
+	env, teardown := configureEnvironment(t)
+	defer teardown()
+
+	userToken := env.accessToken(t, 1, token.RoleUser)
+	adminToken := env.accessToken(t, 3, token.RoleAdmin)
+
+	t.Run("search users", func(t *testing.T) {
+		mocks.ExpectSearchUsers(env.mock, 41, "%te\\_st%", "%te\\_st%", "%te\\_st%", "%te\\_st%", token.RoleUser)
+
+		response := getAuthorized(env.api, adminToken, "/admin/users?query=te_st&role=user&page=3&per_page=20")
+		assert.Equal(t, http.StatusOK, response.Code)
+		var page JSON
+		assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &page))
+		assert.Equal(t, float64(41), page["total"])
+		assert.Equal(t, float64(3), page["page"])
+		assert.Len(t, page["users"], 1)
+	})
+	t.Run("invalid search", func(t *testing.T) {
+		response := getAuthorized(env.api, adminToken, "/admin/users?per_page=101")
+		assert.Equal(t, http.StatusBadRequest, response.Code)
+
+		response = getAuthorized(env.api, adminToken, "/admin/users?role=owner")
+		assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+	})
+	t.Run("change role", func(t *testing.T) {
+		mocks.ExpectGetUser(env.mock, 1, token.RoleUser)
+		mocks.ExpectSetRole(env.mock, 1, token.RoleCoach, true)
+		mocks.ExpectAddAuditEntry(env.mock, audit.ActionRoleChanged)
+		response := putAuthorized(env.api, adminToken, "/admin/users/1/role", JSON{"role": "coach"})
+		assert.Equal(t, http.StatusOK, response.Code)
+
+		mocks.ExpectGetUser(env.mock, 5, "")
+		response = putAuthorized(env.api, adminToken, "/admin/users/5/role", JSON{"role": "coach"})
+		assert.Equal(t, http.StatusNotFound, response.Code)
+
+		response = putAuthorized(env.api, adminToken, "/admin/users/1/role", JSON{"role": "owner"})
+		assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+
+		response = putAuthorized(env.api, adminToken, "/admin/users/3/role", JSON{"role": "user"})
+		assert.Equal(t, http.StatusForbidden, response.Code)
+	})
+	t.Run("ban revokes sessions", func(t *testing.T) {
+		mocks.ExpectBanUser(env.mock, 1, "Spam", true)
+		mocks.ExpectAddAuditEntry(env.mock, audit.ActionUserBanned)
+		mocks.ExpectRevokeUserSessions(env.mock, 1, "", 2, true)
+
+		response := postAuthorized(env.api, adminToken, "/admin/users/1/ban", JSON{"reason": " Spam "})
+		assert.Equal(t, http.StatusOK, response.Code)
+	})
+	t.Run("invalid bans", func(t *testing.T) {
+		response := postAuthorized(env.api, adminToken, "/admin/users/3/ban", JSON{"reason": "Spam"})
+		assert.Equal(t, http.StatusForbidden, response.Code)
+
+		response = postAuthorized(env.api, adminToken, "/admin/users/1/ban", JSON{"until": time.Now().Add(-time.Hour)})
+		assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+	})
+	t.Run("banned users cannot log in", func(t *testing.T) {
+		mocks.ExpectGetPasswordHash(env.mock)
+		mocks.ExpectUpdatePasswordHash(env.mock)
+		mocks.ExpectMockGetUserAuthParams(env.mock)
+		mocks.ExpectGetTOTP(env.mock, 1, "", false)
+		mocks.ExpectGetBan(env.mock, 1, "Spam")
+
+		response := post(env.api, "/auth/login", JSON{"username": "test@example.com", "password": "123"})
+		assert.Equal(t, http.StatusForbidden, response.Code)
+		assert.Contains(t, response.Body.String(), "Spam")
+	})
+	t.Run("unban", func(t *testing.T) {
+		mocks.ExpectUnbanUser(env.mock, 1, true)
+		mocks.ExpectAddAuditEntry(env.mock, audit.ActionUserUnbanned)
+		response := delAuthorized(env.api, adminToken, "/admin/users/1/ban")
+		assert.Equal(t, http.StatusOK, response.Code)
+
+		mocks.ExpectUnbanUser(env.mock, 5, false)
+		response = delAuthorized(env.api, adminToken, "/admin/users/5/ban")
+		assert.Equal(t, http.StatusNotFound, response.Code)
+	})
+	t.Run("only admins", func(t *testing.T) {
+		response := getAuthorized(env.api, userToken, "/admin/users")
+		assert.Equal(t, http.StatusForbidden, response.Code)
+
+		response = postAuthorized(env.api, userToken, "/admin/users/2/ban", JSON{"reason": "Spam"})
+		assert.Equal(t, http.StatusForbidden, response.Code)
+	})
+}
+
+func TestAdminContent(t *testing.T) {
+	env, teardown := configureEnvironment(t)
+	defer teardown()
+
+	adminToken := env.accessToken(t, 3, token.RoleAdmin)
+
+	t.Run("add sport", func(t *testing.T) {
+		mocks.ExpectAddSport(env.mock, "Padel", false)
+		mocks.ExpectAddAuditEntry(env.mock, audit.ActionSportAdded)
+		response := postAuthorized(env.api, adminToken, "/admin/sports", JSON{"name": "Padel"})
+		assert.Equal(t, http.StatusCreated, response.Code)
+
+		mocks.ExpectAddSport(env.mock, "Padel", true)
+		response = postAuthorized(env.api, adminToken, "/admin/sports", JSON{"name": "Padel"})
+		assert.Equal(t, http.StatusConflict, response.Code)
+
+		response = postAuthorized(env.api, adminToken, "/admin/sports", JSON{"name": " "})
+		assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+	})
+	t.Run("delete sport", func(t *testing.T) {
+		mocks.ExpectDeleteSport(env.mock, 7, 0)
+		mocks.ExpectAddAuditEntry(env.mock, audit.ActionSportDeleted)
+		response := delAuthorized(env.api, adminToken, "/admin/sports/7")
+		assert.Equal(t, http.StatusOK, response.Code)
+
+		mocks.ExpectDeleteSport(env.mock, 1, 12)
+		response = delAuthorized(env.api, adminToken, "/admin/sports/1")
+		assert.Equal(t, http.StatusConflict, response.Code)
+	})
+	t.Run("merge sports", func(t *testing.T) {
+		mocks.ExpectMergeSports(env.mock, 8, 1)
+		mocks.ExpectAddAuditEntry(env.mock, audit.ActionSportsMerged)
+		response := postAuthorized(env.api, adminToken, "/admin/sports/8/merge", JSON{"into": 1})
+		assert.Equal(t, http.StatusOK, response.Code)
+
+		response = postAuthorized(env.api, adminToken, "/admin/sports/1/merge", JSON{"into": 1})
+		assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+	})
+	t.Run("delete training", func(t *testing.T) {
+		mocks.ExpectGetGroupTraining(env.mock, 4, true)
+		mocks.ExpectDeleteGroupTraining(env.mock, 4, true)
+		mocks.ExpectAddAuditEntry(env.mock, audit.ActionTrainingDeleted)
+		response := delAuthorized(env.api, adminToken, "/admin/trainings/4")
+		assert.Equal(t, http.StatusOK, response.Code)
+
+		mocks.ExpectGetGroupTraining(env.mock, 5, false)
+		response = delAuthorized(env.api, adminToken, "/admin/trainings/5")
+		assert.Equal(t, http.StatusNotFound, response.Code)
+	})
+	t.Run("delete message", func(t *testing.T) {
+		mocks.ExpectDeleteMessage(env.mock, 9, true)
+		mocks.ExpectAddAuditEntry(env.mock, audit.ActionMessageDeleted)
+		response := delAuthorized(env.api, adminToken, "/admin/messages/9")
+		assert.Equal(t, http.StatusOK, response.Code)
+	})
+}
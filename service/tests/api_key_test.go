@@ -0,0 +1,124 @@
+package tests
+
+import (
+	"SB/service/repository/token"
+	"SB/service/service/tests/mocks"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const apiKey = "sbk_m4zdgnbr_q3k7xw2mzf8yc0vn7bt5rj9hl4sd6ga1"
+
+func withAPIKey(key string) http.Header {
+	return http.Header{"X-Api-Key": {key}}
+}
+
+// expectAPIKey expects apiKey of user 1 to be used with the scopes
+func (env *environment) expectAPIKey(scopes string) {
+	mocks.ExpectGetAPIKey(env.mock, apiKey, token.RoleUser, scopes)
+	mocks.ExpectTouchAPIKey(env.mock, 1)
+}
+
+func TestAPIKeys(t *testing.T) {
+	env, teardown := configureEnvironment(t)
+	defer teardown()
+
+	userToken := env.accessToken(t, 1, token.RoleUser)
+
+	t.Run("create a key", func(t *testing.T) {
+		mocks.ExpectAddAPIKey(env.mock, 1, "Club website", "trainings:read messages:write", false, 0, 10)
+
+		response := postAuthorized(env.api, userToken, "/auth/api-keys", JSON{
+			"name":   "Club website",
+			"scopes": []string{"trainings:read", "messages:write"},
+		})
+		assert.Equal(t, http.StatusCreated, response.Code)
+		var created JSON
+		assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &created))
+		key, _ := created["key"].(string)
+		prefix, _ := created["prefix"].(string)
+		assert.True(t, strings.HasPrefix(key, prefix+"_"), "key %q must start with prefix %q", key, prefix)
+		assert.True(t, strings.HasPrefix(prefix, "sbk_"))
+		assert.Equal(t, []interface{}{"trainings:read", "messages:write"}, created["scopes"])
+	})
+	t.Run("invalid scopes", func(t *testing.T) {
+		response := postAuthorized(env.api, userToken, "/auth/api-keys", JSON{"name": "Script", "scopes": []string{"users:delete"}})
+		assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+
+		response = postAuthorized(env.api, userToken, "/auth/api-keys", JSON{"name": "Script"})
+		assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+	})
+	t.Run("too many keys", func(t *testing.T) {
+		mocks.ExpectAddAPIKey(env.mock, 1, "Script", "trainings:read", false, 10, 10)
+
+		response := postAuthorized(env.api, userToken, "/auth/api-keys", JSON{"name": "Script", "scopes": []string{"trainings:read"}})
+		assert.Equal(t, http.StatusConflict, response.Code)
+	})
+	t.Run("key with the scope", func(t *testing.T) {
+		env.expectAPIKey("trainings:read messages:write")
+		mocks.ExpectGetUserTrainings(env.mock, 1)
+
+		response := do(env.api, http.MethodGet, "/user/1/trainings", withAPIKey(apiKey))
+		assert.Equal(t, http.StatusOK, response.Code)
+	})
+	t.Run("key without the scope", func(t *testing.T) {
+		env.expectAPIKey("trainings:read")
+
+		response := do(env.api, http.MethodPost, "/training", withAPIKey(apiKey))
+		assert.Equal(t, http.StatusForbidden, response.Code)
+	})
+	t.Run("keys cannot manage keys", func(t *testing.T) {
+		env.expectAPIKey("trainings:read")
+
+		response := do(env.api, http.MethodPost, "/auth/api-keys", withAPIKey(apiKey))
+		assert.Equal(t, http.StatusForbidden, response.Code)
+	})
+	t.Run("keys act as their owner only", func(t *testing.T) {
+		env.expectAPIKey("trainings:read")
+
+		response := do(env.api, http.MethodGet, "/user/2/trainings", withAPIKey(apiKey))
+		assert.Equal(t, http.StatusForbidden, response.Code)
+	})
+	t.Run("wrong secret", func(t *testing.T) {
+		mocks.ExpectGetAPIKey(env.mock, apiKey, token.RoleUser, "trainings:read")
+
+		response := do(env.api, http.MethodGet, "/user/1/trainings", withAPIKey("sbk_m4zdgnbr_wrong"))
+		assert.Equal(t, http.StatusUnauthorized, response.Code)
+	})
+	t.Run("revoke a key", func(t *testing.T) {
+		mocks.ExpectRevokeAPIKey(env.mock, 1, 1, true)
+		response := delAuthorized(env.api, userToken, "/auth/api-keys/1")
+		assert.Equal(t, http.StatusOK, response.Code)
+
+		mocks.ExpectRevokeAPIKey(env.mock, 1, 1, false)
+		response = delAuthorized(env.api, userToken, "/auth/api-keys/1")
+		assert.Equal(t, http.StatusNotFound, response.Code)
+
+		mocks.ExpectGetAPIKey(env.mock, apiKey, "", "")
+		response = do(env.api, http.MethodGet, "/user/1/trainings", withAPIKey(apiKey))
+		assert.Equal(t, http.StatusUnauthorized, response.Code)
+	})
+}
+
+func TestAPIKeyTwoFactor(t *testing.T) {
+	env, teardown := configureEnvironment(t, requireAdminTwoFactor)
+	defer teardown()
+
+	mocks.ExpectAddAPIKey(env.mock, 1, "Script", "trainings:read", true, 0, 10)
+	response := postAuthorized(env.api, env.twoFactorAccessToken(t, 1, token.RoleUser), "/auth/api-keys", JSON{"name": "Script", "scopes": []string{"trainings:read"}})
+	assert.Equal(t, http.StatusCreated, response.Code, "keys remember the second factor of the session")
+
+	mocks.ExpectGetAPIKey(env.mock, apiKey, token.RoleAdmin, "trainings:read")
+	mocks.ExpectTouchAPIKey(env.mock, 1)
+	response = do(env.api, http.MethodGet, "/user/1/trainings", withAPIKey(apiKey))
+	assert.Equal(t, http.StatusForbidden, response.Code, "keys created without a second factor do not pass the requirement of the role")
+
+	mocks.ExpectGetTwoFactorAPIKey(env.mock, apiKey, token.RoleAdmin, "trainings:read")
+	mocks.ExpectTouchAPIKey(env.mock, 1)
+	mocks.ExpectGetUserTrainings(env.mock, 1)
+	response = do(env.api, http.MethodGet, "/user/1/trainings", withAPIKey(apiKey))
+	assert.Equal(t, http.StatusOK, response.Code)
+}
@@ -0,0 +1,92 @@
+package tests
+
+import (
+	"SB/service/repository/audit"
+	"SB/service/repository/token"
+	"SB/service/service/tests/mocks"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	env, teardown := configureEnvironment(t)
+	defer teardown()
+
+	userToken := env.accessToken(t, 1, token.RoleUser)
+	adminToken := env.accessToken(t, 3, token.RoleAdmin)
+
+	t.Run("deleting a user is recorded", func(t *testing.T) {
+		mocks.ExpectGetUser(env.mock, 1, token.RoleUser)
+		mocks.ExpectDeleteUser(env.mock, 1)
+		mocks.ExpectAddAuditEntry(env.mock, audit.ActionUserDeleted)
+
+		response := delAuthorized(env.api, userToken, "/user/1")
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.NotEmpty(t, response.Header().Get("X-Request-Id"))
+	})
+	t.Run("search", func(t *testing.T) {
+		from := time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC)
+		mocks.ExpectGetAuditEntries(env.mock, 21, int64(3), audit.ActionRoleChanged, from)
+
+		response := getAuthorized(env.api, adminToken, "/admin/audit?actor=3&action=user.role_changed&from=2021-11-01T00:00:00Z&page=2")
+		assert.Equal(t, http.StatusOK, response.Code)
+		var page JSON
+		assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &page))
+		assert.Equal(t, float64(21), page["total"])
+		assert.Equal(t, float64(2), page["page"])
+		entries := page["entries"].([]interface{})
+		assert.Len(t, entries, 1)
+		assert.Equal(t, JSON{"role": "coach"}, JSON(entries[0].(map[string]interface{})["after"].(map[string]interface{})))
+	})
+	t.Run("invalid filters", func(t *testing.T) {
+		response := getAuthorized(env.api, adminToken, "/admin/audit?from=yesterday")
+		assert.Equal(t, http.StatusBadRequest, response.Code)
+
+		response = getAuthorized(env.api, adminToken, "/admin/audit?target_id=x")
+		assert.Equal(t, http.StatusBadRequest, response.Code)
+
+		response = getAuthorized(env.api, adminToken, "/admin/audit?per_page=1000")
+		assert.Equal(t, http.StatusBadRequest, response.Code)
+	})
+	t.Run("export", func(t *testing.T) {
+		mocks.ExpectGetAuditEntries(env.mock, 1, audit.TargetUser, int64(1))
+
+		response := getAuthorized(env.api, adminToken, "/admin/audit/export?target_type=user&target_id=1")
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.Contains(t, response.Header().Get("Content-Disposition"), "audit.csv")
+		records, err := csv.NewReader(strings.NewReader(response.Body.String())).ReadAll()
+		assert.NoError(t, err)
+		assert.Len(t, records, 2)
+		assert.Equal(t, []string{"12", "2021-11-02T10:00:00Z", "3", "", "user.role_changed", "user", "1",
+			`{"role":"user"}`, `{"role":"coach"}`, "192.0.2.1", "req-1"}, records[1])
+	})
+	t.Run("export escapes formulas", func(t *testing.T) {
+		env.mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "audit_log"`)).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+		env.mock.ExpectQuery(regexp.QuoteMeta(`SELECT id_entry, created_at, id_actor, impersonated_by, action, target_type, target_id, before, after, ip, request_id FROM "audit_log"`)).
+			WillReturnRows(sqlmock.NewRows([]string{"id_entry", "created_at", "id_actor", "impersonated_by", "action", "target_type", "target_id", "before", "after", "ip", "request_id"}).
+				AddRow(13, time.Date(2021, 11, 2, 10, 0, 0, 0, time.UTC), 3, nil, "user.banned", "user", 1, nil, `{"reason":"Spam"}`, "192.0.2.1", `=HYPERLINK("http://example.com")`))
+
+		response := getAuthorized(env.api, adminToken, "/admin/audit/export")
+		assert.Equal(t, http.StatusOK, response.Code)
+		records, err := csv.NewReader(strings.NewReader(response.Body.String())).ReadAll()
+		assert.NoError(t, err)
+		assert.Len(t, records, 2)
+		assert.Equal(t, `'=HYPERLINK("http://example.com")`, records[1][10])
+		assert.Equal(t, `{"reason":"Spam"}`, records[1][8])
+	})
+	t.Run("only admins", func(t *testing.T) {
+		response := getAuthorized(env.api, userToken, "/admin/audit")
+		assert.Equal(t, http.StatusForbidden, response.Code)
+
+		response = getAuthorized(env.api, userToken, "/admin/audit/export")
+		assert.Equal(t, http.StatusForbidden, response.Code)
+	})
+}
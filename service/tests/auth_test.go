@@ -1,6 +1,8 @@
 package tests
 
 import (
+	"SB/service/repository/token"
+	"SB/service/service/tests/mocks"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"net/http"
@@ -9,15 +11,103 @@ import (
 
 func TestLogin(t *testing.T) {
 	t.Run("Test /auth/login", func(t *testing.T) {
-		api, teardown := configureEnvironment(t)
+		env, teardown := configureEnvironment(t)
 		defer teardown()
 
+		mocks.ExpectGetPasswordHash(env.mock)
+		mocks.ExpectUpdatePasswordHash(env.mock)
+		mocks.ExpectMockGetUserAuthParams(env.mock)
+		mocks.ExpectGetTOTP(env.mock, 1, "", false)
+		mocks.ExpectAddSession(env.mock)
+
 		authParams := JSON{
-			"username": "test",
+			"username": "test@example.com",
 			"password": "123",
 		}
-		response := post(api, "/auth/login", authParams)
+		response := post(env.api, "/auth/login", authParams)
 		fmt.Println(response.Body.String())
 		assert.Equal(t, http.StatusOK, response.Code)
 	})
 }
+
+func TestSignupPasswordPolicy(t *testing.T) {
+	env, teardown := configureEnvironment(t)
+	defer teardown()
+
+	response := post(env.api, "/auth/signup", JSON{
+		"username": "test@example.com",
+		"password": "123",
+	})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	assert.Contains(t, response.Body.String(), "at least 8 characters")
+}
+
+func TestRefreshToken(t *testing.T) {
+	refresh := func(env *environment) *ResponseTest {
+		return do(env.api, http.MethodPost, "/auth/refresh", http.Header{"Cookie": {"refresh_token=" + mocks.RefreshToken}})
+	}
+
+	t.Run("rotation", func(t *testing.T) {
+		env, teardown := configureEnvironment(t)
+		defer teardown()
+
+		mocks.ExpectGetSession(env.mock, false)
+		mocks.ExpectRotateSession(env.mock)
+
+		response := refresh(env)
+		assert.Equal(t, http.StatusOK, response.Code)
+		cookies := response.Result().Cookies()
+		if assert.Len(t, cookies, 1) {
+			assert.NotEqual(t, mocks.RefreshToken, cookies[0].Value)
+		}
+	})
+
+	t.Run("reuse revokes the family", func(t *testing.T) {
+		env, teardown := configureEnvironment(t)
+		defer teardown()
+
+		mocks.ExpectGetSession(env.mock, true)
+		mocks.ExpectRevokeSessionFamily(env.mock)
+		mocks.ExpectAddSecurityEvent(env.mock, token.EventRefreshTokenReuse)
+
+		response := refresh(env)
+		assert.Equal(t, http.StatusUnauthorized, response.Code)
+		cookies := response.Result().Cookies()
+		if assert.Len(t, cookies, 1) {
+			assert.True(t, cookies[0].MaxAge < 0, "refresh token cookie must be cleared")
+		}
+	})
+}
+
+func TestAccess(t *testing.T) {
+	env, teardown := configureEnvironment(t)
+	defer teardown()
+
+	userToken := env.accessToken(t, 1, token.RoleUser)
+	coachToken := env.accessToken(t, 3, token.RoleCoach)
+
+	t.Run("no token", func(t *testing.T) {
+		response := get(env.api, "/messenger/dialogs")
+		assert.Equal(t, http.StatusUnauthorized, response.Code)
+	})
+	t.Run("invalid token", func(t *testing.T) {
+		response := getAuthorized(env.api, userToken+"x", "/messenger/dialogs")
+		assert.Equal(t, http.StatusUnauthorized, response.Code)
+	})
+	t.Run("delete another user", func(t *testing.T) {
+		response := delAuthorized(env.api, userToken, "/user/2")
+		assert.Equal(t, http.StatusForbidden, response.Code)
+	})
+	t.Run("coach reads another user's trainings", func(t *testing.T) {
+		response := getAuthorized(env.api, userToken, "/user/2/trainings")
+		assert.Equal(t, http.StatusForbidden, response.Code)
+
+		env.mock.ExpectQuery(`SELECT (.+) FROM \(SELECT (.+)\) as gt`).WillReturnRows(env.mock.NewRows([]string{"id_training"}))
+		response = getAuthorized(env.api, coachToken, "/user/2/trainings")
+		assert.Equal(t, http.StatusOK, response.Code)
+	})
+	t.Run("update another user's profile", func(t *testing.T) {
+		response := putAuthorized(env.api, userToken, "/user/profile", JSON{"id_user": 2, "name": "name"})
+		assert.Equal(t, http.StatusForbidden, response.Code)
+	})
+}
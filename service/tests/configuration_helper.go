@@ -1,28 +1,42 @@
 package tests
 
 import (
+	"SB/service/config"
+	"SB/service/repository/account"
+	"SB/service/repository/admin"
+	"SB/service/repository/apikey"
+	"SB/service/repository/audit"
 	"SB/service/repository/db"
+	"SB/service/repository/health"
+	"SB/service/repository/keys"
+	"SB/service/repository/lockout"
+	"SB/service/repository/logging"
 	"SB/service/repository/messenger"
+	"SB/service/repository/oidc"
+	"SB/service/repository/password"
 	"SB/service/repository/persistence"
+	"SB/service/repository/pubsub"
 	"SB/service/repository/token"
 	"SB/service/repository/training"
+	"SB/service/repository/twofactor"
 	"SB/service/service"
 	"SB/service/service/tests/mocks"
-	"b.yadro.com/storlib/logger"
 	"bytes"
+	"context"
 	"encoding/json"
-	"flag"
 	"fmt"
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/dgrijalva/jwt-go"
 	"github.com/labstack/echo/v4"
-	"github.com/labstack/gommon/log"
 	"github.com/stretchr/testify/assert"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
+	"time"
 )
 
 type (
@@ -32,6 +46,15 @@ type (
 	IJSON        interface {
 		AsReader() io.Reader
 	}
+
+	environment struct {
+		api     *echo.Echo
+		mock    sqlmock.Sqlmock
+		cfg     config.Config
+		mailer  *mocks.Mailer
+		keys    keys.Ring
+		account account.AccountManager
+	}
 )
 
 var (
@@ -39,72 +62,135 @@ var (
 	post = handler(http.MethodPost)
 	put  = handler(http.MethodPut)
 	del  = handler(http.MethodDelete)
+
+	getAuthorized  = authorizedHandler(http.MethodGet)
+	postAuthorized = authorizedHandler(http.MethodPost)
+	putAuthorized  = authorizedHandler(http.MethodPut)
+	delAuthorized  = authorizedHandler(http.MethodDelete)
 )
 
-//func configureEnvironment(t *testing.T) (*echo.Echo, func()) {
-//	controller := gomock.NewController(t)
-//
-//	srv := NewServer("test", nil, &config)
-//	srv.Start()
-//
-//	return srv.ServerApi(), func() {
-//		controller.Finish()
-//		rcTeardown()
-//		fmt.Println("teardown")
-//	}
-//}
-
-func startEchoServer(e *echo.Echo, port string) {
-	go func(e *echo.Echo, port string) {
-		err := e.Start(":" + port)
-		if err != http.ErrServerClosed {
-			logger.Fatal()
-		}
-	}(e, port)
+// configureEnvironment starts the API on a mocked database, options change
+// the default test configuration
+func configureEnvironment(t *testing.T, options ...func(cfg *config.Config)) (*environment, func()) {
+	return configureReplica(t, pubsub.NewMemory(), options...)
+}
+
+// configureReplica starts the API as one of the nodes sharing pubSub, each
+// node has a database mock of its own
+func configureReplica(t *testing.T, pubSub pubsub.PubSub, options ...func(cfg *config.Config)) (*environment, func()) {
+	return configure(t, pubSub, logging.New(os.Stdout, logging.LevelInfo, logging.FormatText), options...)
+}
+
+// configureLogged starts the API writing its log lines with logger
+func configureLogged(t *testing.T, logger *logging.Logger, options ...func(cfg *config.Config)) (*environment, func()) {
+	return configure(t, pubsub.NewMemory(), logger, options...)
 }
 
-func configureEnvironment(t *testing.T) (*echo.Echo, func()) {
-	psqlDb, mock, err := sqlmock.New()
+func configure(t *testing.T, pubSub pubsub.PubSub, logger *logging.Logger, options ...func(cfg *config.Config)) (*environment, func()) {
+	psqlDb, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
 	assert.NoError(t, err)
+	// gorm checks the connection when it is opened
+	mock.ExpectPing()
 
 	gormDB, err := gorm.Open(postgres.New(postgres.Config{
 		Conn: psqlDb,
-	}), &gorm.Config{})
+	}), &gorm.Config{Logger: logging.DatabaseLogger(logger)})
 
 	assert.NoError(t, err)
 
-	address := flag.String("address", "", "address to listen")
-	port := flag.String("port", "3000", "port to listen")
-
-	log.Info(fmt.Sprintf(
-		"address: %s, port: %s", *address, *port,
-	))
+	cfg := config.Default()
+	cfg.Token.KeyStore = "memory"
+	cfg.Password.Argon2Memory = 1024
+	cfg.Password.Argon2Iterations = 1
+	// tests scrape the metrics from the API
+	cfg.Server.Address = "127.0.0.1"
+	cfg.Server.MetricsAddress = ""
+	for _, option := range options {
+		option(&cfg)
+	}
 
-	persistent := persistence.NewPersistent(gormDB)
-	usrMgr := db.NewDbManager(persistent)
-	tknMgr := token.NewTokenManager(persistent)
-	trainingMgr := training.NewTrainingManager(persistent)
+	persistent := persistence.NewPersistent(gormDB, logger)
+	hasher, err := password.NewHasher(cfg.Password)
+	assert.NoError(t, err)
+	auditLog := audit.NewLog(persistent, cfg.Audit, logger)
+	policy, err := password.NewPolicy(cfg.Password, logger)
+	assert.NoError(t, err)
+	usrMgr, err := db.NewDbManager(persistent, hasher, policy, auditLog, logger)
+	assert.NoError(t, err)
+	ring, err := keys.NewRing(context.Background(), persistent, cfg.Token, logger)
+	assert.NoError(t, err)
+	tknMgr := token.NewTokenManager(persistent, ring, cfg.Token, auditLog, logger)
+	mailer := &mocks.Mailer{}
+	accountMgr := account.NewAccountManager(persistent, hasher, policy, mailer, cfg.Token, cfg.Mail, logger)
+	twoFactorMgr, err := twofactor.NewTwoFactorManager(persistent, tknMgr, cfg.TwoFactor, logger)
+	assert.NoError(t, err)
+	guard, err := lockout.NewGuard(persistent, cfg.Lockout, logger)
+	assert.NoError(t, err)
+	oidcMgr := oidc.NewManager(persistent, ring, cfg.OIDC, logger)
+	apiKeyMgr := apikey.NewManager(persistent, cfg.APIKeys, logger)
+	adminMgr := admin.NewAdminManager(persistent, auditLog)
+	trainingMgr := training.NewTrainingManager(persistent, auditLog)
 	messenger := messenger.NewMessenger(persistent)
 
-	server := service.NewServer(*address, *port, usrMgr, tknMgr, trainingMgr, messenger)
-	log.Info("starting a server")
+	server := service.NewServer(&cfg, usrMgr, tknMgr, accountMgr, twoFactorMgr, guard, oidcMgr, apiKeyMgr, adminMgr, auditLog, trainingMgr, messenger, health.NewChecker(map[string]health.Check{"database": persistent.Ping}), pubSub, logger)
 
-	mocks.ExpectCheckPassword(mock)
-	mocks.ExpectMockGetUserAuthParams(mock)
+	return &environment{api: server.ServerApi(), mock: mock, cfg: cfg, mailer: mailer, keys: ring, account: accountMgr}, func() {
+		accountMgr.Wait()
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.NoError(t, server.Stop(context.Background()))
+		fmt.Println("teardown")
+	}
+}
 
-	server.Start()
+// accessToken signs an access token for the user the same way TokenManager does
+func (env *environment) accessToken(t *testing.T, idUser int64, role string) string {
+	return env.signAccessToken(t, idUser, role, false)
+}
 
-	return server.ServerApi(), func() {
-		server.Stop()
-		fmt.Println("teardown")
+// twoFactorAccessToken signs an access token of a session started with a second factor
+func (env *environment) twoFactorAccessToken(t *testing.T, idUser int64, role string) string {
+	return env.signAccessToken(t, idUser, role, true)
+}
+
+func (env *environment) signAccessToken(t *testing.T, idUser int64, role string, twoFactor bool) string {
+	claims := token.CustomizedClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        fmt.Sprintf("%d", idUser),
+			ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		},
+		Role:      role,
+		SessionId: mocks.Family,
+		TwoFactor: twoFactor,
 	}
+	tkn, err := token.SignAccessToken(env.keys, &claims)
+	assert.NoError(t, err)
+	return tkn
+}
+
+// signAccessToken signs an access token with a key that need not be the
+// signing key of the ring
+func signAccessToken(t *testing.T, key keys.Key, claims *token.CustomizedClaims) string {
+	tkn := jwt.NewWithClaims(key.Method(), claims)
+	tkn.Header["kid"] = key.ID
+	tkn.Header["typ"] = token.AccessType
+	signed, err := tkn.SignedString(key.Signer)
+	assert.NoError(t, err)
+	return signed
 }
 
 func handler(method string) func(h http.Handler, path string, body ...IJSON) *ResponseTest {
-	return func(h http.Handler, path string, body ...IJSON) *ResponseTest { return do(h, method, path, body...) }
+	return func(h http.Handler, path string, body ...IJSON) *ResponseTest {
+		return do(h, method, path, nil, body...)
+	}
 }
 
-func do(h http.Handler, method, path string, body ...IJSON) *ResponseTest {
+func authorizedHandler(method string) func(h http.Handler, accessToken string, path string, body ...IJSON) *ResponseTest {
+	return func(h http.Handler, accessToken string, path string, body ...IJSON) *ResponseTest {
+		return do(h, method, path, http.Header{"X-Auth-Token": {accessToken}}, body...)
+	}
+}
+
+func do(h http.Handler, method, path string, header http.Header, body ...IJSON) *ResponseTest {
 	if body == nil {
 		body = append(body, JSON{})
 	}
@@ -113,6 +199,10 @@ func do(h http.Handler, method, path string, body ...IJSON) *ResponseTest {
 		resp = ResponseTest{httptest.NewRecorder()}
 		req  = httptest.NewRequest(method, path, body[0].AsReader())
 	)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	for k, v := range header {
+		req.Header[k] = v
+	}
 
 	h.ServeHTTP(resp, req)
 	return &resp
@@ -0,0 +1,136 @@
+package tests
+
+import (
+	"SB/service/config"
+	"SB/service/repository/token"
+	"SB/service/service/tests/mocks"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func errorBody(t *testing.T, response *ResponseTest) JSON {
+	var body JSON
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &body))
+	return body
+}
+
+func TestErrorResponses(t *testing.T) {
+	env, teardown := configureEnvironment(t)
+	defer teardown()
+
+	userToken := env.accessToken(t, 1, token.RoleUser)
+	otherToken := env.accessToken(t, 2, token.RoleUser)
+
+	t.Run("missing profile", func(t *testing.T) {
+		env.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "user_info" WHERE id_user=$1`)).WithArgs(5).
+			WillReturnRows(env.mock.NewRows([]string{"id_user"}))
+
+		response := getAuthorized(env.api, userToken, "/user/profile/5")
+		assert.Equal(t, http.StatusNotFound, response.Code)
+		assert.Equal(t, JSON{"code": "not_found", "message": "no such user"}, errorBody(t, response))
+	})
+	t.Run("missing training", func(t *testing.T) {
+		mocks.ExpectGetGroupTraining(env.mock, 7, false)
+		response := putAuthorized(env.api, userToken, "/training/7", JSON{"location": "Park"})
+		assert.Equal(t, http.StatusNotFound, response.Code)
+		assert.Equal(t, "not_found", errorBody(t, response)["code"])
+
+		mocks.ExpectGetGroupTraining(env.mock, 7, false)
+		response = getAuthorized(env.api, userToken, "/training/7")
+		assert.Equal(t, http.StatusNotFound, response.Code)
+	})
+	t.Run("training of another user", func(t *testing.T) {
+		mocks.ExpectGetGroupTraining(env.mock, 4, true)
+		response := delAuthorized(env.api, otherToken, "/training/4")
+		assert.Equal(t, http.StatusForbidden, response.Code)
+		assert.Equal(t, JSON{"code": "forbidden", "message": "No rights to configure trainings"}, errorBody(t, response))
+	})
+	t.Run("handler errors", func(t *testing.T) {
+		response := getAuthorized(env.api, userToken, "/user/profile/x")
+		assert.Equal(t, http.StatusBadRequest, response.Code)
+		assert.Equal(t, JSON{"code": "bad_request", "message": "Invalid user id"}, errorBody(t, response))
+	})
+	t.Run("invalid bodies", func(t *testing.T) {
+		response := postAuthorized(env.api, userToken, "/training", JSON{
+			"meet_date": "2000-01-01T00:00:00Z", "training_duration": "long", "fee": -100, "kind": "solo",
+		})
+		assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+		body := errorBody(t, response)
+		assert.Equal(t, "validation_failed", body["code"])
+		assert.Equal(t, map[string]interface{}{
+			"meet_date":         "must be in the future",
+			"training_duration": "must be a duration like 1h30m",
+			"location":          "is required",
+			"sport":             "is required",
+			"fee":               "must be at least 0",
+			"kind":              "must be one of group, personal",
+		}, body["fields"])
+
+		mocks.ExpectGetGroupTraining(env.mock, 4, true)
+		response = putAuthorized(env.api, userToken, "/training/4", JSON{
+			"meet_date": "2000-01-01T00:00:00Z", "training_duration": "long", "location": "Park", "sport": "Running",
+		})
+		assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+		assert.Equal(t, map[string]interface{}{"training_duration": "must be a duration like 1h30m"}, errorBody(t, response)["fields"],
+			"trainings past their meeting stay editable")
+
+		response = putAuthorized(env.api, userToken, "/user/profile", JSON{"id_user": 1, "sex": "other", "height": -1, "email": "nobody"})
+		assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+		assert.Equal(t, map[string]interface{}{"sex": "must be one of male, female", "height": "must be at least 1", "email": "must be an e-mail address"}, errorBody(t, response)["fields"])
+
+		response = post(env.api, "/auth/login", JSON{"username": "test@example.com"})
+		assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+		assert.Equal(t, map[string]interface{}{"password": "is required"}, errorBody(t, response)["fields"])
+
+		response = post(env.api, "/auth/signup", JSON{"username": "andrey", "password": "Password123"})
+		assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+		assert.Equal(t, map[string]interface{}{"username": "must be an e-mail address"}, errorBody(t, response)["fields"])
+
+		response = post(env.api, "/auth/login/2fa", JSON{"challenge": "c"})
+		assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+		assert.Equal(t, map[string]interface{}{"code": "is required"}, errorBody(t, response)["fields"])
+
+		response = post(env.api, "/auth/password/forgot", JSON{"email": "andrey"})
+		assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+		assert.Equal(t, map[string]interface{}{"email": "must be an e-mail address"}, errorBody(t, response)["fields"])
+
+		response = putAuthorized(env.api, userToken, "/messenger/request/reply", JSON{"id_to": 1, "type": "friends", "status": "maybe"})
+		assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+		assert.Equal(t, map[string]interface{}{
+			"id_from": "is required",
+			"type":    "must be one of personal, group",
+			"status":  "must be one of request, accepted, declined",
+		}, errorBody(t, response)["fields"])
+	})
+	t.Run("unknown route", func(t *testing.T) {
+		response := get(env.api, "/nowhere")
+		assert.Equal(t, http.StatusNotFound, response.Code)
+		assert.Equal(t, "not_found", errorBody(t, response)["code"])
+	})
+	t.Run("unauthenticated", func(t *testing.T) {
+		response := get(env.api, "/user/profile/1")
+		assert.Equal(t, http.StatusUnauthorized, response.Code)
+		assert.Equal(t, "unauthorized", errorBody(t, response)["code"])
+	})
+}
+
+func TestRequestTimeout(t *testing.T) {
+	env, teardown := configureEnvironment(t, func(cfg *config.Config) {
+		cfg.Database.RequestTimeout = 20 * time.Millisecond
+	})
+	defer teardown()
+
+	env.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "user_info" WHERE id_user=$1`)).WithArgs(5).
+		WillDelayFor(time.Second).
+		WillReturnRows(env.mock.NewRows([]string{"id_user"}).AddRow(5))
+
+	started := time.Now()
+	response := getAuthorized(env.api, env.accessToken(t, 1, token.RoleUser), "/user/profile/5")
+	assert.Less(t, int64(time.Since(started)), int64(time.Second), "the query must stop at the deadline")
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code)
+	assert.Equal(t, JSON{"code": "service_unavailable", "message": "Request timed out"}, errorBody(t, response))
+}
@@ -0,0 +1,27 @@
+package tests
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	env, teardown := configureEnvironment(t)
+	defer teardown()
+
+	response := get(env.api, "/healthz")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, JSON{"status": "ok"}, errorBody(t, response))
+
+	env.mock.ExpectPing()
+	response = get(env.api, "/readyz")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, JSON{"status": "ok", "checks": map[string]interface{}{"database": "ok"}}, errorBody(t, response))
+
+	env.mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+	response = get(env.api, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code)
+	assert.Equal(t, JSON{"status": "unavailable", "checks": map[string]interface{}{"database": "unavailable"}}, errorBody(t, response))
+}
@@ -0,0 +1,101 @@
+package tests
+
+import (
+	"SB/service/repository/audit"
+	"SB/service/repository/token"
+	"SB/service/service/tests/mocks"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestImpersonation(t *testing.T) {
+	env, teardown := configureEnvironment(t)
+	defer teardown()
+
+	userToken := env.accessToken(t, 1, token.RoleUser)
+	adminToken := env.accessToken(t, 3, token.RoleAdmin)
+
+	var impersonation, session string
+	t.Run("admin impersonates a user", func(t *testing.T) {
+		mocks.ExpectGetUser(env.mock, 1, token.RoleUser)
+		mocks.ExpectAddImpersonationSession(env.mock, 1)
+		mocks.ExpectAddAuditEntry(env.mock, audit.ActionImpersonationStarted)
+
+		response := postAuthorized(env.api, adminToken, "/admin/impersonate/1")
+		assert.Equal(t, http.StatusOK, response.Code)
+		var body JSON
+		assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &body))
+		assert.Equal(t, float64(1), body["id_user"])
+		assert.Equal(t, float64(3), body["impersonated_by"])
+		impersonation, _ = body["access_token"].(string)
+		session, _ = body["session_id"].(string)
+		assert.NotEmpty(t, session)
+	})
+	t.Run("requests are marked and recorded", func(t *testing.T) {
+		mocks.ExpectHasSession(env.mock, 1, true)
+		mocks.ExpectGetSessions(env.mock, 1)
+		mocks.ExpectAddAuditEntry(env.mock, audit.ActionImpersonatedRequest)
+
+		response := getAuthorized(env.api, impersonation, "/auth/sessions")
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.Equal(t, "3", response.Header().Get("X-Impersonated-By"))
+
+		mocks.ExpectGetSessions(env.mock, 1)
+		response = getAuthorized(env.api, userToken, "/auth/sessions")
+		assert.Empty(t, response.Header().Get("X-Impersonated-By"))
+	})
+	t.Run("destructive actions are denied", func(t *testing.T) {
+		mocks.ExpectHasSession(env.mock, 1, true)
+		mocks.ExpectAddAuditEntry(env.mock, audit.ActionImpersonatedRequest)
+		response := delAuthorized(env.api, impersonation, "/user/1")
+		assert.Equal(t, http.StatusForbidden, response.Code)
+
+		mocks.ExpectHasSession(env.mock, 1, true)
+		mocks.ExpectAddAuditEntry(env.mock, audit.ActionImpersonatedRequest)
+		response = postAuthorized(env.api, impersonation, "/auth/logout-all")
+		assert.Equal(t, http.StatusForbidden, response.Code)
+	})
+	t.Run("responses carry a banner", func(t *testing.T) {
+		mocks.ExpectHasSession(env.mock, 1, true)
+		mocks.ExpectAddAuditEntry(env.mock, audit.ActionImpersonatedRequest)
+		response := delAuthorized(env.api, impersonation, "/user/1")
+		var body JSON
+		assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &body))
+		assert.NotEmpty(t, body["message"])
+		banner, _ := body["impersonation"].(map[string]interface{})
+		assert.Equal(t, float64(3), banner["impersonated_by"])
+		assert.Equal(t, float64(1), banner["id_user"])
+		assert.NotEmpty(t, banner["expires_at"])
+
+		mocks.ExpectGetSessions(env.mock, 1)
+		response = getAuthorized(env.api, userToken, "/auth/sessions")
+		assert.NotContains(t, response.Body.String(), "impersonation")
+	})
+	t.Run("revoking the session ends the impersonation", func(t *testing.T) {
+		mocks.ExpectRevokeSession(env.mock, 1, session)
+		response := delAuthorized(env.api, adminToken, "/admin/users/1/sessions/"+session)
+		assert.Equal(t, http.StatusOK, response.Code)
+
+		mocks.ExpectHasSession(env.mock, 1, false)
+		response = getAuthorized(env.api, impersonation, "/auth/sessions")
+		assert.Equal(t, http.StatusUnauthorized, response.Code)
+	})
+	t.Run("admins cannot be impersonated", func(t *testing.T) {
+		response := postAuthorized(env.api, adminToken, "/admin/impersonate/3")
+		assert.Equal(t, http.StatusForbidden, response.Code)
+
+		mocks.ExpectGetUser(env.mock, 4, token.RoleAdmin)
+		response = postAuthorized(env.api, adminToken, "/admin/impersonate/4")
+		assert.Equal(t, http.StatusForbidden, response.Code)
+
+		mocks.ExpectGetUser(env.mock, 5, "")
+		response = postAuthorized(env.api, adminToken, "/admin/impersonate/5")
+		assert.Equal(t, http.StatusNotFound, response.Code)
+	})
+	t.Run("only admins impersonate", func(t *testing.T) {
+		response := postAuthorized(env.api, userToken, "/admin/impersonate/2")
+		assert.Equal(t, http.StatusForbidden, response.Code)
+	})
+}
@@ -0,0 +1,119 @@
+package tests
+
+import (
+	"SB/service/config"
+	"SB/service/repository/keys"
+	"SB/service/repository/token"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const legacySecret = "test-secret-0123456789"
+
+func legacySecretConfigured(cfg *config.Config) {
+	cfg.Token.Secret = legacySecret
+}
+
+func legacyToken(t *testing.T, idUser int64, role string) string {
+	claims := token.CustomizedClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        fmt.Sprintf("%d", idUser),
+			ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		},
+		Role: role,
+	}
+	tkn, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &claims).SignedString([]byte(legacySecret))
+	require.NoError(t, err)
+	return tkn
+}
+
+// authenticated tells whether the token is accepted, admin routes answer
+// users with 403 after the token is verified
+func authenticated(env *environment, accessToken string) int {
+	return getAuthorized(env.api, accessToken, "/admin/users/2/sessions").Code
+}
+
+func TestJWKS(t *testing.T) {
+	env, teardown := configureEnvironment(t)
+	defer teardown()
+
+	signing, err := env.keys.Signing()
+	require.NoError(t, err)
+	response := get(env.api, "/.well-known/jwks.json")
+	require.Equal(t, http.StatusOK, response.Code)
+	var jwks keys.JWKS
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &jwks))
+	require.Len(t, jwks.Keys, 1)
+	assert.Equal(t, keys.JWK{Kty: "OKP", Kid: signing.ID, Use: "sig", Alg: "EdDSA", Crv: "Ed25519", X: jwks.Keys[0].X}, jwks.Keys[0])
+	assert.NotContains(t, response.Body.String(), `"d"`, "private keys are not published")
+}
+
+func TestKeyRotation(t *testing.T) {
+	env, teardown := configureEnvironment(t)
+	defer teardown()
+
+	oldToken := env.accessToken(t, 1, token.RoleUser)
+	signing, err := env.keys.Signing()
+	require.NoError(t, err)
+	key, err := env.keys.Rotate(context.Background())
+	require.NoError(t, err)
+
+	response := get(env.api, "/.well-known/jwks.json")
+	assert.Equal(t, "public, max-age=300", response.Header().Get("Cache-Control"))
+	var jwks keys.JWKS
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &jwks))
+	assert.Len(t, jwks.Keys, 2, "the new key is published before it signs")
+	current, err := env.keys.Signing()
+	require.NoError(t, err)
+	assert.Equal(t, signing.ID, current.ID)
+
+	claims := token.CustomizedClaims{
+		StandardClaims: jwt.StandardClaims{Id: "1", ExpiresAt: time.Now().Add(time.Minute).Unix(), Audience: token.AccessAudience},
+		Role:           token.RoleUser,
+	}
+	newToken := signAccessToken(t, key, &claims)
+	assert.Equal(t, http.StatusForbidden, authenticated(env, oldToken), "rotated keys verify during the overlap")
+	assert.Equal(t, http.StatusForbidden, authenticated(env, newToken), "published keys verify before they sign")
+
+	unknown, err := keys.Generate(keys.AlgorithmRS256)
+	require.NoError(t, err)
+	claims.Role = token.RoleAdmin
+	assert.Equal(t, http.StatusUnauthorized, authenticated(env, signAccessToken(t, unknown, &claims)), "keys not in the ring are rejected")
+}
+
+func TestAccessTokenType(t *testing.T) {
+	env, teardown := configureEnvironment(t)
+	defer teardown()
+
+	claims := token.CustomizedClaims{
+		StandardClaims: jwt.StandardClaims{Id: "1", ExpiresAt: time.Now().Add(time.Minute).Unix()},
+		Role:           token.RoleUser,
+	}
+	tkn, err := keys.Sign(env.keys, &claims)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, authenticated(env, tkn), "tokens signed with the keys are access tokens only with their typ and audience")
+
+	claims.Audience = token.AccessAudience
+	tkn, err = keys.Sign(env.keys, &claims)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, authenticated(env, tkn), "the typ is required")
+
+	assert.Equal(t, http.StatusForbidden, authenticated(env, env.accessToken(t, 1, token.RoleUser)))
+}
+
+func TestLegacyTokens(t *testing.T) {
+	env, teardown := configureEnvironment(t)
+	defer teardown()
+	assert.Equal(t, http.StatusUnauthorized, authenticated(env, legacyToken(t, 1, token.RoleUser)), "HS256 tokens need the secret")
+
+	env, teardown = configureEnvironment(t, legacySecretConfigured)
+	defer teardown()
+	assert.Equal(t, http.StatusForbidden, authenticated(env, legacyToken(t, 1, token.RoleUser)))
+}
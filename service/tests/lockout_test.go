@@ -0,0 +1,106 @@
+package tests
+
+import (
+	"SB/service/config"
+	"SB/service/repository/token"
+	"SB/service/service/tests/mocks"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+func strictLockout(cfg *config.Config) {
+	cfg.Lockout.AccountAttempts = 2
+	cfg.Lockout.IPAttempts = 3
+}
+
+func TestLockout(t *testing.T) {
+	env, teardown := configureEnvironment(t, strictLockout)
+	defer teardown()
+
+	t.Run("locks the account after failed logins", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			mocks.ExpectGetPasswordHash(env.mock)
+			response := post(env.api, "/auth/login", JSON{"username": "test@example.com", "password": "wrong"})
+			require.Equal(t, http.StatusUnauthorized, response.Code)
+		}
+
+		response := post(env.api, "/auth/login", JSON{"username": "Test@example.com", "password": "123"})
+		require.Equal(t, http.StatusTooManyRequests, response.Code)
+		assert.Equal(t, "1", response.Header().Get("Retry-After"))
+	})
+
+	t.Run("unknown logins get the same responses", func(t *testing.T) {
+		// the IP address has one failure left
+		mocks.ExpectGetPasswordHashUnknown(env.mock, "nobody@example.com")
+		response := post(env.api, "/auth/login", JSON{"username": "nobody@example.com", "password": "wrong"})
+		require.Equal(t, http.StatusUnauthorized, response.Code)
+		assert.JSONEq(t, `{"code":"unauthorized","message":"Failed to login"}`, response.Body.String())
+
+		response = post(env.api, "/auth/login", JSON{"username": "other@example.com", "password": "wrong"})
+		require.Equal(t, http.StatusTooManyRequests, response.Code, "the IP address is locked")
+	})
+
+	t.Run("admin unlocks the account", func(t *testing.T) {
+		response := postAuthorized(env.api, env.accessToken(t, 1, token.RoleUser), "/admin/users/1/unlock")
+		assert.Equal(t, http.StatusForbidden, response.Code)
+
+		mocks.ExpectGetUsername(env.mock, 1)
+		response = postAuthorized(env.api, env.accessToken(t, 3, token.RoleAdmin), "/admin/users/1/unlock")
+		require.Equal(t, http.StatusOK, response.Code)
+
+		response = post(env.api, "/auth/login", JSON{"username": "test@example.com", "password": "123"})
+		assert.Equal(t, http.StatusTooManyRequests, response.Code, "failures of the IP address are kept")
+	})
+}
+
+func TestLockoutIgnoresForwardedFor(t *testing.T) {
+	login := func(env *environment, i int) int {
+		username := fmt.Sprintf("user%d@example.com", i)
+		mocks.ExpectGetPasswordHashUnknown(env.mock, username)
+		header := http.Header{"X-Forwarded-For": {fmt.Sprintf("203.0.113.%d", i)}}
+		return do(env.api, http.MethodPost, "/auth/login", header, JSON{"username": username, "password": "wrong"}).Code
+	}
+
+	t.Run("clients", func(t *testing.T) {
+		env, teardown := configureEnvironment(t, strictLockout)
+		defer teardown()
+		for i := 0; i < 3; i++ {
+			require.Equal(t, http.StatusUnauthorized, login(env, i))
+		}
+		response := do(env.api, http.MethodPost, "/auth/login", http.Header{"X-Forwarded-For": {"203.0.113.9"}}, JSON{"username": "user9@example.com", "password": "wrong"})
+		assert.Equal(t, http.StatusTooManyRequests, response.Code, "X-Forwarded-For of clients is not trusted")
+	})
+	t.Run("trusted proxy", func(t *testing.T) {
+		env, teardown := configureEnvironment(t, strictLockout, func(cfg *config.Config) {
+			// the address of httptest requests
+			cfg.Server.TrustedProxies = []string{"192.0.2.0/24"}
+		})
+		defer teardown()
+		for i := 0; i < 4; i++ {
+			assert.Equal(t, http.StatusUnauthorized, login(env, i), "clients behind the proxy are told apart")
+		}
+	})
+}
+
+func TestLockoutTwoFactor(t *testing.T) {
+	env, teardown := configureEnvironment(t, strictLockout)
+	defer teardown()
+
+	challenge := loginChallenge(t, env)
+
+	wrong := wrongCode(t)
+	for i := 0; i < 2; i++ {
+		mocks.ExpectAttemptTwoFactorChallenge(env.mock, true)
+		mocks.ExpectGetTOTP(env.mock, 1, totpSecret, true)
+		response := post(env.api, "/auth/login/2fa", JSON{"challenge": challenge, "code": wrong})
+		require.Equal(t, http.StatusUnauthorized, response.Code)
+	}
+	// the IP address has attempts left, the account has not
+	response := post(env.api, "/auth/login/2fa", JSON{"challenge": challenge, "code": wrong})
+	assert.Equal(t, http.StatusTooManyRequests, response.Code)
+	response = post(env.api, "/auth/login", JSON{"username": "test@example.com", "password": "123"})
+	assert.Equal(t, http.StatusTooManyRequests, response.Code, "wrong codes lock the password login too")
+}
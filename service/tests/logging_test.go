@@ -0,0 +1,57 @@
+package tests
+
+import (
+	"SB/service/repository/logging"
+	"SB/service/service/tests/mocks"
+	"bytes"
+	"encoding/json"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLogging(t *testing.T) {
+	var buf bytes.Buffer
+	env, teardown := configureLogged(t, logging.New(&buf, logging.LevelDebug, logging.FormatJSON))
+	defer teardown()
+	buf.Reset()
+
+	mocks.ExpectGetPasswordHashUnknown(env.mock, "ann@example.com")
+	response := post(env.api, "/auth/login", JSON{
+		"username": "ann@example.com",
+		"password": "hunter2hunter2",
+	})
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	requestId := response.Header().Get(echo.HeaderXRequestID)
+	assert.NotEmpty(t, requestId)
+
+	output := buf.String()
+	assert.NotContains(t, output, "ann@example.com")
+	assert.NotContains(t, output, "hunter2hunter2")
+
+	var messages []string
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		var fields map[string]interface{}
+		if !assert.NoError(t, json.Unmarshal([]byte(line), &fields), line) {
+			continue
+		}
+		assert.Equal(t, requestId, fields["request_id"], "every line of the request has its id: %s", line)
+		messages = append(messages, fields["msg"].(string))
+	}
+	assert.Contains(t, messages, "no such user", "persistence logs with the logger of the request")
+	assert.Equal(t, "request served", messages[len(messages)-1])
+
+	t.Run("client request id", func(t *testing.T) {
+		buf.Reset()
+		header := http.Header{}
+		header.Set(echo.HeaderXRequestID, "forged")
+		response := do(env.api, http.MethodGet, "/healthz", header)
+		assert.Equal(t, http.StatusOK, response.Code)
+		requestId := response.Header().Get(echo.HeaderXRequestID)
+		assert.NotEqual(t, "forged", requestId, "the server generates the ids recorded in the audit log")
+		assert.Contains(t, buf.String(), `"client_request_id":"forged"`)
+		assert.Contains(t, buf.String(), `"request_id":"`+requestId+`"`)
+	})
+}
@@ -0,0 +1,214 @@
+package tests
+
+import (
+	"SB/service/config"
+	"SB/service/repository/pubsub"
+	"SB/service/repository/token"
+	"SB/service/service/tests/mocks"
+	"encoding/json"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessenger(t *testing.T) {
+	env, teardown := configureEnvironment(t)
+	defer teardown()
+	server := httptest.NewServer(env.api)
+	defer server.Close()
+
+	connect := func(idUser int64) *websocket.Conn {
+		header := http.Header{"X-Auth-Token": {env.accessToken(t, idUser, token.RoleUser)}}
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/messenger", header)
+		require.NoError(t, err)
+		return conn
+	}
+	receive := func(conn *websocket.Conn, wait time.Duration) (map[string]interface{}, error) {
+		_ = conn.SetReadDeadline(time.Now().Add(wait))
+		var message map[string]interface{}
+		err := conn.ReadJSON(&message)
+		return message, err
+	}
+
+	phone, laptop, sender := connect(2), connect(2), connect(1)
+	defer phone.Close()
+	defer laptop.Close()
+	defer sender.Close()
+	// sessions are registered after the upgrade, wait for all three
+	require.Eventually(t, messengerSessions(env, 3), time.Second, 10*time.Millisecond)
+
+	mocks.ExpectAddMessage(env.mock, 2, 1, "Hello!")
+	require.NoError(t, sender.WriteJSON(map[string]interface{}{"id_to": 2, "content": "Hello!", "type": "personal"}))
+
+	for _, device := range []*websocket.Conn{phone, laptop} {
+		message, err := receive(device, time.Second)
+		if assert.NoError(t, err, "every device of the recipient gets the message") {
+			assert.Equal(t, "Hello!", message["content"])
+			assert.Equal(t, float64(1), message["id_from"], "the sender is the user of the websocket")
+		}
+	}
+	_, err := receive(sender, 100*time.Millisecond)
+	assert.Error(t, err, "the sending device does not get its own message back")
+	assert.NoError(t, env.mock.ExpectationsWereMet())
+}
+
+func TestMessengerReplicas(t *testing.T) {
+	pubSub := pubsub.NewMemory()
+	first, teardownFirst := configureReplica(t, pubSub)
+	defer teardownFirst()
+	second, teardownSecond := configureReplica(t, pubSub)
+	defer teardownSecond()
+	firstServer, secondServer := httptest.NewServer(first.api), httptest.NewServer(second.api)
+	defer firstServer.Close()
+	defer secondServer.Close()
+
+	connect := func(server *httptest.Server, env *environment, idUser int64) *websocket.Conn {
+		header := http.Header{"X-Auth-Token": {env.accessToken(t, idUser, token.RoleUser)}}
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/messenger", header)
+		require.NoError(t, err)
+		return conn
+	}
+	// the load balancer put the sender and the recipient on different nodes
+	sender, recipient, senderLaptop := connect(firstServer, first, 1), connect(secondServer, second, 2), connect(secondServer, second, 1)
+	defer sender.Close()
+	defer recipient.Close()
+	defer senderLaptop.Close()
+	require.Eventually(t, messengerSessions(first, 3), time.Second, 10*time.Millisecond)
+
+	mocks.ExpectAddMessage(first.mock, 2, 1, "Hello!")
+	require.NoError(t, sender.WriteJSON(map[string]interface{}{"id_to": 2, "content": "Hello!", "type": "personal"}))
+	for _, device := range []*websocket.Conn{recipient, senderLaptop} {
+		_ = device.SetReadDeadline(time.Now().Add(time.Second))
+		var message map[string]interface{}
+		if assert.NoError(t, device.ReadJSON(&message), "devices on other nodes get the message") {
+			assert.Equal(t, "Hello!", message["content"])
+		}
+	}
+	_ = sender.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err := sender.ReadMessage()
+	assert.Error(t, err, "the sending device does not get its own message back")
+}
+
+func TestMessengerSpoofedSender(t *testing.T) {
+	env, teardown := configureEnvironment(t)
+	defer teardown()
+	server := httptest.NewServer(env.api)
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/messenger"
+	_, response, err := websocket.DefaultDialer.Dial(url, nil)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode, "the user is authenticated before the upgrade")
+
+	header := http.Header{"X-Auth-Token": {env.accessToken(t, 1, token.RoleUser)}}
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	require.NoError(t, err)
+	defer conn.Close()
+	message, _ := json.Marshal(map[string]interface{}{"id_to": 2, "id_from": 3, "content": "Hello!", "type": "personal"})
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, message))
+	// a message that was stored would be an unexpected query
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, env.mock.ExpectationsWereMet())
+}
+
+func TestMessengerIdleTimeout(t *testing.T) {
+	env, teardown := configureEnvironment(t, func(cfg *config.Config) {
+		cfg.Messenger.PingInterval = 10 * time.Millisecond
+		cfg.Messenger.IdleTimeout = 50 * time.Millisecond
+	})
+	defer teardown()
+	server := httptest.NewServer(env.api)
+	defer server.Close()
+
+	// a client that never reads does not answer pings
+	header := http.Header{"X-Auth-Token": {env.accessToken(t, 1, token.RoleUser)}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/messenger", header)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Eventually(t, messengerSessions(env, 1), time.Second, 5*time.Millisecond)
+	assert.Eventually(t, messengerSessions(env, 0), time.Second, 5*time.Millisecond, "idle websockets are closed")
+}
+
+func TestMessengerRevocation(t *testing.T) {
+	env, teardown := configureEnvironment(t)
+	defer teardown()
+	server := httptest.NewServer(env.api)
+	defer server.Close()
+
+	connect := func(accessToken string) *websocket.Conn {
+		header := http.Header{"X-Auth-Token": {accessToken}}
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/messenger", header)
+		require.NoError(t, err)
+		return conn
+	}
+	current := connect(env.accessToken(t, 1, token.RoleUser))
+	defer current.Close()
+	other := connect(sessionAccessToken(t, env, "other-family", time.Minute))
+	defer other.Close()
+	require.Eventually(t, messengerSessions(env, 2), time.Second, 10*time.Millisecond)
+
+	mocks.ExpectRevokeUserSessions(env.mock, 1, mocks.Family, 1, false)
+	response := postAuthorized(env.api, env.accessToken(t, 1, token.RoleUser), "/auth/logout-all")
+	require.Equal(t, http.StatusOK, response.Code)
+	assertRevoked(t, other, "logging out of other devices closes their websockets")
+	require.Eventually(t, messengerSessions(env, 1), time.Second, 10*time.Millisecond)
+
+	mocks.ExpectGetSession(env.mock, false)
+	mocks.ExpectRevokeSessionFamily(env.mock)
+	header := http.Header{"X-Auth-Token": {env.accessToken(t, 1, token.RoleUser)}, "Cookie": {"refresh_token=" + mocks.RefreshToken}}
+	response = do(env.api, http.MethodPost, "/auth/logout", header)
+	require.Equal(t, http.StatusOK, response.Code)
+	assertRevoked(t, current, "logging out closes the websockets of the session")
+	assert.Eventually(t, messengerSessions(env, 0), time.Second, 10*time.Millisecond)
+}
+
+func TestMessengerTokenExpiry(t *testing.T) {
+	env, teardown := configureEnvironment(t)
+	defer teardown()
+	server := httptest.NewServer(env.api)
+	defer server.Close()
+
+	header := http.Header{"X-Auth-Token": {sessionAccessToken(t, env, mocks.Family, time.Second)}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/messenger", header)
+	require.NoError(t, err)
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "the websocket is closed when its access token expires, got %v", err)
+}
+
+// sessionAccessToken signs an access token of user 1 of the session family
+// expiring after ttl
+func sessionAccessToken(t *testing.T, env *environment, family string, ttl time.Duration) string {
+	claims := token.CustomizedClaims{
+		StandardClaims: jwt.StandardClaims{Id: "1", ExpiresAt: time.Now().Add(ttl).Unix()},
+		Role:           token.RoleUser,
+		SessionId:      family,
+	}
+	tkn, err := token.SignAccessToken(env.keys, &claims)
+	require.NoError(t, err)
+	return tkn
+}
+
+// assertRevoked asserts that the server closes the websocket because its
+// session is revoked
+func assertRevoked(t *testing.T, conn *websocket.Conn, msg string) {
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), msg)
+}
+
+// messengerSessions reports whether the number of open websockets is n
+func messengerSessions(env *environment, n int) func() bool {
+	return func() bool {
+		body := get(env.api, "/metrics").Body.String()
+		return strings.Contains(body, fmt.Sprintf("sb_messenger_sessions %d\n", n))
+	}
+}
@@ -0,0 +1,28 @@
+package mocks
+
+import (
+	"SB/service/repository/mail"
+	"sync"
+)
+
+// Mailer keeps sent messages instead of delivering them
+type Mailer struct {
+	mu   sync.Mutex
+	Sent []mail.Message
+}
+
+func (m *Mailer) Send(msg mail.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Sent = append(m.Sent, msg)
+	return nil
+}
+
+func (m *Mailer) Last() mail.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.Sent) == 0 {
+		return mail.Message{}
+	}
+	return m.Sent[len(m.Sent)-1]
+}
@@ -0,0 +1,172 @@
+package mocks
+
+import (
+	"SB/service/repository/keys"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+type (
+	// OIDCProvider is a local OpenID Connect provider supporting the
+	// authorization code flow with PKCE, users log in with Authorize
+	OIDCProvider struct {
+		*httptest.Server
+		ClientID     string
+		ClientSecret string
+
+		key   keys.Key
+		mu    sync.Mutex
+		codes map[string]authorization
+	}
+
+	// OIDCUser is the user logging in at the provider
+	OIDCUser struct {
+		Subject           string
+		Email             string
+		PreferredUsername string
+	}
+
+	authorization struct {
+		user          OIDCUser
+		redirectURI   string
+		nonce         string
+		codeChallenge string
+	}
+
+	idTokenClaims struct {
+		jwt.StandardClaims
+		Nonce             string `json:"nonce"`
+		Email             string `json:"email,omitempty"`
+		EmailVerified     bool   `json:"email_verified,omitempty"`
+		PreferredUsername string `json:"preferred_username,omitempty"`
+	}
+)
+
+// NewOIDCProvider starts a provider signing ID tokens with an RS256 key,
+// close it at the end of the test
+func NewOIDCProvider(clientID, clientSecret string) *OIDCProvider {
+	key, err := keys.Generate(keys.AlgorithmRS256)
+	if err != nil {
+		panic(err)
+	}
+	p := &OIDCProvider{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		key:          key,
+		codes:        make(map[string]authorization),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/token", p.token)
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+// Authorize logs the user in at the authorization URL and returns the code
+// and the state the provider redirects back with
+func (p *OIDCProvider) Authorize(authorizationURL string, user OIDCUser) (code, state string, err error) {
+	u, err := url.Parse(authorizationURL)
+	if err != nil {
+		return "", "", err
+	}
+	q := u.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != p.ClientID || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		return "", "", errors.New("invalid authorization request " + u.RawQuery)
+	}
+	code = randomCode()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.codes[code] = authorization{
+		user:          user,
+		redirectURI:   q.Get("redirect_uri"),
+		nonce:         q.Get("nonce"),
+		codeChallenge: q.Get("code_challenge"),
+	}
+	return code, q.Get("state"), nil
+}
+
+func (p *OIDCProvider) discovery(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 p.URL,
+		"authorization_endpoint": p.URL + "/authorize",
+		"token_endpoint":         p.URL + "/token",
+		"jwks_uri":               p.URL + "/jwks",
+	})
+}
+
+func (p *OIDCProvider) jwks(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, keys.JWKS{Keys: []keys.JWK{p.key.JWK()}})
+}
+
+// token redeems a code once if the client proves it has the code verifier
+func (p *OIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+	if r.PostForm.Get("client_id") != p.ClientID || r.PostForm.Get("client_secret") != p.ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	p.mu.Lock()
+	auth, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mu.Unlock()
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || auth.redirectURI != r.PostForm.Get("redirect_uri") || base64.RawURLEncoding.EncodeToString(sum[:]) != auth.codeChallenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	claims := idTokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    p.URL,
+			Subject:   auth.user.Subject,
+			Audience:  p.ClientID,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(time.Minute).Unix(),
+		},
+		Nonce:             auth.nonce,
+		Email:             auth.user.Email,
+		EmailVerified:     auth.user.Email != "",
+		PreferredUsername: auth.user.PreferredUsername,
+	}
+	tkn := jwt.NewWithClaims(p.key.Method(), &claims)
+	tkn.Header["kid"] = p.key.ID
+	idToken, err := tkn.SignedString(p.key.Signer)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"access_token": randomCode(),
+		"token_type":   "Bearer",
+		"id_token":     idToken,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func randomCode() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
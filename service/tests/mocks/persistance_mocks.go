@@ -1,19 +1,520 @@
 package mocks
 
 import (
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
 	"github.com/DATA-DOG/go-sqlmock"
+	"regexp"
+	"strings"
+	"time"
 )
 
-var username = "test"
+var (
+	username = "test@example.com"
+	// RefreshToken is the refresh token returned by ExpectGetSession
+	RefreshToken = "YHT2HFCRKALV7ZMQRMBFH6434T6PCZWD7X73AOJVRDCS3ERR"
+	// Family is the session id of RefreshToken
+	Family = "Q2V3OPVKXEPU6JH6RBMIAFHSTQZ4ZJ3WQJQNE4LBKL7QWF2N"
+	device = "Pixel 7"
+)
 
 func ExpectMockGetUserAuthParams(mock sqlmock.Sqlmock) {
 	// 	res := persistent.db.Table(`users`).Select(`id_user, role`).Where(`username=?`, &params.Username).Take(&params)
-	mock.ExpectQuery(`SELECT id_user, role FROM users WHERE username=$1`).WithArgs(username).
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id_user, role FROM "users" WHERE username=$1`)).WithArgs(username).
 		WillReturnRows(sqlmock.NewRows([]string{"id_user", "role"}).AddRow(00001, "user"))
 }
 
-func ExpectCheckPassword(mock sqlmock.Sqlmock) {
-	// 	res := persistent.db.Table(`users`).Select(`id_user, role`).Where(`username=?`, &params.Username).Take(&params)
-	mock.ExpectQuery(`SELECT (password = crypt(?, password)) AS pswmatch user_auth_info WHERE (login = $1)`).WithArgs(username).
-		WillReturnRows(sqlmock.NewRows([]string{"pswmatch"}).AddRow(true))
+// ExpectGetPasswordHash returns the hash of password "123" made by pgcrypto
+// crypt with MD5, so a successful login replaces it
+func ExpectGetPasswordHash(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT "password" FROM "user_auth_info" WHERE login=$1 LIMIT 1`)).WithArgs(username).
+		WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow("$1$Wj3kQ9aZ$SyIxVbJ8yf9yb1cXmMWH91"))
+}
+
+// ExpectGetPasswordHashUnknown finds no user with the login
+func ExpectGetPasswordHashUnknown(mock sqlmock.Sqlmock, login string) {
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT "password" FROM "user_auth_info" WHERE login=$1 LIMIT 1`)).WithArgs(login).
+		WillReturnRows(sqlmock.NewRows([]string{"password"}))
+}
+
+func ExpectUpdatePasswordHash(mock sqlmock.Sqlmock) {
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE user_auth_info SET password = $1 WHERE login = $2;`)).WithArgs(argon2idHash{}, username).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+type (
+	argon2idHash struct{}
+	prefix       string
+)
+
+func (p prefix) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	return ok && strings.HasPrefix(s, string(p)) && len(s) > len(p)
+}
+
+func (argon2idHash) Match(v driver.Value) bool {
+	hash, ok := v.(string)
+	return ok && strings.HasPrefix(hash, "$argon2id$")
+}
+
+func ExpectAddSession(mock sqlmock.Sqlmock) {
+	expectAddSession(mock, false)
+}
+
+// ExpectAddTwoFactorSession expects a session started with a second factor
+func ExpectAddTwoFactorSession(mock sqlmock.Sqlmock) {
+	expectAddSession(mock, true)
+}
+
+// expectAddSession expects the ban check done before every new session
+func expectAddSession(mock sqlmock.Sqlmock, twoFactor bool) {
+	ExpectGetBan(mock, 1, "")
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO sessions (id_user, login_time, token, expires, family, device, user_agent, ip, two_factor) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);`)).
+		WithArgs(00001, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), twoFactor).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+// ExpectAddImpersonationSession expects the session an impersonation token
+// is bound to, admins are not checked for bans of the user
+func ExpectAddImpersonationSession(mock sqlmock.Sqlmock, idUser int64) {
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO sessions (id_user, login_time, token, expires, family, device, user_agent, ip, two_factor) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);`)).
+		WithArgs(idUser, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+// ExpectHasSession expects the lookup of the session of an impersonation token
+func ExpectHasSession(mock sqlmock.Sqlmock, idUser int64, active bool) {
+	var count int64
+	if active {
+		count = 1
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "sessions" WHERE id_user = $1 AND family = $2 AND expires > now()`)).WithArgs(idUser, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+}
+
+func ExpectRevokeSession(mock sqlmock.Sqlmock, idUser int64, family string) {
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "sessions" WHERE id_user=$1 AND family=$2`)).WithArgs(idUser, family).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+}
+
+func ExpectGetSession(mock sqlmock.Sqlmock, rotated bool) {
+	var rotatedAt *time.Time
+	if rotated {
+		t := time.Now().Add(-time.Minute)
+		rotatedAt = &t
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT login_time, token, expires, family, rotated_at, device, user_agent, ip, last_used, two_factor, sessions.id_user, username, role FROM "sessions"`)).WithArgs(RefreshToken).
+		WillReturnRows(sqlmock.NewRows([]string{"id_user", "login_time", "token", "expires", "family", "rotated_at", "device", "user_agent", "ip", "last_used", "two_factor", "username", "role"}).
+			AddRow(00001, time.Now().Add(-time.Hour), RefreshToken, time.Now().Add(time.Hour), Family, rotatedAt, device, "okhttp/4.9.3", "192.0.2.1", time.Now().Add(-time.Hour), false, username, "user"))
+}
+
+func ExpectRotateSession(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE sessions SET rotated_at = now() WHERE token = $1 AND rotated_at IS NULL;`)).WithArgs(RefreshToken).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO sessions (id_user, login_time, token, expires, family, device, user_agent, ip, two_factor) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);`)).
+		WithArgs(00001, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), Family, device, sqlmock.AnyArg(), sqlmock.AnyArg(), false).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
+func ExpectRevokeSessionFamily(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "sessions" WHERE family=$1`)).WithArgs(Family).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+}
+
+func ExpectAddSecurityEvent(mock sqlmock.Sqlmock, event string) {
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO security_events (id_user, event, details) VALUES ($1, $2, $3);`)).WithArgs(00001, event, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+func ExpectGetSessions(mock sqlmock.Sqlmock, idUser int64, families ...string) {
+	rows := sqlmock.NewRows([]string{"family", "device", "user_agent", "ip", "login_time", "last_used"})
+	for _, f := range families {
+		rows.AddRow(f, device, "okhttp/4.9.3", "192.0.2.1", time.Now().Add(-time.Hour), time.Now())
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT family, device, user_agent, ip, login_time, last_used FROM "sessions"`)).WithArgs(idUser).
+		WillReturnRows(rows)
+}
+
+func ExpectRevokeUserSessions(mock sqlmock.Sqlmock, idUser int64, except string, revoked int64, revokeKeys bool) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "sessions"`)).WithArgs(idUser, except).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(revoked))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "sessions" WHERE id_user=$1 AND family<>$2`)).WithArgs(idUser, except).
+		WillReturnResult(sqlmock.NewResult(0, revoked))
+	if revokeKeys {
+		mock.ExpectExec(regexp.QuoteMeta(`UPDATE api_keys SET revoked_at = now() WHERE id_user = $1 AND revoked_at IS NULL;`)).WithArgs(idUser).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+}
+
+func ExpectAddAccountToken(mock sqlmock.Sqlmock, idUser int64, purpose string) {
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM account_tokens WHERE id_user = $1 AND purpose = $2 AND used_at IS NULL;`)).WithArgs(idUser, purpose).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO account_tokens (token_hash, id_user, purpose, expires) VALUES ($1, $2, $3, $4);`)).
+		WithArgs(sqlmock.AnyArg(), idUser, purpose, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+// ExpectUseAccountToken expects the token to be used, an empty result means
+// the token is invalid
+func ExpectUseAccountToken(mock sqlmock.Sqlmock, tokenHash, purpose string, idUser ...int64) {
+	rows := sqlmock.NewRows([]string{"id_user"})
+	for _, id := range idUser {
+		rows.AddRow(id)
+	}
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`UPDATE account_tokens SET used_at = now()`)).WithArgs(tokenHash, purpose).
+		WillReturnRows(rows)
+}
+
+func ExpectResetPassword(mock sqlmock.Sqlmock, idUser int64) {
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE user_auth_info SET password = $1 WHERE id_user = $2;`)).WithArgs(argon2idHash{}, idUser).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM sessions WHERE id_user = $1;`)).WithArgs(idUser).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE api_keys SET revoked_at = now() WHERE id_user = $1 AND revoked_at IS NULL;`)).WithArgs(idUser).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+func ExpectGetUsername(mock sqlmock.Sqlmock, idUser int64) {
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT "username" FROM "users" WHERE id_user=$1 LIMIT 1`)).WithArgs(idUser).
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow(username))
+}
+
+// ExpectGetUser finds the user with the role unless it is empty
+func ExpectGetUser(mock sqlmock.Sqlmock, idUser int64, role string) {
+	rows := sqlmock.NewRows([]string{"id_user", "username", "role"})
+	if role != "" {
+		rows.AddRow(idUser, username, role)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id_user, username, role FROM "users" WHERE id_user=$1 LIMIT 1`)).WithArgs(idUser).
+		WillReturnRows(rows)
+}
+
+// ExpectGetBan returns no ban if reason is empty
+func ExpectGetBan(mock sqlmock.Sqlmock, idUser int64, reason string) {
+	rows := sqlmock.NewRows([]string{"ban_reason", "banned_until"})
+	if reason != "" {
+		rows.AddRow(reason, nil)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT ban_reason, banned_until FROM "users" WHERE id_user = $1 AND banned_at IS NOT NULL AND (banned_until IS NULL OR banned_until > now()) LIMIT 1`)).
+		WithArgs(idUser).WillReturnRows(rows)
+}
+
+// ExpectGetTOTP returns no secret if secret is empty
+func ExpectGetTOTP(mock sqlmock.Sqlmock, idUser int64, secret string, enabled bool) {
+	rows := sqlmock.NewRows([]string{"id_user", "secret", "last_step", "enabled_at"})
+	if secret != "" {
+		var enabledAt *time.Time
+		if enabled {
+			t := time.Now().Add(-time.Hour)
+			enabledAt = &t
+		}
+		rows.AddRow(idUser, secret, 0, enabledAt)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id_user, secret, last_step, enabled_at FROM "user_totp" WHERE id_user = $1 LIMIT 1`)).WithArgs(idUser).
+		WillReturnRows(rows)
+}
+
+func ExpectSetTOTPSecret(mock sqlmock.Sqlmock, idUser int64) {
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO user_totp (id_user, secret) VALUES ($1, $2)`)).WithArgs(idUser, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func ExpectEnableTOTP(mock sqlmock.Sqlmock, idUser int64, recoveryCodes int) {
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE user_totp SET enabled_at = now(), last_step = $1 WHERE id_user = $2 AND enabled_at IS NULL;`)).WithArgs(sqlmock.AnyArg(), idUser).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM recovery_codes WHERE id_user = $1;`)).WithArgs(idUser).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	for i := 0; i < recoveryCodes; i++ {
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO recovery_codes (id_user, code_hash) VALUES ($1, $2);`)).WithArgs(idUser, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+}
+
+// ExpectUseTOTPStep reports the code as already used unless fresh is set
+func ExpectUseTOTPStep(mock sqlmock.Sqlmock, idUser int64, fresh bool) {
+	var affected int64
+	if fresh {
+		affected = 1
+	}
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE user_totp SET last_step = $1 WHERE id_user = $2 AND enabled_at IS NOT NULL AND last_step < $3;`)).
+		WithArgs(sqlmock.AnyArg(), idUser, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, affected))
+}
+
+func ExpectUseRecoveryCode(mock sqlmock.Sqlmock, idUser int64, codeHash string) {
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE recovery_codes SET used_at = now() WHERE id_user = $1 AND code_hash = $2 AND used_at IS NULL;`)).
+		WithArgs(idUser, codeHash).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func ExpectAddTwoFactorChallenge(mock sqlmock.Sqlmock, idUser int64) {
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO two_factor_challenges (id, id_user, expires) VALUES ($1, $2, $3);`)).
+		WithArgs(sqlmock.AnyArg(), idUser, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// ExpectAttemptTwoFactorChallenge reports the challenge as used up unless ok
+// is set
+func ExpectAttemptTwoFactorChallenge(mock sqlmock.Sqlmock, ok bool) {
+	var affected int64
+	if ok {
+		affected = 1
+	}
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE two_factor_challenges SET attempts = attempts + 1 WHERE id = $1 AND expires > now() AND attempts < $2;`)).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, affected))
+}
+
+// ExpectUseTwoFactorChallenge reports the challenge as already used unless
+// used is set
+func ExpectUseTwoFactorChallenge(mock sqlmock.Sqlmock, used bool) {
+	var affected int64
+	if used {
+		affected = 1
+	}
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM two_factor_challenges WHERE id = $1 AND expires > now();`)).
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, affected))
+}
+
+// ExpectGetIdentityUser finds user 1 if linked is set
+func ExpectGetIdentityUser(mock sqlmock.Sqlmock, provider, subject string, linked bool) {
+	rows := sqlmock.NewRows([]string{"id_user", "username", "role"})
+	if linked {
+		rows.AddRow(1, username, "user")
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT users.id_user, users.username, users.role FROM "user_identities" JOIN users ON users.id_user = user_identities.id_user WHERE user_identities.provider = $1 AND user_identities.subject = $2 LIMIT 1`)).
+		WithArgs(provider, subject).WillReturnRows(rows)
+}
+
+// ExpectAddExternalUser creates user 1 with the username, taken usernames
+// are not inserted. A login ending with - matches usernames with a random suffix.
+func ExpectAddExternalUser(mock sqlmock.Sqlmock, login, provider, subject, email string, taken bool) {
+	mock.ExpectBegin()
+	rows := sqlmock.NewRows([]string{"id_user", "username", "role"})
+	if !taken {
+		rows.AddRow(1, login, "user")
+	}
+	var loginArg driver.Value = login
+	if strings.HasSuffix(login, "-") {
+		loginArg = prefix(login)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO users (username, email_verified_at) VALUES ($1, $2) ON CONFLICT (username) DO NOTHING RETURNING id_user, username, role;`)).
+		WithArgs(loginArg, sqlmock.AnyArg()).WillReturnRows(rows)
+	if taken {
+		mock.ExpectRollback()
+		return
+	}
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO user_info (id_user, email) VALUES ($1, $2);`)).WithArgs(1, email).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO user_identities (provider, subject, id_user, email) VALUES ($1, $2, $3, $4);`)).
+		WithArgs(provider, subject, 1, email).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+func ExpectLinkIdentity(mock sqlmock.Sqlmock, idUser int64, provider, subject string, linked bool) {
+	var affected int64 = 1
+	if linked {
+		affected = 0
+	}
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO user_identities (provider, subject, id_user, email) VALUES ($1, $2, $3, $4) ON CONFLICT (provider, subject) DO NOTHING;`)).
+		WithArgs(provider, subject, idUser, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, affected))
+}
+
+// ExpectAddAPIKey stores key 1 of the user unless the user already has
+// max active keys
+func ExpectAddAPIKey(mock sqlmock.Sqlmock, idUser int64, name, scopes string, twoFactor bool, active, max int64) {
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`SELECT id_user FROM users WHERE id_user = $1 FOR UPDATE;`)).WithArgs(idUser).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "api_keys" WHERE id_user = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())`)).
+		WithArgs(idUser).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(active))
+	if active >= max {
+		mock.ExpectRollback()
+		return
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO api_keys (id_user, name, prefix, hash, scopes, expires_at, two_factor) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id_key, created_at;`)).
+		WithArgs(idUser, name, prefix("sbk_"), sqlmock.AnyArg(), scopes, sqlmock.AnyArg(), twoFactor).
+		WillReturnRows(sqlmock.NewRows([]string{"id_key", "created_at"}).AddRow(1, time.Now()))
+	mock.ExpectCommit()
+}
+
+// ExpectGetAPIKey finds key 1 of user 1 matching the key if role is set,
+// the key has not been used yet and was created without a second factor
+func ExpectGetAPIKey(mock sqlmock.Sqlmock, key, role, scopes string) {
+	expectGetAPIKey(mock, key, role, scopes, false)
+}
+
+// ExpectGetTwoFactorAPIKey finds key 1 of user 1 created in a session
+// started with a second factor
+func ExpectGetTwoFactorAPIKey(mock sqlmock.Sqlmock, key, role, scopes string) {
+	expectGetAPIKey(mock, key, role, scopes, true)
+}
+
+func expectGetAPIKey(mock sqlmock.Sqlmock, key, role, scopes string, twoFactor bool) {
+	i := strings.LastIndexByte(key, '_')
+	rows := sqlmock.NewRows([]string{"id_key", "id_user", "name", "prefix", "hash", "scopes", "created_at", "last_used_at", "expires_at", "two_factor", "role"})
+	if role != "" {
+		sum := sha256.Sum256([]byte(key))
+		rows.AddRow(1, 1, "Club website", key[:i], hex.EncodeToString(sum[:]), scopes, time.Now(), nil, nil, twoFactor, role)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT api_keys.id_key, api_keys.id_user, api_keys.name, api_keys.prefix, api_keys.hash, api_keys.scopes, api_keys.created_at, api_keys.last_used_at, api_keys.expires_at, api_keys.two_factor, users.role FROM "api_keys" JOIN users ON users.id_user = api_keys.id_user WHERE api_keys.prefix = $1 AND api_keys.revoked_at IS NULL AND (users.banned_at IS NULL OR users.banned_until <= now()) LIMIT 1`)).
+		WithArgs(key[:i]).WillReturnRows(rows)
+}
+
+func ExpectTouchAPIKey(mock sqlmock.Sqlmock, idKey int64) {
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE api_keys SET last_used_at = now() WHERE id_key = $1;`)).WithArgs(idKey).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func ExpectRevokeAPIKey(mock sqlmock.Sqlmock, idUser, idKey int64, found bool) {
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE api_keys SET revoked_at = now() WHERE id_key = $1 AND id_user = $2 AND revoked_at IS NULL;`)).
+		WithArgs(idKey, idUser).WillReturnResult(sqlmock.NewResult(0, affected(found)))
+}
+
+func ExpectGetUserTrainings(mock sqlmock.Sqlmock, idUser int64) {
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT member_training.id_training`)).WithArgs(idUser).
+		WillReturnRows(sqlmock.NewRows([]string{"id_training", "meet_date", "location", "sport", "id_level", "fee", "kind", "duration", "comment", "owner"}))
+}
+
+// ExpectSearchUsers returns total users of which the page holds one
+func ExpectSearchUsers(mock sqlmock.Sqlmock, total int64, args ...driver.Value) {
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "users" LEFT JOIN user_info ON user_info.id_user = users.id_user`)).WithArgs(args...).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(total))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT users.id_user, users.username, users.role`)).WithArgs(args...).
+		WillReturnRows(sqlmock.NewRows([]string{"id_user", "username", "role", "email", "name", "second_name", "banned", "banned_until", "ban_reason"}).
+			AddRow(1, username, "user", "test@example.com", nil, nil, false, nil, nil))
+}
+
+func ExpectSetRole(mock sqlmock.Sqlmock, idUser int64, role string, found bool) {
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE users SET role = $1 WHERE id_user = $2;`)).WithArgs(role, idUser).
+		WillReturnResult(sqlmock.NewResult(0, affected(found)))
+}
+
+func ExpectBanUser(mock sqlmock.Sqlmock, idUser int64, reason string, found bool) {
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE users SET banned_at = now(), banned_until = $1, ban_reason = $2 WHERE id_user = $3;`)).
+		WithArgs(sqlmock.AnyArg(), reason, idUser).WillReturnResult(sqlmock.NewResult(0, affected(found)))
+}
+
+func ExpectUnbanUser(mock sqlmock.Sqlmock, idUser int64, found bool) {
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE users SET banned_at = NULL, banned_until = NULL, ban_reason = NULL WHERE id_user = $1;`)).
+		WithArgs(idUser).WillReturnResult(sqlmock.NewResult(0, affected(found)))
+}
+
+// ExpectAddSport returns no row for duplicate names
+func ExpectAddSport(mock sqlmock.Sqlmock, name string, duplicate bool) {
+	rows := sqlmock.NewRows([]string{"id_sport", "sport_type"})
+	if !duplicate {
+		rows.AddRow(7, name)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO sports (sport_type) VALUES ($1) ON CONFLICT (sport_type) DO NOTHING RETURNING id_sport, sport_type;`)).
+		WithArgs(name).WillReturnRows(rows)
+}
+
+// ExpectDeleteSport expects the sport to be deleted only if it is not used
+func ExpectDeleteSport(mock sqlmock.Sqlmock, idSport int64, used int64) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT (SELECT count(*) FROM person_sports WHERE id_sport = $1) + (SELECT count(*) FROM group_training WHERE id_sport = $2);`)).
+		WithArgs(idSport, idSport).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(used))
+	if used > 0 {
+		mock.ExpectRollback()
+		return
+	}
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM sports WHERE id_sport = $1;`)).WithArgs(idSport).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+func ExpectMergeSports(mock sqlmock.Sqlmock, from, into int64) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "sports" WHERE id_sport IN ($1,$2)`)).WithArgs(from, into).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO person_sports (id_user, id_sport) SELECT id_user, $1 FROM person_sports WHERE id_sport = $2 ON CONFLICT DO NOTHING;`)).
+		WithArgs(into, from).WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE group_training SET id_sport = $1 WHERE id_sport = $2;`)).WithArgs(into, from).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM sports WHERE id_sport = $1;`)).WithArgs(from).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+func ExpectDeleteGroupTraining(mock sqlmock.Sqlmock, idTraining int64, found bool) {
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "group_training" WHERE id_training=$1`)).WithArgs(idTraining).
+		WillReturnResult(sqlmock.NewResult(0, affected(found)))
+	mock.ExpectCommit()
+}
+
+func ExpectDeleteMessage(mock sqlmock.Sqlmock, idMessage int64, found bool) {
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM messages WHERE id_mes = $1;`)).WithArgs(idMessage).
+		WillReturnResult(sqlmock.NewResult(0, affected(found)))
+}
+
+func affected(found bool) int64 {
+	if found {
+		return 1
+	}
+	return 0
+}
+
+// ExpectGetGroupTraining returns the training owned by user 1 if found
+func ExpectGetGroupTraining(mock sqlmock.Sqlmock, idTraining int64, found bool) {
+	rows := sqlmock.NewRows([]string{"kind", "id_training", "location", "sport"})
+	if !found {
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT group_training.kind, group_training.id_training`)).WithArgs(idTraining).
+			WillReturnRows(rows)
+		return
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT group_training.kind, group_training.id_training`)).WithArgs(idTraining).
+		WillReturnRows(rows.AddRow("group", idTraining, "Park", "Running"))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "member_training" WHERE id_training=$1`)).WithArgs(idTraining).
+		WillReturnRows(sqlmock.NewRows([]string{"id_training", "id_user", "training_owner"}).AddRow(idTraining, 1, true))
+}
+
+func ExpectAddAuditEntry(mock sqlmock.Sqlmock, action string) {
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO audit_log`)).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), action, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// ExpectGetAuditEntries returns a role change of user 1 made by admin 3
+func ExpectGetAuditEntries(mock sqlmock.Sqlmock, total int64, args ...driver.Value) {
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "audit_log"`)).WithArgs(args...).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(total))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id_entry, created_at, id_actor, impersonated_by, action, target_type, target_id, before, after, ip, request_id FROM "audit_log"`)).
+		WithArgs(args...).
+		WillReturnRows(sqlmock.NewRows([]string{"id_entry", "created_at", "id_actor", "impersonated_by", "action", "target_type", "target_id", "before", "after", "ip", "request_id"}).
+			AddRow(12, time.Date(2021, 11, 2, 10, 0, 0, 0, time.UTC), 3, nil, "user.role_changed", "user", 1, `{"role":"user"}`, `{"role":"coach"}`, "192.0.2.1", "req-1"))
+}
+
+func ExpectDeleteUser(mock sqlmock.Sqlmock, idUser int64) {
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "group_training" WHERE id_training IN`)).
+		WithArgs(idUser).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM users WHERE id_user = $1;`)).WithArgs(idUser).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+func ExpectAddMessage(mock sqlmock.Sqlmock, idTo, idFrom int64, content string) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "messages" ("id_to","id_from","content","created_at") VALUES ($1,$2,$3,$4) RETURNING "id_mes"`)).
+		WithArgs(idTo, idFrom, content, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id_mes"}).AddRow(1))
+	mock.ExpectCommit()
 }
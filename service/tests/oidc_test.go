@@ -0,0 +1,132 @@
+package tests
+
+import (
+	"SB/service/config"
+	"SB/service/repository/token"
+	"SB/service/service/tests/mocks"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+func withProvider(provider *mocks.OIDCProvider) func(cfg *config.Config) {
+	return func(cfg *config.Config) {
+		cfg.OIDC.Providers = []config.OIDCProvider{{
+			Name:         "mock",
+			Issuer:       provider.URL,
+			ClientID:     provider.ClientID,
+			ClientSecret: provider.ClientSecret,
+			RedirectURL:  "http://localhost:8080/login/mock",
+		}}
+	}
+}
+
+// authorizeAt starts a login or linking and returns the state cookie with
+// the code and state the provider redirects back with
+func authorizeAt(t *testing.T, env *environment, provider *mocks.OIDCProvider, path string, header http.Header, user mocks.OIDCUser) (http.Header, JSON) {
+	response := do(env.api, http.MethodPost, path, header)
+	require.Equal(t, http.StatusOK, response.Code, response.Body.String())
+	var authorization struct {
+		AuthorizationURL string `json:"authorization_url"`
+	}
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &authorization))
+	cookies := response.Result().Cookies()
+	require.Len(t, cookies, 1)
+	assert.True(t, cookies[0].HttpOnly)
+
+	code, state, err := provider.Authorize(authorization.AuthorizationURL, user)
+	require.NoError(t, err)
+	callbackHeader := http.Header{"Cookie": {cookies[0].String()}}
+	for k, v := range header {
+		callbackHeader[k] = v
+	}
+	return callbackHeader, JSON{"code": code, "state": state}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	provider := mocks.NewOIDCProvider("sport-buddy", "client-secret")
+	defer provider.Close()
+	env, teardown := configureEnvironment(t, withProvider(provider))
+	defer teardown()
+	user := mocks.OIDCUser{Subject: "248289761001", Email: "Andrey.Petrov@example.com"}
+
+	response := get(env.api, "/auth/oidc")
+	assert.JSONEq(t, `["mock"]`, response.Body.String())
+	response = post(env.api, "/auth/oidc/unknown/authorize")
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	t.Run("first login creates a user", func(t *testing.T) {
+		header, callback := authorizeAt(t, env, provider, "/auth/oidc/mock/authorize", nil, user)
+
+		mocks.ExpectGetIdentityUser(env.mock, "mock", user.Subject, false)
+		mocks.ExpectAddExternalUser(env.mock, "andrey.petrov", "mock", user.Subject, user.Email, true)
+		mocks.ExpectAddExternalUser(env.mock, "andrey.petrov-", "mock", user.Subject, user.Email, false)
+		mocks.ExpectGetTOTP(env.mock, 1, "", false)
+		mocks.ExpectAddSession(env.mock)
+		response := do(env.api, http.MethodPost, "/auth/oidc/mock/callback", header, callback)
+		require.Equal(t, http.StatusOK, response.Code, response.Body.String())
+		var login struct {
+			IdUser      int64  `json:"id_user"`
+			AccessToken string `json:"access_token"`
+		}
+		require.NoError(t, json.Unmarshal(response.Body.Bytes(), &login))
+		assert.Equal(t, int64(1), login.IdUser)
+		assert.NotEmpty(t, login.AccessToken)
+
+		response = do(env.api, http.MethodPost, "/auth/oidc/mock/callback", header, callback)
+		assert.Equal(t, http.StatusUnauthorized, response.Code, "codes are redeemed once")
+	})
+
+	t.Run("linked identity logs in", func(t *testing.T) {
+		header, callback := authorizeAt(t, env, provider, "/auth/oidc/mock/authorize", nil, user)
+
+		mocks.ExpectGetIdentityUser(env.mock, "mock", user.Subject, true)
+		mocks.ExpectGetTOTP(env.mock, 1, totpSecret, true)
+		mocks.ExpectAddTwoFactorChallenge(env.mock, 1)
+		response := do(env.api, http.MethodPost, "/auth/oidc/mock/callback", header, callback)
+		require.Equal(t, http.StatusOK, response.Code)
+		assert.Contains(t, response.Body.String(), `"two_factor_required":true`, "the second factor is still required")
+	})
+
+	t.Run("state must match the cookie", func(t *testing.T) {
+		header, callback := authorizeAt(t, env, provider, "/auth/oidc/mock/authorize", nil, user)
+		callback["state"] = "forged"
+		response := do(env.api, http.MethodPost, "/auth/oidc/mock/callback", header, callback)
+		assert.Equal(t, http.StatusBadRequest, response.Code)
+
+		callback["state"] = "forged"
+		response = post(env.api, "/auth/oidc/mock/callback", callback)
+		assert.Equal(t, http.StatusBadRequest, response.Code, "no state cookie")
+	})
+}
+
+func TestOIDCLink(t *testing.T) {
+	provider := mocks.NewOIDCProvider("sport-buddy", "client-secret")
+	defer provider.Close()
+	env, teardown := configureEnvironment(t, withProvider(provider))
+	defer teardown()
+	user := mocks.OIDCUser{Subject: "248289761001", PreferredUsername: "andrey"}
+	auth := http.Header{"X-Auth-Token": {env.accessToken(t, 1, token.RoleUser)}}
+
+	header, callback := authorizeAt(t, env, provider, "/auth/oidc/mock/link", auth, user)
+	mocks.ExpectLinkIdentity(env.mock, 1, "mock", user.Subject, false)
+	response := do(env.api, http.MethodPost, "/auth/oidc/mock/link/callback", header, callback)
+	require.Equal(t, http.StatusOK, response.Code, response.Body.String())
+
+	header, callback = authorizeAt(t, env, provider, "/auth/oidc/mock/link", auth, user)
+	mocks.ExpectLinkIdentity(env.mock, 1, "mock", user.Subject, true)
+	response = do(env.api, http.MethodPost, "/auth/oidc/mock/link/callback", header, callback)
+	assert.Equal(t, http.StatusConflict, response.Code)
+
+	header, callback = authorizeAt(t, env, provider, "/auth/oidc/mock/link", auth, user)
+	header.Set("X-Auth-Token", env.accessToken(t, 2, token.RoleUser))
+	response = do(env.api, http.MethodPost, "/auth/oidc/mock/link/callback", header, callback)
+	assert.Equal(t, http.StatusBadRequest, response.Code, "the state belongs to another user")
+
+	header, callback = authorizeAt(t, env, provider, "/auth/oidc/mock/link", auth, user)
+	header.Del("X-Auth-Token")
+	response = do(env.api, http.MethodPost, "/auth/oidc/mock/callback", header, callback)
+	assert.Equal(t, http.StatusBadRequest, response.Code, "a linking state does not log in")
+}
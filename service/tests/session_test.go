@@ -0,0 +1,55 @@
+package tests
+
+import (
+	"SB/service/repository/token"
+	"SB/service/service/tests/mocks"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestSessions(t *testing.T) {
+	env, teardown := configureEnvironment(t)
+	defer teardown()
+
+	userToken := env.accessToken(t, 1, token.RoleUser)
+	adminToken := env.accessToken(t, 3, token.RoleAdmin)
+
+	t.Run("list own sessions", func(t *testing.T) {
+		mocks.ExpectGetSessions(env.mock, 1, mocks.Family, "ZUQ6QIDKB7ZJFDT5CVMOCA3AYBNDQIJXWGQV2XF5YJ4JIFBC")
+
+		response := getAuthorized(env.api, userToken, "/auth/sessions")
+		assert.Equal(t, http.StatusOK, response.Code)
+		var sessions []JSON
+		assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &sessions))
+		if assert.Len(t, sessions, 2) {
+			assert.Equal(t, true, sessions[0]["current"])
+			assert.Equal(t, false, sessions[1]["current"])
+			assert.Equal(t, "Pixel 7", sessions[1]["device"])
+		}
+	})
+	t.Run("logout from other devices", func(t *testing.T) {
+		mocks.ExpectRevokeUserSessions(env.mock, 1, mocks.Family, 1, false)
+
+		response := postAuthorized(env.api, userToken, "/auth/logout-all")
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.JSONEq(t, `{"revoked": 1}`, response.Body.String())
+	})
+	t.Run("sessions of another user", func(t *testing.T) {
+		response := getAuthorized(env.api, userToken, "/admin/users/2/sessions")
+		assert.Equal(t, http.StatusForbidden, response.Code)
+
+		mocks.ExpectGetSessions(env.mock, 2)
+		response = getAuthorized(env.api, adminToken, "/admin/users/2/sessions")
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.JSONEq(t, `[]`, response.Body.String())
+	})
+	t.Run("lock an account", func(t *testing.T) {
+		mocks.ExpectRevokeUserSessions(env.mock, 2, "", 3, true)
+
+		response := delAuthorized(env.api, adminToken, "/admin/users/2/sessions")
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.JSONEq(t, `{"revoked": 3}`, response.Body.String())
+	})
+}
@@ -0,0 +1,49 @@
+package tests
+
+import (
+	"SB/service/repository/logging"
+	"SB/service/repository/token"
+	"SB/service/repository/tracing"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type spanRecorder struct{ spans []tracing.SpanData }
+
+func (r *spanRecorder) Export(ctx context.Context, spans []tracing.SpanData) error {
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func TestTracing(t *testing.T) {
+	env, teardown := configureEnvironment(t)
+	defer teardown()
+
+	recorder := &spanRecorder{}
+	provider := tracing.NewProvider(recorder, 1, logging.Discard())
+	tracing.SetProvider(provider)
+	defer tracing.SetProvider(nil)
+
+	request := httptest.NewRequest(http.MethodGet, "/user/profile/x", nil)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	request.Header.Set("X-Auth-Token", env.accessToken(t, 1, token.RoleUser))
+	env.api.ServeHTTP(httptest.NewRecorder(), request)
+	get(env.api, "/healthz")
+	assert.NoError(t, provider.Shutdown(context.Background()))
+
+	if assert.Len(t, recorder.spans, 2) {
+		profile := recorder.spans[0]
+		assert.Equal(t, "GET /user/profile/:id", profile.Name)
+		assert.Equal(t, tracing.KindServer, profile.Kind)
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", profile.Context.TraceID.String())
+		assert.Equal(t, "00f067aa0ba902b7", profile.Parent.String())
+		assert.Contains(t, profile.Attributes, tracing.Int("http.status_code", http.StatusBadRequest))
+
+		healthz := recorder.spans[1]
+		assert.Equal(t, "GET /healthz", healthz.Name)
+		assert.NotEqual(t, profile.Context.TraceID, healthz.Context.TraceID, "requests without traceparent start traces")
+	}
+}
@@ -0,0 +1,178 @@
+package tests
+
+import (
+	"SB/service/config"
+	"SB/service/repository/token"
+	"SB/service/repository/totp"
+	"SB/service/repository/twofactor"
+	"SB/service/service/tests/mocks"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const totpSecret = "JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"
+
+func currentCode(t *testing.T) string {
+	code, err := totp.Code(totpSecret, totp.Step(time.Now()))
+	require.NoError(t, err)
+	return code
+}
+
+// wrongCode returns a code that differs from the current one in every digit
+func wrongCode(t *testing.T) string {
+	code := []byte(currentCode(t))
+	for i := range code {
+		code[i] = '0' + (code[i]-'0'+5)%10
+	}
+	return string(code)
+}
+
+func requireAdminTwoFactor(cfg *config.Config) {
+	cfg.TwoFactor.RequiredRoles = []string{token.RoleAdmin}
+}
+
+func TestTwoFactorSetup(t *testing.T) {
+	env, teardown := configureEnvironment(t)
+	defer teardown()
+	accessToken := env.accessToken(t, 1, token.RoleUser)
+
+	mocks.ExpectGetUsername(env.mock, 1)
+	mocks.ExpectSetTOTPSecret(env.mock, 1)
+	response := postAuthorized(env.api, accessToken, "/auth/2fa/setup")
+	require.Equal(t, http.StatusOK, response.Code)
+	var setup struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &setup))
+	assert.Contains(t, setup.URI, "secret="+setup.Secret)
+
+	mocks.ExpectGetTOTP(env.mock, 1, setup.Secret, false)
+	response = postAuthorized(env.api, accessToken, "/auth/2fa/confirm", JSON{"code": "000000"})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+
+	code, err := totp.Code(setup.Secret, totp.Step(time.Now()))
+	require.NoError(t, err)
+	mocks.ExpectGetTOTP(env.mock, 1, setup.Secret, false)
+	mocks.ExpectEnableTOTP(env.mock, 1, env.cfg.TwoFactor.RecoveryCodes)
+	response = postAuthorized(env.api, accessToken, "/auth/2fa/confirm", JSON{"code": code})
+	require.Equal(t, http.StatusOK, response.Code)
+	var recovery struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &recovery))
+	assert.Len(t, recovery.RecoveryCodes, env.cfg.TwoFactor.RecoveryCodes)
+}
+
+// loginChallenge logs user 1 in with the password and returns the two-factor
+// challenge
+func loginChallenge(t *testing.T, env *environment) string {
+	mocks.ExpectGetPasswordHash(env.mock)
+	mocks.ExpectUpdatePasswordHash(env.mock)
+	mocks.ExpectMockGetUserAuthParams(env.mock)
+	mocks.ExpectGetTOTP(env.mock, 1, totpSecret, true)
+	mocks.ExpectAddTwoFactorChallenge(env.mock, 1)
+	response := post(env.api, "/auth/login", JSON{"username": "test@example.com", "password": "123"})
+	require.Equal(t, http.StatusOK, response.Code)
+	assert.Empty(t, response.Result().Cookies(), "no session before the second factor")
+	var login struct {
+		TwoFactorRequired bool   `json:"two_factor_required"`
+		Challenge         string `json:"challenge"`
+		AccessToken       string `json:"access_token"`
+	}
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &login))
+	require.True(t, login.TwoFactorRequired)
+	require.Empty(t, login.AccessToken)
+	return login.Challenge
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	env, teardown := configureEnvironment(t)
+	defer teardown()
+
+	challenge := loginChallenge(t, env)
+
+	t.Run("challenge is not an access token", func(t *testing.T) {
+		response := getAuthorized(env.api, challenge, "/auth/sessions")
+		assert.Equal(t, http.StatusUnauthorized, response.Code)
+	})
+	t.Run("access token is not a challenge", func(t *testing.T) {
+		response := post(env.api, "/auth/login/2fa", JSON{"challenge": env.accessToken(t, 1, token.RoleUser), "code": currentCode(t)})
+		assert.Equal(t, http.StatusUnauthorized, response.Code)
+	})
+	t.Run("code", func(t *testing.T) {
+		mocks.ExpectAttemptTwoFactorChallenge(env.mock, true)
+		mocks.ExpectGetTOTP(env.mock, 1, totpSecret, true)
+		mocks.ExpectUseTOTPStep(env.mock, 1, true)
+		mocks.ExpectUseTwoFactorChallenge(env.mock, true)
+		mocks.ExpectAddTwoFactorSession(env.mock)
+		response := post(env.api, "/auth/login/2fa", JSON{"challenge": challenge, "code": currentCode(t)})
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.Len(t, response.Result().Cookies(), 1)
+	})
+	t.Run("challenge is single use", func(t *testing.T) {
+		mocks.ExpectAttemptTwoFactorChallenge(env.mock, false)
+		response := post(env.api, "/auth/login/2fa", JSON{"challenge": challenge, "code": "K7QA-3XMF"})
+		assert.Equal(t, http.StatusUnauthorized, response.Code)
+	})
+	t.Run("reused code", func(t *testing.T) {
+		challenge := loginChallenge(t, env)
+		mocks.ExpectAttemptTwoFactorChallenge(env.mock, true)
+		mocks.ExpectGetTOTP(env.mock, 1, totpSecret, true)
+		mocks.ExpectUseTOTPStep(env.mock, 1, false)
+		response := post(env.api, "/auth/login/2fa", JSON{"challenge": challenge, "code": currentCode(t)})
+		assert.Equal(t, http.StatusUnauthorized, response.Code)
+	})
+	t.Run("recovery code", func(t *testing.T) {
+		challenge := loginChallenge(t, env)
+		sum := sha256.Sum256([]byte("k7qa3xmf"))
+		mocks.ExpectAttemptTwoFactorChallenge(env.mock, true)
+		mocks.ExpectGetTOTP(env.mock, 1, totpSecret, true)
+		mocks.ExpectUseRecoveryCode(env.mock, 1, hex.EncodeToString(sum[:]))
+		mocks.ExpectAddSecurityEvent(env.mock, twofactor.EventRecoveryCodeUsed)
+		mocks.ExpectUseTwoFactorChallenge(env.mock, true)
+		mocks.ExpectAddTwoFactorSession(env.mock)
+		response := post(env.api, "/auth/login/2fa", JSON{"challenge": challenge, "code": "K7QA-3XMF"})
+		assert.Equal(t, http.StatusOK, response.Code)
+	})
+	t.Run("too many wrong codes", func(t *testing.T) {
+		challenge := loginChallenge(t, env)
+		mocks.ExpectAttemptTwoFactorChallenge(env.mock, false)
+		response := post(env.api, "/auth/login/2fa", JSON{"challenge": challenge, "code": currentCode(t)})
+		assert.Equal(t, http.StatusUnauthorized, response.Code, "the challenge is used up before the code is checked")
+	})
+}
+
+func TestTwoFactorRequiredRole(t *testing.T) {
+	env, teardown := configureEnvironment(t, requireAdminTwoFactor)
+	defer teardown()
+
+	response := getAuthorized(env.api, env.accessToken(t, 2, token.RoleAdmin), "/admin/users/1/sessions")
+	assert.Equal(t, http.StatusForbidden, response.Code)
+
+	mocks.ExpectGetSessions(env.mock, 1)
+	response = getAuthorized(env.api, env.twoFactorAccessToken(t, 2, token.RoleAdmin), "/admin/users/1/sessions")
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	t.Run("setup is allowed without a second factor", func(t *testing.T) {
+		mocks.ExpectGetUsername(env.mock, 2)
+		mocks.ExpectSetTOTPSecret(env.mock, 2)
+		response := postAuthorized(env.api, env.accessToken(t, 2, token.RoleAdmin), "/auth/2fa/setup")
+		assert.Equal(t, http.StatusOK, response.Code)
+	})
+	t.Run("cannot be disabled", func(t *testing.T) {
+		response := postAuthorized(env.api, env.twoFactorAccessToken(t, 2, token.RoleAdmin), "/auth/2fa/disable", JSON{"code": currentCode(t)})
+		assert.Equal(t, http.StatusForbidden, response.Code)
+	})
+	t.Run("other roles are not affected", func(t *testing.T) {
+		mocks.ExpectGetSessions(env.mock, 1)
+		response := getAuthorized(env.api, env.accessToken(t, 1, token.RoleUser), "/auth/sessions")
+		assert.Equal(t, http.StatusOK, response.Code)
+	})
+}